@@ -2,14 +2,36 @@ package http
 
 import (
 	server_state "server-optimized/api/admin/http/procedures/server-state"
+	"server-optimized/api/admin/http/procedures/webhooks"
+	"server-optimized/lib/auth"
 	"server-optimized/services"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
 )
 
 func RegisterAdminPlaneHTTPRoutes(app *fiber.App, services services.Services) {
-	app.Delete("/:appId/server-state/:key", server_state.RemoveKey(services))
-	app.Put("/:appId/server-state/:key", server_state.ReplaceKey(services))
-	app.Patch("/:appId/server-state/:key", server_state.DeepMergeKey(services))
-	app.Post("/:appId/server-state/:key", server_state.AtomicOps(services))
+	credentials := auth.NewAdminCredentialsFromConfig()
+
+	if !credentials.Enabled() {
+		log.Warn().Msg("no admin keys are configured; the admin-plane http api is open to anyone who can reach it")
+	}
+
+	requireCredentials := RequireAdminCredentials(services, credentials)
+
+	app.Get("/:appId/server-state", requireCredentials, server_state.ListKeys(services))
+	app.Get("/:appId/server-state/:key", requireCredentials, server_state.GetKey(services))
+	app.Delete("/:appId/server-state/:key", requireCredentials, server_state.RemoveKey(services))
+	app.Put("/:appId/server-state/:key", requireCredentials, server_state.ReplaceKey(services))
+	app.Patch("/:appId/server-state/:key", requireCredentials, server_state.PatchKey(services))
+	app.Post("/:appId/server-state/:key", requireCredentials, server_state.AtomicOps(services))
+	app.Post("/:appId/server-state/:key/expire", requireCredentials, server_state.ExpireKey(services))
+	app.Get("/:appId/server-state/:key/versions", requireCredentials, server_state.ListVersions(services))
+	app.Get("/:appId/server-state/:key/versions/:updateCount", requireCredentials, server_state.GetVersion(services))
+	app.Post("/:appId/server-state/:key/versions/:updateCount/revert", requireCredentials, server_state.RevertVersion(services))
+	app.Post("/:appId/server-state-transaction", requireCredentials, server_state.Transaction(services))
+	app.Get("/:appId/server-state-changes", requireCredentials, server_state.ChangeFeed(services))
+	app.Get("/:appId/webhooks/dead-letters", requireCredentials, webhooks.ListDeadLetters(services))
+	app.Post("/:appId/webhooks/dead-letters/:id/redeliver", requireCredentials, webhooks.RedeliverDeadLetter(services))
+	app.Delete("/:appId/webhooks/dead-letters/:id", requireCredentials, webhooks.DiscardDeadLetter(services))
 }
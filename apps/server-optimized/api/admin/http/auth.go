@@ -0,0 +1,83 @@
+package http
+
+import (
+	"errors"
+	"server-optimized/lib/auth"
+	"server-optimized/services"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	adminKeyIDHeader     = "X-AirState-Key-Id"
+	adminTimestampHeader = "X-AirState-Timestamp"
+	adminSignatureHeader = "X-AirState-Signature"
+)
+
+// RequireAdminCredentials accepts either `Authorization: Bearer <key>` or an
+// HMAC signed request (see auth.SignAdminRequest), and rejects credentials that
+// are not scoped to the `:appId` path param.
+func RequireAdminCredentials(svc services.Services, credentials *auth.AdminCredentials) fiber.Handler {
+	kvClient := svc.GetKVClient()
+
+	return func(c *fiber.Ctx) error {
+		if !credentials.Enabled() {
+			return c.Next()
+		}
+
+		var (
+			principal *auth.AdminPrincipal
+			err       error
+		)
+
+		if signature := c.Get(adminSignatureHeader); signature != "" {
+			principal, err = credentials.AuthenticateSignature(&auth.SignedRequest{
+				KeyID:     c.Get(adminKeyIDHeader),
+				Timestamp: c.Get(adminTimestampHeader),
+				Signature: signature,
+				Method:    c.Method(),
+				URI:       c.OriginalURL(),
+				Body:      c.Body(),
+			}, time.Now())
+
+			if err == nil {
+				// a signature is only good once, and only for as long as its
+				// timestamp is inside the tolerance window on either side
+				firstUse, setErr := kvClient.SetNX(c.Context(), "admin:signatures:"+strings.ToLower(signature), 1, 2*credentials.SignatureTolerance()).Result()
+				if setErr != nil {
+					log.Error().Err(setErr).Msg("failed to record admin request signature")
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+						"error": "failed to verify request signature",
+					})
+				}
+
+				if !firstUse {
+					err = errors.New("request signature has already been used")
+				}
+			}
+		} else if bearer, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+			principal, err = credentials.AuthenticateBearer(strings.TrimSpace(bearer))
+		} else {
+			err = errors.New("admin credentials are required")
+		}
+
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if !principal.AllowsApp(c.Params("appId")) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "credentials are not valid for this app",
+			})
+		}
+
+		c.Locals(auth.AdminPrincipalLocal, principal)
+
+		return c.Next()
+	}
+}
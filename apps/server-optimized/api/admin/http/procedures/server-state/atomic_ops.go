@@ -5,44 +5,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"server-optimized/lib/kv_scripts"
-	"server-optimized/utils"
-	"strconv"
+	"server-optimized/services/hub"
 
 	"server-optimized/services"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 )
 
-type AtomicOpsRequest struct {
-	Set    map[string]interface{} `json:"$set,omitempty"`
-	Unset  []string               `json:"$unset,omitempty"`
-	Inc    map[string]float64     `json:"$inc,omitempty"`
-	Concat map[string]interface{} `json:"$concat,omitempty"`
-	Push   map[string]interface{} `json:"$push,omitempty"`
-}
-
-type AtomicOpsResult struct {
-	Success     bool                   `json:"success"`
-	Value       map[string]interface{} `json:"value,omitempty"`
-	UpdateCount int64                  `json:"update_count,omitempty"`
-	Error       string                 `json:"error,omitempty"`
-}
-
 func AtomicOps(svc services.Services) fiber.Handler {
 	scriptMgr := kv_scripts.GetScriptManager(svc.GetKVClient())
-	natsConn := svc.GetNATSConnection()
+	pubSub := svc.GetPubSub()
+	expiry := svc.GetExpiry()
 
 	return func(c *fiber.Ctx) error {
 		appID := c.Params("appId")
 		key := c.Params("key")
-		hashedKey, err := utils.GenerateHash(key)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to generate key hash",
-			})
-		}
 
 		if appID == "" || key == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -50,16 +28,30 @@ func AtomicOps(svc services.Services) fiber.Handler {
 			})
 		}
 
-		var req AtomicOpsRequest
+		var req kv_scripts.AtomicOps
 		if err := c.BodyParser(&req); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "invalid request body",
 			})
 		}
 
-		if req.Set == nil && req.Unset == nil && req.Inc == nil && req.Concat == nil && req.Push == nil {
+		if req.IsEmpty() {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "at least one operation ($set, $unset, $inc, $concat, $push) must be provided",
+				"error": "at least one operation ($set, $unset, $rename, $inc, $mul, $min, $max, $concat, $push, $addToSet, $pull, $pop) must be provided",
+			})
+		}
+
+		expectedUpdateCount, err := parseExpectedUpdateCount(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		ttl, err := parseTTL(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
 			})
 		}
 
@@ -77,7 +69,7 @@ func AtomicOps(svc services.Services) fiber.Handler {
 
 		log.Debug().Str("full_key", fullKey).Msg("this is full key")
 
-		result := scriptMgr.Execute(ctx, scriptMgr.GetAtomicOps(), []string{fullKey, counterKey}, string(opsJSON))
+		result := scriptMgr.Execute(ctx, scriptMgr.GetAtomicOps(), expiry.ScriptKeys(ctx, appID, fullKey, counterKey), expectedUpdateCount, string(opsJSON), kv_scripts.TTLArg(ttl), kv_scripts.HistoryArg())
 		if result.Err() != nil {
 			log.Error().Err(result.Err()).Msg("Failed to execute atomic_ops script")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -85,6 +77,10 @@ func AtomicOps(svc services.Services) fiber.Handler {
 			})
 		}
 
+		if conflict, ok := kv_scripts.ParseConflict(result.Val()); ok {
+			return respondConflict(c, conflict)
+		}
+
 		resultStr, err := result.Text()
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to get script result")
@@ -93,7 +89,7 @@ func AtomicOps(svc services.Services) fiber.Handler {
 			})
 		}
 
-		var opsResult AtomicOpsResult
+		var opsResult kv_scripts.AtomicOpsResult
 		if err := json.Unmarshal([]byte(resultStr), &opsResult); err != nil {
 			log.Error().Err(err).Msg("Failed to unmarshal script result")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -108,22 +104,17 @@ func AtomicOps(svc services.Services) fiber.Handler {
 		}
 
 		if opsResult.Value != nil {
-			finalJSON, err := json.Marshal(opsResult.Value)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to marshal merged value for NATS")
-			} else {
-				subject := fmt.Sprintf("server-state.%s_%s", appID, hashedKey)
-				msg := nats.NewMsg(subject)
-				msg.Data = finalJSON
-				msg.Header.Add("update_count", strconv.FormatInt(opsResult.UpdateCount, 10))
-				if err := natsConn.PublishMsg(msg); err != nil {
-					log.Error().Err(err).Msg("Failed to publish to NATS")
-				}
+			var previous interface{}
+			if opsResult.Previous != nil {
+				previous = *opsResult.Previous
 			}
+
+			hub.Publish(pubSub, appID, key, hub.DiffFromStored(previous, opsResult.Value), opsResult.Value, opsResult.UpdateCount, adminOrigin(c, "atomic"))
 		}
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{
-			"message": "atomic operations applied successfully",
-			"value":   opsResult.Value,
+			"message":      "atomic operations applied successfully",
+			"value":        opsResult.Value,
+			"update_count": opsResult.UpdateCount,
 		})
 	}
 }
@@ -0,0 +1,175 @@
+package server_state
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"server-optimized/services/changefeed"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"server-optimized/services"
+)
+
+const (
+	// changeFeedBuffer is how many changes a consumer may lag behind before
+	// its stream is ended with an overflow event
+	changeFeedBuffer = 1024
+
+	changeFeedKeepAlive = 15 * time.Second
+)
+
+type feedChange struct {
+	data     []byte
+	sequence uint64
+}
+
+// ChangeFeed streams every write of an app as server-sent events: a `change`
+// event per write, with the JSON of a hub.Change as its data. The prefix
+// query parameter keeps the keys starting with one of its comma-separated
+// prefixes. When the feed is durable, every event has the stream sequence as
+// its id, and since (or the Last-Event-ID header) resumes after it.
+//
+// A consumer that falls too far behind gets an `overflow` event and the
+// stream ends; it can resume from the last id it saw.
+func ChangeFeed(svc services.Services) fiber.Handler {
+	feed := svc.GetChangeFeed()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+
+		if appID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id is required",
+			})
+		}
+
+		var prefixes []string
+		for _, prefix := range strings.Split(c.Query("prefix"), ",") {
+			if prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+
+		since, err := parseSince(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if since != nil && !feed.Durable() {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": changefeed.ErrNotDurable.Error(),
+			})
+		}
+
+		changes := make(chan feedChange, changeFeedBuffer)
+		overflow := make(chan struct{})
+		var overflowOnce sync.Once
+
+		stop, err := feed.Subscribe(context.Background(), appID, since, func(data []byte, sequence uint64) {
+			if len(prefixes) > 0 && !matchesPrefix(data, prefixes) {
+				return
+			}
+
+			select {
+			case changes <- feedChange{data: data, sequence: sequence}:
+			default:
+				overflowOnce.Do(func() { close(overflow) })
+			}
+		})
+		if err != nil {
+			log.Error().Err(err).Str("app", appID).Msg("Failed to subscribe to the change feed")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to subscribe to the change feed",
+			})
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer stop()
+
+			keepAlive := time.NewTicker(changeFeedKeepAlive)
+			defer keepAlive.Stop()
+
+			// tells the consumer the stream is open before the first change
+			fmt.Fprint(w, ": connected\n\n")
+			if w.Flush() != nil {
+				return
+			}
+
+			for {
+				select {
+				case change := <-changes:
+					if change.sequence > 0 {
+						fmt.Fprintf(w, "id: %d\n", change.sequence)
+					}
+					fmt.Fprintf(w, "event: change\ndata: %s\n\n", change.data)
+				case <-overflow:
+					fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+					w.Flush()
+					return
+				case <-keepAlive.C:
+					fmt.Fprint(w, ": keep-alive\n\n")
+				}
+
+				// the consumer is gone
+				if w.Flush() != nil {
+					return
+				}
+			}
+		})
+
+		return nil
+	}
+}
+
+// parseSince reads the sequence to resume after from the since query
+// parameter, or from the Last-Event-ID header an EventSource sends when it
+// reconnects.
+func parseSince(c *fiber.Ctx) (*uint64, error) {
+	raw := c.Query("since")
+	if raw == "" {
+		raw = c.Get("Last-Event-ID")
+	}
+
+	if raw == "" {
+		return nil, nil
+	}
+
+	since, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("since must be a stream sequence")
+	}
+
+	return &since, nil
+}
+
+func matchesPrefix(data []byte, prefixes []string) bool {
+	var change struct {
+		Key string `json:"key"`
+	}
+
+	if err := json.Unmarshal(data, &change); err != nil {
+		return false
+	}
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(change.Key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
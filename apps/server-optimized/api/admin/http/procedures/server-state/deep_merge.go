@@ -5,11 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"server-optimized/lib/kv_scripts"
-	"server-optimized/utils"
-	"strconv"
+	"server-optimized/services/hub"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 
 	"server-optimized/services"
@@ -21,17 +19,12 @@ type DeepMergeRequest struct {
 
 func DeepMergeKey(svc services.Services) fiber.Handler {
 	scriptMgr := kv_scripts.GetScriptManager(svc.GetKVClient())
-	natsConn := svc.GetNATSConnection()
+	pubSub := svc.GetPubSub()
+	expiry := svc.GetExpiry()
 
 	return func(c *fiber.Ctx) error {
 		appID := c.Params("appId")
 		key := c.Params("key")
-		hashedKey, err := utils.GenerateHash(key)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to generate key hash",
-			})
-		}
 
 		if appID == "" || key == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -46,6 +39,20 @@ func DeepMergeKey(svc services.Services) fiber.Handler {
 			})
 		}
 
+		expectedUpdateCount, err := parseExpectedUpdateCount(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		ttl, err := parseTTL(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
 		ctx := context.Background()
 
 		fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
@@ -57,7 +64,7 @@ func DeepMergeKey(svc services.Services) fiber.Handler {
 				"error": "failed to serialize value",
 			})
 		}
-		result := scriptMgr.Execute(ctx, scriptMgr.GetDeepMerge(), []string{fullKey, counterKey}, string(valueJSON))
+		result := scriptMgr.Execute(ctx, scriptMgr.GetDeepMerge(), expiry.ScriptKeys(ctx, appID, fullKey, counterKey), expectedUpdateCount, string(valueJSON), kv_scripts.TTLArg(ttl), kv_scripts.HistoryArg())
 		if result.Err() != nil {
 			log.Error().Err(result.Err()).Msg("Failed to execute deep_merge script")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -65,6 +72,10 @@ func DeepMergeKey(svc services.Services) fiber.Handler {
 			})
 		}
 
+		if conflict, ok := kv_scripts.ParseConflict(result.Val()); ok {
+			return respondConflict(c, conflict)
+		}
+
 		resultSlice, err := result.Slice()
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to parse script result")
@@ -73,7 +84,7 @@ func DeepMergeKey(svc services.Services) fiber.Handler {
 			})
 		}
 
-		if len(resultSlice) != 2 {
+		if len(resultSlice) != 3 {
 			log.Error().Int("result_length", len(resultSlice)).Msg("Unexpected script result length")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "unexpected script result",
@@ -101,23 +112,12 @@ func DeepMergeKey(svc services.Services) fiber.Handler {
 			finalValue = finalValueStr
 		}
 
-		finalValueJSON, err := json.Marshal(finalValue)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to marshal deep_merge event")
-		} else {
-			subject := fmt.Sprintf("server-state.%s_%s", appID, hashedKey)
-			msg := nats.NewMsg(subject)
-			msg.Data = finalValueJSON
-			msg.Header.Add("update_count", strconv.FormatInt(updateCount, 10))
-
-			if err := natsConn.PublishMsg(msg); err != nil {
-				log.Error().Err(err).Msg("Failed to publish to NATS")
-			}
-		}
+		hub.Publish(pubSub, appID, key, hub.DiffFromStored(resultSlice[2], finalValue), finalValue, updateCount, adminOrigin(c, "merge"))
 
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{
-			"message": "value merged successfully",
-			"value":   finalValue,
+			"message":      "value merged successfully",
+			"value":        finalValue,
+			"update_count": updateCount,
 		})
 	}
 }
@@ -0,0 +1,41 @@
+package server_state
+
+import (
+	"errors"
+	"server-optimized/lib/kv_scripts"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseExpectedUpdateCount reads the If-Match header, which carries the
+// update count the caller last saw (bare or quoted like an ETag). An empty
+// result means the write is unconditional.
+func parseExpectedUpdateCount(c *fiber.Ctx) (string, error) {
+	ifMatch := strings.TrimSpace(c.Get(fiber.HeaderIfMatch))
+	if ifMatch == "" {
+		return "", nil
+	}
+
+	ifMatch = strings.Trim(ifMatch, `"`)
+
+	if _, err := strconv.ParseUint(ifMatch, 10, 64); err != nil {
+		return "", errors.New("If-Match must be an update count")
+	}
+
+	return ifMatch, nil
+}
+
+func respondConflict(c *fiber.Ctx, conflict *kv_scripts.Conflict) error {
+	var value interface{}
+	if conflict.Value != nil {
+		value = kv_scripts.DecodeStoredValue(*conflict.Value)
+	}
+
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error":        "update count mismatch",
+		"update_count": conflict.UpdateCount,
+		"value":        value,
+	})
+}
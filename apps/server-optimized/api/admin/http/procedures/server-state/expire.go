@@ -0,0 +1,79 @@
+package server_state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"server-optimized/lib/kv_scripts"
+
+	"github.com/gofiber/fiber/v2"
+	goRedis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+
+	"server-optimized/services"
+)
+
+// ExpireKey sets the TTL of a key to the ttl query parameter, or removes it
+// with ttl=0, without writing the value. Watchers hear nothing until the key
+// expires, then they get null.
+func ExpireKey(svc services.Services) fiber.Handler {
+	scriptMgr := kv_scripts.GetScriptManager(svc.GetKVClient())
+	expiry := svc.GetExpiry()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+		key := c.Params("key")
+
+		if appID == "" || key == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id and key are required",
+			})
+		}
+
+		ttl, err := parseTTL(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if ttl == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "ttl is required, 0 removes it",
+			})
+		}
+
+		ctx := context.Background()
+
+		fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
+		counterKey := fmt.Sprintf("%s:update-count", fullKey)
+
+		result := scriptMgr.Execute(ctx, scriptMgr.GetTouch(), expiry.ScriptKeys(ctx, appID, fullKey, counterKey), kv_scripts.TTLArg(ttl))
+		if errors.Is(result.Err(), goRedis.Nil) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "key not found",
+			})
+		}
+
+		if result.Err() != nil {
+			log.Error().Err(result.Err()).Msg("Failed to execute touch script")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to set the ttl",
+			})
+		}
+
+		updateCount, err := result.Int64()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to parse touch result")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to parse touch result",
+			})
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message":      "ttl updated successfully",
+			"ttl":          *ttl,
+			"update_count": updateCount,
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package server_state
+
+import (
+	"context"
+	"fmt"
+	"server-optimized/lib/kv_scripts"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"server-optimized/services"
+)
+
+type GetKeyResponse struct {
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"`
+	UpdateCount int64       `json:"update_count"`
+}
+
+func GetKey(svc services.Services) fiber.Handler {
+	kvClient := svc.GetKVClient()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+		key := c.Params("key")
+
+		if appID == "" || key == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id and key are required",
+			})
+		}
+
+		ctx := context.Background()
+
+		fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
+		counterKey := fmt.Sprintf("%s:update-count", fullKey)
+
+		// a single MGET so the value and the count belong to the same write
+		values, err := kvClient.MGet(ctx, fullKey, counterKey).Result()
+		if err != nil {
+			log.Error().Err(err).Str("full_key", fullKey).Msg("Failed to read value from KV")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to read value",
+			})
+		}
+
+		updateCount := parseUpdateCount(values[1])
+
+		rawValue, ok := values[0].(string)
+		if !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":        "key not found",
+				"update_count": updateCount,
+			})
+		}
+
+		// lets the caller hand the count straight back through If-Match
+		c.Set(fiber.HeaderETag, fmt.Sprintf(`"%d"`, updateCount))
+
+		return c.Status(fiber.StatusOK).JSON(&GetKeyResponse{
+			Key:         key,
+			Value:       kv_scripts.DecodeStoredValue(rawValue),
+			UpdateCount: updateCount,
+		})
+	}
+}
+
+func parseUpdateCount(rawCount interface{}) int64 {
+	countStr, ok := rawCount.(string)
+	if !ok {
+		return 0
+	}
+
+	updateCount, err := strconv.ParseInt(countStr, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return updateCount
+}
@@ -0,0 +1,163 @@
+package server_state
+
+import (
+	"context"
+	"fmt"
+	"server-optimized/lib/kv_scripts"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"server-optimized/services"
+)
+
+const (
+	defaultListCount = 100
+	maxListCount     = 1000
+)
+
+type ListedKey struct {
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value,omitempty"`
+	UpdateCount int64       `json:"update_count"`
+}
+
+type ListKeysResponse struct {
+	Keys []ListedKey `json:"keys"`
+
+	// Cursor is "0" once the scan is complete; it is a string since SCAN
+	// cursors do not fit in a JSON number
+	Cursor string `json:"cursor"`
+}
+
+// ListKeys walks `<appId>:server-state:*:state` one SCAN page at a time. Like
+// SCAN itself, a page may hold fewer than `count` keys (or none) while the
+// returned cursor is not yet "0".
+func ListKeys(svc services.Services) fiber.Handler {
+	kvClient := svc.GetKVClient()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+
+		if appID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id is required",
+			})
+		}
+
+		cursor, err := strconv.ParseUint(c.Query("cursor", "0"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "cursor must be an unsigned integer",
+			})
+		}
+
+		count := c.QueryInt("count", defaultListCount)
+		if count <= 0 || count > maxListCount {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("count must be between 1 and %d", maxListCount),
+			})
+		}
+
+		includeValues := c.QueryBool("values", false)
+
+		keyPrefix := fmt.Sprintf("%s:server-state:", appID)
+
+		// only a trailing `*`, as KVRocks matches SCAN patterns by prefix; the
+		// `:state` suffix is filtered below
+		pattern := escapeGlob(keyPrefix+c.Query("prefix")) + "*"
+
+		ctx := context.Background()
+
+		scannedKeys, nextCursor, err := kvClient.Scan(ctx, cursor, pattern, int64(count)).Result()
+		if err != nil {
+			log.Error().Err(err).Str("pattern", pattern).Msg("Failed to scan keys")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to list keys",
+			})
+		}
+
+		fullKeys := make([]string, 0, len(scannedKeys))
+		seen := make(map[string]struct{}, len(scannedKeys))
+
+		for _, fullKey := range scannedKeys {
+			if !strings.HasSuffix(fullKey, ":state") {
+				continue
+			}
+
+			// SCAN may return a key more than once
+			if _, ok := seen[fullKey]; ok {
+				continue
+			}
+
+			seen[fullKey] = struct{}{}
+			fullKeys = append(fullKeys, fullKey)
+		}
+
+		listedKeys := make([]ListedKey, 0, len(fullKeys))
+
+		if len(fullKeys) > 0 {
+			readKeys := make([]string, 0, len(fullKeys)*2)
+			for _, fullKey := range fullKeys {
+				readKeys = append(readKeys, fmt.Sprintf("%s:update-count", fullKey))
+				if includeValues {
+					readKeys = append(readKeys, fullKey)
+				}
+			}
+
+			values, err := kvClient.MGet(ctx, readKeys...).Result()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to read listed keys from KV")
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "failed to read listed keys",
+				})
+			}
+
+			stride := 1
+			if includeValues {
+				stride = 2
+			}
+
+			for i, fullKey := range fullKeys {
+				listedKey := ListedKey{
+					Key:         strings.TrimSuffix(strings.TrimPrefix(fullKey, keyPrefix), ":state"),
+					UpdateCount: parseUpdateCount(values[i*stride]),
+				}
+
+				if includeValues {
+					rawValue, ok := values[i*stride+1].(string)
+					if !ok {
+						// removed between SCAN and MGET
+						continue
+					}
+
+					listedKey.Value = kv_scripts.DecodeStoredValue(rawValue)
+				}
+
+				listedKeys = append(listedKeys, listedKey)
+			}
+		}
+
+		return c.Status(fiber.StatusOK).JSON(&ListKeysResponse{
+			Keys:   listedKeys,
+			Cursor: strconv.FormatUint(nextCursor, 10),
+		})
+	}
+}
+
+func escapeGlob(s string) string {
+	var builder strings.Builder
+
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			builder.WriteRune('\\')
+		}
+
+		builder.WriteRune(r)
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,16 @@
+package server_state
+
+import (
+	"server-optimized/lib/auth"
+	"server-optimized/services/hub"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// adminOrigin is the origin of a write made through the admin plane, for
+// the change feed.
+func adminOrigin(c *fiber.Ctx, op string) hub.Origin {
+	principal, _ := c.Locals(auth.AdminPrincipalLocal).(*auth.AdminPrincipal)
+
+	return hub.Origin{Op: op, Actor: principal.Actor()}
+}
@@ -0,0 +1,248 @@
+package server_state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"server-optimized/lib/kv_scripts"
+	expiryService "server-optimized/services/expiry"
+	"server-optimized/services/hub"
+	natsService "server-optimized/services/nats"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"server-optimized/services"
+)
+
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+// JSONPatchOperation is one operation of an RFC 6902 document. Path and From
+// are pointers since the empty JSON Pointer (the whole value) is valid.
+type JSONPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type PatchResult struct {
+	Success     bool        `json:"success"`
+	Value       interface{} `json:"value"`
+	Previous    *string     `json:"previous,omitempty"`
+	UpdateCount int64       `json:"update_count,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Index       *int        `json:"index,omitempty"`
+	TestFailed  bool        `json:"test_failed,omitempty"`
+}
+
+// PatchKey picks the update format by Content-Type: an RFC 7386 merge patch,
+// an RFC 6902 JSON patch, or the original deep merge for anything else.
+func PatchKey(svc services.Services) fiber.Handler {
+	deepMerge := DeepMergeKey(svc)
+	mergePatch := MergePatchKey(svc)
+	jsonPatch := JSONPatchKey(svc)
+
+	return func(c *fiber.Ctx) error {
+		mediaType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+
+		switch mediaType {
+		case MergePatchContentType:
+			return mergePatch(c)
+		case JSONPatchContentType:
+			return jsonPatch(c)
+		default:
+			return deepMerge(c)
+		}
+	}
+}
+
+// MergePatchKey applies the request body as an RFC 7386 merge patch: null
+// removes a field and arrays are replaced as a whole.
+func MergePatchKey(svc services.Services) fiber.Handler {
+	scriptMgr := kv_scripts.GetScriptManager(svc.GetKVClient())
+	pubSub := svc.GetPubSub()
+	expiry := svc.GetExpiry()
+
+	return func(c *fiber.Ctx) error {
+		if !json.Valid(c.Body()) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "request body must be a JSON merge patch",
+			})
+		}
+
+		return applyPatch(c, scriptMgr, pubSub, expiry, scriptMgr.GetMergePatch(), string(c.Body()))
+	}
+}
+
+// JSONPatchKey applies the request body as an RFC 6902 JSON patch. The
+// operations are all-or-nothing: if one fails, including a `test`, nothing is
+// written.
+func JSONPatchKey(svc services.Services) fiber.Handler {
+	scriptMgr := kv_scripts.GetScriptManager(svc.GetKVClient())
+	pubSub := svc.GetPubSub()
+	expiry := svc.GetExpiry()
+
+	return func(c *fiber.Ctx) error {
+		var operations []JSONPatchOperation
+		if err := json.Unmarshal(c.Body(), &operations); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "request body must be a JSON patch array",
+			})
+		}
+
+		if len(operations) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "a JSON patch must have at least one operation",
+			})
+		}
+
+		for i, operation := range operations {
+			if err := validateJSONPatchOperation(&operation); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": err.Error(),
+					"index": i,
+				})
+			}
+		}
+
+		operationsJSON, err := json.Marshal(operations)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "failed to serialize operations",
+			})
+		}
+
+		return applyPatch(c, scriptMgr, pubSub, expiry, scriptMgr.GetJSONPatch(), string(operationsJSON))
+	}
+}
+
+func validateJSONPatchOperation(operation *JSONPatchOperation) error {
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return fmt.Errorf("%q operation is missing a value", operation.Op)
+		}
+	case "move", "copy":
+		if operation.From == nil {
+			return fmt.Errorf("%q operation is missing from", operation.Op)
+		}
+
+		if !isJSONPointer(*operation.From) {
+			return fmt.Errorf("from %q is not a JSON Pointer", *operation.From)
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("op must be one of add, remove, replace, move, copy or test, got %q", operation.Op)
+	}
+
+	if operation.Path == nil {
+		return fmt.Errorf("%q operation is missing a path", operation.Op)
+	}
+
+	if !isJSONPointer(*operation.Path) {
+		return fmt.Errorf("path %q is not a JSON Pointer", *operation.Path)
+	}
+
+	return nil
+}
+
+func isJSONPointer(pointer string) bool {
+	return pointer == "" || strings.HasPrefix(pointer, "/")
+}
+
+// applyPatch runs one of the patch scripts against the key in the route and
+// publishes the patched value.
+func applyPatch(c *fiber.Ctx, scriptMgr *kv_scripts.ScriptManager, pubSub natsService.PubSub, expiry *expiryService.Expiry, script *kv_scripts.Script, patch string) error {
+	appID := c.Params("appId")
+	key := c.Params("key")
+	if appID == "" || key == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "app-id and key are required",
+		})
+	}
+
+	expectedUpdateCount, err := parseExpectedUpdateCount(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ttl, err := parseTTL(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := context.Background()
+
+	fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
+	counterKey := fmt.Sprintf("%s:update-count", fullKey)
+
+	result := scriptMgr.Execute(ctx, script, expiry.ScriptKeys(ctx, appID, fullKey, counterKey), expectedUpdateCount, patch, kv_scripts.TTLArg(ttl), kv_scripts.HistoryArg())
+	if result.Err() != nil {
+		log.Error().Err(result.Err()).Str("script", script.Name).Msg("Failed to execute patch script")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to apply patch",
+		})
+	}
+
+	if conflict, ok := kv_scripts.ParseConflict(result.Val()); ok {
+		return respondConflict(c, conflict)
+	}
+
+	resultStr, err := result.Text()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get script result")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse script result",
+		})
+	}
+
+	var patchResult PatchResult
+	if err := json.Unmarshal([]byte(resultStr), &patchResult); err != nil {
+		log.Error().Err(err).Msg("Failed to unmarshal script result")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse script result",
+		})
+	}
+
+	if !patchResult.Success {
+		status := fiber.StatusUnprocessableEntity
+		if patchResult.TestFailed {
+			status = fiber.StatusConflict
+		} else if patchResult.Index == nil {
+			status = fiber.StatusBadRequest
+		}
+
+		response := fiber.Map{
+			"error": patchResult.Error,
+		}
+
+		if patchResult.Index != nil {
+			response["index"] = *patchResult.Index
+		}
+
+		return c.Status(status).JSON(response)
+	}
+
+	var previous interface{}
+	if patchResult.Previous != nil {
+		previous = *patchResult.Previous
+	}
+
+	hub.Publish(pubSub, appID, key, hub.DiffFromStored(previous, patchResult.Value), patchResult.Value, patchResult.UpdateCount, adminOrigin(c, script.Name))
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":      "patch applied successfully",
+		"value":        patchResult.Value,
+		"update_count": patchResult.UpdateCount,
+	})
+}
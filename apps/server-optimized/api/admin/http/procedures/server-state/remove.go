@@ -3,12 +3,11 @@ package server_state
 import (
 	"context"
 	"fmt"
+	"server-optimized/lib/jsonpatch"
 	"server-optimized/lib/kv_scripts"
-	"server-optimized/utils"
-	"strconv"
+	"server-optimized/services/hub"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 
 	"server-optimized/services"
@@ -16,17 +15,12 @@ import (
 
 func RemoveKey(svc services.Services) fiber.Handler {
 	scriptMgr := kv_scripts.GetScriptManager(svc.GetKVClient())
-	natsConn := svc.GetNATSConnection()
+	pubSub := svc.GetPubSub()
+	expiry := svc.GetExpiry()
 
 	return func(c *fiber.Ctx) error {
 		appID := c.Params("appId")
 		key := c.Params("key")
-		hashedKey, err := utils.GenerateHash(key)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to generate key hash",
-			})
-		}
 
 		if appID == "" || key == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -34,12 +28,19 @@ func RemoveKey(svc services.Services) fiber.Handler {
 			})
 		}
 
+		expectedUpdateCount, err := parseExpectedUpdateCount(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
 		ctx := context.Background()
 
 		fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
 		counterKey := fmt.Sprintf("%s:update-count", fullKey)
 
-		result := scriptMgr.Execute(ctx, scriptMgr.GetRemove(), []string{fullKey, counterKey})
+		result := scriptMgr.Execute(ctx, scriptMgr.GetRemove(), expiry.ScriptKeys(ctx, appID, fullKey, counterKey), expectedUpdateCount, kv_scripts.HistoryArg())
 		if result.Err() != nil {
 			log.Error().Err(result.Err()).Msg("Failed to execute remove script")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -47,6 +48,10 @@ func RemoveKey(svc services.Services) fiber.Handler {
 			})
 		}
 
+		if conflict, ok := kv_scripts.ParseConflict(result.Val()); ok {
+			return respondConflict(c, conflict)
+		}
+
 		updateCount, err := result.Int64()
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to parse delete result")
@@ -54,17 +59,12 @@ func RemoveKey(svc services.Services) fiber.Handler {
 				"error": "failed to parse delete result",
 			})
 		}
-		subject := fmt.Sprintf("server-state.%s_%s", appID, hashedKey)
-		msg := nats.NewMsg(subject)
-		msg.Data = []byte("null")
-		msg.Header.Add("update_count", strconv.FormatInt(updateCount, 10))
 
-		if err := natsConn.PublishMsg(msg); err != nil {
-			log.Error().Err(err).Msg("Failed to publish to NATS")
-		}
+		hub.Publish(pubSub, appID, key, jsonpatch.Replace(nil), nil, updateCount, adminOrigin(c, "remove"))
 
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{
-			"message": "key deleted successfully",
+			"message":      "key deleted successfully",
+			"update_count": updateCount,
 		})
 	}
 }
@@ -2,14 +2,11 @@ package server_state
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"server-optimized/lib/kv_scripts"
-	"server-optimized/utils"
-	"strconv"
+	"server-optimized/services/hub"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 
 	"server-optimized/services"
@@ -21,17 +18,12 @@ type ReplaceRequest struct {
 
 func ReplaceKey(svc services.Services) fiber.Handler {
 	scriptMgr := kv_scripts.GetScriptManager(svc.GetKVClient())
-	natsConn := svc.GetNATSConnection()
+	pubSub := svc.GetPubSub()
+	expiry := svc.GetExpiry()
 
 	return func(c *fiber.Ctx) error {
 		appID := c.Params("appId")
 		key := c.Params("key")
-		hashedKey, err := utils.GenerateHash(key)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to generate key hash",
-			})
-		}
 
 		if appID == "" || key == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -46,26 +38,33 @@ func ReplaceKey(svc services.Services) fiber.Handler {
 			})
 		}
 
+		expectedUpdateCount, err := parseExpectedUpdateCount(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		ttl, err := parseTTL(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
 		ctx := context.Background()
 
 		fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
 		counterKey := fmt.Sprintf("%s:update-count", fullKey)
 
-		var valueStr string
-		switch v := req.Value.(type) {
-		case string:
-			valueStr = v
-		default:
-			jsonBytes, err := json.Marshal(v)
-			if err != nil {
-				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-					"error": "failed to serialize value",
-				})
-			}
-			valueStr = string(jsonBytes)
+		valueStr, err := kv_scripts.EncodeReplaceValue(req.Value)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "failed to serialize value",
+			})
 		}
 
-		result := scriptMgr.Execute(ctx, scriptMgr.GetReplace(), []string{fullKey, counterKey}, valueStr)
+		result := scriptMgr.Execute(ctx, scriptMgr.GetReplace(), expiry.ScriptKeys(ctx, appID, fullKey, counterKey), expectedUpdateCount, valueStr, kv_scripts.TTLArg(ttl), kv_scripts.HistoryArg())
 		if result.Err() != nil {
 			log.Error().Err(result.Err()).Msg("Failed to execute Lua script")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -73,32 +72,31 @@ func ReplaceKey(svc services.Services) fiber.Handler {
 			})
 		}
 
-		updateCount, err := result.Int64()
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to parse update count")
+		if conflict, ok := kv_scripts.ParseConflict(result.Val()); ok {
+			return respondConflict(c, conflict)
+		}
+
+		resultSlice, err := result.Slice()
+		if err != nil || len(resultSlice) != 2 {
+			log.Error().Err(err).Msg("Failed to parse script result")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to parse update count",
+				"error": "failed to parse script result",
 			})
 		}
 
-		valueJSON, err := json.Marshal(req.Value)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to marshal event")
+		updateCount, ok := resultSlice[0].(int64)
+		if !ok {
+			log.Error().Msg("Failed to parse update count")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to create event",
+				"error": "failed to parse update count",
 			})
 		}
 
-		subject := fmt.Sprintf("server-state.%s_%s", appID, hashedKey)
-		msg := nats.NewMsg(subject)
-		msg.Data = valueJSON
-		msg.Header.Add("update_count", strconv.FormatInt(updateCount, 10))
-		if err := natsConn.PublishMsg(msg); err != nil {
-			log.Error().Err(err).Msg("Failed to publish to NATS")
-		}
+		hub.Publish(pubSub, appID, key, hub.DiffFromStored(resultSlice[1], req.Value), req.Value, updateCount, adminOrigin(c, "set"))
 
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{
-			"message": "value replaced successfully",
+			"message":      "value replaced successfully",
+			"update_count": updateCount,
 		})
 	}
 }
@@ -0,0 +1,252 @@
+package server_state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"server-optimized/lib/kv_scripts"
+	"server-optimized/services/hub"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"server-optimized/services"
+)
+
+const maxTransactionOperations = 128
+
+type TransactionOperation struct {
+	// Type is one of "replace", "merge", "atomic" or "delete"
+	Type  string                `json:"type"`
+	Key   string                `json:"key"`
+	Value interface{}           `json:"value,omitempty"`
+	Ops   *kv_scripts.AtomicOps `json:"ops,omitempty"`
+
+	// ExpectedUpdateCount works like If-Match on the single-key endpoints
+	ExpectedUpdateCount *uint64 `json:"expected_update_count,omitempty"`
+}
+
+type TransactionRequest struct {
+	Operations []TransactionOperation `json:"operations"`
+}
+
+type transactionScriptOperation struct {
+	KeyIndex int    `json:"key_index"`
+	Type     string `json:"type"`
+	Payload  string `json:"payload,omitempty"`
+	Expected string `json:"expected,omitempty"`
+}
+
+type transactionScriptResult struct {
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+	Index    int    `json:"index"`
+	Conflict *struct {
+		UpdateCount int64   `json:"update_count"`
+		Value       *string `json:"value"`
+	} `json:"conflict,omitempty"`
+	Results []struct {
+		KeyIndex    int     `json:"key_index"`
+		UpdateCount int64   `json:"update_count"`
+		Value       *string `json:"value"`
+		Previous    *string `json:"previous"`
+	} `json:"results,omitempty"`
+}
+
+type TransactionResult struct {
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"`
+	UpdateCount int64       `json:"update_count"`
+}
+
+// Transaction applies a list of operations across keys of one app in a single
+// script run: either all of them are written or none are. Each changed key is
+// published once, with its final value.
+func Transaction(svc services.Services) fiber.Handler {
+	scriptMgr := kv_scripts.GetScriptManager(svc.GetKVClient())
+	pubSub := svc.GetPubSub()
+	expiry := svc.GetExpiry()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+
+		if appID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id is required",
+			})
+		}
+
+		var req TransactionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+
+		if len(req.Operations) == 0 || len(req.Operations) > maxTransactionOperations {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("a transaction must have between 1 and %d operations", maxTransactionOperations),
+			})
+		}
+
+		var (
+			keys       []string
+			scriptKeys []string
+			keyIndexes = make(map[string]int)
+			scriptOps  = make([]transactionScriptOperation, 0, len(req.Operations))
+		)
+
+		for i, op := range req.Operations {
+			if op.Key == "" {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "key is required",
+					"index": i,
+				})
+			}
+
+			keyIndex, ok := keyIndexes[op.Key]
+			if !ok {
+				fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, op.Key)
+				counterKey := fmt.Sprintf("%s:update-count", fullKey)
+
+				keys = append(keys, op.Key)
+				scriptKeys = append(scriptKeys, fullKey, counterKey)
+
+				// lua arrays are 1-based
+				keyIndex = len(keys)
+				keyIndexes[op.Key] = keyIndex
+			}
+
+			scriptOp := transactionScriptOperation{
+				KeyIndex: keyIndex,
+				Type:     op.Type,
+			}
+
+			if op.ExpectedUpdateCount != nil {
+				scriptOp.Expected = strconv.FormatUint(*op.ExpectedUpdateCount, 10)
+			}
+
+			var payloadErr error
+
+			switch op.Type {
+			case "replace":
+				scriptOp.Payload, payloadErr = kv_scripts.EncodeReplaceValue(op.Value)
+			case "merge":
+				var payload []byte
+				payload, payloadErr = json.Marshal(op.Value)
+				scriptOp.Payload = string(payload)
+			case "atomic":
+				if op.Ops == nil || op.Ops.IsEmpty() {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+						"error": "atomic operations require at least one operator in ops",
+						"index": i,
+					})
+				}
+
+				var payload []byte
+				payload, payloadErr = json.Marshal(op.Ops)
+				scriptOp.Payload = string(payload)
+			case "delete":
+			default:
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "type must be one of replace, merge, atomic or delete",
+					"index": i,
+				})
+			}
+
+			if payloadErr != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "failed to serialize value",
+					"index": i,
+				})
+			}
+
+			scriptOps = append(scriptOps, scriptOp)
+		}
+
+		opsJSON, err := json.Marshal(scriptOps)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "failed to serialize operations",
+			})
+		}
+
+		ctx := context.Background()
+
+		result := scriptMgr.Execute(ctx, scriptMgr.GetTransaction(), expiry.ScriptKeys(ctx, appID, scriptKeys...), string(opsJSON), kv_scripts.HistoryArg())
+		if result.Err() != nil {
+			log.Error().Err(result.Err()).Msg("Failed to execute transaction script")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to execute transaction",
+			})
+		}
+
+		resultStr, err := result.Text()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get script result")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to parse script result",
+			})
+		}
+
+		var txResult transactionScriptResult
+		if err := json.Unmarshal([]byte(resultStr), &txResult); err != nil {
+			log.Error().Err(err).Msg("Failed to unmarshal script result")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to parse script result",
+			})
+		}
+
+		if !txResult.Success {
+			if txResult.Conflict != nil {
+				var value interface{}
+				if txResult.Conflict.Value != nil {
+					value = kv_scripts.DecodeStoredValue(*txResult.Conflict.Value)
+				}
+
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error":        "update count mismatch",
+					"index":        txResult.Index,
+					"key":          req.Operations[txResult.Index].Key,
+					"update_count": txResult.Conflict.UpdateCount,
+					"value":        value,
+				})
+			}
+
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": txResult.Error,
+				"index": txResult.Index,
+			})
+		}
+
+		results := make([]TransactionResult, 0, len(txResult.Results))
+
+		for _, keyResult := range txResult.Results {
+			key := keys[keyResult.KeyIndex-1]
+
+			var value interface{}
+			if keyResult.Value != nil {
+				value = kv_scripts.DecodeStoredValue(*keyResult.Value)
+			}
+
+			results = append(results, TransactionResult{
+				Key:         key,
+				Value:       value,
+				UpdateCount: keyResult.UpdateCount,
+			})
+
+			var previous interface{}
+			if keyResult.Previous != nil {
+				previous = *keyResult.Previous
+			}
+
+			hub.Publish(pubSub, appID, key, hub.DiffFromStored(previous, value), value, keyResult.UpdateCount, adminOrigin(c, "transaction"))
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": "transaction applied successfully",
+			"results": results,
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package server_state
+
+import (
+	"server-optimized/lib/kv_scripts"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseTTL reads the ttl query parameter of a write, in milliseconds or as a
+// duration like 30s. nil keeps the TTL the key has, 0 removes it.
+func parseTTL(c *fiber.Ctx) (*int64, error) {
+	raw := c.Query("ttl")
+	if raw == "" {
+		return nil, nil
+	}
+
+	ttl, err := kv_scripts.ParseTTL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ttl, nil
+}
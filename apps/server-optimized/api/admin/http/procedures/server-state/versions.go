@@ -0,0 +1,263 @@
+package server_state
+
+import (
+	"context"
+	"fmt"
+	"server-optimized/lib/jsonpatch"
+	"server-optimized/lib/kv_scripts"
+	"server-optimized/services/hub"
+	"server-optimized/services/kv"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+
+	"server-optimized/services"
+)
+
+type Version struct {
+	UpdateCount int64       `json:"update_count"`
+	Value       interface{} `json:"value"`
+	Deleted     bool        `json:"deleted,omitempty"`
+	Time        int64       `json:"time"`
+}
+
+func toVersion(entry *kv.HistoryEntry) Version {
+	version := Version{
+		UpdateCount: entry.UpdateCount,
+		Deleted:     entry.Deleted,
+		Time:        entry.Time,
+	}
+
+	if entry.Value != nil {
+		version.Value = kv_scripts.DecodeStoredValue(*entry.Value)
+	}
+
+	return version
+}
+
+// readVersions reads the history of the key in the route, newest first,
+// within the configured bounds.
+func readVersions(c *fiber.Ctx, kvClient kv.Store) ([]kv.HistoryEntry, error) {
+	fullKey := fmt.Sprintf("%s:server-state:%s:state", c.Params("appId"), c.Params("key"))
+
+	entries, err := kv.ReadHistory(context.Background(), kvClient, fullKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return kv.TrimHistory(entries, viper.GetInt("serverState.history.maxVersions"), viper.GetDuration("serverState.history.maxAge")), nil
+}
+
+// findVersion is the version the key had at updateCount: the newest one
+// written at or before it, or nil when the history does not go back that far.
+func findVersion(c *fiber.Ctx, kvClient kv.Store) (*kv.HistoryEntry, error) {
+	updateCount, err := strconv.ParseInt(c.Params("updateCount"), 10, 64)
+	if err != nil || updateCount < 1 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "update count must be a positive integer")
+	}
+
+	entries, err := readVersions(c, kvClient)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		if entries[i].UpdateCount <= updateCount {
+			return &entries[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func respondVersionError(c *fiber.Ctx, err error) error {
+	if fiberErr, ok := err.(*fiber.Error); ok {
+		return c.Status(fiberErr.Code).JSON(fiber.Map{
+			"error": fiberErr.Message,
+		})
+	}
+
+	log.Error().Err(err).Msg("Failed to read key history")
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "failed to read history",
+	})
+}
+
+// ListVersions lists the versions of a key that are still in its history,
+// newest first.
+func ListVersions(svc services.Services) fiber.Handler {
+	kvClient := svc.GetKVClient()
+
+	return func(c *fiber.Ctx) error {
+		if c.Params("appId") == "" || c.Params("key") == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id and key are required",
+			})
+		}
+
+		entries, err := readVersions(c, kvClient)
+		if err != nil {
+			return respondVersionError(c, err)
+		}
+
+		versions := make([]Version, len(entries))
+		for i := range entries {
+			versions[i] = toVersion(&entries[i])
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"key":      c.Params("key"),
+			"versions": versions,
+		})
+	}
+}
+
+// GetVersion reads the value a key had at an update count.
+func GetVersion(svc services.Services) fiber.Handler {
+	kvClient := svc.GetKVClient()
+
+	return func(c *fiber.Ctx) error {
+		if c.Params("appId") == "" || c.Params("key") == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id and key are required",
+			})
+		}
+
+		entry, err := findVersion(c, kvClient)
+		if err != nil {
+			return respondVersionError(c, err)
+		}
+
+		if entry == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "the history does not go back to this update count",
+			})
+		}
+
+		version := toVersion(entry)
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"key":          c.Params("key"),
+			"update_count": version.UpdateCount,
+			"value":        version.Value,
+			"deleted":      version.Deleted,
+			"time":         version.Time,
+		})
+	}
+}
+
+// RevertVersion writes the value a key had at an update count back as a new
+// version, or removes the key if it did not exist then. Watchers get it like
+// any other write; If-Match makes it conditional.
+func RevertVersion(svc services.Services) fiber.Handler {
+	kvClient := svc.GetKVClient()
+	scriptMgr := kv_scripts.GetScriptManager(kvClient)
+	pubSub := svc.GetPubSub()
+	expiry := svc.GetExpiry()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+		key := c.Params("key")
+
+		if appID == "" || key == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id and key are required",
+			})
+		}
+
+		expectedUpdateCount, err := parseExpectedUpdateCount(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		entry, err := findVersion(c, kvClient)
+		if err != nil {
+			return respondVersionError(c, err)
+		}
+
+		if entry == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "the history does not go back to this update count",
+			})
+		}
+
+		ctx := context.Background()
+
+		fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
+		counterKey := fmt.Sprintf("%s:update-count", fullKey)
+
+		if entry.Deleted {
+			result := scriptMgr.Execute(ctx, scriptMgr.GetRemove(), expiry.ScriptKeys(ctx, appID, fullKey, counterKey), expectedUpdateCount, kv_scripts.HistoryArg())
+			if result.Err() != nil {
+				log.Error().Err(result.Err()).Msg("Failed to execute remove script")
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "failed to revert",
+				})
+			}
+
+			if conflict, ok := kv_scripts.ParseConflict(result.Val()); ok {
+				return respondConflict(c, conflict)
+			}
+
+			updateCount, err := result.Int64()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to parse remove result")
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "failed to parse remove result",
+				})
+			}
+
+			hub.Publish(pubSub, appID, key, jsonpatch.Replace(nil), nil, updateCount, adminOrigin(c, "revert"))
+
+			return c.Status(fiber.StatusOK).JSON(fiber.Map{
+				"message":      "key reverted successfully",
+				"reverted_to":  entry.UpdateCount,
+				"value":        nil,
+				"update_count": updateCount,
+			})
+		}
+
+		// the stored value goes back as it is, the key keeps its TTL
+		result := scriptMgr.Execute(ctx, scriptMgr.GetReplace(), []string{fullKey, counterKey}, expectedUpdateCount, *entry.Value, "", kv_scripts.HistoryArg())
+		if result.Err() != nil {
+			log.Error().Err(result.Err()).Msg("Failed to execute replace script")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to revert",
+			})
+		}
+
+		if conflict, ok := kv_scripts.ParseConflict(result.Val()); ok {
+			return respondConflict(c, conflict)
+		}
+
+		resultSlice, err := result.Slice()
+		if err != nil || len(resultSlice) != 2 {
+			log.Error().Err(err).Msg("Failed to parse script result")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to parse script result",
+			})
+		}
+
+		updateCount, ok := resultSlice[0].(int64)
+		if !ok {
+			log.Error().Msg("Failed to parse update count")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to parse update count",
+			})
+		}
+
+		value := kv_scripts.DecodeStoredValue(*entry.Value)
+		hub.Publish(pubSub, appID, key, hub.DiffFromStored(resultSlice[1], value), value, updateCount, adminOrigin(c, "revert"))
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message":      "key reverted successfully",
+			"reverted_to":  entry.UpdateCount,
+			"value":        value,
+			"update_count": updateCount,
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	webhooksService "server-optimized/services/webhooks"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"server-optimized/services"
+)
+
+// ListDeadLetters lists the webhook deliveries of an app that ran out of
+// attempts, newest first.
+func ListDeadLetters(svc services.Services) fiber.Handler {
+	hooks := svc.GetWebhooks()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+
+		if appID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id is required",
+			})
+		}
+
+		deadLetters, err := hooks.DeadLetters(context.Background(), appID)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read webhook dead letters")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to read dead letters",
+			})
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"dead_letters": deadLetters,
+		})
+	}
+}
+
+// RedeliverDeadLetter queues a dead letter again, with a fresh set of
+// attempts.
+func RedeliverDeadLetter(svc services.Services) fiber.Handler {
+	hooks := svc.GetWebhooks()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+		id := c.Params("id")
+
+		if appID == "" || id == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id and id are required",
+			})
+		}
+
+		if err := hooks.Redeliver(context.Background(), appID, id); err != nil {
+			return respondDeadLetterError(c, err)
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": "dead letter queued for redelivery",
+		})
+	}
+}
+
+// DiscardDeadLetter drops a dead letter.
+func DiscardDeadLetter(svc services.Services) fiber.Handler {
+	hooks := svc.GetWebhooks()
+
+	return func(c *fiber.Ctx) error {
+		appID := c.Params("appId")
+		id := c.Params("id")
+
+		if appID == "" || id == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "app-id and id are required",
+			})
+		}
+
+		if err := hooks.Discard(context.Background(), appID, id); err != nil {
+			return respondDeadLetterError(c, err)
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": "dead letter discarded",
+		})
+	}
+}
+
+func respondDeadLetterError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, webhooksService.ErrDeadLetterNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, webhooksService.ErrEndpointGone):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	log.Error().Err(err).Msg("Failed to handle webhook dead letter")
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "failed to handle dead letter",
+	})
+}
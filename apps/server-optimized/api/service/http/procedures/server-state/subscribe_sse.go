@@ -4,19 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"server-optimized/utils"
+	"server-optimized/lib/auth"
+	"server-optimized/services/hub"
+	"server-optimized/services/localstate"
+	"strconv"
 	"strings"
 	"sync"
 
 	"server-optimized/services"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 )
 
-func RegisterSSESubscriptionRoute(app *fiber.App, services services.Services) {
-	natsConn := services.GetNATSConnection()
+func RegisterSSESubscriptionRoute(app *fiber.App, services services.Services, verifier *auth.Verifier) {
+	serverStateHub := services.GetHub()
 
 	app.Get("/:appId/server-state/keys", func(c *fiber.Ctx) error {
 		appID := c.Params("appId")
@@ -29,6 +31,29 @@ func RegisterSSESubscriptionRoute(app *fiber.App, services services.Services) {
 			})
 		}
 
+		token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if token == "" {
+			token = c.Query("token")
+		}
+
+		identity, err := verifier.Authenticate(token)
+		if err != nil {
+			log.Debug().Err(err).Msg("[SSE] Error: failed to authenticate request")
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "unauthorized",
+			})
+		}
+
+		if !identity.AllowsApp(appID) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "the token is not valid for this app",
+			})
+		}
+
+		// with deltas=1, updates the client can apply on top of the previous
+		// event for the same key are sent as `delta` events
+		deltas := c.QueryBool("deltas")
+
 		keysParam := c.Query("keys")
 
 		if keysParam == "" {
@@ -54,6 +79,12 @@ func RegisterSSESubscriptionRoute(app *fiber.App, services services.Services) {
 					"error": "keys cannot be empty",
 				})
 			}
+
+			if !identity.CanReadServerStateKey(keys[i]) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"error": fmt.Sprintf("the token does not have the permission to read key: %s", keys[i]),
+				})
+			}
 		}
 
 		c.Set("Content-Type", "text/event-stream")
@@ -64,93 +95,45 @@ func RegisterSSESubscriptionRoute(app *fiber.App, services services.Services) {
 		ctx, cancel := context.WithCancel(c.Context())
 		defer cancel()
 
-		var subscriptions []*nats.Subscription
-		var subscriptionsMutex sync.Mutex
-		var cleanupOnce sync.Once
+		queue := hub.NewQueue()
 
-		updateChan := make(chan SSEUpdate, 100)
+		var watches []*hub.Watch
+		var cleanupOnce sync.Once
 
 		for _, key := range keys {
-			hashedKey, err := utils.GenerateHash(key)
-			if err != nil {
-				log.Error().Str("key", key).Err(err).Msg("[SSE] Failed to generate hash for key")
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": fmt.Sprintf("failed to generate hash for key: %s", key),
-				})
-			}
-
-			subject := fmt.Sprintf("server-state.%s_%s", appID, hashedKey)
-			log.Info().Str("subject", subject).Str("key", key).Str("hashedKey", hashedKey).Msg("[SSE] Subscribing to NATS subject")
-
-			sub, err := natsConn.Subscribe(subject, func(msg *nats.Msg) {
-				log.Debug().Str("subject", subject).Str("key", key).Msg("[SSE] NATS message received")
-				log.Debug().Str("data", string(msg.Data)).Msg("[SSE] Message data")
-
-				updateCount := msg.Header.Get("update_count")
-				if updateCount == "" {
-					updateCount = "0"
-				}
-				log.Debug().Str("update_count", updateCount).Msg("[SSE] Update count")
-
-				var value interface{}
-				if string(msg.Data) == "null" {
-					value = nil
-					log.Debug().Msg("[SSE] Message value is null")
-				} else {
-					if err := json.Unmarshal(msg.Data, &value); err != nil {
-						log.Error().Str("key", key).Err(err).Msg("[SSE] Failed to unmarshal NATS message for key")
-						return
-					}
-					log.Debug().Interface("value", value).Msg("[SSE] Parsed value")
-				}
-
-				update := SSEUpdate{
-					Key:         key,
-					Value:       value,
-					UpdateCount: updateCount,
-				}
-
-				select {
-				case updateChan <- update:
-				case <-ctx.Done():
-					return
-				default:
-					log.Warn().Str("key", key).Msg("[SSE] Update channel full, dropping update")
-				}
-			})
+			log.Info().Str("key", key).Msg("[SSE] Watching key")
 
+			watch, err := serverStateHub.Watch(appID, key, queue.Push)
 			if err != nil {
-				log.Error().Str("subject", subject).Err(err).Msg("[SSE] Failed to subscribe to NATS subject")
-				subscriptionsMutex.Lock()
-				for _, s := range subscriptions {
-					s.Unsubscribe()
+				log.Error().Str("key", key).Err(err).Msg("[SSE] Failed to watch key")
+				for _, w := range watches {
+					_ = w.Unsubscribe()
 				}
-				subscriptionsMutex.Unlock()
 				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 					"error": fmt.Sprintf("failed to subscribe to key: %s", key),
 				})
 			}
 
-			subscriptionsMutex.Lock()
-			subscriptions = append(subscriptions, sub)
-			subscriptionsMutex.Unlock()
+			watches = append(watches, watch)
 		}
 
 		cleanup := func() {
 			cleanupOnce.Do(func() {
 				log.Info().Str("appId", appID).Msg("[SSE] Starting cleanup")
 				cancel()
-				subscriptionsMutex.Lock()
-				log.Info().Int("subscription_count", len(subscriptions)).Msg("[SSE] Unsubscribing from NATS subscriptions")
-				for _, sub := range subscriptions {
-					sub.Unsubscribe()
+				log.Info().Int("subscription_count", len(watches)).Msg("[SSE] Unsubscribing from NATS subscriptions")
+				for _, watch := range watches {
+					_ = watch.Unsubscribe()
 				}
-				subscriptionsMutex.Unlock()
-				close(updateChan)
+				queue.Close()
 				log.Info().Str("appId", appID).Msg("[SSE] Cleanup completed")
 			})
 		}
 
+		// the update count of the last event sent per key, which is what a
+		// delta has to be based on
+		sentUpdateCounts := make(map[string]string)
+
 		if _, err := c.Write([]byte(": connected\n\n")); err != nil {
 			log.Error().Err(err).Msg("[SSE] Failed to write initial connection message")
 			cleanup()
@@ -167,24 +150,41 @@ func RegisterSSESubscriptionRoute(app *fiber.App, services services.Services) {
 				log.Info().Str("appId", appID).Msg("[SSE] Client disconnected, stopping stream")
 				cleanup()
 				return nil
-			case update, ok := <-updateChan:
-				if !ok {
-					log.Info().Str("appId", appID).Msg("[SSE] Update channel closed, stopping stream")
-					cleanup()
-					return nil
-				}
+			case <-queue.Ready():
+			}
+
+			for _, upd := range queue.Drain() {
+				update := sseUpdateFrom(upd)
 
 				log.Debug().Str("key", update.Key).Str("update_count", update.UpdateCount).Msg("[SSE] Received update from channel")
 				log.Debug().Interface("value", update.Value).Msg("[SSE] Update value")
 
-				eventData, err := json.Marshal(update)
+				var (
+					eventData  []byte
+					eventField string
+				)
+
+				if sentUpdateCount, known := sentUpdateCounts[update.Key]; deltas && len(update.delta) > 0 && known && sentUpdateCount == update.baseUpdateCount {
+					eventData, err = json.Marshal(&SSEDelta{
+						Key:             update.Key,
+						Delta:           update.delta,
+						BaseUpdateCount: update.baseUpdateCount,
+						UpdateCount:     update.UpdateCount,
+					})
+					eventField = "event: delta\n"
+				} else {
+					eventData, err = json.Marshal(update)
+				}
+
 				if err != nil {
 					log.Error().Err(err).Msg("[SSE] Failed to marshal update")
 					continue
 				}
 				log.Debug().Str("event_data", string(eventData)).Msg("[SSE] Marshaled event data")
 
-				sseMessage := fmt.Sprintf("data: %s\n\n", string(eventData))
+				sentUpdateCounts[update.Key] = update.UpdateCount
+
+				sseMessage := fmt.Sprintf("%sdata: %s\n\n", eventField, string(eventData))
 				log.Debug().Str("sse_message", sseMessage).Msg("[SSE] Writing SSE message to client")
 				if _, err := c.Write([]byte(sseMessage)); err != nil {
 					log.Error().Err(err).Msg("[SSE] Failed to write SSE message")
@@ -197,8 +197,42 @@ func RegisterSSESubscriptionRoute(app *fiber.App, services services.Services) {
 	})
 }
 
+// sseUpdateFrom formats an update from the hub the way events carry it, with
+// the counts as strings and "0" for a message that came without one.
+func sseUpdateFrom(update *localstate.ServerStateUpdate) SSEUpdate {
+	sseUpdate := SSEUpdate{
+		Key:         update.Key,
+		Value:       update.Value,
+		UpdateCount: "0",
+	}
+
+	if update.UpdateCount >= 0 {
+		sseUpdate.UpdateCount = strconv.FormatInt(update.UpdateCount, 10)
+	}
+
+	if update.Delta != nil {
+		sseUpdate.delta = update.Delta
+		sseUpdate.baseUpdateCount = strconv.FormatInt(update.BaseUpdateCount, 10)
+	}
+
+	return sseUpdate
+}
+
 type SSEUpdate struct {
 	Key         string      `json:"key"`
 	Value       interface{} `json:"value"`
 	UpdateCount string      `json:"update_count"`
+
+	delta           json.RawMessage
+	baseUpdateCount string
+}
+
+// SSEDelta is sent as a `delta` event: a JSON Patch (RFC 6902) that turns the
+// value of the previous event for the key into the one at UpdateCount. A
+// client that misses an event should reconnect to start from full values.
+type SSEDelta struct {
+	Key             string          `json:"key"`
+	Delta           json.RawMessage `json:"delta"`
+	BaseUpdateCount string          `json:"base_update_count"`
+	UpdateCount     string          `json:"update_count"`
 }
@@ -6,7 +6,9 @@ import (
 	"reflect"
 	"server-optimized/api/service/trpc"
 	"server-optimized/api/service/trpc/procedures"
+	"server-optimized/lib/auth"
 	"server-optimized/services"
+	"server-optimized/services/webhooks"
 	trpcFramework "server-optimized/trpc"
 
 	"github.com/bytedance/sonic"
@@ -21,7 +23,7 @@ type SubscriptionContext struct {
 	cancel context.CancelFunc
 }
 
-func RegisterWebSocketTRPCRoute(app *fiber.App, services services.Services) {
+func RegisterWebSocketTRPCRoute(app *fiber.App, services services.Services, verifier *auth.Verifier) {
 	var _trpcMessage trpcFramework.TRPCMessage
 	var _connectionParamsMessage trpcFramework.ConnectionParamsMessage
 
@@ -78,7 +80,35 @@ func RegisterWebSocketTRPCRoute(app *fiber.App, services services.Services) {
 		// the central response channel
 		responseChannel := make(chan json.RawMessage, maxWorkerRoutines)
 
-		trpcContext := trpc.CreateTRPCContext(app, services, c, &connectionParamsMessage.Data)
+		trpcContext, err := trpc.CreateTRPCContext(app, services, c, connectionId, &connectionParamsMessage.Data, verifier)
+		if err != nil {
+			log.Debug().Str("connection_id", connectionId).Err(err).Msg("failed to authenticate connection; dropping connection")
+			_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"))
+			return
+		}
+
+		hooks := services.GetWebhooks()
+		clientEvent := &webhooks.ClientEvent{
+			ClientID: connectionId,
+			AppID:    trpcContext.Identity.AppID(),
+			Actor:    trpcContext.Identity.Actor(),
+		}
+
+		if err := hooks.Authorize(context.Background(), clientEvent.AppID, webhooks.EventClientConnected, clientEvent); err != nil {
+			log.Debug().Str("connection_id", connectionId).Err(err).Msg("connection dropped by a webhook; dropping connection")
+
+			// a close reason has to fit in a control frame
+			reason := err.Error()
+			if len(reason) > 123 {
+				reason = reason[:123]
+			}
+
+			_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+			return
+		}
+
+		hooks.Dispatch(clientEvent.AppID, webhooks.EventClientConnected, clientEvent)
+		defer hooks.Dispatch(clientEvent.AppID, webhooks.EventClientDisconnected, clientEvent)
 
 		subscriptionContexts := make(map[int64]*SubscriptionContext, 8)
 
@@ -157,6 +187,24 @@ func RegisterWebSocketTRPCRoute(app *fiber.App, services services.Services) {
 									switch message.Params.Path {
 									case "serverState.watchKeys":
 										response, err = procedures.HandleServerStateWatchKeysMutation(ctx, trpcContext, message.Params.Input)
+									case "serverState.unwatchKeys":
+										response, err = procedures.HandleServerStateUnwatchKeysMutation(ctx, trpcContext, message.Params.Input)
+									case "serverState.resync":
+										response, err = procedures.HandleServerStateResyncMutation(ctx, trpcContext, message.Params.Input)
+									case "serverState.set":
+										response, err = procedures.HandleServerStateSetMutation(ctx, trpcContext, message.Params.Input)
+									case "serverState.merge":
+										response, err = procedures.HandleServerStateMergeMutation(ctx, trpcContext, message.Params.Input)
+									case "serverState.atomic":
+										response, err = procedures.HandleServerStateAtomicMutation(ctx, trpcContext, message.Params.Input)
+									case "presence.peerInit":
+										response, err = procedures.HandlePresencePeerInitMutation(ctx, trpcContext, message.Params.Input)
+									case "presence.update":
+										response, err = procedures.HandlePresenceUpdateMutation(ctx, trpcContext, message.Params.Input)
+									case "yjs.docInit":
+										response, err = procedures.HandleYjsDocInitMutation(ctx, trpcContext, message.Params.Input)
+									case "yjs.docUpdate":
+										response, err = procedures.HandleYjsDocUpdateMutation(ctx, trpcContext, message.Params.Input)
 									}
 								}
 
@@ -217,31 +265,27 @@ func RegisterWebSocketTRPCRoute(app *fiber.App, services services.Services) {
 
 					var trpcError *trpcFramework.TRPCError
 
+					emit := func(message json.RawMessage) {
+						marshaledResponseMessage, _ := sonic.Marshal(&trpcFramework.TRPCResultResponse{
+							Id: trpcMessage.Id,
+							Result: trpcFramework.TRPCResult{
+								Type: "data",
+								Data: message,
+							},
+						})
+
+						responseChannel <- marshaledResponseMessage
+					}
+
 					switch trpcMessage.Params.Path {
 					case "seconds":
-						trpcError = procedures.HandleSecondsSubscription(subscriptionContext, trpcContext, trpcMessage.Params.Input, func(message json.RawMessage) {
-							marshaledResponseMessage, _ := sonic.Marshal(&trpcFramework.TRPCResultResponse{
-								Id: trpcMessage.Id,
-								Result: trpcFramework.TRPCResult{
-									Type: "data",
-									Data: message,
-								},
-							})
-
-							responseChannel <- marshaledResponseMessage
-						})
+						trpcError = procedures.HandleSecondsSubscription(subscriptionContext, trpcContext, trpcMessage.Params.Input, emit)
 					case "serverState.serverState":
-						trpcError = procedures.HandleServerStateSubscription(subscriptionContext, trpcContext, trpcMessage.Params.Input, func(message json.RawMessage) {
-							marshaledResponseMessage, _ := sonic.Marshal(&trpcFramework.TRPCResultResponse{
-								Id: trpcMessage.Id,
-								Result: trpcFramework.TRPCResult{
-									Type: "data",
-									Data: message,
-								},
-							})
-
-							responseChannel <- marshaledResponseMessage
-						})
+						trpcError = procedures.HandleServerStateSubscription(subscriptionContext, trpcContext, trpcMessage.Params.Input, emit)
+					case "presence.roomUpdates":
+						trpcError = procedures.HandlePresenceRoomUpdatesSubscription(subscriptionContext, trpcContext, trpcMessage.Params.Input, emit)
+					case "yjs.docUpdates":
+						trpcError = procedures.HandleYjsDocUpdatesSubscription(subscriptionContext, trpcContext, trpcMessage.Params.Input, emit)
 					}
 
 					if trpcError != nil {
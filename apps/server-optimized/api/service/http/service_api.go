@@ -3,15 +3,23 @@ package http
 import (
 	"server-optimized/api/service/http/procedures"
 	serverState "server-optimized/api/service/http/procedures/server-state"
+	"server-optimized/lib/auth"
 	"server-optimized/services"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func RegisterServicePlaneAPIRoutes(app *fiber.App, services services.Services) {
+func RegisterServicePlaneAPIRoutes(app *fiber.App, services services.Services) error {
+	verifier, err := auth.NewVerifierFromConfig()
+	if err != nil {
+		return err
+	}
+
 	// /:appid/server-state/keys
-	serverState.RegisterSSESubscriptionRoute(app, services)
+	serverState.RegisterSSESubscriptionRoute(app, services, verifier)
 
 	// /trpc
-	procedures.RegisterWebSocketTRPCRoute(app, services)
+	procedures.RegisterWebSocketTRPCRoute(app, services, verifier)
+
+	return nil
 }
@@ -1,6 +1,7 @@
 package trpc
 
 import (
+	"server-optimized/lib/auth"
 	"server-optimized/services"
 
 	"github.com/gofiber/contrib/websocket"
@@ -8,15 +9,36 @@ import (
 )
 
 type TRPCContext struct {
-	App        *fiber.App
-	Services   services.Services
-	Connection *websocket.Conn
+	App          *fiber.App
+	Services     services.Services
+	Connection   *websocket.Conn
+	ConnectionID string
+	Identity     *auth.Identity
 }
 
-func CreateTRPCContext(app *fiber.App, services services.Services, connection *websocket.Conn, connectionParams *map[string]string) *TRPCContext {
-	return &TRPCContext{
-		App:        app,
-		Services:   services,
-		Connection: connection,
+// CreateTRPCContext authenticates the connection with the token found in the
+// connection params, falling back to the `token` query param.
+func CreateTRPCContext(app *fiber.App, services services.Services, connection *websocket.Conn, connectionID string, connectionParams *map[string]string, verifier *auth.Verifier) (*TRPCContext, error) {
+	var token string
+
+	if connectionParams != nil {
+		token = (*connectionParams)["token"]
+	}
+
+	if token == "" && connection != nil {
+		token = connection.Query("token")
 	}
+
+	identity, err := verifier.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TRPCContext{
+		App:          app,
+		Services:     services,
+		Connection:   connection,
+		ConnectionID: connectionID,
+		Identity:     identity,
+	}, nil
 }
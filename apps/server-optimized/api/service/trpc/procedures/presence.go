@@ -0,0 +1,218 @@
+package procedures
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"server-optimized/services/kv"
+	natsService "server-optimized/services/nats"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultPresenceAppID = "_default"
+
+// presenceMessage is both the NATS wire format and the shape emitted to
+// roomUpdates subscribers (minus session_id, which is only used internally).
+type presenceMessage struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id,omitempty"`
+	PeerID    string `json:"peer_id"`
+	Timestamp int64  `json:"timestamp"`
+	Meta      any    `json:"meta,omitempty"`
+	State     any    `json:"state,omitempty"`
+}
+
+type presencePeer struct {
+	Peer          string `json:"peer"`
+	Meta          any    `json:"meta,omitempty"`
+	State         any    `json:"state,omitempty"`
+	Connected     bool   `json:"connected"`
+	LastConnected int64  `json:"lastConnected"`
+	LastUpdated   int64  `json:"lastUpdated"`
+}
+
+type presenceStats struct {
+	TotalPeers int `json:"totalPeers"`
+}
+
+type presenceState struct {
+	Peers map[string]presencePeer `json:"peers"`
+	Stats presenceStats           `json:"stats"`
+}
+
+func presenceSubject(appID string, hashedRoom string) string {
+	return fmt.Sprintf("presence.%s_%s", appID, hashedRoom)
+}
+
+func presencePeersKey(appID string, hashedRoom string) string {
+	return fmt.Sprintf("%s:presence:%s:peers", appID, hashedRoom)
+}
+
+func presenceHeartbeatsKey(appID string, hashedRoom string) string {
+	return fmt.Sprintf("%s:presence:%s:heartbeats", appID, hashedRoom)
+}
+
+// presenceConnectionsKey is a hash of the sessions joined as a peer, from the
+// session id to "<last seen in unix milliseconds>:<peer id>". One peer can
+// be connected through several sessions, and only leaves with the last one.
+func presenceConnectionsKey(appID string, hashedRoom string) string {
+	return fmt.Sprintf("%s:presence:%s:connections", appID, hashedRoom)
+}
+
+func presenceConnection(peerID string) string {
+	return strconv.FormatInt(time.Now().UnixMilli(), 10) + ":" + peerID
+}
+
+func parsePresenceConnection(raw string) (int64, string, bool) {
+	rawLastSeen, peerID, found := strings.Cut(raw, ":")
+	lastSeen, err := strconv.ParseInt(rawLastSeen, 10, 64)
+
+	return lastSeen, peerID, found && err == nil
+}
+
+func publishPresenceMessage(pubSub natsService.PubSub, appID string, hashedRoom string, message *presenceMessage) {
+	data, err := sonic.Marshal(message)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshal presence message")
+		return
+	}
+
+	if err := pubSub.Publish(presenceSubject(appID, hashedRoom), data); err != nil {
+		log.Error().Err(err).Str("type", message.Type).Msg("failed to publish presence message")
+	}
+}
+
+// storePresencePeer writes the peer record and refreshes its heartbeat and
+// the session's connection in one round trip.
+func storePresencePeer(ctx context.Context, kvClient kv.Store, appID string, hashedRoom string, sessionID string, peer *presencePeer) error {
+	peerJSON, err := sonic.Marshal(peer)
+	if err != nil {
+		return err
+	}
+
+	pipe := kvClient.TxPipeline()
+	pipe.HSet(ctx, presencePeersKey(appID, hashedRoom), peer.Peer, string(peerJSON))
+	pipe.HSet(ctx, presenceHeartbeatsKey(appID, hashedRoom), peer.Peer, time.Now().UnixMilli())
+	pipe.HSet(ctx, presenceConnectionsKey(appID, hashedRoom), sessionID, presenceConnection(peer.Peer))
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+// removePresencePeer deletes the peer from the room and reports whether this
+// call was the one that removed it, so that exactly one node announces the leave.
+func removePresencePeer(ctx context.Context, kvClient kv.Store, appID string, hashedRoom string, peerID string) (bool, error) {
+	removed, err := kvClient.HDel(ctx, presenceHeartbeatsKey(appID, hashedRoom), peerID).Result()
+	if err != nil {
+		return false, err
+	}
+
+	if err := kvClient.HDel(ctx, presencePeersKey(appID, hashedRoom), peerID).Err(); err != nil {
+		return removed > 0, err
+	}
+
+	return removed > 0, nil
+}
+
+// releasePresenceConnection drops the connection of a session that is going
+// away and reports whether its peer is still connected through another
+// session that was seen within timeout, in which case the peer stays.
+func releasePresenceConnection(ctx context.Context, kvClient kv.Store, appID string, hashedRoom string, sessionID string, peerID string, timeout time.Duration) (bool, error) {
+	connectionsKey := presenceConnectionsKey(appID, hashedRoom)
+
+	if err := kvClient.HDel(ctx, connectionsKey, sessionID).Err(); err != nil {
+		return false, err
+	}
+
+	connections, err := kvClient.HGetAll(ctx, connectionsKey).Result()
+	if err != nil {
+		return false, err
+	}
+
+	deadline := time.Now().Add(-timeout).UnixMilli()
+
+	for _, raw := range connections {
+		if lastSeen, connectedPeerID, ok := parsePresenceConnection(raw); ok && connectedPeerID == peerID && lastSeen >= deadline {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func readPresenceState(ctx context.Context, kvClient kv.Store, appID string, hashedRoom string) (*presenceState, error) {
+	rawPeers, err := kvClient.HGetAll(ctx, presencePeersKey(appID, hashedRoom)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &presenceState{
+		Peers: make(map[string]presencePeer, len(rawPeers)),
+	}
+
+	for peerID, rawPeer := range rawPeers {
+		var peer presencePeer
+
+		if err := json.Unmarshal([]byte(rawPeer), &peer); err != nil {
+			log.Error().Err(err).Str("peer_id", peerID).Msg("failed to unmarshal presence peer from kv")
+			continue
+		}
+
+		state.Peers[peerID] = peer
+	}
+
+	state.Stats.TotalPeers = len(state.Peers)
+
+	return state, nil
+}
+
+// sweepPresencePeers removes peers whose owning node stopped heartbeating,
+// e.g. because it crashed before it could announce the disconnect.
+func sweepPresencePeers(ctx context.Context, kvClient kv.Store, pubSub natsService.PubSub, appID string, hashedRoom string, timeout time.Duration) {
+	heartbeats, err := kvClient.HGetAll(ctx, presenceHeartbeatsKey(appID, hashedRoom)).Result()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read presence heartbeats")
+		return
+	}
+
+	deadline := time.Now().Add(-timeout).UnixMilli()
+
+	// connections of sessions whose node went away
+	if connections, err := kvClient.HGetAll(ctx, presenceConnectionsKey(appID, hashedRoom)).Result(); err != nil {
+		log.Error().Err(err).Msg("failed to read presence connections")
+	} else {
+		for sessionID, raw := range connections {
+			if lastSeen, _, ok := parsePresenceConnection(raw); !ok || lastSeen < deadline {
+				kvClient.HDel(ctx, presenceConnectionsKey(appID, hashedRoom), sessionID)
+			}
+		}
+	}
+
+	for peerID, rawLastSeen := range heartbeats {
+		lastSeen, err := strconv.ParseInt(rawLastSeen, 10, 64)
+		if err == nil && lastSeen >= deadline {
+			continue
+		}
+
+		removed, err := removePresencePeer(ctx, kvClient, appID, hashedRoom, peerID)
+		if err != nil {
+			log.Error().Err(err).Str("peer_id", peerID).Msg("failed to expire presence peer")
+			continue
+		}
+
+		if removed {
+			log.Debug().Str("peer_id", peerID).Msg("presence peer expired after missed heartbeats")
+
+			publishPresenceMessage(pubSub, appID, hashedRoom, &presenceMessage{
+				Type:      "disconnected",
+				PeerID:    peerID,
+				Timestamp: time.Now().UnixMilli(),
+			})
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package procedures
+
+import (
+	"context"
+	"encoding/json"
+	"server-optimized/api/service/trpc"
+	trpc2 "server-optimized/trpc"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/rs/zerolog/log"
+)
+
+type presencePeerInitInput struct {
+	SessionID    string `json:"sessionId"`
+	Peer         string `json:"peer"`
+	PeerID       string `json:"peerId"`
+	Meta         any    `json:"meta"`
+	InitialState any    `json:"initialState"`
+}
+
+func HandlePresencePeerInitMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	if trpcContext.Services == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput presencePeerInitInput
+
+	if len(input) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	sessionID := strings.TrimSpace(parsedInput.SessionID)
+	if sessionID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "sessionId is required",
+		}
+	}
+
+	peerID := strings.TrimSpace(parsedInput.Peer)
+	if peerID == "" {
+		peerID = strings.TrimSpace(parsedInput.PeerID)
+	}
+
+	if peerID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "peer is required",
+		}
+	}
+
+	if pinnedPeerID := trpcContext.Identity.PresencePeerID(); pinnedPeerID != "" && pinnedPeerID != peerID {
+		return nil, &trpc2.TRPCError{
+			Code:    403,
+			Message: "peerId mismatch between token and request",
+		}
+	}
+
+	// meta issued by the token can't be overridden by the client
+	meta := parsedInput.Meta
+	if tokenMeta := trpcContext.Identity.PresenceMeta(); tokenMeta != nil {
+		meta = tokenMeta
+	}
+
+	session, ok := trpcContext.Services.GetLocalState().GetPresenceSession(sessionID)
+	if !ok {
+		return nil, &trpc2.TRPCError{
+			Code:    404,
+			Message: "session not found",
+		}
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.PeerID != "" {
+		return nil, &trpc2.TRPCError{
+			Code:    409,
+			Message: "session is already initialized",
+		}
+	}
+
+	now := time.Now().UnixMilli()
+
+	peer := presencePeer{
+		Peer:          peerID,
+		Meta:          meta,
+		State:         parsedInput.InitialState,
+		Connected:     true,
+		LastConnected: now,
+		LastUpdated:   now,
+	}
+
+	if err := storePresencePeer(ctx, trpcContext.Services.GetKVClient(), session.AppID, session.HashedRoom, sessionID, &peer); err != nil {
+		log.Error().Err(err).Str("peer_id", peerID).Msg("failed to store presence peer in kv")
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to join room",
+		}
+	}
+
+	session.PeerID = peerID
+	session.PeerMeta = meta
+	session.PeerState = parsedInput.InitialState
+	session.JoinedAt = now
+
+	pubSub := trpcContext.Services.GetPubSub()
+
+	publishPresenceMessage(pubSub, session.AppID, session.HashedRoom, &presenceMessage{
+		Type:      "connected",
+		SessionID: sessionID,
+		PeerID:    peerID,
+		Timestamp: now,
+	})
+
+	if meta != nil {
+		publishPresenceMessage(pubSub, session.AppID, session.HashedRoom, &presenceMessage{
+			Type:      "meta",
+			SessionID: sessionID,
+			PeerID:    peerID,
+			Timestamp: now,
+			Meta:      meta,
+		})
+	}
+
+	if parsedInput.InitialState != nil {
+		publishPresenceMessage(pubSub, session.AppID, session.HashedRoom, &presenceMessage{
+			Type:      "state",
+			SessionID: sessionID,
+			PeerID:    peerID,
+			Timestamp: now,
+			State:     parsedInput.InitialState,
+		})
+	}
+
+	return json.RawMessage("null"), nil
+}
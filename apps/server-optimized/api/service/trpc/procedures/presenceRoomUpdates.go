@@ -0,0 +1,283 @@
+package procedures
+
+import (
+	"context"
+	"encoding/json"
+	"server-optimized/api/service/trpc"
+	"server-optimized/services/localstate"
+	trpc2 "server-optimized/trpc"
+	"server-optimized/utils"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+type presenceRoomUpdatesInput struct {
+	AppID string `json:"appId"`
+	Room  string `json:"room"`
+}
+
+type PresenceSessionInfoMessage struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id"`
+}
+
+type PresenceInitMessage struct {
+	Type  string         `json:"type"`
+	State *presenceState `json:"state"`
+}
+
+func HandlePresenceRoomUpdatesSubscription(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage, emit func(message json.RawMessage)) *trpc2.TRPCError {
+	if trpcContext.Services == nil {
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput presenceRoomUpdatesInput
+
+	if len(input) == 0 {
+		return &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	room := strings.TrimSpace(parsedInput.Room)
+	if room == "" {
+		return &trpc2.TRPCError{
+			Code:    400,
+			Message: "room is required",
+		}
+	}
+
+	appID := strings.TrimSpace(parsedInput.AppID)
+	if appID == "" {
+		appID = defaultPresenceAppID
+	}
+
+	if !trpcContext.Identity.AllowsApp(appID) {
+		return &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token is not valid for this app",
+		}
+	}
+
+	if !trpcContext.Identity.CanJoinPresence() {
+		return &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token does not have the permission to join this room",
+		}
+	}
+
+	hashedRoom, err := utils.GenerateHash(room)
+	if err != nil {
+		log.Error().Err(err).Str("room", room).Msg("failed to generate hash for presence room")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to prepare room subscription",
+		}
+	}
+
+	localStateService := trpcContext.Services.GetLocalState()
+	pubSub := trpcContext.Services.GetPubSub()
+	kvClient := trpcContext.Services.GetKVClient()
+
+	sessionID, err := gonanoid.New()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to generate session id")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to generate session id",
+		}
+	}
+
+	session := &localstate.PresenceSession{
+		AppID:      appID,
+		Room:       room,
+		HashedRoom: hashedRoom,
+	}
+
+	messagesChan := make(chan *nats.Msg, 128)
+
+	// subscribe before reading the snapshot so no event falls in between
+	subscription, err := pubSub.ChanSubscribe(presenceSubject(appID, hashedRoom), messagesChan)
+	if err != nil {
+		log.Error().Err(err).Str("room", room).Msg("failed to subscribe to presence room")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to subscribe to room",
+		}
+	}
+
+	localStateService.SetPresenceSession(sessionID, session)
+
+	defer func() {
+		_ = subscription.Unsubscribe()
+		localStateService.DeletePresenceSession(sessionID)
+
+		session.Lock()
+		peerID := session.PeerID
+		session.Unlock()
+
+		if peerID == "" {
+			return
+		}
+
+		// the subscription context is already cancelled at this point
+		stillConnected, err := releasePresenceConnection(context.Background(), kvClient, appID, hashedRoom, sessionID, peerID, viper.GetDuration("presence.peerTimeout"))
+		if err != nil {
+			log.Error().Err(err).Str("peer_id", peerID).Msg("failed to release presence connection on disconnect")
+			return
+		}
+
+		// the peer is still in the room through another session
+		if stillConnected {
+			return
+		}
+
+		removed, err := removePresencePeer(context.Background(), kvClient, appID, hashedRoom, peerID)
+		if err != nil {
+			log.Error().Err(err).Str("peer_id", peerID).Msg("failed to remove presence peer on disconnect")
+			return
+		}
+
+		if removed {
+			publishPresenceMessage(pubSub, appID, hashedRoom, &presenceMessage{
+				Type:      "disconnected",
+				SessionID: sessionID,
+				PeerID:    peerID,
+				Timestamp: time.Now().UnixMilli(),
+			})
+		}
+	}()
+
+	sessionInfoJSON, err := sonic.Marshal(&PresenceSessionInfoMessage{
+		Type:      "session-info",
+		SessionID: sessionID,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshal presence session-info message")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to prepare session info",
+		}
+	}
+
+	emit(sessionInfoJSON)
+
+	state, err := readPresenceState(ctx, kvClient, appID, hashedRoom)
+	if err != nil {
+		log.Error().Err(err).Str("room", room).Msg("failed to read presence room state from kv")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to read room state",
+		}
+	}
+
+	initJSON, err := sonic.Marshal(&PresenceInitMessage{
+		Type:  "init",
+		State: state,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshal presence init message")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to prepare init message",
+		}
+	}
+
+	emit(initJSON)
+
+	heartbeatInterval := viper.GetDuration("presence.heartbeatInterval")
+	peerTimeout := viper.GetDuration("presence.peerTimeout")
+
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeatTicker.C:
+			session.Lock()
+			peerID := session.PeerID
+			session.Unlock()
+
+			if peerID != "" {
+				pipe := kvClient.TxPipeline()
+				heartbeat := pipe.HSet(ctx, presenceHeartbeatsKey(appID, hashedRoom), peerID, time.Now().UnixMilli())
+				pipe.HSet(ctx, presenceConnectionsKey(appID, hashedRoom), sessionID, presenceConnection(peerID))
+
+				if _, err := pipe.Exec(ctx); err != nil {
+					log.Error().Err(err).Str("peer_id", peerID).Msg("failed to refresh presence heartbeat")
+				} else if heartbeat.Val() > 0 {
+					// another node swept this peer (e.g. after a long stall); rejoin
+					rejoinPresencePeer(ctx, trpcContext, sessionID, session)
+				}
+			}
+
+			sweepPresencePeers(ctx, kvClient, pubSub, appID, hashedRoom, peerTimeout)
+		case msg := <-messagesChan:
+			var message presenceMessage
+
+			if err := sonic.Unmarshal(msg.Data, &message); err != nil {
+				log.Error().Err(err).Str("subject", msg.Subject).Msg("failed to unmarshal presence message")
+				continue
+			}
+
+			message.SessionID = ""
+
+			marshaled, err := sonic.Marshal(&message)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to marshal presence message")
+				continue
+			}
+
+			emit(marshaled)
+		}
+	}
+}
+
+func rejoinPresencePeer(ctx context.Context, trpcContext *trpc.TRPCContext, sessionID string, session *localstate.PresenceSession) {
+	session.Lock()
+	defer session.Unlock()
+
+	now := time.Now().UnixMilli()
+
+	peer := presencePeer{
+		Peer:          session.PeerID,
+		Meta:          session.PeerMeta,
+		State:         session.PeerState,
+		Connected:     true,
+		LastConnected: now,
+		LastUpdated:   now,
+	}
+
+	if err := storePresencePeer(ctx, trpcContext.Services.GetKVClient(), session.AppID, session.HashedRoom, sessionID, &peer); err != nil {
+		log.Error().Err(err).Str("peer_id", session.PeerID).Msg("failed to restore expired presence peer")
+		return
+	}
+
+	session.JoinedAt = now
+
+	publishPresenceMessage(trpcContext.Services.GetPubSub(), session.AppID, session.HashedRoom, &presenceMessage{
+		Type:      "connected",
+		SessionID: sessionID,
+		PeerID:    session.PeerID,
+		Timestamp: now,
+	})
+}
@@ -0,0 +1,117 @@
+package procedures
+
+import (
+	"context"
+	"encoding/json"
+	"server-optimized/api/service/trpc"
+	trpc2 "server-optimized/trpc"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/rs/zerolog/log"
+)
+
+type presenceUpdateInput struct {
+	SessionID string `json:"sessionId"`
+	Update    struct {
+		Type  string `json:"type"`
+		State any    `json:"state"`
+	} `json:"update"`
+}
+
+func HandlePresenceUpdateMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	if trpcContext.Services == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput presenceUpdateInput
+
+	if len(input) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	sessionID := strings.TrimSpace(parsedInput.SessionID)
+	if sessionID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "sessionId is required",
+		}
+	}
+
+	if parsedInput.Update.Type != "state" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "unsupported update type",
+		}
+	}
+
+	if !trpcContext.Identity.CanUpdatePresenceState() {
+		return nil, &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token does not have the permission to update state",
+		}
+	}
+
+	session, ok := trpcContext.Services.GetLocalState().GetPresenceSession(sessionID)
+	if !ok {
+		return nil, &trpc2.TRPCError{
+			Code:    404,
+			Message: "session not found",
+		}
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.PeerID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    412,
+			Message: "this session is not initialized yet",
+		}
+	}
+
+	now := time.Now().UnixMilli()
+
+	peer := presencePeer{
+		Peer:          session.PeerID,
+		Meta:          session.PeerMeta,
+		State:         parsedInput.Update.State,
+		Connected:     true,
+		LastConnected: session.JoinedAt,
+		LastUpdated:   now,
+	}
+
+	if err := storePresencePeer(ctx, trpcContext.Services.GetKVClient(), session.AppID, session.HashedRoom, sessionID, &peer); err != nil {
+		log.Error().Err(err).Str("peer_id", session.PeerID).Msg("failed to store presence state in kv")
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to update presence state",
+		}
+	}
+
+	session.PeerState = parsedInput.Update.State
+
+	publishPresenceMessage(trpcContext.Services.GetPubSub(), session.AppID, session.HashedRoom, &presenceMessage{
+		Type:      "state",
+		SessionID: sessionID,
+		PeerID:    session.PeerID,
+		Timestamp: now,
+		State:     parsedInput.Update.State,
+	})
+
+	return json.RawMessage("null"), nil
+}
@@ -0,0 +1,88 @@
+package procedures
+
+import (
+	"context"
+	"errors"
+	"server-optimized/services/kv"
+	"server-optimized/services/localstate"
+	"time"
+
+	"github.com/bytedance/sonic"
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+// serverStateResumeRecord is what a server-state session leaves behind in KV
+// when its connection ends, so that a reconnecting client (on any node) can
+// pick up its watched keys within the grace period.
+type serverStateResumeRecord struct {
+	Keys []serverStateResumeKey `json:"keys"`
+}
+
+type serverStateResumeKey struct {
+	AppID string `json:"appId"`
+	Key   string `json:"key"`
+
+	// UpdateCount is the count of the value last sent for the key, if any
+	UpdateCount *int64 `json:"update_count,omitempty"`
+}
+
+func serverStateResumeRecordKey(resumeToken string) string {
+	return "server-state:sessions:" + resumeToken
+}
+
+// saveServerStateResumeRecord stores the session's watched keys under the
+// resume token for gracePeriod.
+func saveServerStateResumeRecord(ctx context.Context, kvClient kv.Store, resumeToken string, session *localstate.ServerStateSession, sentUpdateCounts map[localstate.ServerStateKey]int64, gracePeriod time.Duration) error {
+	session.Lock()
+
+	record := serverStateResumeRecord{
+		Keys: make([]serverStateResumeKey, 0, len(session.Keys)),
+	}
+
+	for stateKey := range session.Keys {
+		resumeKey := serverStateResumeKey{
+			AppID: stateKey.AppID,
+			Key:   stateKey.Key,
+		}
+
+		if updateCount, ok := sentUpdateCounts[stateKey]; ok {
+			resumeKey.UpdateCount = &updateCount
+		}
+
+		record.Keys = append(record.Keys, resumeKey)
+	}
+
+	session.Unlock()
+
+	if len(record.Keys) == 0 {
+		return nil
+	}
+
+	raw, err := sonic.Marshal(&record)
+	if err != nil {
+		return err
+	}
+
+	return kvClient.Set(ctx, serverStateResumeRecordKey(resumeToken), raw, gracePeriod).Err()
+}
+
+// claimServerStateResumeRecord takes the record for a resume token out of KV,
+// so that a token can only ever be used once. A missing or expired token
+// yields nil.
+func claimServerStateResumeRecord(ctx context.Context, kvClient kv.Store, resumeToken string) (*serverStateResumeRecord, error) {
+	raw, err := kvClient.GetDel(ctx, serverStateResumeRecordKey(resumeToken)).Result()
+	if errors.Is(err, goRedis.Nil) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var record serverStateResumeRecord
+	if err := sonic.Unmarshal([]byte(raw), &record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
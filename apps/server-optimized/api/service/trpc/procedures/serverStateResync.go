@@ -0,0 +1,168 @@
+package procedures
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"server-optimized/api/service/trpc"
+	"server-optimized/services"
+	"server-optimized/services/hub"
+	"server-optimized/services/localstate"
+	trpc2 "server-optimized/trpc"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/rs/zerolog/log"
+)
+
+type serverStateResyncInput struct {
+	AppID     string   `json:"appId"`
+	SessionID string   `json:"sessionId"`
+	Keys      []string `json:"keys"`
+}
+
+type serverStateResyncResult struct {
+	Resynced []string `json:"resynced"`
+}
+
+// HandleServerStateResyncMutation is for clients that noticed a gap in the
+// deltas of a key (a base_update_count other than the count they hold). The
+// current values are pushed through the session's subscription as full
+// `updates`, so they stay ordered with the deltas that follow.
+func HandleServerStateResyncMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	if trpcContext.Services == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput serverStateResyncInput
+
+	if len(input) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	appID := strings.TrimSpace(parsedInput.AppID)
+	if appID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "appId is required",
+		}
+	}
+
+	if !trpcContext.Identity.AllowsApp(appID) {
+		return nil, &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token is not valid for this app",
+		}
+	}
+
+	sessionID := strings.TrimSpace(parsedInput.SessionID)
+	if sessionID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "sessionId is required",
+		}
+	}
+
+	if len(parsedInput.Keys) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "at least one key is required",
+		}
+	}
+
+	for _, key := range parsedInput.Keys {
+		if !trpcContext.Identity.CanReadServerStateKey(key) {
+			return nil, &trpc2.TRPCError{
+				Code:    403,
+				Message: fmt.Sprintf("the token does not have the permission to read key %s", key),
+			}
+		}
+	}
+
+	localStateService := trpcContext.Services.GetLocalState()
+	if localStateService == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "local state not available",
+		}
+	}
+
+	session, ok := localStateService.GetSession(sessionID)
+	if !ok {
+		return forwardServerStateSessionRequest(ctx, trpcContext.Services.GetPubSub(), sessionID, &serverStateSessionRequest{
+			Op:    serverStateSessionOpResync,
+			AppID: appID,
+			Keys:  parsedInput.Keys,
+		})
+	}
+
+	return resyncServerStateKeys(ctx, trpcContext.Services, session, appID, parsedInput.Keys)
+}
+
+// resyncServerStateKeys pushes the current values of keys watched by a
+// session owned by this node. Each key has to be watched in appID, the app
+// the token was checked for.
+func resyncServerStateKeys(ctx context.Context, svc services.Services, session *localstate.ServerStateSession, appID string, keys []string) (json.RawMessage, *trpc2.TRPCError) {
+	kvClient := svc.GetKVClient()
+	if kvClient == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "kv client not available",
+		}
+	}
+
+	resynced := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		session.Lock()
+		_, watched := session.Keys[localstate.ServerStateKey{AppID: appID, Key: key}]
+		session.Unlock()
+
+		if !watched {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: fmt.Sprintf("key %s is not watched by this session in app %s", key, appID),
+			}
+		}
+
+		snapshot, err := hub.ReadSnapshot(ctx, kvClient, appID, key)
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Msg("failed to read server-state value for resync")
+			return nil, &trpc2.TRPCError{
+				Code:    500,
+				Message: "failed to read state from kv",
+			}
+		}
+
+		if session.Handler != nil {
+			session.Handler(snapshot)
+		}
+
+		resynced = append(resynced, key)
+	}
+
+	output, err := sonic.Marshal(&serverStateResyncResult{
+		Resynced: resynced,
+	})
+	if err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to marshal resync result",
+		}
+	}
+
+	return output, nil
+}
@@ -0,0 +1,142 @@
+package procedures
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"server-optimized/services"
+	"server-optimized/services/localstate"
+	natsService "server-optimized/services/nats"
+	trpc2 "server-optimized/trpc"
+
+	"github.com/bytedance/sonic"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Server-state sessions live on the node that holds their subscription, but
+// the mutations that act on them (watchKeys, unwatchKeys, resync) can land on
+// any node behind the load balancer. Each session therefore answers NATS
+// requests on its own subject, and a node that does not own a session
+// forwards the already authorized mutation there.
+
+const (
+	serverStateSessionOpWatch   = "watch"
+	serverStateSessionOpUnwatch = "unwatch"
+	serverStateSessionOpResync  = "resync"
+)
+
+type serverStateSessionRequest struct {
+	Op    string   `json:"op"`
+	AppID string   `json:"appId,omitempty"`
+	Keys  []string `json:"keys"`
+}
+
+type serverStateSessionReply struct {
+	Result json.RawMessage  `json:"result,omitempty"`
+	Error  *trpc2.TRPCError `json:"error,omitempty"`
+}
+
+func serverStateSessionSubject(sessionID string) string {
+	return "server-state-session." + sessionID
+}
+
+// serveServerStateSession answers forwarded mutations for a session owned by
+// this node until the returned subscription is unsubscribed. ctx is the
+// session's, so keys watched through it live as long as the session does.
+func serveServerStateSession(ctx context.Context, svc services.Services, pubSub natsService.PubSub, sessionID string, session *localstate.ServerStateSession) (natsService.Subscription, error) {
+	return pubSub.Subscribe(serverStateSessionSubject(sessionID), func(msg *nats.Msg) {
+		var reply serverStateSessionReply
+
+		var request serverStateSessionRequest
+		if err := sonic.Unmarshal(msg.Data, &request); err != nil {
+			reply.Error = &trpc2.TRPCError{
+				Code:    400,
+				Message: "invalid forwarded request",
+			}
+		} else {
+			reply.Result, reply.Error = handleServerStateSessionRequest(ctx, svc, sessionID, session, &request)
+		}
+
+		raw, err := sonic.Marshal(&reply)
+		if err != nil {
+			log.Error().Err(err).Str("sessionId", sessionID).Msg("failed to marshal forwarded server-state reply")
+			return
+		}
+
+		// published rather than msg.Respond, which only works on a NATS
+		// connection's own messages
+		if err := pubSub.Publish(msg.Reply, raw); err != nil {
+			log.Error().Err(err).Str("sessionId", sessionID).Msg("failed to reply to forwarded server-state request")
+		}
+	})
+}
+
+func handleServerStateSessionRequest(ctx context.Context, svc services.Services, sessionID string, session *localstate.ServerStateSession, request *serverStateSessionRequest) (json.RawMessage, *trpc2.TRPCError) {
+	switch request.Op {
+	case serverStateSessionOpWatch:
+		return watchServerStateKeys(ctx, svc, session, request.AppID, request.Keys)
+	case serverStateSessionOpUnwatch:
+		return unwatchServerStateKeys(svc, sessionID, session, request.AppID, request.Keys)
+	case serverStateSessionOpResync:
+		return resyncServerStateKeys(ctx, svc, session, request.AppID, request.Keys)
+	default:
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "unknown forwarded operation",
+		}
+	}
+}
+
+// forwardServerStateSessionRequest hands a mutation to the node owning the
+// session. A session no node answers for is reported as not found.
+func forwardServerStateSessionRequest(ctx context.Context, pubSub natsService.PubSub, sessionID string, request *serverStateSessionRequest) (json.RawMessage, *trpc2.TRPCError) {
+	if pubSub == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "pub/sub not available",
+		}
+	}
+
+	raw, err := sonic.Marshal(request)
+	if err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to marshal forwarded request",
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("serverState.sessionRoutingTimeout"))
+	defer cancel()
+
+	msg, err := pubSub.RequestWithContext(ctx, serverStateSessionSubject(sessionID), raw)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, &trpc2.TRPCError{
+			Code:    404,
+			Message: "session not found",
+		}
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("sessionId", sessionID).Str("op", request.Op).Msg("failed to forward server-state request")
+		return nil, &trpc2.TRPCError{
+			Code:    504,
+			Message: "the node owning the session did not respond",
+		}
+	}
+
+	var reply serverStateSessionReply
+	if err := sonic.Unmarshal(msg.Data, &reply); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    502,
+			Message: "invalid reply from the node owning the session",
+		}
+	}
+
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+
+	return reply.Result, nil
+}
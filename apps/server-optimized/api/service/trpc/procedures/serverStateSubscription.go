@@ -3,17 +3,30 @@ package procedures
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"server-optimized/api/service/trpc"
+	"server-optimized/services/hub"
+	"server-optimized/services/localstate"
 	trpc2 "server-optimized/trpc"
 
 	"github.com/bytedance/sonic"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 )
 
 type ServerStateSessionInfoMessage struct {
 	Type      string `json:"type"`
 	SessionID string `json:"session_id"`
+
+	// ResumeToken lets the client pick this session up again after a
+	// reconnect; it is only good for one resume
+	ResumeToken string `json:"resume_token,omitempty"`
+
+	// Resumed tells whether the watched keys of the session named by the
+	// input's resumeToken were carried over; if not, the client has to watch
+	// them again
+	Resumed bool `json:"resumed"`
 }
 
 type ServerStateInitMessage struct {
@@ -21,8 +34,10 @@ type ServerStateInitMessage struct {
 }
 
 type ServerStateUpdate struct {
-	Key   string      `json:"key"`
-	Value interface{} `json:"value"`
+	AppID       string      `json:"app_id"`
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"`
+	UpdateCount *int64      `json:"update_count,omitempty"`
 }
 
 type ServerStateUpdatesMessage struct {
@@ -30,6 +45,39 @@ type ServerStateUpdatesMessage struct {
 	Updates []ServerStateUpdate `json:"updates"`
 }
 
+// ServerStateDelta is a JSON Patch (RFC 6902) that turns the value the client
+// has at BaseUpdateCount into the one at UpdateCount.
+type ServerStateDelta struct {
+	AppID           string          `json:"app_id"`
+	Key             string          `json:"key"`
+	Delta           json.RawMessage `json:"delta"`
+	BaseUpdateCount int64           `json:"base_update_count"`
+	UpdateCount     int64           `json:"update_count"`
+}
+
+type ServerStateDeltasMessage struct {
+	Type   string             `json:"type"`
+	Deltas []ServerStateDelta `json:"deltas"`
+}
+
+type serverStateSubscriptionInput struct {
+	// Deltas opts into `deltas` messages in place of full values wherever the
+	// server knows the client holds the base value
+	Deltas bool `json:"deltas"`
+
+	// ResumeToken is the resume_token of an earlier session, whose watched
+	// keys are carried over if it ended less than the grace period ago
+	ResumeToken string `json:"resumeToken"`
+
+	// LastUpdateCounts are the update counts the client last saw per key;
+	// on resume, only keys that moved past them are sent again
+	LastUpdateCounts map[string]int64 `json:"lastUpdateCounts"`
+
+	// LastUpdateCountsByApp is LastUpdateCounts per app, for a session that
+	// watches the same key in more than one app; it takes precedence
+	LastUpdateCountsByApp map[string]map[string]int64 `json:"lastUpdateCountsByApp"`
+}
+
 func HandleServerStateSubscription(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage, emit func(message json.RawMessage)) *trpc2.TRPCError { 
 	
 	if trpcContext.Services == nil {
@@ -39,6 +87,17 @@ func HandleServerStateSubscription(ctx context.Context, trpcContext *trpc.TRPCCo
 		}
 	}
 
+	var parsedInput serverStateSubscriptionInput
+
+	if len(input) != 0 && string(input) != "null" {
+		if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+			return &trpc2.TRPCError{
+				Code:    400,
+				Message: "invalid input",
+			}
+		}
+	}
+
 	localStateService := trpcContext.Services.GetLocalState()
 	if localStateService == nil {
 		return &trpc2.TRPCError{
@@ -56,44 +115,144 @@ func HandleServerStateSubscription(ctx context.Context, trpcContext *trpc.TRPCCo
 		}
 	}
 
+	kvClient := trpcContext.Services.GetKVClient()
+	if kvClient == nil {
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "kv client not available",
+		}
+	}
+
+	pubSub := trpcContext.Services.GetPubSub()
+	if pubSub == nil {
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "pub/sub not available",
+		}
+	}
+
+	resumeGracePeriod := viper.GetDuration("serverState.resumeGracePeriod")
+
+	var resumeToken string
+	if resumeGracePeriod > 0 {
+		if resumeToken, err = gonanoid.New(32); err != nil {
+			log.Error().Err(err).Msg("failed to generate resume token")
+			return &trpc2.TRPCError{
+				Code:    500,
+				Message: "failed to generate resume token",
+			}
+		}
+	}
+
+	var resumed *serverStateResumeRecord
+
+	if parsedInput.ResumeToken != "" {
+		resumed, err = claimServerStateResumeRecord(ctx, kvClient, parsedInput.ResumeToken)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read server-state resume record")
+			return &trpc2.TRPCError{
+				Code:    500,
+				Message: "failed to resume session",
+			}
+		}
+
+		// the token may have been issued to a different identity
+		if resumed != nil {
+			for _, resumeKey := range resumed.Keys {
+				if !trpcContext.Identity.AllowsApp(resumeKey.AppID) || !trpcContext.Identity.CanReadServerStateKey(resumeKey.Key) {
+					return &trpc2.TRPCError{
+						Code:    403,
+						Message: fmt.Sprintf("the token does not have the permission to read key %s", resumeKey.Key),
+					}
+				}
+			}
+		}
+	}
+
 	session := localStateService.UpsertServerStateSession(sessionID)
-	session.Keys = make(map[string]struct{})
+	session.Keys = make(map[localstate.ServerStateKey]struct{})
 
-	type updatePayload struct {
-		Key   string
-		Value interface{}
+	serverStateHub := trpcContext.Services.GetHub()
+	if serverStateHub == nil {
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "hub not available",
+		}
 	}
 
-	updatesChan := make(chan updatePayload, 128)
+	queue := hub.NewQueue()
+	session.Handler = queue.Push
 
-	session.Handler = func(stateKey string, data any) {
-		select {
-		case <-ctx.Done():
-			return
-		case updatesChan <- updatePayload{
-			Key:   stateKey,
-			Value: data,
-		}:
+	// the update count of the value last sent per key of an app. Published
+	// updates at or below it are stale or duplicates and are dropped; a delta
+	// is only sent when it applies on top of it, anything else falls back to
+	// the full value so a gap can never go unnoticed
+	sentUpdateCounts := make(map[localstate.ServerStateKey]int64)
+
+	if resumed != nil {
+		// a count keyed by the key alone cannot tell apart the apps the key
+		// is resumed in, so it only applies to a key resumed in one of them
+		appsPerKey := make(map[string]int, len(resumed.Keys))
+		for _, resumeKey := range resumed.Keys {
+			appsPerKey[resumeKey.Key]++
+		}
+
+		for _, resumeKey := range resumed.Keys {
+			stateKey := localstate.ServerStateKey{AppID: resumeKey.AppID, Key: resumeKey.Key}
+
+			if lastUpdateCount, ok := parsedInput.LastUpdateCountsByApp[resumeKey.AppID][resumeKey.Key]; ok {
+				sentUpdateCounts[stateKey] = lastUpdateCount
+			} else if lastUpdateCount, ok := parsedInput.LastUpdateCounts[resumeKey.Key]; ok && appsPerKey[resumeKey.Key] == 1 {
+				sentUpdateCounts[stateKey] = lastUpdateCount
+			} else if resumeKey.UpdateCount != nil {
+				sentUpdateCounts[stateKey] = *resumeKey.UpdateCount
+			}
+		}
+	}
+
+	routing, err := serveServerStateSession(ctx, trpcContext.Services, pubSub, sessionID, session)
+	if err != nil {
+		localStateService.DeleteSession(sessionID)
+
+		log.Error().Err(err).Msg("failed to subscribe to server-state session subject")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to register session",
 		}
 	}
 
 	defer func() {
+		if err := routing.Unsubscribe(); err != nil {
+			log.Error().Err(err).Str("sessionId", sessionID).Msg("failed to unsubscribe server-state session subject")
+		}
+
+		if resumeToken != "" {
+			if err := saveServerStateResumeRecord(context.Background(), kvClient, resumeToken, session, sentUpdateCounts, resumeGracePeriod); err != nil {
+				log.Error().Err(err).Str("sessionId", sessionID).Msg("failed to save server-state resume record")
+			}
+		}
+
+		session.Lock()
 		if session.Subscriptions != nil {
-			for subject, sub := range session.Subscriptions {
+			for stateKey, sub := range session.Subscriptions {
 				if sub != nil {
-					log.Debug().Str("sessionId", sessionID).Str("subject", subject).Msg("unsubscribing server-state NATS subscription")
+					log.Debug().Str("sessionId", sessionID).Str("appId", stateKey.AppID).Str("key", stateKey.Key).Msg("unsubscribing server-state NATS subscription")
 					_ = sub.Unsubscribe()
 				}
 			}
 		}
 
+		session.Unlock()
+
 		localStateService.DeleteSession(sessionID)
-		close(updatesChan)
+		queue.Close()
 	}()
 
 	sessionInfo := &ServerStateSessionInfoMessage{
-		Type:      "session-info",
-		SessionID: sessionID,
+		Type:        "session-info",
+		SessionID:   sessionID,
+		ResumeToken: resumeToken,
+		Resumed:     resumed != nil,
 	}
 
 	sessionInfoJSON, err := sonic.Marshal(sessionInfo)
@@ -122,35 +281,112 @@ func HandleServerStateSubscription(ctx context.Context, trpcContext *trpc.TRPCCo
 
 	emit(initJSON)
 
+	resumeErrors := make(chan error, 1)
+
+	if resumed != nil {
+		go func() {
+			for _, resumeKey := range resumed.Keys {
+				if err := subscribeServerStateKey(session, serverStateHub, resumeKey.AppID, resumeKey.Key); err != nil {
+					resumeErrors <- err
+					return
+				}
+
+				snapshot, err := hub.ReadSnapshot(ctx, kvClient, resumeKey.AppID, resumeKey.Key)
+				if err != nil {
+					resumeErrors <- err
+					return
+				}
+
+				// unlike on a fresh watch, the value is only sent again if it
+				// moved past what the client already has
+				snapshot.Snapshot = false
+				session.Handler(snapshot)
+			}
+		}()
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case upd, ok := <-updatesChan:
-			if !ok {
-				return nil
+		case err := <-resumeErrors:
+			log.Error().Err(err).Str("sessionId", sessionID).Msg("failed to resume server-state session")
+			return &trpc2.TRPCError{
+				Code:    500,
+				Message: "failed to resume session",
 			}
+		case <-queue.Ready():
+			var (
+				updates []ServerStateUpdate
+				deltas  []ServerStateDelta
+			)
+
+			for _, upd := range queue.Drain() {
+				sentUpdateCount, known := sentUpdateCounts[upd.StateKey()]
+
+				if known && upd.UpdateCount >= 0 && (upd.UpdateCount < sentUpdateCount || (upd.UpdateCount == sentUpdateCount && !upd.Snapshot)) {
+					log.Debug().Str("key", upd.Key).Int64("update_count", upd.UpdateCount).Int64("sent_update_count", sentUpdateCount).Msg("dropping stale server-state update")
+					continue
+				}
 
-			msg := &ServerStateUpdatesMessage{
-				Type: "updates",
-				Updates: []ServerStateUpdate{
-					{
+				if parsedInput.Deltas && upd.Delta != nil && known && sentUpdateCount == upd.BaseUpdateCount {
+					deltas = append(deltas, ServerStateDelta{
+						AppID:           upd.AppID,
+						Key:             upd.Key,
+						Delta:           upd.Delta,
+						BaseUpdateCount: upd.BaseUpdateCount,
+						UpdateCount:     upd.UpdateCount,
+					})
+				} else {
+					update := ServerStateUpdate{
+						AppID: upd.AppID,
 						Key:   upd.Key,
 						Value: upd.Value,
-					},
-				},
+					}
+
+					if upd.UpdateCount >= 0 {
+						updateCount := upd.UpdateCount
+						update.UpdateCount = &updateCount
+					}
+
+					updates = append(updates, update)
+				}
+
+				if upd.UpdateCount >= 0 {
+					sentUpdateCounts[upd.StateKey()] = upd.UpdateCount
+				} else {
+					delete(sentUpdateCounts, upd.StateKey())
+				}
 			}
 
-			marshaled, marshalErr := sonic.Marshal(msg)
-			if marshalErr != nil {
-				log.Error().Err(marshalErr).Msg("failed to marshal server-state updates message")
-				return &trpc2.TRPCError{
-					Code:    500,
-					Message: "failed to marshal server-state updates",
+			// everything that piled up while the client was busy goes out in
+			// at most two messages
+			if len(deltas) > 0 {
+				if err := emitServerStateMessage(emit, &ServerStateDeltasMessage{Type: "deltas", Deltas: deltas}); err != nil {
+					return err
 				}
 			}
 
-			emit(marshaled)
+			if len(updates) > 0 {
+				if err := emitServerStateMessage(emit, &ServerStateUpdatesMessage{Type: "updates", Updates: updates}); err != nil {
+					return err
+				}
+			}
 		}
 	}
 }
+
+func emitServerStateMessage(emit func(message json.RawMessage), msg any) *trpc2.TRPCError {
+	marshaled, err := sonic.Marshal(msg)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshal server-state updates message")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to marshal server-state updates",
+		}
+	}
+
+	emit(marshaled)
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package procedures
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"server-optimized/api/service/trpc"
+	"server-optimized/services"
+	"server-optimized/services/localstate"
+	"server-optimized/services/webhooks"
+	trpc2 "server-optimized/trpc"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/rs/zerolog/log"
+)
+
+type serverStateUnwatchKeysInput struct {
+	AppID     string   `json:"appId"`
+	SessionID string   `json:"sessionId"`
+	Keys      []string `json:"keys"`
+}
+
+type serverStateUnwatchKeysResult struct {
+	Unwatched []string `json:"unwatched"`
+}
+
+func HandleServerStateUnwatchKeysMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	if trpcContext.Services == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput serverStateUnwatchKeysInput
+
+	if len(input) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	appID := strings.TrimSpace(parsedInput.AppID)
+	if appID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "appId is required",
+		}
+	}
+
+	if !trpcContext.Identity.AllowsApp(appID) {
+		return nil, &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token is not valid for this app",
+		}
+	}
+
+	sessionID := strings.TrimSpace(parsedInput.SessionID)
+	if sessionID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "sessionId is required",
+		}
+	}
+
+	if len(parsedInput.Keys) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "at least one key is required",
+		}
+	}
+
+	for _, key := range parsedInput.Keys {
+		if !trpcContext.Identity.CanReadServerStateKey(key) {
+			return nil, &trpc2.TRPCError{
+				Code:    403,
+				Message: fmt.Sprintf("the token does not have the permission to read key %s", key),
+			}
+		}
+	}
+
+	localStateService := trpcContext.Services.GetLocalState()
+	if localStateService == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "local state not available",
+		}
+	}
+
+	session, ok := localStateService.GetSession(sessionID)
+	if !ok {
+		return forwardServerStateSessionRequest(ctx, trpcContext.Services.GetPubSub(), sessionID, &serverStateSessionRequest{
+			Op:    serverStateSessionOpUnwatch,
+			AppID: appID,
+			Keys:  parsedInput.Keys,
+		})
+	}
+
+	return unwatchServerStateKeys(trpcContext.Services, sessionID, session, appID, parsedInput.Keys)
+}
+
+// unwatchServerStateKeys unsubscribes a session owned by this node from keys
+// of appID; the same keys watched in other apps are left alone.
+func unwatchServerStateKeys(svc services.Services, sessionID string, session *localstate.ServerStateSession, appID string, keys []string) (json.RawMessage, *trpc2.TRPCError) {
+	unwatched := make([]string, 0, len(keys))
+
+	session.Lock()
+	defer session.Unlock()
+
+	for _, key := range keys {
+		stateKey := localstate.ServerStateKey{AppID: appID, Key: key}
+
+		if _, watched := session.Keys[stateKey]; !watched {
+			continue
+		}
+
+		if subscription := session.Subscriptions[stateKey]; subscription != nil {
+			if err := subscription.Unsubscribe(); err != nil {
+				log.Error().Err(err).Str("sessionId", sessionID).Str("appId", appID).Str("key", key).Msg("failed to unsubscribe server-state NATS subscription")
+			}
+		}
+
+		delete(session.Subscriptions, stateKey)
+		delete(session.Keys, stateKey)
+		unwatched = append(unwatched, key)
+	}
+
+	if len(unwatched) > 0 {
+		svc.GetWebhooks().Dispatch(appID, webhooks.EventClientUnsubscribed, &webhooks.SubscriptionEvent{
+			Service:   "server-state",
+			SessionID: sessionID,
+			AppID:     appID,
+			Keys:      unwatched,
+		})
+	}
+
+	log.Debug().Str("sessionId", sessionID).Str("appId", appID).Strs("keys", unwatched).Msg("unwatched server-state keys")
+
+	output, err := sonic.Marshal(&serverStateUnwatchKeysResult{
+		Unwatched: unwatched,
+	})
+	if err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to marshal unwatch-keys result",
+		}
+	}
+
+	return output, nil
+}
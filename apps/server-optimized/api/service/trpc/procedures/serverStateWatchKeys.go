@@ -5,13 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"server-optimized/api/service/trpc"
+	"server-optimized/services"
+	"server-optimized/services/hub"
+	"server-optimized/services/localstate"
+	"server-optimized/services/webhooks"
 	trpc2 "server-optimized/trpc"
-	"server-optimized/utils"
 	"strings"
 
 	"github.com/bytedance/sonic"
-	"github.com/nats-io/nats.go"
-	goRedis "github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
@@ -22,8 +23,9 @@ type serverStateWatchKeysInput struct {
 }
 
 type serverStateWatchKeysResult struct {
-	Key   string      `json:"key"`
-	Value interface{} `json:"value"`
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"`
+	UpdateCount int64       `json:"update_count"`
 }
 
 func HandleServerStateWatchKeysMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) { 
@@ -58,6 +60,13 @@ func HandleServerStateWatchKeysMutation(ctx context.Context, trpcContext *trpc.T
 		}
 	}
 
+	if !trpcContext.Identity.AllowsApp(appID) {
+		return nil, &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token is not valid for this app",
+		}
+	}
+
 	sessionID := strings.TrimSpace(parsedInput.SessionID)
 	if sessionID == "" {
 		return nil, &trpc2.TRPCError{
@@ -73,6 +82,17 @@ func HandleServerStateWatchKeysMutation(ctx context.Context, trpcContext *trpc.T
 		}
 	}
 
+	keys := parsedInput.Keys
+
+	for _, key := range keys {
+		if !trpcContext.Identity.CanReadServerStateKey(key) {
+			return nil, &trpc2.TRPCError{
+				Code:    403,
+				Message: fmt.Sprintf("the token does not have the permission to read key %s", key),
+			}
+		}
+	}
+
 	localStateService := trpcContext.Services.GetLocalState()
 	if localStateService == nil {
 		return nil, &trpc2.TRPCError{
@@ -81,27 +101,59 @@ func HandleServerStateWatchKeysMutation(ctx context.Context, trpcContext *trpc.T
 		}
 	}
 
-	session, ok := localStateService.GetSession(sessionID)
-	if !ok {
+	hooks := trpcContext.Services.GetWebhooks()
+	subscriptionEvent := &webhooks.SubscriptionEvent{
+		Service:   "server-state",
+		ClientID:  trpcContext.ConnectionID,
+		Actor:     trpcContext.Identity.Actor(),
+		SessionID: sessionID,
+		AppID:     appID,
+		Keys:      keys,
+	}
+
+	if err := hooks.Authorize(ctx, appID, webhooks.EventClientSubscribed, subscriptionEvent); err != nil {
 		return nil, &trpc2.TRPCError{
-			Code:    404,
-			Message: "session not found",
+			Code:    403,
+			Message: err.Error(),
 		}
 	}
 
-	if session.Subscriptions == nil {
-		session.Subscriptions = make(map[string]*nats.Subscription)
+	var (
+		output  json.RawMessage
+		trpcErr *trpc2.TRPCError
+	)
+
+	session, ok := localStateService.GetSession(sessionID)
+	if !ok {
+		output, trpcErr = forwardServerStateSessionRequest(ctx, trpcContext.Services.GetPubSub(), sessionID, &serverStateSessionRequest{
+			Op:    serverStateSessionOpWatch,
+			AppID: appID,
+			Keys:  keys,
+		})
+	} else {
+		output, trpcErr = watchServerStateKeys(ctx, trpcContext.Services, session, appID, keys)
+	}
+
+	if trpcErr == nil {
+		hooks.Dispatch(appID, webhooks.EventClientSubscribed, subscriptionEvent)
 	}
 
-	natsConn := trpcContext.Services.GetNATSConnection()
-	if natsConn == nil {
+	return output, trpcErr
+}
+
+// watchServerStateKeys subscribes a session owned by this node to keys the
+// caller is already known to be allowed to read, and returns their current
+// values.
+func watchServerStateKeys(ctx context.Context, svc services.Services, session *localstate.ServerStateSession, appID string, keys []string) (json.RawMessage, *trpc2.TRPCError) {
+	serverStateHub := svc.GetHub()
+	if serverStateHub == nil {
 		return nil, &trpc2.TRPCError{
 			Code:    500,
-			Message: "nats connection not available",
+			Message: "hub not available",
 		}
 	}
 
-	kvClient := trpcContext.Services.GetKVClient()
+	kvClient := svc.GetKVClient()
 	if kvClient == nil {
 		return nil, &trpc2.TRPCError{
 			Code:    500,
@@ -109,98 +161,38 @@ func HandleServerStateWatchKeysMutation(ctx context.Context, trpcContext *trpc.T
 		}
 	}
 
-	keys := parsedInput.Keys
-	if len(keys) == 0 {
-		return nil, &trpc2.TRPCError{
-			Code:    400,
-			Message: "no valid keys provided",
-		}
-	}
-
 	resultMap := make(map[string]serverStateWatchKeysResult, len(keys))
 
 	for _, key := range keys {
-		hashedKey, err := utils.GenerateHash(key)
-		if err != nil {
-			log.Error().Err(err).Str("key", key).Msg("failed to generate hash for server-state key")
+		if err := subscribeServerStateKey(session, serverStateHub, appID, key); err != nil {
+			log.Error().Err(err).Str("key", key).Msg("failed to subscribe to nats subject for server-state")
 			return nil, &trpc2.TRPCError{
 				Code:    500,
-				Message: "failed to prepare key subscription",
-			}
-		}
-
-		subject := fmt.Sprintf("server-state.%s_%s", appID, hashedKey)
-
-		if _, exists := session.Subscriptions[subject]; !exists {
-			keyCopy := key
-			subjectCopy := subject
-
-			subscription, err := natsConn.Subscribe(subjectCopy, func(msg *nats.Msg) {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-				}
-
-				var value interface{}
-				if len(msg.Data) == 0 || string(msg.Data) == "null" {
-					value = nil
-				} else if err := json.Unmarshal(msg.Data, &value); err != nil {
-					log.Error().Err(err).Str("subject", subjectCopy).Msg("failed to unmarshal nats message for server-state")
-					return
-				}
-
-				if session.Handler != nil {
-					session.Handler(keyCopy, value)
-				}
-			})
-
-			if err != nil {
-				log.Error().Err(err).Str("subject", subjectCopy).Msg("failed to subscribe to nats subject for server-state")
-				return nil, &trpc2.TRPCError{
-					Code:    500,
-					Message: fmt.Sprintf("failed to subscribe to key %s", key),
-				}
+				Message: fmt.Sprintf("failed to subscribe to key %s", key),
 			}
-
-			session.Subscriptions[subjectCopy] = subscription
-		}
-
-		if session.Keys == nil {
-			session.Keys = make(map[string]struct{})
 		}
 
-		session.Keys[key] = struct{}{}
-
-		fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
-
-		rawValue, err := kvClient.Get(ctx, fullKey).Result()
-		if err != nil && err != goRedis.Nil {
-			log.Error().Err(err).Str("key", fullKey).Msg("failed to get initial server-state value from kv")
+		// the subscription above is already live, so an update published
+		// while this snapshot is read is not lost; whichever of the two
+		// reaches the session first, the subscription drops the older one by
+		// its update count
+		snapshot, err := hub.ReadSnapshot(ctx, kvClient, appID, key)
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Msg("failed to get initial server-state value from kv")
 			return nil, &trpc2.TRPCError{
 				Code:    500,
 				Message: "failed to read initial state from kv",
 			}
 		}
 
-		var value interface{}
-		if err == goRedis.Nil || rawValue == "" || rawValue == "null" {
-			value = nil
-		} else if unmarshalErr := json.Unmarshal([]byte(rawValue), &value); unmarshalErr != nil {
-			log.Error().Err(unmarshalErr).Str("key", fullKey).Msg("failed to unmarshal initial server-state value from kv")
-			return nil, &trpc2.TRPCError{
-				Code:    500,
-				Message: "failed to parse initial state from kv",
-			}
-		}
-
 		if session.Handler != nil {
-			session.Handler(key, value)
+			session.Handler(snapshot)
 		}
 
 		resultMap[key] = serverStateWatchKeysResult{
-			Key:   key,
-			Value: value,
+			Key:         key,
+			Value:       snapshot.Value,
+			UpdateCount: snapshot.UpdateCount,
 		}
 	}
 
@@ -215,3 +207,32 @@ func HandleServerStateWatchKeysMutation(ctx context.Context, trpcContext *trpc.T
 	return output, nil
 }
 
+// subscribeServerStateKey adds key to the session's watched keys and
+// registers the session with the hub for its updates, unless it already is.
+func subscribeServerStateKey(session *localstate.ServerStateSession, serverStateHub *hub.Hub, appID string, key string) error {
+	stateKey := localstate.ServerStateKey{AppID: appID, Key: key}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.Subscriptions == nil {
+		session.Subscriptions = make(map[localstate.ServerStateKey]localstate.Subscription)
+	}
+
+	if _, exists := session.Subscriptions[stateKey]; !exists {
+		watch, err := serverStateHub.Watch(appID, key, session.Handler)
+		if err != nil {
+			return err
+		}
+
+		session.Subscriptions[stateKey] = watch
+	}
+
+	if session.Keys == nil {
+		session.Keys = make(map[localstate.ServerStateKey]struct{})
+	}
+
+	session.Keys[stateKey] = struct{}{}
+
+	return nil
+}
@@ -0,0 +1,343 @@
+package procedures
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"server-optimized/api/service/trpc"
+	"server-optimized/lib/kv_scripts"
+	"server-optimized/services/hub"
+	trpc2 "server-optimized/trpc"
+	"strconv"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	goRedis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	serverStateWriteOpSet    = "set"
+	serverStateWriteOpMerge  = "merge"
+	serverStateWriteOpAtomic = "atomic"
+)
+
+type serverStateWriteInput struct {
+	AppID string `json:"appId"`
+	Key   string `json:"key"`
+
+	// Value is the new value for set, or the object merged into the current
+	// one for merge
+	Value json.RawMessage `json:"value"`
+
+	// Ops are the atomic operations ($set, $inc, $push, ...) for atomic
+	Ops json.RawMessage `json:"ops"`
+
+	// ExpectedUpdateCount makes the write conditional, like If-Match on the
+	// admin API
+	ExpectedUpdateCount *int64 `json:"expectedUpdateCount"`
+
+	// TTL is how long the key lives on after the write, in milliseconds; 0
+	// removes the TTL and leaving it out keeps the one the key has
+	TTL *int64 `json:"ttl"`
+}
+
+// serverStateWriteResult is the key after the write; on a conflict, it is
+// the key as it is, which the write was not applied to.
+type serverStateWriteResult struct {
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"`
+	UpdateCount int64       `json:"update_count"`
+	Conflict    bool        `json:"conflict,omitempty"`
+}
+
+// HandleServerStateSetMutation replaces the value of a key.
+func HandleServerStateSetMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	return handleServerStateWrite(ctx, trpcContext, input, serverStateWriteOpSet)
+}
+
+// HandleServerStateMergeMutation deep merges an object into the value of a
+// key.
+func HandleServerStateMergeMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	return handleServerStateWrite(ctx, trpcContext, input, serverStateWriteOpMerge)
+}
+
+// HandleServerStateAtomicMutation applies atomic operations to the value of a
+// key.
+func HandleServerStateAtomicMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	return handleServerStateWrite(ctx, trpcContext, input, serverStateWriteOpAtomic)
+}
+
+// handleServerStateWrite runs a client write through the same scripts as the
+// admin API and publishes it the same way, once the token's write rules allow
+// the op on the key at the size of its payload.
+func handleServerStateWrite(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage, op string) (json.RawMessage, *trpc2.TRPCError) {
+	if trpcContext.Services == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput serverStateWriteInput
+
+	if len(input) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	appID := strings.TrimSpace(parsedInput.AppID)
+	if appID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "appId is required",
+		}
+	}
+
+	if !trpcContext.Identity.AllowsApp(appID) {
+		return nil, &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token is not valid for this app",
+		}
+	}
+
+	key := parsedInput.Key
+	if key == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "key is required",
+		}
+	}
+
+	payload := parsedInput.Value
+	if op == serverStateWriteOpAtomic {
+		payload = parsedInput.Ops
+	}
+
+	if len(payload) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: fmt.Sprintf("%s needs a value or ops", op),
+		}
+	}
+
+	allowed, maxValueSize := trpcContext.Identity.ServerStateWriteLimit(key, op)
+	if !allowed {
+		return nil, &trpc2.TRPCError{
+			Code:    403,
+			Message: fmt.Sprintf("the token does not have the permission to %s key %s", op, key),
+		}
+	}
+
+	if serverMax := viper.GetInt("serverState.maxClientValueSize"); serverMax > 0 && (maxValueSize == 0 || maxValueSize > serverMax) {
+		maxValueSize = serverMax
+	}
+
+	if maxValueSize > 0 && len(payload) > maxValueSize {
+		return nil, &trpc2.TRPCError{
+			Code:    413,
+			Message: fmt.Sprintf("the %s is %d bytes, the limit for key %s is %d", op, len(payload), key, maxValueSize),
+		}
+	}
+
+	kvClient := trpcContext.Services.GetKVClient()
+	if kvClient == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "kv client not available",
+		}
+	}
+
+	var expectedUpdateCount string
+	if parsedInput.ExpectedUpdateCount != nil {
+		if *parsedInput.ExpectedUpdateCount < 0 {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: "expectedUpdateCount must not be negative",
+			}
+		}
+
+		expectedUpdateCount = strconv.FormatInt(*parsedInput.ExpectedUpdateCount, 10)
+	}
+
+	if parsedInput.TTL != nil && *parsedInput.TTL < 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "ttl must not be negative",
+		}
+	}
+
+	ttl := kv_scripts.TTLArg(parsedInput.TTL)
+	history := kv_scripts.HistoryArg()
+
+	scriptMgr := kv_scripts.GetScriptManager(kvClient)
+
+	fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
+	keys := trpcContext.Services.GetExpiry().ScriptKeys(ctx, appID, fullKey, fullKey+":update-count")
+
+	var result *goRedis.Cmd
+
+	switch op {
+	case serverStateWriteOpSet:
+		var value interface{}
+		if err := sonic.Unmarshal(payload, &value); err != nil {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: "invalid value",
+			}
+		}
+
+		valueStr, err := kv_scripts.EncodeReplaceValue(value)
+		if err != nil {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: "failed to serialize value",
+			}
+		}
+
+		result = scriptMgr.Execute(ctx, scriptMgr.GetReplace(), keys, expectedUpdateCount, valueStr, ttl, history)
+	case serverStateWriteOpMerge:
+		if trimmed := bytes.TrimSpace(payload); len(trimmed) == 0 || trimmed[0] != '{' {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: "merge needs an object value",
+			}
+		}
+
+		result = scriptMgr.Execute(ctx, scriptMgr.GetDeepMerge(), keys, expectedUpdateCount, string(payload), ttl, history)
+	case serverStateWriteOpAtomic:
+		var ops kv_scripts.AtomicOps
+		if err := json.Unmarshal(payload, &ops); err != nil || ops.IsEmpty() {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: "ops needs at least one valid operation",
+			}
+		}
+
+		opsJSON, err := json.Marshal(&ops)
+		if err != nil {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: "failed to serialize operations",
+			}
+		}
+
+		result = scriptMgr.Execute(ctx, scriptMgr.GetAtomicOps(), keys, expectedUpdateCount, string(opsJSON), ttl, history)
+	}
+
+	if result.Err() != nil {
+		log.Error().Err(result.Err()).Str("op", op).Str("key", key).Msg("failed to execute server-state write script")
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: fmt.Sprintf("failed to %s key %s", op, key),
+		}
+	}
+
+	writeResult := serverStateWriteResult{Key: key}
+
+	if conflict, ok := kv_scripts.ParseConflict(result.Val()); ok {
+		writeResult.Conflict = true
+		writeResult.UpdateCount = conflict.UpdateCount
+
+		if conflict.Value != nil {
+			writeResult.Value = kv_scripts.DecodeStoredValue(*conflict.Value)
+		}
+
+		return marshalServerStateWriteResult(&writeResult)
+	}
+
+	var previous interface{}
+
+	switch op {
+	case serverStateWriteOpSet, serverStateWriteOpMerge:
+		// replace returns [count, previous], deep_merge [count, value, previous]
+		values, err := result.Slice()
+		if err != nil || (op == serverStateWriteOpSet && len(values) != 2) || (op == serverStateWriteOpMerge && len(values) != 3) {
+			log.Error().Err(err).Str("op", op).Msg("failed to parse server-state write script result")
+			return nil, &trpc2.TRPCError{
+				Code:    500,
+				Message: "failed to parse script result",
+			}
+		}
+
+		writeResult.UpdateCount, _ = values[0].(int64)
+
+		if op == serverStateWriteOpSet {
+			previous = values[1]
+			sonic.Unmarshal(payload, &writeResult.Value)
+		} else {
+			previous = values[2]
+
+			merged, _ := values[1].(string)
+			writeResult.Value = kv_scripts.DecodeStoredValue(merged)
+		}
+	case serverStateWriteOpAtomic:
+		raw, err := result.Text()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to parse atomic_ops script result")
+			return nil, &trpc2.TRPCError{
+				Code:    500,
+				Message: "failed to parse script result",
+			}
+		}
+
+		var opsResult kv_scripts.AtomicOpsResult
+		if err := json.Unmarshal([]byte(raw), &opsResult); err != nil {
+			log.Error().Err(err).Msg("failed to parse atomic_ops script result")
+			return nil, &trpc2.TRPCError{
+				Code:    500,
+				Message: "failed to parse script result",
+			}
+		}
+
+		if !opsResult.Success {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: opsResult.Error,
+			}
+		}
+
+		writeResult.UpdateCount = opsResult.UpdateCount
+
+		// operations that changed nothing are not published
+		if opsResult.Value == nil {
+			return marshalServerStateWriteResult(&writeResult)
+		}
+
+		writeResult.Value = opsResult.Value
+
+		if opsResult.Previous != nil {
+			previous = *opsResult.Previous
+		}
+	}
+
+	hub.Publish(trpcContext.Services.GetPubSub(), appID, key, hub.DiffFromStored(previous, writeResult.Value), writeResult.Value, writeResult.UpdateCount, hub.Origin{
+		Op:    op,
+		Actor: trpcContext.Identity.Actor(),
+	})
+
+	return marshalServerStateWriteResult(&writeResult)
+}
+
+func marshalServerStateWriteResult(result *serverStateWriteResult) (json.RawMessage, *trpc2.TRPCError) {
+	output, err := sonic.Marshal(result)
+	if err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to marshal write result",
+		}
+	}
+
+	return output, nil
+}
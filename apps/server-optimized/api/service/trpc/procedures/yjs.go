@@ -0,0 +1,142 @@
+package procedures
+
+import (
+	"context"
+	"fmt"
+	"server-optimized/lib/kv_scripts"
+	"server-optimized/lib/yjs"
+	"server-optimized/services/kv"
+	natsService "server-optimized/services/nats"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/nats-io/nats.go"
+	goRedis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultYjsAppID = "_default"
+
+func yjsSubject(appID string, hashedDocumentID string) string {
+	return fmt.Sprintf("yjs.%s_%s", appID, hashedDocumentID)
+}
+
+func yjsSnapshotKey(appID string, hashedDocumentID string) string {
+	return fmt.Sprintf("%s:yjs:%s:snapshot", appID, hashedDocumentID)
+}
+
+func yjsUpdatesKey(appID string, hashedDocumentID string) string {
+	return fmt.Sprintf("%s:yjs:%s:updates", appID, hashedDocumentID)
+}
+
+func yjsCompactionLockKey(appID string, hashedDocumentID string) string {
+	return fmt.Sprintf("%s:yjs:%s:compaction-lock", appID, hashedDocumentID)
+}
+
+// readYjsLog reads the snapshot and the pending update log in one
+// transaction, so a concurrent compaction cannot be observed half-way.
+func readYjsLog(ctx context.Context, kvClient kv.Store, appID string, hashedDocumentID string) ([]byte, [][]byte, error) {
+	pipe := kvClient.TxPipeline()
+	snapshotCmd := pipe.Get(ctx, yjsSnapshotKey(appID, hashedDocumentID))
+	updatesCmd := pipe.LRange(ctx, yjsUpdatesKey(appID, hashedDocumentID), 0, -1)
+
+	if _, err := pipe.Exec(ctx); err != nil && err != goRedis.Nil {
+		return nil, nil, err
+	}
+
+	snapshot, err := snapshotCmd.Bytes()
+	if err != nil && err != goRedis.Nil {
+		return nil, nil, err
+	}
+
+	updates := make([][]byte, 0, len(updatesCmd.Val()))
+	for _, update := range updatesCmd.Val() {
+		updates = append(updates, []byte(update))
+	}
+
+	return snapshot, updates, nil
+}
+
+func readYjsDocument(ctx context.Context, kvClient kv.Store, appID string, hashedDocumentID string) ([]byte, error) {
+	snapshot, updates, err := readYjsLog(ctx, kvClient, appID, hashedDocumentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot != nil {
+		updates = append([][]byte{snapshot}, updates...)
+	}
+
+	return yjs.MergeUpdates(updates)
+}
+
+func appendYjsUpdates(ctx context.Context, kvClient kv.Store, appID string, hashedDocumentID string, updates [][]byte) (int64, error) {
+	values := make([]interface{}, len(updates))
+	for i, update := range updates {
+		values[i] = update
+	}
+
+	return kvClient.RPush(ctx, yjsUpdatesKey(appID, hashedDocumentID), values...).Result()
+}
+
+// compactYjsDocument folds the update log into the snapshot. Only the entries
+// that were merged are trimmed, so updates appended meanwhile are kept.
+func compactYjsDocument(ctx context.Context, kvClient kv.Store, appID string, hashedDocumentID string) error {
+	lockKey := yjsCompactionLockKey(appID, hashedDocumentID)
+
+	// the lock runs out after a minute; the token keeps a compaction that
+	// took longer from releasing the lock of the next one
+	token, err := gonanoid.New()
+	if err != nil {
+		return err
+	}
+
+	acquired, err := kvClient.SetNX(ctx, lockKey, token, time.Minute).Result()
+	if err != nil || !acquired {
+		return err
+	}
+
+	defer func() {
+		scriptMgr := kv_scripts.GetScriptManager(kvClient)
+
+		if err := scriptMgr.Execute(context.Background(), scriptMgr.GetUnlock(), []string{lockKey}, token).Err(); err != nil {
+			log.Error().Err(err).Str("key", lockKey).Msg("failed to release the yjs compaction lock")
+		}
+	}()
+
+	snapshot, updates, err := readYjsLog(ctx, kvClient, appID, hashedDocumentID)
+	if err != nil || len(updates) == 0 {
+		return err
+	}
+
+	mergedCount := int64(len(updates))
+
+	if snapshot != nil {
+		updates = append([][]byte{snapshot}, updates...)
+	}
+
+	snapshot, err = yjs.MergeUpdates(updates)
+	if err != nil {
+		return err
+	}
+
+	pipe := kvClient.TxPipeline()
+	pipe.Set(ctx, yjsSnapshotKey(appID, hashedDocumentID), snapshot, 0)
+	pipe.LTrim(ctx, yjsUpdatesKey(appID, hashedDocumentID), mergedCount, -1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	log.Debug().Str("app_id", appID).Str("document", hashedDocumentID).Int64("merged", mergedCount).Msg("compacted yjs update log")
+
+	return nil
+}
+
+func publishYjsUpdate(pubSub natsService.PubSub, appID string, hashedDocumentID string, sessionID string, update []byte) error {
+	msg := nats.NewMsg(yjsSubject(appID, hashedDocumentID))
+	msg.Data = update
+	msg.Header.Add("session_id", sessionID)
+
+	return pubSub.PublishMsg(msg)
+}
@@ -0,0 +1,91 @@
+package procedures
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"server-optimized/api/service/trpc"
+	"server-optimized/lib/yjs"
+	trpc2 "server-optimized/trpc"
+	"strings"
+
+	"github.com/bytedance/sonic"
+)
+
+type yjsDocInitInput struct {
+	SessionID   string `json:"sessionId"`
+	StateVector string `json:"stateVector"`
+}
+
+func HandleYjsDocInitMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	if trpcContext.Services == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput yjsDocInitInput
+
+	if len(input) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	sessionID := strings.TrimSpace(parsedInput.SessionID)
+	if sessionID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "sessionId is required",
+		}
+	}
+
+	stateVector, err := base64.StdEncoding.DecodeString(parsedInput.StateVector)
+	if err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "stateVector must be base64 encoded",
+		}
+	}
+
+	if err := yjs.ValidateStateVector(stateVector); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid state vector",
+		}
+	}
+
+	session, ok := trpcContext.Services.GetLocalState().GetYjsSession(sessionID)
+	if !ok {
+		return nil, &trpc2.TRPCError{
+			Code:    404,
+			Message: "session not found",
+		}
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	select {
+	case <-session.Initialized:
+		return nil, &trpc2.TRPCError{
+			Code:    409,
+			Message: "session is already initialized",
+		}
+	default:
+	}
+
+	session.StateVector = stateVector
+	close(session.Initialized)
+
+	return json.RawMessage("null"), nil
+}
@@ -0,0 +1,137 @@
+package procedures
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"server-optimized/api/service/trpc"
+	"server-optimized/lib/yjs"
+	trpc2 "server-optimized/trpc"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+type yjsDocUpdateInput struct {
+	SessionID      string   `json:"sessionId"`
+	EncodedUpdates []string `json:"encodedUpdates"`
+}
+
+func HandleYjsDocUpdateMutation(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage) (json.RawMessage, *trpc2.TRPCError) {
+	if trpcContext.Services == nil {
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput yjsDocUpdateInput
+
+	if len(input) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	sessionID := strings.TrimSpace(parsedInput.SessionID)
+	if sessionID == "" {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "sessionId is required",
+		}
+	}
+
+	if len(parsedInput.EncodedUpdates) == 0 {
+		return nil, &trpc2.TRPCError{
+			Code:    400,
+			Message: "at least one update is required",
+		}
+	}
+
+	if !trpcContext.Identity.CanWriteYjs() {
+		return nil, &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token does not have the permission to write to this document",
+		}
+	}
+
+	session, ok := trpcContext.Services.GetLocalState().GetYjsSession(sessionID)
+	if !ok {
+		return nil, &trpc2.TRPCError{
+			Code:    404,
+			Message: "session not found",
+		}
+	}
+
+	select {
+	case <-session.Initialized:
+	default:
+		return nil, &trpc2.TRPCError{
+			Code:    412,
+			Message: "the session has not been initialized yet",
+		}
+	}
+
+	updates := make([][]byte, 0, len(parsedInput.EncodedUpdates))
+
+	for _, encodedUpdate := range parsedInput.EncodedUpdates {
+		update, err := base64.StdEncoding.DecodeString(encodedUpdate)
+		if err != nil {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: "updates must be base64 encoded",
+			}
+		}
+
+		if err := yjs.ValidateUpdate(update); err != nil {
+			return nil, &trpc2.TRPCError{
+				Code:    400,
+				Message: "invalid yjs update",
+			}
+		}
+
+		updates = append(updates, update)
+	}
+
+	kvClient := trpcContext.Services.GetKVClient()
+	pubSub := trpcContext.Services.GetPubSub()
+
+	logLength, err := appendYjsUpdates(ctx, kvClient, session.AppID, session.HashedDocumentID, updates)
+	if err != nil {
+		log.Error().Err(err).Str("document_id", session.DocumentID).Msg("failed to store yjs updates in kv")
+		return nil, &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to store updates",
+		}
+	}
+
+	for _, update := range updates {
+		if err := publishYjsUpdate(pubSub, session.AppID, session.HashedDocumentID, sessionID, update); err != nil {
+			log.Error().Err(err).Str("document_id", session.DocumentID).Msg("failed to publish yjs update")
+			return nil, &trpc2.TRPCError{
+				Code:    500,
+				Message: "failed to publish update",
+			}
+		}
+	}
+
+	if logLength >= viper.GetInt64("yjs.compactionThreshold") {
+		go func(appID string, hashedDocumentID string) {
+			if err := compactYjsDocument(context.Background(), kvClient, appID, hashedDocumentID); err != nil {
+				log.Error().Err(err).Str("document", hashedDocumentID).Msg("failed to compact yjs document")
+			}
+		}(session.AppID, session.HashedDocumentID)
+	}
+
+	return json.RawMessage("null"), nil
+}
@@ -0,0 +1,242 @@
+package procedures
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"server-optimized/api/service/trpc"
+	"server-optimized/lib/yjs"
+	"server-optimized/services/localstate"
+	trpc2 "server-optimized/trpc"
+	"server-optimized/utils"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+type yjsDocUpdatesInput struct {
+	AppID      string `json:"appId"`
+	DocumentID string `json:"documentId"`
+}
+
+type YjsSessionInfoMessage struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id"`
+}
+
+// YjsSyncMessage is y-protocols' sync step 2 (what the client is missing)
+// together with the server's state vector, so the client can answer with its
+// own step 2 through `yjs.docUpdate`.
+type YjsSyncMessage struct {
+	Type        string `json:"type"`
+	Update      string `json:"update"`
+	StateVector string `json:"stateVector"`
+}
+
+type YjsUpdateMessage struct {
+	Type    string   `json:"type"`
+	Updates []string `json:"updates"`
+}
+
+func HandleYjsDocUpdatesSubscription(ctx context.Context, trpcContext *trpc.TRPCContext, input json.RawMessage, emit func(message json.RawMessage)) *trpc2.TRPCError {
+	if trpcContext.Services == nil {
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "services not available",
+		}
+	}
+
+	var parsedInput yjsDocUpdatesInput
+
+	if len(input) == 0 {
+		return &trpc2.TRPCError{
+			Code:    400,
+			Message: "input is required",
+		}
+	}
+
+	if err := sonic.Unmarshal(input, &parsedInput); err != nil {
+		return &trpc2.TRPCError{
+			Code:    400,
+			Message: "invalid input",
+		}
+	}
+
+	documentID := strings.TrimSpace(parsedInput.DocumentID)
+	if documentID == "" {
+		return &trpc2.TRPCError{
+			Code:    400,
+			Message: "documentId is required",
+		}
+	}
+
+	appID := strings.TrimSpace(parsedInput.AppID)
+	if appID == "" {
+		appID = defaultYjsAppID
+	}
+
+	if !trpcContext.Identity.AllowsApp(appID) {
+		return &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token is not valid for this app",
+		}
+	}
+
+	if !trpcContext.Identity.CanReadYjs() {
+		return &trpc2.TRPCError{
+			Code:    403,
+			Message: "the token does not have the permission to read this document",
+		}
+	}
+
+	hashedDocumentID, err := utils.GenerateHash(documentID)
+	if err != nil {
+		log.Error().Err(err).Str("document_id", documentID).Msg("failed to generate hash for yjs document")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to prepare document subscription",
+		}
+	}
+
+	localStateService := trpcContext.Services.GetLocalState()
+	pubSub := trpcContext.Services.GetPubSub()
+	kvClient := trpcContext.Services.GetKVClient()
+
+	sessionID, err := gonanoid.New()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to generate session id")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to generate session id",
+		}
+	}
+
+	session := &localstate.YjsSession{
+		AppID:            appID,
+		DocumentID:       documentID,
+		HashedDocumentID: hashedDocumentID,
+		Initialized:      make(chan struct{}),
+	}
+
+	messagesChan := make(chan *nats.Msg, 256)
+
+	// subscribe before reading the document so no update falls in between;
+	// anything already contained in the snapshot is a no-op for the client
+	subscription, err := pubSub.ChanSubscribe(yjsSubject(appID, hashedDocumentID), messagesChan)
+	if err != nil {
+		log.Error().Err(err).Str("document_id", documentID).Msg("failed to subscribe to yjs document")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to subscribe to document",
+		}
+	}
+
+	localStateService.SetYjsSession(sessionID, session)
+
+	defer func() {
+		_ = subscription.Unsubscribe()
+		localStateService.DeleteYjsSession(sessionID)
+	}()
+
+	sessionInfoJSON, err := sonic.Marshal(&YjsSessionInfoMessage{
+		Type:      "session-info",
+		SessionID: sessionID,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshal yjs session-info message")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to prepare session info",
+		}
+	}
+
+	emit(sessionInfoJSON)
+
+	// wait for sync step 1 (the client's state vector) through `yjs.docInit`
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-session.Initialized:
+	}
+
+	session.Lock()
+	clientStateVector := session.StateVector
+	session.Unlock()
+
+	document, err := readYjsDocument(ctx, kvClient, appID, hashedDocumentID)
+	if err != nil {
+		log.Error().Err(err).Str("document_id", documentID).Msg("failed to read yjs document from kv")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to read document",
+		}
+	}
+
+	diff, err := yjs.DiffUpdate(document, clientStateVector)
+	if err != nil {
+		log.Error().Err(err).Str("document_id", documentID).Msg("failed to diff yjs document")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to compute document diff",
+		}
+	}
+
+	serverStateVector, err := yjs.EncodeStateVectorFromUpdate(document)
+	if err != nil {
+		log.Error().Err(err).Str("document_id", documentID).Msg("failed to encode yjs state vector")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to compute state vector",
+		}
+	}
+
+	syncJSON, err := sonic.Marshal(&YjsSyncMessage{
+		Type:        "sync",
+		Update:      base64.StdEncoding.EncodeToString(diff),
+		StateVector: base64.StdEncoding.EncodeToString(serverStateVector),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshal yjs sync message")
+		return &trpc2.TRPCError{
+			Code:    500,
+			Message: "failed to prepare sync message",
+		}
+	}
+
+	emit(syncJSON)
+
+	compactionTicker := time.NewTicker(viper.GetDuration("yjs.compactionInterval"))
+	defer compactionTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-compactionTicker.C:
+			if err := compactYjsDocument(ctx, kvClient, appID, hashedDocumentID); err != nil {
+				log.Error().Err(err).Str("document_id", documentID).Msg("failed to compact yjs document")
+			}
+		case msg := <-messagesChan:
+			// the originating client already has its own update
+			if msg.Header.Get("session_id") == sessionID {
+				continue
+			}
+
+			marshaled, err := sonic.Marshal(&YjsUpdateMessage{
+				Type:    "update",
+				Updates: []string{base64.StdEncoding.EncodeToString(msg.Data)},
+			})
+			if err != nil {
+				log.Error().Err(err).Msg("failed to marshal yjs update message")
+				continue
+			}
+
+			emit(marshaled)
+		}
+	}
+}
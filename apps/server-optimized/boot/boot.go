@@ -3,6 +3,7 @@ package boot
 import (
 	"context"
 	services2 "server-optimized/services"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -21,12 +22,140 @@ func SetupGlobals() {
 	viper.BindEnv("maxTransactionalRoutines", "AIRSTATE_MAX_TRANSACTIONAL_ROUTINES")
 	viper.BindEnv("adminPort", "AIRSTATE_ADMIN_PORT")
 	viper.BindEnv("port", "AIRSTATE_PORT")
+	viper.BindEnv("presence.heartbeatInterval", "AIRSTATE_PRESENCE_HEARTBEAT_INTERVAL")
+	viper.BindEnv("presence.peerTimeout", "AIRSTATE_PRESENCE_PEER_TIMEOUT")
+	viper.BindEnv("yjs.compactionInterval", "AIRSTATE_YJS_COMPACTION_INTERVAL")
+	viper.BindEnv("yjs.compactionThreshold", "AIRSTATE_YJS_COMPACTION_THRESHOLD")
+	viper.BindEnv("serverState.resumeGracePeriod", "AIRSTATE_SERVER_STATE_RESUME_GRACE_PERIOD")
+	viper.BindEnv("serverState.sessionRoutingTimeout", "AIRSTATE_SERVER_STATE_SESSION_ROUTING_TIMEOUT")
+	viper.BindEnv("serverState.maxClientValueSize", "AIRSTATE_SERVER_STATE_MAX_CLIENT_VALUE_SIZE")
+	viper.BindEnv("serverState.expirySweepInterval", "AIRSTATE_SERVER_STATE_EXPIRY_SWEEP_INTERVAL")
+	viper.BindEnv("serverState.history.maxVersions", "AIRSTATE_SERVER_STATE_HISTORY_MAX_VERSIONS")
+	viper.BindEnv("serverState.history.maxAge", "AIRSTATE_SERVER_STATE_HISTORY_MAX_AGE")
+	viper.BindEnv("changeFeed.durable", "AIRSTATE_CHANGE_FEED_DURABLE")
+	viper.BindEnv("changeFeed.maxAge", "AIRSTATE_CHANGE_FEED_MAX_AGE")
+	viper.BindEnv("changeFeed.replicas", "AIRSTATE_CHANGE_FEED_REPLICAS")
+	viper.BindEnv("webhooks.url", "AIRSTATE_WEBHOOKS_URL")
+	viper.BindEnv("webhooks.secret", "AIRSTATE_WEBHOOKS_SECRET")
+	viper.BindEnv("webhooks.timeout", "AIRSTATE_WEBHOOKS_TIMEOUT")
+	viper.BindEnv("webhooks.authorizeTimeout", "AIRSTATE_WEBHOOKS_AUTHORIZE_TIMEOUT")
+	viper.BindEnv("webhooks.maxAttempts", "AIRSTATE_WEBHOOKS_MAX_ATTEMPTS")
+	viper.BindEnv("webhooks.initialBackoff", "AIRSTATE_WEBHOOKS_INITIAL_BACKOFF")
+	viper.BindEnv("webhooks.maxBackoff", "AIRSTATE_WEBHOOKS_MAX_BACKOFF")
+	viper.BindEnv("webhooks.workers", "AIRSTATE_WEBHOOKS_WORKERS")
+	viper.BindEnv("webhooks.queueSize", "AIRSTATE_WEBHOOKS_QUEUE_SIZE")
+	viper.BindEnv("webhooks.maxDeadLetters", "AIRSTATE_WEBHOOKS_MAX_DEAD_LETTERS")
+	viper.BindEnv("auth.required", "AIRSTATE_AUTH_REQUIRED")
+	viper.BindEnv("auth.jwksFile", "AIRSTATE_AUTH_JWKS_FILE")
+	viper.BindEnv("admin.rootKey", "AIRSTATE_ADMIN_ROOT_KEY")
+	viper.BindEnv("admin.signatureTolerance", "AIRSTATE_ADMIN_SIGNATURE_TOLERANCE")
+	viper.BindEnv("nats.url", "AIRSTATE_NATS_URL")
+	viper.BindEnv("nats.servers", "AIRSTATE_NATS_SERVERS")
+	viper.BindEnv("nats.name", "AIRSTATE_NATS_NAME")
+	viper.BindEnv("nats.user", "AIRSTATE_NATS_USER")
+	viper.BindEnv("nats.password", "AIRSTATE_NATS_PASSWORD")
+	viper.BindEnv("nats.token", "AIRSTATE_NATS_TOKEN")
+	viper.BindEnv("nats.credentialsFile", "AIRSTATE_NATS_CREDENTIALS_FILE")
+	viper.BindEnv("nats.nkeyFile", "AIRSTATE_NATS_NKEY_FILE")
+	viper.BindEnv("nats.tls.enabled", "AIRSTATE_NATS_TLS")
+	viper.BindEnv("nats.tls.caFile", "AIRSTATE_NATS_TLS_CA_FILE")
+	viper.BindEnv("nats.tls.certFile", "AIRSTATE_NATS_TLS_CERT_FILE")
+	viper.BindEnv("nats.tls.keyFile", "AIRSTATE_NATS_TLS_KEY_FILE")
+	viper.BindEnv("nats.tls.insecureSkipVerify", "AIRSTATE_NATS_TLS_INSECURE_SKIP_VERIFY")
+	viper.BindEnv("nats.maxReconnects", "AIRSTATE_NATS_MAX_RECONNECTS")
+	viper.BindEnv("nats.reconnectWait", "AIRSTATE_NATS_RECONNECT_WAIT")
+	viper.BindEnv("nats.reconnectBufferSize", "AIRSTATE_NATS_RECONNECT_BUFFER_SIZE")
+	viper.BindEnv("nats.connectTimeout", "AIRSTATE_NATS_CONNECT_TIMEOUT")
+	viper.BindEnv("kv.backend", "AIRSTATE_KV_BACKEND")
+	viper.BindEnv("kv.url", "AIRSTATE_KV_URL")
+	viper.BindEnv("kv.mode", "AIRSTATE_KV_MODE")
+	viper.BindEnv("kv.username", "AIRSTATE_KV_USERNAME")
+	viper.BindEnv("kv.password", "AIRSTATE_KV_PASSWORD")
+	viper.BindEnv("kv.db", "AIRSTATE_KV_DB")
+	viper.BindEnv("kv.tls.enabled", "AIRSTATE_KV_TLS")
+	viper.BindEnv("kv.tls.caFile", "AIRSTATE_KV_TLS_CA_FILE")
+	viper.BindEnv("kv.tls.certFile", "AIRSTATE_KV_TLS_CERT_FILE")
+	viper.BindEnv("kv.tls.keyFile", "AIRSTATE_KV_TLS_KEY_FILE")
+	viper.BindEnv("kv.tls.serverName", "AIRSTATE_KV_TLS_SERVER_NAME")
+	viper.BindEnv("kv.tls.insecureSkipVerify", "AIRSTATE_KV_TLS_INSECURE_SKIP_VERIFY")
+	viper.BindEnv("kv.sentinel.masterName", "AIRSTATE_KV_SENTINEL_MASTER_NAME")
+	viper.BindEnv("kv.sentinel.addresses", "AIRSTATE_KV_SENTINEL_ADDRESSES")
+	viper.BindEnv("kv.sentinel.username", "AIRSTATE_KV_SENTINEL_USERNAME")
+	viper.BindEnv("kv.sentinel.password", "AIRSTATE_KV_SENTINEL_PASSWORD")
+	viper.BindEnv("kv.cluster.addresses", "AIRSTATE_KV_CLUSTER_ADDRESSES")
+	viper.BindEnv("kv.cluster.hashTag", "AIRSTATE_KV_CLUSTER_HASH_TAG")
+	viper.BindEnv("kv.pool.size", "AIRSTATE_KV_POOL_SIZE")
+	viper.BindEnv("kv.pool.minIdle", "AIRSTATE_KV_POOL_MIN_IDLE")
+	viper.BindEnv("kv.pool.timeout", "AIRSTATE_KV_POOL_TIMEOUT")
+	viper.BindEnv("kv.timeouts.dial", "AIRSTATE_KV_DIAL_TIMEOUT")
+	viper.BindEnv("kv.timeouts.read", "AIRSTATE_KV_READ_TIMEOUT")
+	viper.BindEnv("kv.timeouts.write", "AIRSTATE_KV_WRITE_TIMEOUT")
+	viper.BindEnv("kv.maxRetries", "AIRSTATE_KV_MAX_RETRIES")
+	viper.BindEnv("kv.jetstream.bucketPrefix", "AIRSTATE_KV_JETSTREAM_BUCKET_PREFIX")
+	viper.BindEnv("kv.jetstream.replicas", "AIRSTATE_KV_JETSTREAM_REPLICAS")
+	viper.BindEnv("kv.jetstream.history", "AIRSTATE_KV_JETSTREAM_HISTORY")
+	viper.BindEnv("standalone.enabled", "AIRSTATE_STANDALONE")
+	viper.BindEnv("standalone.dataFile", "AIRSTATE_STANDALONE_DATA_FILE")
+	viper.BindEnv("standalone.persistInterval", "AIRSTATE_STANDALONE_PERSIST_INTERVAL")
 
 	viper.SetDefault("maxTransactionalRoutines", 4)
 	viper.SetDefault("port", 11001)
 	viper.SetDefault("adminPort", 11002)
+	viper.SetDefault("presence.heartbeatInterval", 5*time.Second)
+	viper.SetDefault("presence.peerTimeout", 15*time.Second)
+	viper.SetDefault("yjs.compactionInterval", 30*time.Second)
+	viper.SetDefault("yjs.compactionThreshold", 100)
+	viper.SetDefault("serverState.resumeGracePeriod", 2*time.Minute)
+	viper.SetDefault("serverState.sessionRoutingTimeout", 5*time.Second)
+	viper.SetDefault("serverState.maxClientValueSize", 256*1024)
+	viper.SetDefault("serverState.expirySweepInterval", time.Second)
+	// no history unless one of the bounds is set
+	viper.SetDefault("serverState.history.maxVersions", 0)
+	viper.SetDefault("serverState.history.maxAge", time.Duration(0))
+	// live only unless a JetStream stream keeps the changes to resume from
+	viper.SetDefault("changeFeed.durable", false)
+	viper.SetDefault("changeFeed.maxAge", 24*time.Hour)
+	viper.SetDefault("changeFeed.replicas", 1)
+	// webhooks.url is an endpoint for every event of every app; the config
+	// file can list more in webhooks.endpoints, and per app in webhooks.apps
+	viper.SetDefault("webhooks.url", "")
+	viper.SetDefault("webhooks.secret", "")
+	viper.SetDefault("webhooks.timeout", 5*time.Second)
+	viper.SetDefault("webhooks.authorizeTimeout", 2*time.Second)
+	viper.SetDefault("webhooks.maxAttempts", 6)
+	viper.SetDefault("webhooks.initialBackoff", time.Second)
+	viper.SetDefault("webhooks.maxBackoff", time.Minute)
+	viper.SetDefault("webhooks.workers", 4)
+	viper.SetDefault("webhooks.queueSize", 4096)
+	viper.SetDefault("webhooks.maxDeadLetters", 1000)
+	viper.SetDefault("auth.required", false)
+	viper.SetDefault("auth.appSecrets", map[string]string{})
+	viper.SetDefault("auth.jwksFile", "")
+	viper.SetDefault("admin.rootKey", "")
+	viper.SetDefault("admin.appKeys", map[string]string{})
+	viper.SetDefault("admin.signatureTolerance", 5*time.Minute)
+	viper.SetDefault("nats.url", "")
+	viper.SetDefault("nats.name", "airstate")
+	viper.SetDefault("nats.maxReconnects", -1)
+	viper.SetDefault("nats.reconnectWait", 2*time.Second)
+	viper.SetDefault("nats.reconnectBufferSize", 8*1024*1024)
+	viper.SetDefault("nats.connectTimeout", 2*time.Second)
+	viper.SetDefault("kv.backend", "kvrocks")
+	viper.SetDefault("kv.url", "")
+	viper.SetDefault("kv.mode", "single")
+	viper.SetDefault("kv.tls.enabled", false)
+	viper.SetDefault("kv.cluster.hashTag", "app")
+	viper.SetDefault("kv.jetstream.bucketPrefix", "airstate")
+	viper.SetDefault("kv.jetstream.replicas", 1)
+	viper.SetDefault("kv.jetstream.history", 1)
+	viper.SetDefault("standalone.enabled", false)
+	viper.SetDefault("standalone.dataFile", "")
+	viper.SetDefault("standalone.persistInterval", time.Second)
 }
 
+// shutdown tracks the services of every Boot until they are closed
+var shutdown sync.WaitGroup
+
 func Boot(ctx context.Context) error {
 	log.Debug().Msg("creating services")
 	services, servicesError := services2.CreateServices()
@@ -35,6 +164,18 @@ func Boot(ctx context.Context) error {
 		return servicesError
 	}
 
+	shutdown.Add(1)
+
+	go func() {
+		defer shutdown.Done()
+
+		<-ctx.Done()
+
+		if err := services.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close services")
+		}
+	}()
+
 	servicePlaneInitError := ServicePlane(ctx, services)
 
 	if servicePlaneInitError != nil {
@@ -50,3 +191,9 @@ func Boot(ctx context.Context) error {
 
 	return nil
 }
+
+// Wait blocks until the services of every Boot whose context is done are
+// closed, so the standalone store gets its final save.
+func Wait() {
+	shutdown.Wait()
+}
@@ -38,7 +38,10 @@ func startServicePlaneHTTPServer(ctx context.Context, services services.Services
 		})
 	})
 
-	http.RegisterServicePlaneAPIRoutes(app, services)
+	if err := http.RegisterServicePlaneAPIRoutes(app, services); err != nil {
+		log.Error().Err(err).Msg("failed to register service-plane routes")
+		return err
+	}
 
 	go func() {
 		if err := app.Listen(":" + strconv.Itoa(int(getServicePort()))); err != nil {
@@ -4,6 +4,8 @@ export type TServerStateMessage =
     | {
           type: 'session-info';
           session_id: string;
+          resume_token?: string;
+          resumed: boolean;
       }
     | {
           type: 'init';
@@ -11,9 +13,73 @@ export type TServerStateMessage =
     | {
           type: 'updates';
           updates: Array<{
+              app_id: string;
               key: string;
               value: any;
+              update_count?: number;
           }>;
+      }
+    | {
+          type: 'deltas';
+          deltas: Array<{
+              app_id: string;
+              key: string;
+              delta: Array<{ op: 'add' | 'remove' | 'replace'; path: string; value?: any }>;
+              base_update_count: number;
+              update_count: number;
+          }>;
+      };
+
+export type TServerStateWriteResult = {
+    key: string;
+    value: any;
+    update_count: number;
+    conflict?: boolean;
+};
+
+export type TPresenceMessage =
+    | {
+          type: 'session-info';
+          session_id: string;
+      }
+    | {
+          type: 'init';
+          state: {
+              peers: Record<string, { peer: string; meta?: any; state?: any; connected: boolean }>;
+              stats: { totalPeers: number };
+          };
+      }
+    | {
+          type: 'meta';
+          peer_id: string;
+          timestamp: number;
+          meta: any;
+      }
+    | {
+          type: 'state';
+          peer_id: string;
+          timestamp: number;
+          state: any;
+      }
+    | {
+          type: 'connected' | 'disconnected';
+          peer_id: string;
+          timestamp: number;
+      };
+
+export type TYjsMessage =
+    | {
+          type: 'session-info';
+          session_id: string;
+      }
+    | {
+          type: 'sync';
+          update: string;
+          stateVector: string;
+      }
+    | {
+          type: 'update';
+          updates: string[];
       };
 
 export type TRouter = TRPCBuiltRouter<
@@ -37,7 +103,12 @@ export type TRouter = TRPCBuiltRouter<
         serverState: {
             serverState: TRPCSubscriptionProcedure<{
                 meta: unknown;
-                input: {};
+                input: {
+                    deltas?: boolean;
+                    resumeToken?: string;
+                    lastUpdateCounts?: Record<string, number>;
+                    lastUpdateCountsByApp?: Record<string, Record<string, number>>;
+                };
                 output: TServerStateMessage;
             }>;
             watchKeys: TRPCMutationProcedure<{
@@ -52,9 +123,119 @@ export type TRouter = TRPCBuiltRouter<
                     {
                         key: string;
                         value: any;
+                        update_count: number;
                     }
                 >;
             }>;
+            unwatchKeys: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    appId: string;
+                    sessionId: string;
+                    keys: string[];
+                };
+                output: {
+                    unwatched: string[];
+                };
+            }>;
+            resync: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    appId: string;
+                    sessionId: string;
+                    keys: string[];
+                };
+                output: {
+                    resynced: string[];
+                };
+            }>;
+            set: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    appId: string;
+                    key: string;
+                    value: any;
+                    expectedUpdateCount?: number;
+                };
+                output: TServerStateWriteResult;
+            }>;
+            merge: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    appId: string;
+                    key: string;
+                    value: Record<string, any>;
+                    expectedUpdateCount?: number;
+                };
+                output: TServerStateWriteResult;
+            }>;
+            atomic: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    appId: string;
+                    key: string;
+                    ops: Record<string, any>;
+                    expectedUpdateCount?: number;
+                };
+                output: TServerStateWriteResult;
+            }>;
+        };
+        presence: {
+            roomUpdates: TRPCSubscriptionProcedure<{
+                meta: unknown;
+                input: {
+                    appId?: string;
+                    room: string;
+                };
+                output: TPresenceMessage;
+            }>;
+            peerInit: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    sessionId: string;
+                    peer: string;
+                    meta?: any;
+                    initialState?: any;
+                };
+                output: null;
+            }>;
+            update: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    sessionId: string;
+                    update: {
+                        type: 'state';
+                        state: any;
+                    };
+                };
+                output: null;
+            }>;
+        };
+        yjs: {
+            docUpdates: TRPCSubscriptionProcedure<{
+                meta: unknown;
+                input: {
+                    appId?: string;
+                    documentId: string;
+                };
+                output: TYjsMessage;
+            }>;
+            docInit: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    sessionId: string;
+                    stateVector: string;
+                };
+                output: null;
+            }>;
+            docUpdate: TRPCMutationProcedure<{
+                meta: unknown;
+                input: {
+                    sessionId: string;
+                    encodedUpdates: string[];
+                };
+                output: null;
+            }>;
         };
     }
 >;
@@ -0,0 +1,56 @@
+import logger from './common/logger.mjs';
+
+const URL = `http://localhost:11002/_default/server-state/e2e-admin-atomic-ops-${Date.now()}`;
+
+async function request(method: string, body: any) {
+    const response = await fetch(URL, {
+        method,
+        headers: { 'content-type': 'application/json' },
+        body: JSON.stringify(body),
+    });
+
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${URL} -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+try {
+    await request('PUT', { value: { feed: [], tags: ['a'], score: 4, players: [{ id: 1 }, { id: 2 }] } });
+
+    // a capped activity feed that keeps the 3 newest entries
+    for (const entry of ['e1', 'e2', 'e3', 'e4']) {
+        await request('POST', { $push: { feed: { $each: [entry], $slice: -3 } } });
+    }
+
+    const result = await request('POST', {
+        $addToSet: { tags: { $each: ['a', 'b'] } },
+        $pull: { players: { id: 1 } },
+        $mul: { score: 2 },
+        $max: { best: 10 },
+    });
+
+    const value = result.json.value;
+    const expected = {
+        feed: ['e2', 'e3', 'e4'],
+        tags: ['a', 'b'],
+        score: 8,
+        players: [{ id: 2 }],
+        best: 10,
+    };
+
+    for (const [field, expectedValue] of Object.entries(expected)) {
+        if (JSON.stringify(value[field]) !== JSON.stringify(expectedValue)) {
+            throw new Error(`unexpected ${field}: ${JSON.stringify(value[field])}`);
+        }
+    }
+
+    const mismatch = await request('POST', { $pop: { score: 1 } });
+    if (mismatch.status !== 400) {
+        throw new Error(`expected a type mismatch error, got ${mismatch.status}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+}
@@ -0,0 +1,48 @@
+import logger from './common/logger.mjs';
+
+const URL = `http://localhost:11002/_default/server-state/e2e-admin-atomic-paths-${Date.now()}`;
+
+async function request(method: string, body: any) {
+    const response = await fetch(URL, {
+        method,
+        headers: { 'content-type': 'application/json' },
+        body: JSON.stringify(body),
+    });
+
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${URL} -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+try {
+    await request('PUT', { value: { items: [{ qty: 1 }, { qty: 2 }], tags: [], 'a.b': 0 } });
+
+    const updated = await request('POST', {
+        $inc: { 'items.0.qty': 1, 'items[-1].qty': 10, 'a\\.b': 1 },
+        $set: { '/items/-': { qty: 3 } },
+    });
+
+    const value = updated.json.value;
+
+    if (JSON.stringify(value.items) !== JSON.stringify([{ qty: 2 }, { qty: 12 }, { qty: 3 }])) {
+        throw new Error(`unexpected items: ${JSON.stringify(value.items)}`);
+    }
+
+    if (value['a.b'] !== 1) {
+        throw new Error('escaped dot did not address the literal key');
+    }
+
+    if (!Array.isArray(value.tags) || value.tags.length !== 0) {
+        throw new Error(`empty array did not survive the round trip: ${JSON.stringify(value.tags)}`);
+    }
+
+    const outOfRange = await request('POST', { $set: { 'items[7]': { qty: 0 } } });
+    if (outOfRange.status !== 400 || !`${outOfRange.json.error}`.includes('out of range')) {
+        throw new Error(`expected an out of range error, got ${JSON.stringify(outOfRange)}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+}
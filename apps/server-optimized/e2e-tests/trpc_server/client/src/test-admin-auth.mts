@@ -0,0 +1,74 @@
+import { createHash, createHmac } from 'node:crypto';
+import logger from './common/logger.mjs';
+
+// must match the keys configured by TestTRPCServerAdminAuth
+const APP_ID = 'e2e-admin-auth-app';
+const APP_KEY = 'e2e-admin-app-key';
+const OTHER_APP_KEY = 'e2e-admin-other-app-key';
+
+const PATH = `/${APP_ID}/server-state/e2e-admin-auth-key`;
+const URL = `http://localhost:11002${PATH}`;
+
+function sign(secret: string, method: string, uri: string, timestamp: string, body: string) {
+    const bodyHash = createHash('sha256').update(body).digest('hex');
+
+    return createHmac('sha256', secret).update(`${method}\n${uri}\n${timestamp}\n${bodyHash}`).digest('hex');
+}
+
+async function put(headers: Record<string, string>, body: string) {
+    const response = await fetch(URL, {
+        method: 'PUT',
+        headers: {
+            'content-type': 'application/json',
+            ...headers,
+        },
+        body,
+    });
+
+    logger.debug(`PUT ${PATH} -> ${response.status}`, await response.text().catch(() => ''));
+
+    return response.status;
+}
+
+function expectStatus(label: string, actual: number, expected: number) {
+    if (actual !== expected) {
+        throw new Error(`${label}: expected status ${expected}, got ${actual}`);
+    }
+}
+
+try {
+    const body = JSON.stringify({ value: { marker: Date.now() } });
+
+    expectStatus('no credentials', await put({}, body), 401);
+    expectStatus('wrong key', await put({ authorization: 'Bearer not-a-key' }, body), 401);
+    expectStatus('key of another app', await put({ authorization: `Bearer ${OTHER_APP_KEY}` }, body), 403);
+    expectStatus('app key', await put({ authorization: `Bearer ${APP_KEY}` }, body), 200);
+
+    const timestamp = `${Math.floor(Date.now() / 1000)}`;
+    const signedHeaders = {
+        'x-airstate-key-id': APP_ID,
+        'x-airstate-timestamp': timestamp,
+        'x-airstate-signature': sign(APP_KEY, 'PUT', PATH, timestamp, body),
+    };
+
+    expectStatus('signed request', await put(signedHeaders, body), 200);
+    expectStatus('replayed signed request', await put(signedHeaders, body), 401);
+
+    const staleTimestamp = `${Math.floor(Date.now() / 1000) - 3600}`;
+    expectStatus(
+        'stale signed request',
+        await put(
+            {
+                'x-airstate-key-id': APP_ID,
+                'x-airstate-timestamp': staleTimestamp,
+                'x-airstate-signature': sign(APP_KEY, 'PUT', PATH, staleTimestamp, body),
+            },
+            body,
+        ),
+        401,
+    );
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+}
@@ -0,0 +1,53 @@
+import logger from './common/logger.mjs';
+
+const URL = `http://localhost:11002/_default/server-state/e2e-admin-cas-${Date.now()}`;
+
+async function request(method: string, body: any, ifMatch?: string) {
+    const headers: Record<string, string> = { 'content-type': 'application/json' };
+    if (ifMatch !== undefined) {
+        headers['if-match'] = ifMatch;
+    }
+
+    const response = await fetch(URL, { method, headers, body: JSON.stringify(body) });
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${URL} (If-Match: ${ifMatch}) -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+try {
+    // 0 means "only if the key was never written"
+    const created = await request('PUT', { value: { n: 1 } }, '0');
+    if (created.status !== 200 || created.json.update_count !== 1) {
+        throw new Error(`conditional create failed: ${JSON.stringify(created)}`);
+    }
+
+    const stale = await request('PATCH', { value: { n: 2 } }, '0');
+    if (stale.status !== 409 || stale.json.update_count !== 1 || stale.json.value.n !== 1) {
+        throw new Error(`expected a conflict carrying the current state, got ${JSON.stringify(stale)}`);
+    }
+
+    const merged = await request('PATCH', { value: { n: 2 } }, '"1"');
+    if (merged.status !== 200 || merged.json.update_count !== 2) {
+        throw new Error(`conditional merge failed: ${JSON.stringify(merged)}`);
+    }
+
+    const staleOps = await request('POST', { $inc: { n: 1 } }, '1');
+    if (staleOps.status !== 409) {
+        throw new Error(`expected a conflict for atomic ops, got ${staleOps.status}`);
+    }
+
+    const staleDelete = await request('DELETE', {}, '1');
+    if (staleDelete.status !== 409) {
+        throw new Error(`expected a conflict for delete, got ${staleDelete.status}`);
+    }
+
+    const deleted = await request('DELETE', {}, '2');
+    if (deleted.status !== 200) {
+        throw new Error(`conditional delete failed with ${deleted.status}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+}
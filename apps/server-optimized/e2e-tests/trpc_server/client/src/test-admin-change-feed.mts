@@ -0,0 +1,91 @@
+import { closeClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+
+const APP_ID = '_default';
+const PREFIX = `e2e-change-feed-${Date.now()}`;
+const ADMIN_URL = `http://localhost:11002/${APP_ID}`;
+
+const changes: Array<{ key: string; op: string; value: any; update_count: number; actor?: string }> = [];
+const abort = new AbortController();
+
+async function readFeed(body: ReadableStream<Uint8Array>) {
+    const decoder = new TextDecoder();
+    let buffered = '';
+
+    for await (const chunk of body) {
+        buffered += decoder.decode(chunk, { stream: true });
+
+        let end: number;
+        while ((end = buffered.indexOf('\n\n')) !== -1) {
+            const event = buffered.slice(0, end);
+            buffered = buffered.slice(end + 2);
+
+            const lines = event.split('\n');
+            if (!lines.includes('event: change')) {
+                continue;
+            }
+
+            const data = lines.find((line) => line.startsWith('data: '))!.slice('data: '.length);
+            logger.debug('change', data);
+            changes.push(JSON.parse(data));
+        }
+    }
+}
+
+async function write(method: string, key: string, body?: any) {
+    const response = await fetch(`${ADMIN_URL}/server-state/${key}`, {
+        method,
+        headers: { 'content-type': 'application/json' },
+        body: body === undefined ? undefined : JSON.stringify(body),
+    });
+
+    if (response.status !== 200) {
+        throw new Error(`${method} ${key} failed with ${response.status}`);
+    }
+}
+
+try {
+    const notDurable = await fetch(`${ADMIN_URL}/server-state-changes?since=1`);
+    if (notDurable.status !== 400) {
+        throw new Error(`expected 400 when resuming a feed that is not durable, got ${notDurable.status}`);
+    }
+
+    const feed = await fetch(`${ADMIN_URL}/server-state-changes?prefix=${PREFIX}`, { signal: abort.signal });
+    if (feed.status !== 200 || !feed.headers.get('content-type')?.startsWith('text/event-stream')) {
+        throw new Error(`unexpected feed response: ${feed.status} ${feed.headers.get('content-type')}`);
+    }
+
+    const reading = readFeed(feed.body!).catch(() => {});
+
+    await new Promise((r) => setTimeout(r, 200));
+
+    await write('PUT', `${PREFIX}-a`, { value: { n: 1 } });
+    await write('PUT', `other-${PREFIX}`, { value: { n: 1 } });
+    await write('POST', `${PREFIX}-a`, { $inc: { n: 2 } });
+    await write('DELETE', `${PREFIX}-a`);
+
+    const deadline = Date.now() + 5_000;
+    while (changes.length < 3 && Date.now() < deadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    const summary = changes.map((change) => `${change.key}:${change.op}:${change.update_count}`);
+    const expected = [`${PREFIX}-a:set:1`, `${PREFIX}-a:atomic:2`, `${PREFIX}-a:remove:3`];
+    if (JSON.stringify(summary) !== JSON.stringify(expected)) {
+        throw new Error(`unexpected changes: ${JSON.stringify(changes)}`);
+    }
+
+    if (changes[1].value?.n !== 3 || changes[2].value !== null || !changes[0].actor?.startsWith('admin')) {
+        throw new Error(`unexpected change contents: ${JSON.stringify(changes)}`);
+    }
+
+    abort.abort();
+    await reading;
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    abort.abort();
+    await closeClient();
+}
@@ -0,0 +1,71 @@
+import logger from './common/logger.mjs';
+
+const URL = `http://localhost:11002/_default/server-state/e2e-admin-patch-${Date.now()}`;
+
+async function request(method: string, contentType: string, body: any) {
+    const response = await fetch(URL, {
+        method,
+        headers: { 'content-type': contentType },
+        body: JSON.stringify(body),
+    });
+
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${URL} (${contentType}) -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+try {
+    await request('PUT', 'application/json', { value: { title: 'a', tags: ['x', 'y'], author: { name: 'n', email: 'e' } } });
+
+    const merged = await request('PATCH', 'application/merge-patch+json', {
+        title: 'b',
+        tags: ['z'],
+        author: { email: null },
+    });
+
+    if (
+        merged.status !== 200 ||
+        JSON.stringify(merged.json.value) !== JSON.stringify({ author: { name: 'n' }, tags: ['z'], title: 'b' })
+    ) {
+        throw new Error(`unexpected merge patch result: ${JSON.stringify(merged)}`);
+    }
+
+    const patched = await request('PATCH', 'application/json-patch+json', [
+        { op: 'test', path: '/title', value: 'b' },
+        { op: 'add', path: '/tags/0', value: 'first' },
+        { op: 'move', from: '/author/name', path: '/owner' },
+        { op: 'remove', path: '/author' },
+    ]);
+
+    if (
+        patched.status !== 200 ||
+        patched.json.update_count !== merged.json.update_count + 1 ||
+        JSON.stringify(patched.json.value) !== JSON.stringify({ owner: 'n', tags: ['first', 'z'], title: 'b' })
+    ) {
+        throw new Error(`unexpected json patch result: ${JSON.stringify(patched)}`);
+    }
+
+    const failedTest = await request('PATCH', 'application/json-patch+json', [
+        { op: 'replace', path: '/title', value: 'c' },
+        { op: 'test', path: '/owner', value: 'someone else' },
+    ]);
+
+    if (failedTest.status !== 409 || failedTest.json.index !== 1) {
+        throw new Error(`expected the test to fail, got ${JSON.stringify(failedTest)}`);
+    }
+
+    const missing = await request('PATCH', 'application/json-patch+json', [{ op: 'remove', path: '/nope' }]);
+    if (missing.status !== 422) {
+        throw new Error(`expected 422 for a missing path, got ${missing.status}`);
+    }
+
+    const current = await fetch(URL).then((response) => response.json());
+    if (current.value.title !== 'b' || current.update_count !== patched.json.update_count) {
+        throw new Error(`a failed patch changed the value: ${JSON.stringify(current)}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+}
@@ -0,0 +1,61 @@
+import logger from './common/logger.mjs';
+
+const APP_ID = `e2e-admin-read-${Date.now()}`;
+const ADMIN_URL = `http://localhost:11002/${encodeURIComponent(APP_ID)}/server-state`;
+
+async function request(method: string, path: string, body?: any) {
+    const response = await fetch(`${ADMIN_URL}${path}`, {
+        method,
+        headers: body === undefined ? {} : { 'content-type': 'application/json' },
+        body: body === undefined ? undefined : JSON.stringify(body),
+    });
+
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${path} -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+try {
+    await request('PUT', '/list-a', { value: { n: 1 } });
+    await request('PUT', '/list-a', { value: { n: 2 } });
+    await request('PUT', '/list-b', { value: { n: 3 } });
+    await request('PUT', '/other', { value: { n: 4 } });
+
+    const single = await request('GET', '/list-a');
+    if (single.status !== 200 || single.json.value.n !== 2 || single.json.update_count !== 2) {
+        throw new Error(`unexpected GET result: ${JSON.stringify(single)}`);
+    }
+
+    const missing = await request('GET', '/never-written');
+    if (missing.status !== 404) {
+        throw new Error(`expected 404 for a missing key, got ${missing.status}`);
+    }
+
+    // walk every page, since a SCAN page may come back empty
+    const listed: Array<{ key: string; value?: any; update_count: number }> = [];
+    let cursor = '0';
+
+    do {
+        const page = await request('GET', `?prefix=list-&values=true&count=10&cursor=${cursor}`);
+        if (page.status !== 200) {
+            throw new Error(`listing failed with status ${page.status}`);
+        }
+
+        listed.push(...page.json.keys);
+        cursor = page.json.cursor;
+    } while (cursor !== '0');
+
+    const keys = listed.map((k) => k.key).sort();
+    if (JSON.stringify(keys) !== JSON.stringify(['list-a', 'list-b'])) {
+        throw new Error(`unexpected listed keys: ${JSON.stringify(keys)}`);
+    }
+
+    if (listed.find((k) => k.key === 'list-b')?.value?.n !== 3) {
+        throw new Error('listed values are missing');
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+}
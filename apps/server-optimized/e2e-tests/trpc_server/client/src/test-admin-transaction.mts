@@ -0,0 +1,69 @@
+import logger from './common/logger.mjs';
+
+const APP_ID = `e2e-admin-transaction-${Date.now()}`;
+const ADMIN_URL = `http://localhost:11002/${encodeURIComponent(APP_ID)}`;
+
+async function request(method: string, path: string, body?: any) {
+    const response = await fetch(`${ADMIN_URL}${path}`, {
+        method,
+        headers: body === undefined ? {} : { 'content-type': 'application/json' },
+        body: body === undefined ? undefined : JSON.stringify(body),
+    });
+
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${path} -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+try {
+    await request('PUT', '/server-state/inventory-a', { value: { items: ['sword'] } });
+    await request('PUT', '/server-state/inventory-b', { value: { items: [] } });
+
+    // the second operation fails, so the first one must not be applied either
+    const failed = await request('POST', '/server-state-transaction', {
+        operations: [
+            { type: 'replace', key: 'inventory-a', value: { items: [] } },
+            { type: 'atomic', key: 'inventory-b', ops: { $inc: { items: 1 } } },
+        ],
+    });
+
+    if (failed.status !== 400 || failed.json.index !== 1) {
+        throw new Error(`expected the transaction to fail on operation 1, got ${JSON.stringify(failed)}`);
+    }
+
+    const untouched = await request('GET', '/server-state/inventory-a');
+    if (untouched.json.value.items[0] !== 'sword' || untouched.json.update_count !== 1) {
+        throw new Error('a failed transaction left a partial write behind');
+    }
+
+    const conflict = await request('POST', '/server-state-transaction', {
+        operations: [
+            { type: 'replace', key: 'inventory-a', value: { items: [] }, expected_update_count: 7 },
+        ],
+    });
+
+    if (conflict.status !== 409 || conflict.json.key !== 'inventory-a' || conflict.json.update_count !== 1) {
+        throw new Error(`expected a conflict, got ${JSON.stringify(conflict)}`);
+    }
+
+    const moved = await request('POST', '/server-state-transaction', {
+        operations: [
+            { type: 'replace', key: 'inventory-a', value: { items: [] }, expected_update_count: 1 },
+            { type: 'atomic', key: 'inventory-b', ops: { $push: { items: 'sword' } }, expected_update_count: 1 },
+        ],
+    });
+
+    if (moved.status !== 200 || moved.json.results.length !== 2) {
+        throw new Error(`transaction failed: ${JSON.stringify(moved)}`);
+    }
+
+    const b = await request('GET', '/server-state/inventory-b');
+    if (b.json.value.items[0] !== 'sword' || b.json.update_count !== 2) {
+        throw new Error(`unexpected inventory-b after the transaction: ${JSON.stringify(b.json)}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+}
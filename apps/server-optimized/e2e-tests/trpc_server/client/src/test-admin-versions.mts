@@ -0,0 +1,104 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+import type { TServerStateMessage } from './common/types.mjs';
+
+const APP_ID = '_default';
+const KEY = `e2e-admin-versions-${Date.now()}`;
+const URL = `http://localhost:11002/${APP_ID}/server-state/${KEY}`;
+
+const updates: Array<{ key: string; value: any; update_count?: number }> = [];
+
+let sessionId: string | undefined;
+
+const subscription = trpcClient.serverState.serverState.subscribe(
+    {},
+    {
+        onData(message: TServerStateMessage) {
+            logger.debug('server-state message', message);
+
+            if (message.type === 'session-info') {
+                sessionId = message.session_id;
+            } else if (message.type === 'updates') {
+                updates.push(...message.updates.filter((update) => update.key === KEY));
+            }
+        },
+    },
+);
+
+async function request(method: string, path: string, body?: any) {
+    const response = await fetch(`${URL}${path}`, {
+        method,
+        headers: { 'content-type': 'application/json' },
+        body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${path} -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+try {
+    await request('PUT', '', { value: { title: 'first' } });
+    await request('PUT', '', { value: { title: 'second' } });
+    await request('POST', '', { $set: { title: 'bad write' } });
+    await request('PUT', '', { value: { title: 'fourth' } });
+
+    // the server keeps the last 3 versions
+    const listed = await request('GET', '/versions');
+    const counts = listed.json?.versions?.map((version: any) => version.update_count);
+    if (listed.status !== 200 || JSON.stringify(counts) !== '[4,3,2]') {
+        throw new Error(`unexpected versions: ${JSON.stringify(listed)}`);
+    }
+
+    const second = await request('GET', '/versions/2');
+    if (second.status !== 200 || second.json.value.title !== 'second') {
+        throw new Error(`unexpected version 2: ${JSON.stringify(second)}`);
+    }
+
+    const tooOld = await request('GET', '/versions/1');
+    if (tooOld.status !== 404) {
+        throw new Error(`expected 404 for a version out of the history, got ${tooOld.status}`);
+    }
+
+    const deadline = Date.now() + 5_000;
+    while (!sessionId && Date.now() < deadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    if (!sessionId) {
+        throw new Error('timeout while waiting for session id');
+    }
+
+    await trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId, keys: [KEY] });
+
+    const stale = await fetch(`${URL}/versions/2/revert`, { method: 'POST', headers: { 'if-match': '3' } });
+    if (stale.status !== 409) {
+        throw new Error(`expected a conflict for a stale revert, got ${stale.status}`);
+    }
+
+    const reverted = await request('POST', '/versions/2/revert');
+    if (reverted.status !== 200 || reverted.json.update_count !== 5 || reverted.json.value.title !== 'second') {
+        throw new Error(`revert failed: ${JSON.stringify(reverted)}`);
+    }
+
+    const revertedDeadline = Date.now() + 5_000;
+    while (updates.at(-1)?.update_count !== 5 && Date.now() < revertedDeadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    if (updates.at(-1)?.value?.title !== 'second') {
+        throw new Error(`watchers did not get the revert: ${JSON.stringify(updates)}`);
+    }
+
+    const current = await request('GET', '');
+    if (current.json?.value?.title !== 'second' || current.json.update_count !== 5) {
+        throw new Error(`unexpected value after the revert: ${JSON.stringify(current)}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    subscription.unsubscribe();
+    await closeClient();
+}
@@ -0,0 +1,127 @@
+import { createHmac } from 'node:crypto';
+import { createTRPCClient, createWSClient, wsLink } from '@trpc/client';
+import logger from './common/logger.mjs';
+import type { TRouter, TServerStateMessage } from './common/types.mjs';
+
+// must match the secret configured by TestTRPCServerAuth
+const APP_ID = 'e2e-auth-app';
+const APP_SECRET = 'e2e-auth-secret';
+
+function signToken(payload: Record<string, any>, secret: string) {
+    const encode = (value: any) => Buffer.from(JSON.stringify(value)).toString('base64url');
+    const unsigned = `${encode({ alg: 'HS256', typ: 'JWT' })}.${encode(payload)}`;
+    const signature = createHmac('sha256', secret).update(unsigned).digest('base64url');
+
+    return `${unsigned}.${signature}`;
+}
+
+function createClient(token?: string) {
+    const wsClient = createWSClient({
+        url: 'ws://localhost:11001/trpc',
+        connectionParams: token ? { token } : undefined,
+    });
+
+    return {
+        wsClient,
+        trpcClient: createTRPCClient<TRouter>({
+            links: [wsLink<TRouter>({ client: wsClient })],
+        }),
+    };
+}
+
+function openSession(client: ReturnType<typeof createClient>['trpcClient']) {
+    return new Promise<{ sessionId: string; unsubscribe: () => void }>((resolve, reject) => {
+        const timer = setTimeout(() => reject(new Error('timeout while waiting for session id')), 5_000);
+
+        const subscription = client.serverState.serverState.subscribe(
+            {},
+            {
+                onData(message: TServerStateMessage) {
+                    if (message.type === 'session-info') {
+                        clearTimeout(timer);
+                        resolve({ sessionId: message.session_id, unsubscribe: () => subscription.unsubscribe() });
+                    }
+                },
+                onError(err) {
+                    clearTimeout(timer);
+                    reject(err);
+                },
+            },
+        );
+    });
+}
+
+async function expectRejection(promise: Promise<unknown>, label: string) {
+    try {
+        await promise;
+    } catch (e) {
+        logger.debug(`${label} rejected as expected`, e);
+        return;
+    }
+
+    throw new Error(`${label} was not rejected`);
+}
+
+const token = signToken(
+    {
+        appId: APP_ID,
+        exp: Math.floor(Date.now() / 1000) + 60,
+        data: {
+            serverState: { read: ['public-*'] },
+        },
+    },
+    APP_SECRET,
+);
+
+const authorized = createClient(token);
+const anonymous = createClient();
+
+try {
+    const { sessionId, unsubscribe } = await openSession(authorized.trpcClient);
+
+    await authorized.trpcClient.serverState.watchKeys.mutate({
+        appId: APP_ID,
+        sessionId,
+        keys: ['public-e2e-auth'],
+    });
+
+    await expectRejection(
+        authorized.trpcClient.serverState.watchKeys.mutate({
+            appId: APP_ID,
+            sessionId,
+            keys: ['private-e2e-auth'],
+        }),
+        'watching a key outside the token patterns',
+    );
+
+    await expectRejection(
+        authorized.trpcClient.serverState.watchKeys.mutate({
+            appId: '_default',
+            sessionId,
+            keys: ['public-e2e-auth'],
+        }),
+        'watching a key of another app',
+    );
+
+    unsubscribe();
+
+    const anonymousSession = await openSession(anonymous.trpcClient);
+
+    await expectRejection(
+        anonymous.trpcClient.serverState.watchKeys.mutate({
+            appId: APP_ID,
+            sessionId: anonymousSession.sessionId,
+            keys: ['public-e2e-auth'],
+        }),
+        'anonymous access to an app with a signing secret',
+    );
+
+    anonymousSession.unsubscribe();
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    await authorized.wsClient.close();
+    await anonymous.wsClient.close();
+}
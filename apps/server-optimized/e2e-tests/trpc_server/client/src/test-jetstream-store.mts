@@ -0,0 +1,72 @@
+import logger from './common/logger.mjs';
+
+// run against AIRSTATE_KV_BACKEND=jetstream, where update counts are bucket
+// revisions: they grow with every write, but not necessarily by one
+const URL = `http://localhost:11002/_default/server-state/e2e-jetstream-${Date.now()}`;
+
+async function request(method: string, body: any, ifMatch?: string) {
+    const headers: Record<string, string> = { 'content-type': 'application/json' };
+    if (ifMatch !== undefined) {
+        headers['if-match'] = ifMatch;
+    }
+
+    const response = await fetch(URL, {
+        method,
+        headers,
+        body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${URL} (If-Match: ${ifMatch}) -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+try {
+    const created = await request('PUT', { value: { n: 1, tags: [] } }, '0');
+    if (created.status !== 200 || !(created.json.update_count > 0)) {
+        throw new Error(`conditional create failed: ${JSON.stringify(created)}`);
+    }
+
+    const first = created.json.update_count;
+
+    const stale = await request('PATCH', { value: { n: 2 } }, '0');
+    if (stale.status !== 409 || stale.json.update_count !== first) {
+        throw new Error(`expected a conflict at revision ${first}, got ${JSON.stringify(stale)}`);
+    }
+
+    const merged = await request('PATCH', { value: { n: 2 } }, `${first}`);
+    if (merged.status !== 200 || !(merged.json.update_count > first)) {
+        throw new Error(`conditional merge failed: ${JSON.stringify(merged)}`);
+    }
+
+    const second = merged.json.update_count;
+
+    const staleOps = await request('POST', { $inc: { n: 1 } }, `${first}`);
+    if (staleOps.status !== 409) {
+        throw new Error(`expected a conflict for atomic ops, got ${staleOps.status}`);
+    }
+
+    const ops = await request('POST', { $inc: { n: 1 }, $push: { tags: 'a' } }, `${second}`);
+    if (ops.status !== 200 || ops.json.value.n !== 3 || ops.json.value.tags[0] !== 'a' || !(ops.json.update_count > second)) {
+        throw new Error(`atomic ops failed: ${JSON.stringify(ops)}`);
+    }
+
+    const read = await request('GET', undefined);
+    if (read.status !== 200 || read.json.value.n !== 3 || read.json.update_count !== ops.json.update_count) {
+        throw new Error(`read back failed: ${JSON.stringify(read)}`);
+    }
+
+    const deleted = await request('DELETE', {}, `${ops.json.update_count}`);
+    if (deleted.status !== 200) {
+        throw new Error(`conditional delete failed with ${deleted.status}`);
+    }
+
+    const gone = await request('GET', undefined);
+    if (gone.status !== 404) {
+        throw new Error(`expected the key to be gone, got ${gone.status}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+}
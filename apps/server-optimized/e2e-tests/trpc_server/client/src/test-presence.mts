@@ -0,0 +1,80 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+import type { TPresenceMessage } from './common/types.mjs';
+
+const ROOM = `e2e-presence-room-${Date.now()}`;
+
+function joinRoom(peer: string, initialState: any, messages: TPresenceMessage[]) {
+    return trpcClient.presence.roomUpdates.subscribe(
+        { room: ROOM },
+        {
+            async onData(message: TPresenceMessage) {
+                logger.debug(`[${peer}] presence message`, message);
+                messages.push(message);
+
+                if (message.type === 'session-info') {
+                    await trpcClient.presence.peerInit.mutate({
+                        sessionId: message.session_id,
+                        peer,
+                        initialState,
+                    });
+                }
+            },
+        },
+    );
+}
+
+async function waitFor(check: () => boolean, ms: number, label: string) {
+    const deadline = Date.now() + ms;
+
+    while (Date.now() < deadline) {
+        if (check()) {
+            return;
+        }
+
+        await new Promise((r) => setTimeout(r, 50));
+    }
+
+    throw new Error(`timeout (${ms}ms) while waiting for ${label}`);
+}
+
+const aliceMessages: TPresenceMessage[] = [];
+const bobMessages: TPresenceMessage[] = [];
+
+const alice = joinRoom('alice', { cursor: [1, 2] }, aliceMessages);
+
+try {
+    await waitFor(() => aliceMessages.some((m) => m.type === 'connected' && m.peer_id === 'alice'), 5_000, 'alice to join');
+
+    const bob = joinRoom('bob', { cursor: [3, 4] }, bobMessages);
+
+    // bob either sees alice in the initial snapshot or as a later event
+    await waitFor(
+        () =>
+            bobMessages.some(
+                (m) =>
+                    (m.type === 'init' && 'alice' in m.state.peers) ||
+                    (m.type === 'state' && m.peer_id === 'alice'),
+            ),
+        5_000,
+        'bob to see alice',
+    );
+
+    await waitFor(() => aliceMessages.some((m) => m.type === 'state' && m.peer_id === 'bob'), 5_000, 'alice to see bob');
+
+    alice.unsubscribe();
+
+    await waitFor(
+        () => bobMessages.some((m) => m.type === 'disconnected' && m.peer_id === 'alice'),
+        5_000,
+        'bob to see alice leave',
+    );
+
+    bob.unsubscribe();
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    await closeClient();
+}
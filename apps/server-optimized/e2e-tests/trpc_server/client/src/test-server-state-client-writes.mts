@@ -0,0 +1,163 @@
+import { createHmac } from 'node:crypto';
+import { createTRPCClient, createWSClient, wsLink } from '@trpc/client';
+import logger from './common/logger.mjs';
+import type { TRouter, TServerStateMessage } from './common/types.mjs';
+
+// must match the secret configured by TestTRPCServerServerStateClientWrites
+const APP_ID = 'e2e-client-writes-app';
+const APP_SECRET = 'e2e-client-writes-secret';
+
+function signToken(payload: Record<string, any>, secret: string) {
+    const encode = (value: any) => Buffer.from(JSON.stringify(value)).toString('base64url');
+    const unsigned = `${encode({ alg: 'HS256', typ: 'JWT' })}.${encode(payload)}`;
+    const signature = createHmac('sha256', secret).update(unsigned).digest('base64url');
+
+    return `${unsigned}.${signature}`;
+}
+
+function createClient(token: string) {
+    const wsClient = createWSClient({
+        url: 'ws://localhost:11001/trpc',
+        connectionParams: { token },
+    });
+
+    return {
+        wsClient,
+        trpcClient: createTRPCClient<TRouter>({
+            links: [wsLink<TRouter>({ client: wsClient })],
+        }),
+    };
+}
+
+async function expectRejection(promise: Promise<unknown>, label: string) {
+    try {
+        await promise;
+    } catch (e) {
+        logger.debug(`${label} rejected as expected`, e);
+        return;
+    }
+
+    throw new Error(`${label} was not rejected`);
+}
+
+const suffix = Date.now();
+const KEY = `doc-${suffix}`;
+const COUNTER_KEY = `counter-${suffix}`;
+
+const token = signToken(
+    {
+        appId: APP_ID,
+        exp: Math.floor(Date.now() / 1000) + 60,
+        data: {
+            serverState: {
+                write: [
+                    { keys: ['doc-*'], ops: ['set', 'merge'], maxValueSize: 64 },
+                    { keys: ['counter-*'], ops: ['atomic'] },
+                ],
+            },
+        },
+    },
+    APP_SECRET,
+);
+
+const writer = createClient(token);
+const watcher = createClient(token);
+
+try {
+    // the watcher has to see the client's writes like the admin plane's
+    const received = new Promise<any>((resolve, reject) => {
+        const timer = setTimeout(() => reject(new Error('timeout while waiting for the merged value')), 5_000);
+
+        const subscription = watcher.trpcClient.serverState.serverState.subscribe(
+            {},
+            {
+                async onData(message: TServerStateMessage) {
+                    if (message.type === 'session-info') {
+                        await watcher.trpcClient.serverState.watchKeys.mutate({
+                            appId: APP_ID,
+                            sessionId: message.session_id,
+                            keys: [KEY],
+                        });
+                    }
+
+                    if (message.type === 'updates') {
+                        const update = message.updates.find((u) => u.key === KEY && u.update_count === 2);
+                        if (update) {
+                            clearTimeout(timer);
+                            subscription.unsubscribe();
+                            resolve(update.value);
+                        }
+                    }
+                },
+                onError(err) {
+                    clearTimeout(timer);
+                    reject(err);
+                },
+            },
+        );
+    });
+
+    // give the watcher time to watch the key
+    await new Promise((resolve) => setTimeout(resolve, 500));
+
+    const set = await writer.trpcClient.serverState.set.mutate({ appId: APP_ID, key: KEY, value: { a: 1 } });
+    if (set.update_count !== 1 || set.conflict) {
+        throw new Error(`unexpected set result ${JSON.stringify(set)}`);
+    }
+
+    const merged = await writer.trpcClient.serverState.merge.mutate({
+        appId: APP_ID,
+        key: KEY,
+        value: { b: 2 },
+        expectedUpdateCount: 1,
+    });
+    if (merged.update_count !== 2 || merged.value.a !== 1 || merged.value.b !== 2) {
+        throw new Error(`unexpected merge result ${JSON.stringify(merged)}`);
+    }
+
+    const watched = await received;
+    if (watched.a !== 1 || watched.b !== 2) {
+        throw new Error(`the watcher got ${JSON.stringify(watched)}`);
+    }
+
+    const conflict = await writer.trpcClient.serverState.set.mutate({
+        appId: APP_ID,
+        key: KEY,
+        value: { c: 3 },
+        expectedUpdateCount: 1,
+    });
+    if (!conflict.conflict || conflict.update_count !== 2) {
+        throw new Error(`expected a conflict, got ${JSON.stringify(conflict)}`);
+    }
+
+    const counted = await writer.trpcClient.serverState.atomic.mutate({
+        appId: APP_ID,
+        key: COUNTER_KEY,
+        ops: { $inc: { clicks: 1 } },
+    });
+    if (counted.value.clicks !== 1) {
+        throw new Error(`unexpected atomic result ${JSON.stringify(counted)}`);
+    }
+
+    await expectRejection(
+        writer.trpcClient.serverState.atomic.mutate({ appId: APP_ID, key: KEY, ops: { $inc: { a: 1 } } }),
+        'an op the rule does not allow',
+    );
+
+    await expectRejection(
+        writer.trpcClient.serverState.set.mutate({ appId: APP_ID, key: `other-${suffix}`, value: 1 }),
+        'a key outside the write patterns',
+    );
+
+    await expectRejection(
+        writer.trpcClient.serverState.set.mutate({ appId: APP_ID, key: KEY, value: 'x'.repeat(100) }),
+        'a value over the rule size limit',
+    );
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    await writer.wsClient.close();
+    await watcher.wsClient.close();
+}
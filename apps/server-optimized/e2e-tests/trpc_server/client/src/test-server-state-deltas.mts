@@ -0,0 +1,147 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+import type { TServerStateMessage } from './common/types.mjs';
+
+const APP_ID = '_default';
+const KEY = `e2e-server-state-deltas-${Date.now()}`;
+const URL = `http://localhost:11002/${APP_ID}/server-state/${KEY}`;
+
+const messages: TServerStateMessage[] = [];
+
+async function write(method: string, contentType: string, body: any) {
+    const response = await fetch(URL, {
+        method,
+        headers: { 'content-type': contentType },
+        body: JSON.stringify(body),
+    });
+
+    if (!response.ok) {
+        throw new Error(`${method} failed with ${response.status}: ${await response.text()}`);
+    }
+}
+
+async function waitFor<T>(find: () => T | undefined, label: string): Promise<T> {
+    const deadline = Date.now() + 5_000;
+
+    while (Date.now() < deadline) {
+        const found = find();
+        if (found !== undefined) {
+            return found;
+        }
+
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    throw new Error(`timeout while waiting for ${label}`);
+}
+
+// just enough of RFC 6902 for what the server's diff produces
+function applyDelta(document: any, delta: Array<{ op: string; path: string; value?: any }>) {
+    for (const operation of delta) {
+        if (operation.path === '') {
+            document = operation.value;
+            continue;
+        }
+
+        const tokens = operation.path
+            .slice(1)
+            .split('/')
+            .map((token) => token.replace(/~1/g, '/').replace(/~0/g, '~'));
+        const last = tokens.pop()!;
+        const parent = tokens.reduce((node, token) => node[token], document);
+
+        if (operation.op === 'remove') {
+            Array.isArray(parent) ? parent.splice(Number(last), 1) : delete parent[last];
+        } else if (operation.op === 'add' && Array.isArray(parent)) {
+            parent.splice(Number(last), 0, operation.value);
+        } else {
+            parent[last] = operation.value;
+        }
+    }
+
+    return document;
+}
+
+// key order is not part of the value
+function canonical(value: any): string {
+    if (Array.isArray(value)) {
+        return `[${value.map(canonical).join(',')}]`;
+    }
+
+    if (value && typeof value === 'object') {
+        return `{${Object.keys(value)
+            .sort()
+            .map((key) => `${JSON.stringify(key)}:${canonical(value[key])}`)
+            .join(',')}}`;
+    }
+
+    return JSON.stringify(value);
+}
+
+const bigList = Array.from({ length: 200 }, (_, i) => ({ id: i, label: `item number ${i}` }));
+
+let sessionId: string | undefined;
+
+const subscription = trpcClient.serverState.serverState.subscribe(
+    { deltas: true },
+    {
+        onData(message: TServerStateMessage) {
+            logger.debug('server-state message', message);
+
+            if (message.type === 'session-info') {
+                sessionId = message.session_id;
+            } else {
+                messages.push(message);
+            }
+        },
+    },
+);
+
+try {
+    await write('PUT', 'application/json', { value: { title: 'first', list: bigList } });
+
+    const session = await waitFor(() => sessionId, 'session id');
+    const watched = await trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId: session, keys: [KEY] });
+    const base = watched[KEY];
+
+    await write('PATCH', 'application/merge-patch+json', { title: 'second' });
+
+    const delta = await waitFor(
+        () => messages.flatMap((m) => (m.type === 'deltas' ? m.deltas : [])).find((d) => d.key === KEY),
+        'a delta',
+    );
+
+    if (delta.base_update_count !== base.update_count || delta.update_count !== base.update_count + 1) {
+        throw new Error(`delta does not follow the watched value: ${JSON.stringify(delta)}`);
+    }
+
+    const patched = applyDelta(structuredClone(base.value), delta.delta);
+    const stored = await fetch(URL).then((response) => response.json());
+
+    if (canonical(patched) !== canonical(stored.value)) {
+        throw new Error(`applying the delta did not produce the stored value: ${JSON.stringify(delta.delta)}`);
+    }
+
+    const before = messages.length;
+    await trpcClient.serverState.resync.mutate({ appId: APP_ID, sessionId: session, keys: [KEY] });
+
+    const resynced = await waitFor(
+        () =>
+            messages
+                .slice(before)
+                .flatMap((m) => (m.type === 'updates' ? m.updates : []))
+                .find((u) => u.key === KEY),
+        'the resync',
+    );
+
+    if (resynced.update_count !== delta.update_count || resynced.value.title !== 'second') {
+        throw new Error(`unexpected resync: ${JSON.stringify(resynced)}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    subscription.unsubscribe();
+    await closeClient();
+}
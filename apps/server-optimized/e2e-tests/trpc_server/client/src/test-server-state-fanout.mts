@@ -0,0 +1,89 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import type { TServerStateMessage } from './common/types.mjs';
+
+const APP_ID = '_default';
+const KEY = `e2e-server-state-fanout-${Date.now()}`;
+const URL = `http://localhost:11002/${APP_ID}/server-state/${KEY}`;
+const SESSIONS = 50;
+
+type TWatcher = {
+    sessionId?: string;
+    values: any[];
+    unsubscribe: () => void;
+};
+
+// many sessions on one key share a single NATS subscription on the node; each
+// of them still has to see every write
+const watchers: TWatcher[] = Array.from({ length: SESSIONS }, () => {
+    const watcher: TWatcher = { values: [], unsubscribe: () => {} };
+
+    const subscription = trpcClient.serverState.serverState.subscribe(
+        {},
+        {
+            onData(message: TServerStateMessage) {
+                if (message.type === 'session-info') {
+                    watcher.sessionId = message.session_id;
+                } else if (message.type === 'updates') {
+                    watcher.values.push(...message.updates.filter((u) => u.key === KEY).map((u) => u.value));
+                }
+            },
+        },
+    );
+
+    watcher.unsubscribe = () => subscription.unsubscribe();
+
+    return watcher;
+});
+
+async function waitFor(condition: () => boolean, what: string) {
+    const deadline = Date.now() + 5_000;
+    while (!condition() && Date.now() < deadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    if (!condition()) {
+        throw new Error(`timeout while waiting for ${what}`);
+    }
+}
+
+try {
+    await waitFor(() => watchers.every((w) => w.sessionId), 'session ids');
+
+    await Promise.all(
+        watchers.map((w) => trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId: w.sessionId!, keys: [KEY] })),
+    );
+
+    const response = await fetch(URL, {
+        method: 'PUT',
+        headers: { 'content-type': 'application/json' },
+        body: JSON.stringify({ v: 1 }),
+    });
+
+    if (!response.ok) {
+        throw new Error(`write failed with ${response.status}`);
+    }
+
+    await waitFor(() => watchers.every((w) => w.values.at(-1)?.v === 1), 'the write on every session');
+
+    // the shared subscription has to outlive the sessions that leave
+    for (const watcher of watchers.slice(0, SESSIONS - 1)) {
+        watcher.unsubscribe();
+    }
+
+    await new Promise((r) => setTimeout(r, 250));
+
+    await fetch(URL, {
+        method: 'PUT',
+        headers: { 'content-type': 'application/json' },
+        body: JSON.stringify({ v: 2 }),
+    });
+
+    await waitFor(() => watchers.at(-1)!.values.at(-1)?.v === 2, 'the write on the remaining session');
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    watchers.at(-1)!.unsubscribe();
+    await closeClient();
+}
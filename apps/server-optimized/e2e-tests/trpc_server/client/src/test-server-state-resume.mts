@@ -0,0 +1,135 @@
+import { createTRPCClient, createWSClient, wsLink } from '@trpc/client';
+import logger from './common/logger.mjs';
+import type { TRouter, TServerStateMessage } from './common/types.mjs';
+
+const APP_ID = '_default';
+const CHANGED_KEY = `e2e-server-state-resume-changed-${Date.now()}`;
+const UNCHANGED_KEY = `e2e-server-state-resume-unchanged-${Date.now()}`;
+
+type TSession = {
+    wsClient: ReturnType<typeof createWSClient>;
+    trpcClient: ReturnType<typeof createTRPCClient<TRouter>>;
+    sessionInfo: Extract<TServerStateMessage, { type: 'session-info' }>;
+    updates: Array<{ key: string; value: any; update_count?: number }>;
+    unsubscribe: () => void;
+};
+
+function openSession(input: { resumeToken?: string; lastUpdateCounts?: Record<string, number> }) {
+    const wsClient = createWSClient({ url: 'ws://localhost:11001/trpc' });
+    const trpcClient = createTRPCClient<TRouter>({
+        links: [wsLink<TRouter>({ client: wsClient })],
+    });
+
+    const updates: TSession['updates'] = [];
+
+    return new Promise<TSession>((resolve, reject) => {
+        const timer = setTimeout(() => reject(new Error('timeout while waiting for session id')), 5_000);
+
+        const subscription = trpcClient.serverState.serverState.subscribe(input, {
+            onData(message: TServerStateMessage) {
+                logger.debug('server-state message', message);
+
+                if (message.type === 'session-info') {
+                    clearTimeout(timer);
+                    resolve({
+                        wsClient,
+                        trpcClient,
+                        sessionInfo: message,
+                        updates,
+                        unsubscribe: () => subscription.unsubscribe(),
+                    });
+                } else if (message.type === 'updates') {
+                    updates.push(...message.updates);
+                }
+            },
+            onError: reject,
+        });
+    });
+}
+
+async function write(key: string, value: any) {
+    const response = await fetch(`http://localhost:11002/${APP_ID}/server-state/${key}`, {
+        method: 'PUT',
+        headers: { 'content-type': 'application/json' },
+        body: JSON.stringify(value),
+    });
+
+    if (!response.ok) {
+        throw new Error(`write to ${key} failed with ${response.status}`);
+    }
+}
+
+const sessions: TSession[] = [];
+
+try {
+    await write(CHANGED_KEY, { v: 1 });
+    await write(UNCHANGED_KEY, { v: 1 });
+
+    const first = await openSession({});
+    sessions.push(first);
+
+    if (!first.sessionInfo.resume_token || first.sessionInfo.resumed) {
+        throw new Error(`unexpected session info: ${JSON.stringify(first.sessionInfo)}`);
+    }
+
+    await first.trpcClient.serverState.watchKeys.mutate({
+        appId: APP_ID,
+        sessionId: first.sessionInfo.session_id,
+        keys: [CHANGED_KEY, UNCHANGED_KEY],
+    });
+
+    // drop the connection, then change one of the keys while it is gone
+    first.unsubscribe();
+    await first.wsClient.close();
+    await new Promise((r) => setTimeout(r, 250));
+
+    await write(CHANGED_KEY, { v: 2 });
+
+    const second = await openSession({ resumeToken: first.sessionInfo.resume_token });
+    sessions.push(second);
+
+    if (!second.sessionInfo.resumed) {
+        throw new Error(`session was not resumed: ${JSON.stringify(second.sessionInfo)}`);
+    }
+
+    const deadline = Date.now() + 5_000;
+    while (second.updates.length === 0 && Date.now() < deadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    // give a stray update for the unchanged key time to show up
+    await new Promise((r) => setTimeout(r, 250));
+
+    if (second.updates.length !== 1 || second.updates[0].key !== CHANGED_KEY || second.updates[0].value.v !== 2) {
+        throw new Error(`expected only the changed key after resume: ${JSON.stringify(second.updates)}`);
+    }
+
+    // the watched keys were carried over, so live updates keep flowing
+    await write(UNCHANGED_KEY, { v: 2 });
+
+    const liveDeadline = Date.now() + 5_000;
+    while (!second.updates.some((u) => u.key === UNCHANGED_KEY) && Date.now() < liveDeadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    if (!second.updates.some((u) => u.key === UNCHANGED_KEY && u.value.v === 2)) {
+        throw new Error('no live update for a carried over key');
+    }
+
+    // a token is good for one resume only
+    const third = await openSession({ resumeToken: first.sessionInfo.resume_token });
+    sessions.push(third);
+
+    if (third.sessionInfo.resumed) {
+        throw new Error('a resume token was accepted twice');
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    for (const session of sessions) {
+        session.unsubscribe();
+        await session.wsClient.close();
+    }
+}
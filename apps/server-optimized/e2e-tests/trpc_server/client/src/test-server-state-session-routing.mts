@@ -0,0 +1,116 @@
+import { createTRPCClient, createWSClient, wsLink } from '@trpc/client';
+import logger from './common/logger.mjs';
+import type { TRouter, TServerStateMessage } from './common/types.mjs';
+
+// the owning node is the one booted by runNodeClientTest; the peer is the
+// extra service plane started by TestTRPCServerServerStateSessionRouting
+const OWNER_URL = 'ws://localhost:11001/trpc';
+const PEER_URL = 'ws://localhost:11003/trpc';
+
+const APP_ID = '_default';
+const KEY = `e2e-server-state-session-routing-${Date.now()}`;
+
+function createClient(url: string) {
+    const wsClient = createWSClient({ url });
+
+    return {
+        wsClient,
+        trpcClient: createTRPCClient<TRouter>({
+            links: [wsLink<TRouter>({ client: wsClient })],
+        }),
+    };
+}
+
+async function write(value: any) {
+    const response = await fetch(`http://localhost:11002/${APP_ID}/server-state/${KEY}`, {
+        method: 'PUT',
+        headers: { 'content-type': 'application/json' },
+        body: JSON.stringify(value),
+    });
+
+    if (!response.ok) {
+        throw new Error(`write failed with ${response.status}`);
+    }
+}
+
+async function waitFor(condition: () => boolean, what: string) {
+    const deadline = Date.now() + 5_000;
+    while (!condition() && Date.now() < deadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    if (!condition()) {
+        throw new Error(`timeout while waiting for ${what}`);
+    }
+}
+
+const owner = createClient(OWNER_URL);
+const peer = createClient(PEER_URL);
+
+const updates: Array<{ key: string; value: any }> = [];
+
+let sessionId: string | undefined;
+
+const subscription = owner.trpcClient.serverState.serverState.subscribe(
+    {},
+    {
+        onData(message: TServerStateMessage) {
+            logger.debug('server-state message', message);
+
+            if (message.type === 'session-info') {
+                sessionId = message.session_id;
+            } else if (message.type === 'updates') {
+                updates.push(...message.updates);
+            }
+        },
+    },
+);
+
+try {
+    await write({ v: 1 });
+    await waitFor(() => !!sessionId, 'session id');
+
+    const watched = await peer.trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId: sessionId!, keys: [KEY] });
+
+    if (watched[KEY]?.value?.v !== 1) {
+        throw new Error(`unexpected watch result through the peer: ${JSON.stringify(watched)}`);
+    }
+
+    await waitFor(() => updates.some((u) => u.key === KEY && u.value.v === 1), 'the snapshot on the owning node');
+
+    await write({ v: 2 });
+    await waitFor(() => updates.some((u) => u.key === KEY && u.value.v === 2), 'a live update on the owning node');
+
+    const unwatched = await peer.trpcClient.serverState.unwatchKeys.mutate({ appId: APP_ID, sessionId: sessionId!, keys: [KEY] });
+
+    if (unwatched.unwatched.length !== 1 || unwatched.unwatched[0] !== KEY) {
+        throw new Error(`unexpected unwatch result through the peer: ${JSON.stringify(unwatched)}`);
+    }
+
+    const received = updates.length;
+    await write({ v: 3 });
+    await new Promise((r) => setTimeout(r, 250));
+
+    if (updates.length !== received) {
+        throw new Error('an update arrived after unwatching through the peer');
+    }
+
+    let notFound = false;
+    try {
+        await peer.trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId: 'no-such-session', keys: [KEY] });
+    } catch (e) {
+        notFound = `${e}`.includes('session not found');
+    }
+
+    if (!notFound) {
+        throw new Error('a session no node owns was not reported as not found');
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    subscription.unsubscribe();
+    await owner.wsClient.close();
+    await peer.wsClient.close();
+}
@@ -0,0 +1,112 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+import type { TServerStateMessage } from './common/types.mjs';
+
+const APP_ID = '_default';
+const KEY = `e2e-server-state-ttl-${Date.now()}`;
+const PERSISTENT_KEY = `${KEY}-persistent`;
+const BASE_URL = `http://localhost:11002/${APP_ID}/server-state`;
+
+const updates: Array<{ key: string; value: any; update_count?: number }> = [];
+
+let sessionId: string | undefined;
+
+const subscription = trpcClient.serverState.serverState.subscribe(
+    {},
+    {
+        onData(message: TServerStateMessage) {
+            logger.debug('server-state message', message);
+
+            if (message.type === 'session-info') {
+                sessionId = message.session_id;
+            } else if (message.type === 'updates') {
+                updates.push(...message.updates.filter((update) => update.key === KEY));
+            }
+        },
+    },
+);
+
+async function request(method: string, path: string, body?: any) {
+    const response = await fetch(`${BASE_URL}/${path}`, {
+        method,
+        headers: { 'content-type': 'application/json' },
+        body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    const json = await response.json().catch(() => null);
+    logger.debug(`${method} ${path} -> ${response.status}`, json);
+
+    return { status: response.status, json };
+}
+
+async function waitFor(condition: () => boolean, timeout: number) {
+    const deadline = Date.now() + timeout;
+    while (!condition() && Date.now() < deadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+}
+
+try {
+    const created = await request('PUT', `${KEY}?ttl=1500`, { value: { countdown: 3 } });
+    if (created.status !== 200 || created.json.update_count !== 1) {
+        throw new Error(`replace with a ttl failed: ${JSON.stringify(created)}`);
+    }
+
+    // without a ttl, a write keeps the one the key has
+    const incremented = await request('POST', KEY, { $inc: { countdown: -1 } });
+    if (incremented.status !== 200 || incremented.json.update_count !== 2) {
+        throw new Error(`atomic ops failed: ${JSON.stringify(incremented)}`);
+    }
+
+    await waitFor(() => sessionId !== undefined, 5_000);
+    if (!sessionId) {
+        throw new Error('timeout while waiting for session id');
+    }
+
+    await trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId, keys: [KEY] });
+
+    await waitFor(() => updates.some((update) => update.value === null), 10_000);
+
+    const expired = updates.find((update) => update.value === null);
+    if (!expired || expired.update_count !== 3) {
+        throw new Error(`expected a null update with update count 3, got ${JSON.stringify(updates)}`);
+    }
+
+    const gone = await request('GET', KEY);
+    if (gone.status !== 404) {
+        throw new Error(`expired key is still readable: ${JSON.stringify(gone)}`);
+    }
+
+    // the expire op sets and removes the ttl of a key without writing it
+    const missing = await request('POST', `${PERSISTENT_KEY}/expire?ttl=1s`);
+    if (missing.status !== 404) {
+        throw new Error(`expected 404 for expiring a missing key, got ${missing.status}`);
+    }
+
+    await request('PUT', PERSISTENT_KEY, { value: 'stays' });
+
+    const touched = await request('POST', `${PERSISTENT_KEY}/expire?ttl=500ms`);
+    if (touched.status !== 200 || touched.json.update_count !== 1) {
+        throw new Error(`expire failed: ${JSON.stringify(touched)}`);
+    }
+
+    const persisted = await request('POST', `${PERSISTENT_KEY}/expire?ttl=0`);
+    if (persisted.status !== 200) {
+        throw new Error(`removing the ttl failed: ${JSON.stringify(persisted)}`);
+    }
+
+    await new Promise((r) => setTimeout(r, 1_500));
+
+    const kept = await request('GET', PERSISTENT_KEY);
+    if (kept.status !== 200) {
+        throw new Error(`key expired after its ttl was removed: ${JSON.stringify(kept)}`);
+    }
+
+    await request('DELETE', PERSISTENT_KEY);
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    subscription.unsubscribe();
+    await closeClient();
+}
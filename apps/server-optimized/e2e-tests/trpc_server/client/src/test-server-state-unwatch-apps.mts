@@ -0,0 +1,152 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+import type { TServerStateMessage } from './common/types.mjs';
+
+// the same key watched in two apps is two states; unwatching it in one must
+// leave the other alone
+const KEPT_APP_ID = 'e2e-unwatch-kept-app';
+const UNWATCHED_APP_ID = 'e2e-unwatch-unwatched-app';
+const TEST_KEY = 'e2e-trpc-server-state-unwatch-apps-key';
+
+function withTimeout<T>(promise: Promise<T>, ms: number, label: string): Promise<T> {
+    return new Promise<T>((resolve, reject) => {
+        const timer = setTimeout(() => {
+            reject(new Error(`timeout (${ms}ms) while waiting for ${label}`));
+        }, ms);
+
+        promise
+            .then((value) => {
+                clearTimeout(timer);
+                resolve(value);
+            })
+            .catch((err) => {
+                clearTimeout(timer);
+                reject(err);
+            });
+    });
+}
+
+async function replaceServerStateValue(appId: string, key: string, value: any) {
+    const url = `http://localhost:11002/${encodeURIComponent(appId)}/server-state/${encodeURIComponent(key)}`;
+
+    const response = await fetch(url, {
+        method: 'PUT',
+        headers: {
+            'content-type': 'application/json',
+        },
+        body: JSON.stringify({ value }),
+    });
+
+    if (!response.ok) {
+        const text = await response.text().catch(() => '');
+        throw new Error(`failed to replace server-state value: ${response.status} ${response.statusText} ${text}`);
+    }
+}
+
+const receivedUpdates: Array<{ app_id: string; key: string; value: any }> = [];
+
+let resolveSessionId: ((id: string) => void) | null = null;
+const sessionIdPromise = new Promise<string>((resolve) => {
+    resolveSessionId = resolve;
+});
+
+const subscription = trpcClient.serverState.serverState.subscribe(
+    {},
+    {
+        onData(message: TServerStateMessage) {
+            logger.debug('server-state message', message);
+
+            if (message.type === 'session-info') {
+                if (resolveSessionId) {
+                    resolveSessionId(message.session_id);
+                    resolveSessionId = null;
+                }
+            } else if (message.type === 'updates') {
+                for (const update of message.updates) {
+                    receivedUpdates.push(update);
+                }
+            }
+        },
+    },
+);
+
+(async () => {
+    try {
+        const sessionId = await withTimeout(sessionIdPromise, 5_000, 'server-state session id');
+
+        for (const appId of [KEPT_APP_ID, UNWATCHED_APP_ID]) {
+            await withTimeout(
+                trpcClient.serverState.watchKeys.mutate({
+                    appId,
+                    sessionId,
+                    keys: [TEST_KEY],
+                }),
+                5_000,
+                `server-state watchKeys mutation in ${appId}`,
+            );
+        }
+
+        const unwatchResult = await withTimeout(
+            trpcClient.serverState.unwatchKeys.mutate({
+                appId: UNWATCHED_APP_ID,
+                sessionId,
+                keys: [TEST_KEY],
+            }),
+            5_000,
+            'server-state unwatchKeys mutation',
+        );
+
+        logger.debug('unwatchKeys mutation result', unwatchResult);
+
+        if (unwatchResult.unwatched.length !== 1 || unwatchResult.unwatched[0] !== TEST_KEY) {
+            console.log(
+                JSON.stringify({
+                    passed: false,
+                    error: `expected "${TEST_KEY}" to be unwatched, got ${JSON.stringify(unwatchResult.unwatched)}`,
+                }),
+            );
+
+            return;
+        }
+
+        // discard the initial values pushed by watchKeys
+        receivedUpdates.length = 0;
+
+        const marker = `e2e-${Date.now()}`;
+        await withTimeout(
+            replaceServerStateValue(UNWATCHED_APP_ID, TEST_KEY, { marker }),
+            5_000,
+            'server-state value replace in the unwatched app',
+        );
+        await withTimeout(
+            replaceServerStateValue(KEPT_APP_ID, TEST_KEY, { marker }),
+            5_000,
+            'server-state value replace in the kept app',
+        );
+
+        // give a stray update enough time to arrive
+        await new Promise((r) => setTimeout(r, 1_000));
+
+        if (!receivedUpdates.some((u) => u.app_id === KEPT_APP_ID && u.key === TEST_KEY && u.value?.marker === marker)) {
+            console.log(JSON.stringify({ passed: false, error: 'no update for the key in the app still watching it' }));
+            return;
+        }
+
+        if (receivedUpdates.some((u) => u.app_id === UNWATCHED_APP_ID)) {
+            console.log(JSON.stringify({ passed: false, error: 'received update for the app the key was unwatched in' }));
+            return;
+        }
+
+        console.log(JSON.stringify({ passed: true }));
+    } catch (e) {
+        console.log(JSON.stringify({ passed: false, error: `${e}` }));
+    } finally {
+        try {
+            subscription.unsubscribe();
+        } catch {}
+
+        try {
+            await closeClient();
+        } catch {}
+    }
+})();
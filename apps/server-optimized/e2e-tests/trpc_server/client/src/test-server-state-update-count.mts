@@ -0,0 +1,89 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+import type { TServerStateMessage } from './common/types.mjs';
+
+const APP_ID = '_default';
+const KEY = `e2e-server-state-update-count-${Date.now()}`;
+const URL = `http://localhost:11002/${APP_ID}/server-state/${KEY}`;
+const WRITES = 20;
+
+const updates: Array<{ key: string; value: any; update_count?: number }> = [];
+
+let sessionId: string | undefined;
+
+const subscription = trpcClient.serverState.serverState.subscribe(
+    {},
+    {
+        onData(message: TServerStateMessage) {
+            logger.debug('server-state message', message);
+
+            if (message.type === 'session-info') {
+                sessionId = message.session_id;
+            } else if (message.type === 'updates') {
+                updates.push(...message.updates.filter((update) => update.key === KEY));
+            }
+        },
+    },
+);
+
+async function increment() {
+    const response = await fetch(URL, {
+        method: 'POST',
+        headers: { 'content-type': 'application/json' },
+        body: JSON.stringify({ $inc: { n: 1 } }),
+    });
+
+    if (!response.ok) {
+        throw new Error(`increment failed with ${response.status}`);
+    }
+}
+
+try {
+    await increment();
+
+    const deadline = Date.now() + 5_000;
+    while (!sessionId && Date.now() < deadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    if (!sessionId) {
+        throw new Error('timeout while waiting for session id');
+    }
+
+    // writes race the watch on purpose, to exercise the snapshot ordering
+    const writes = Array.from({ length: WRITES }, () => increment());
+    const watched = await trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId, keys: [KEY] });
+    await Promise.all(writes);
+
+    if (typeof watched[KEY].update_count !== 'number' || watched[KEY].value.n !== watched[KEY].update_count) {
+        throw new Error(`the watch result does not carry a matching update count: ${JSON.stringify(watched)}`);
+    }
+
+    const lastDeadline = Date.now() + 5_000;
+    while (updates.at(-1)?.update_count !== WRITES + 1 && Date.now() < lastDeadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    for (let i = 0; i < updates.length; i++) {
+        const update = updates[i];
+
+        if (typeof update.update_count !== 'number' || update.value.n !== update.update_count) {
+            throw new Error(`update without a matching update count: ${JSON.stringify(update)}`);
+        }
+
+        if (i > 0 && update.update_count <= updates[i - 1].update_count!) {
+            throw new Error(`stale or duplicate update delivered: ${JSON.stringify(updates.map((u) => u.update_count))}`);
+        }
+    }
+
+    if (updates.at(-1)?.update_count !== WRITES + 1) {
+        throw new Error(`did not end on the latest value: ${JSON.stringify(updates.map((u) => u.update_count))}`);
+    }
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    subscription.unsubscribe();
+    await closeClient();
+}
@@ -0,0 +1,68 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+import type { TServerStateMessage } from './common/types.mjs';
+
+const APP_ID = '_default';
+
+// the hook of the test server drops every watch of a key with "forbidden"
+const ALLOWED_KEY = 'e2e-webhooks-allowed';
+const FORBIDDEN_KEY = 'e2e-webhooks-forbidden';
+
+let sessionId: string | undefined;
+
+const subscription = trpcClient.serverState.serverState.subscribe(
+    {},
+    {
+        onData(message: TServerStateMessage) {
+            logger.debug('server-state message', message);
+
+            if (message.type === 'session-info') {
+                sessionId = message.session_id;
+            }
+        },
+    },
+);
+
+try {
+    const deadline = Date.now() + 5_000;
+    while (!sessionId && Date.now() < deadline) {
+        await new Promise((r) => setTimeout(r, 25));
+    }
+
+    if (!sessionId) {
+        throw new Error('timeout while waiting for session id');
+    }
+
+    await trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId, keys: [ALLOWED_KEY] });
+
+    let vetoed = false;
+    try {
+        await trpcClient.serverState.watchKeys.mutate({ appId: APP_ID, sessionId, keys: [FORBIDDEN_KEY] });
+    } catch (e) {
+        logger.debug('forbidden watch failed', e);
+        vetoed = `${e}`.includes('not for you');
+    }
+
+    if (!vetoed) {
+        throw new Error('the authorization hook did not drop the watch');
+    }
+
+    const response = await fetch(`http://localhost:11002/${APP_ID}/server-state/${ALLOWED_KEY}`, {
+        method: 'PUT',
+        headers: { 'content-type': 'application/json' },
+        body: JSON.stringify({ value: { hooked: true } }),
+    });
+
+    if (response.status !== 200) {
+        throw new Error(`write failed with ${response.status}`);
+    }
+
+    await trpcClient.serverState.unwatchKeys.mutate({ appId: APP_ID, sessionId, keys: [ALLOWED_KEY] });
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    subscription.unsubscribe();
+    await closeClient();
+}
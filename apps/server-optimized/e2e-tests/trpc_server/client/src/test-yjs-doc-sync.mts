@@ -0,0 +1,97 @@
+import { closeClient, trpcClient } from './common/client.mjs';
+import logger from './common/logger.mjs';
+import type { TYjsMessage } from './common/types.mjs';
+
+const DOCUMENT_ID = `e2e-yjs-doc-${Date.now()}`;
+
+// a v1 update in which client 1 inserts "abc" into the root type "text"
+const INSERT_ABC = Buffer.from([1, 1, 1, 0, 4, 1, 4, 116, 101, 120, 116, 3, 97, 98, 99, 0]).toString('base64');
+
+// an empty state vector (y-protocols sync step 1 of a fresh document)
+const EMPTY_STATE_VECTOR = Buffer.from([0]).toString('base64');
+
+async function waitFor(check: () => boolean, ms: number, label: string) {
+    const deadline = Date.now() + ms;
+
+    while (Date.now() < deadline) {
+        if (check()) {
+            return;
+        }
+
+        await new Promise((r) => setTimeout(r, 50));
+    }
+
+    throw new Error(`timeout (${ms}ms) while waiting for ${label}`);
+}
+
+function openDocument(label: string, messages: TYjsMessage[], sessionIds: string[]) {
+    return trpcClient.yjs.docUpdates.subscribe(
+        { documentId: DOCUMENT_ID },
+        {
+            async onData(message: TYjsMessage) {
+                logger.debug(`[${label}] yjs message`, message);
+                messages.push(message);
+
+                if (message.type === 'session-info') {
+                    sessionIds.push(message.session_id);
+
+                    await trpcClient.yjs.docInit.mutate({
+                        sessionId: message.session_id,
+                        stateVector: EMPTY_STATE_VECTOR,
+                    });
+                }
+            },
+        },
+    );
+}
+
+const writerMessages: TYjsMessage[] = [];
+const writerSessions: string[] = [];
+const readerMessages: TYjsMessage[] = [];
+const readerSessions: string[] = [];
+
+const writer = openDocument('writer', writerMessages, writerSessions);
+const liveReader = openDocument('reader', readerMessages, readerSessions);
+
+try {
+    await waitFor(
+        () => writerMessages.some((m) => m.type === 'sync') && readerMessages.some((m) => m.type === 'sync'),
+        5_000,
+        'initial sync',
+    );
+
+    await trpcClient.yjs.docUpdate.mutate({
+        sessionId: writerSessions[0],
+        encodedUpdates: [INSERT_ABC],
+    });
+
+    await waitFor(
+        () => readerMessages.some((m) => m.type === 'update' && m.updates.includes(INSERT_ABC)),
+        5_000,
+        'live update fan-out',
+    );
+
+    if (writerMessages.some((m) => m.type === 'update')) {
+        throw new Error('writer received its own update back');
+    }
+
+    // a late joiner must receive the stored update through sync step 2
+    const lateMessages: TYjsMessage[] = [];
+    const lateReader = openDocument('late', lateMessages, []);
+
+    await waitFor(
+        () => lateMessages.some((m) => m.type === 'sync' && m.update === INSERT_ABC),
+        5_000,
+        'late joiner sync',
+    );
+
+    lateReader.unsubscribe();
+    liveReader.unsubscribe();
+    writer.unsubscribe();
+
+    console.log(JSON.stringify({ passed: true }));
+} catch (e) {
+    console.log(JSON.stringify({ passed: false, error: `${e}` }));
+} finally {
+    await closeClient();
+}
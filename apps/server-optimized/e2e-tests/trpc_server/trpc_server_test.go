@@ -2,13 +2,22 @@ package trpc_server
 
 import (
 	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os/exec"
 	"server-optimized/boot"
+	"server-optimized/services"
+	"server-optimized/services/webhooks"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/bytedance/sonic"
 	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
 )
 
 func init() {
@@ -62,3 +71,227 @@ func TestTRPCServerServerStateWatchKeys(t *testing.T) {
 	runNodeClientTest(t, t.Context(), "test-server-state-watch-keys.mts")
 }
 
+func TestTRPCServerServerStateUnwatchKeys(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-server-state-unwatch-keys.mts")
+}
+
+func TestTRPCServerServerStateUnwatchApps(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-server-state-unwatch-apps.mts")
+}
+
+func TestTRPCServerPresence(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-presence.mts")
+}
+
+func TestTRPCServerYjsDocSync(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-yjs-doc-sync.mts")
+}
+
+func TestTRPCServerAuth(t *testing.T) {
+	viper.Set("auth.appSecrets", map[string]string{
+		"e2e-auth-app": "e2e-auth-secret",
+	})
+	t.Cleanup(func() {
+		viper.Set("auth.appSecrets", map[string]string{})
+	})
+
+	runNodeClientTest(t, t.Context(), "test-auth.mts")
+}
+
+func TestTRPCServerServerStateClientWrites(t *testing.T) {
+	viper.Set("auth.appSecrets", map[string]string{
+		"e2e-client-writes-app": "e2e-client-writes-secret",
+	})
+	t.Cleanup(func() {
+		viper.Set("auth.appSecrets", map[string]string{})
+	})
+
+	runNodeClientTest(t, t.Context(), "test-server-state-client-writes.mts")
+}
+
+func TestTRPCServerAdminAuth(t *testing.T) {
+	viper.Set("admin.appKeys", map[string]string{
+		"e2e-admin-auth-app":  "e2e-admin-app-key",
+		"e2e-admin-other-app": "e2e-admin-other-app-key",
+	})
+	t.Cleanup(func() {
+		viper.Set("admin.appKeys", map[string]string{})
+	})
+
+	runNodeClientTest(t, t.Context(), "test-admin-auth.mts")
+}
+
+func TestTRPCServerAdminRead(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-admin-read.mts")
+}
+
+func TestTRPCServerAdminCompareAndSwap(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-admin-cas.mts")
+}
+
+func TestTRPCServerAdminTransaction(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-admin-transaction.mts")
+}
+
+func TestTRPCServerAdminAtomicOps(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-admin-atomic-ops.mts")
+}
+
+func TestTRPCServerAdminAtomicPaths(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-admin-atomic-paths.mts")
+}
+
+func TestTRPCServerAdminPatch(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-admin-patch.mts")
+}
+
+func TestTRPCServerAdminVersions(t *testing.T) {
+	viper.Set("serverState.history.maxVersions", 3)
+	t.Cleanup(func() {
+		viper.Set("serverState.history.maxVersions", 0)
+	})
+
+	runNodeClientTest(t, t.Context(), "test-admin-versions.mts")
+}
+
+func TestTRPCServerAdminChangeFeed(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-admin-change-feed.mts")
+}
+
+func TestTRPCServerWebhooks(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+
+	// records every event, and as the authorization hook drops the
+	// watches of forbidden keys
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if r.Header.Get(webhooks.SignatureHeader) != webhooks.Sign("e2e-webhooks-secret", r.Header.Get(webhooks.TimestampHeader), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path == "/authorize" {
+			if strings.Contains(string(body), "forbidden") {
+				io.WriteString(w, `{"drop":true,"reason":"not for you"}`)
+			}
+			return
+		}
+
+		mu.Lock()
+		events = append(events, r.Header.Get(webhooks.EventHeader))
+		mu.Unlock()
+	}))
+	defer endpoint.Close()
+
+	viper.Set("webhooks.apps", map[string]interface{}{
+		"_default": []map[string]interface{}{
+			{"url": endpoint.URL + "/events", "secret": "e2e-webhooks-secret"},
+			{"url": endpoint.URL + "/authorize", "secret": "e2e-webhooks-secret", "authorize": true, "events": []string{webhooks.EventClientSubscribed}},
+		},
+	})
+	t.Cleanup(func() {
+		viper.Set("webhooks.apps", map[string]interface{}{})
+	})
+
+	runNodeClientTest(t, t.Context(), "test-webhooks.mts")
+
+	expected := []string{
+		webhooks.EventClientConnected,
+		webhooks.EventClientSubscribed,
+		webhooks.EventServerStateChanged,
+		webhooks.EventClientUnsubscribed,
+		webhooks.EventClientDisconnected,
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := append([]string(nil), events...)
+		mu.Unlock()
+
+		missing := slices.DeleteFunc(slices.Clone(expected), func(event string) bool {
+			return slices.Contains(got, event)
+		})
+
+		if len(missing) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("missing webhook events %v, got %v", missing, got)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTRPCServerServerStateDeltas(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-server-state-deltas.mts")
+}
+
+func TestTRPCServerServerStateUpdateCount(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-server-state-update-count.mts")
+}
+
+func TestTRPCServerServerStateTTL(t *testing.T) {
+	viper.Set("serverState.expirySweepInterval", 100*time.Millisecond)
+	t.Cleanup(func() {
+		viper.Set("serverState.expirySweepInterval", time.Second)
+	})
+
+	runNodeClientTest(t, t.Context(), "test-server-state-ttl.mts")
+}
+
+func TestTRPCServerServerStateResume(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-server-state-resume.mts")
+}
+
+func TestTRPCServerServerStateSessionRouting(t *testing.T) {
+	// a second node, sharing NATS and KV but not the sessions of the first,
+	// for the client to send its mutations to
+	viper.Set("port", 11003)
+	t.Cleanup(func() {
+		viper.Set("port", 11001)
+	})
+
+	peerServices, err := services.CreateServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := boot.ServicePlane(t.Context(), peerServices); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1 * time.Second)
+	viper.Set("port", 11001)
+
+	runNodeClientTest(t, t.Context(), "test-server-state-session-routing.mts")
+}
+
+func TestTRPCServerServerStateFanout(t *testing.T) {
+	runNodeClientTest(t, t.Context(), "test-server-state-fanout.mts")
+}
+
+func TestTRPCServerStandalone(t *testing.T) {
+	// the same flow on the in-process pub/sub and store of --standalone
+	viper.Set("standalone.enabled", true)
+	t.Cleanup(func() {
+		viper.Set("standalone.enabled", false)
+	})
+
+	runNodeClientTest(t, t.Context(), "test-server-state-update-count.mts")
+}
+
+func TestTRPCServerJetStreamStore(t *testing.T) {
+	viper.Set("kv.backend", "jetstream")
+	t.Cleanup(func() {
+		viper.Set("kv.backend", "kvrocks")
+	})
+
+	runNodeClientTest(t, t.Context(), "test-jetstream-store.mts")
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"server-optimized/lib/config"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RootKeyID is the key id that signed requests use to refer to the root key.
+const RootKeyID = "_root"
+
+var (
+	ErrInvalidAdminKey       = errors.New("invalid admin key")
+	ErrInvalidSignature      = errors.New("invalid request signature")
+	ErrSignatureOutsideRange = errors.New("request timestamp is outside the allowed range")
+)
+
+// AdminCredentials holds the keys accepted by the admin plane: a root key
+// that is valid for every app, and secret keys scoped to a single app.
+type AdminCredentials struct {
+	rootKey            string
+	appKeys            map[string]string
+	signatureTolerance time.Duration
+}
+
+// AdminPrincipalLocal is the fiber local the admin plane keeps the
+// *AdminPrincipal of a request in.
+const AdminPrincipalLocal = "adminPrincipal"
+
+// AdminPrincipal is who an admin request authenticated as.
+type AdminPrincipal struct {
+	Root  bool
+	AppID string
+}
+
+// SignedRequest is everything an HMAC signature covers, plus the claimed key
+// id, timestamp (unix seconds) and hex encoded signature.
+type SignedRequest struct {
+	KeyID     string
+	Timestamp string
+	Signature string
+	Method    string
+	URI       string
+	Body      []byte
+}
+
+func NewAdminCredentials(rootKey string, appKeys map[string]string, signatureTolerance time.Duration) *AdminCredentials {
+	if appKeys == nil {
+		appKeys = make(map[string]string)
+	}
+
+	return &AdminCredentials{
+		rootKey:            rootKey,
+		appKeys:            appKeys,
+		signatureTolerance: signatureTolerance,
+	}
+}
+
+// NewAdminCredentialsFromConfig builds the credentials from the `admin.*`
+// config keys.
+func NewAdminCredentialsFromConfig() *AdminCredentials {
+	return NewAdminCredentials(
+		viper.GetString("admin.rootKey"),
+		config.StringMapString("admin.appKeys"),
+		viper.GetDuration("admin.signatureTolerance"),
+	)
+}
+
+// Enabled reports whether any key is configured at all; without one the admin
+// plane stays open, as it was before credentials existed.
+func (a *AdminCredentials) Enabled() bool {
+	return a.rootKey != "" || len(a.appKeys) > 0
+}
+
+func (a *AdminCredentials) SignatureTolerance() time.Duration {
+	return a.signatureTolerance
+}
+
+func (p *AdminPrincipal) AllowsApp(appID string) bool {
+	return p.Root || p.AppID == appID
+}
+
+// Actor names the principal in the change feed: admin:root, admin:<app> for
+// an app key, or just admin when no keys are configured (a nil principal).
+func (p *AdminPrincipal) Actor() string {
+	switch {
+	case p == nil:
+		return "admin"
+	case p.Root:
+		return "admin:root"
+	default:
+		return "admin:" + p.AppID
+	}
+}
+
+// AuthenticateBearer matches a bearer key against the root key and the app
+// keys.
+func (a *AdminCredentials) AuthenticateBearer(key string) (*AdminPrincipal, error) {
+	if key == "" {
+		return nil, ErrInvalidAdminKey
+	}
+
+	if a.rootKey != "" && secureEqual(key, a.rootKey) {
+		return &AdminPrincipal{Root: true}, nil
+	}
+
+	for appID, appKey := range a.appKeys {
+		if appKey != "" && secureEqual(key, appKey) {
+			return &AdminPrincipal{AppID: appID}, nil
+		}
+	}
+
+	return nil, ErrInvalidAdminKey
+}
+
+// AuthenticateSignature checks an HMAC signed request. Replays within the
+// tolerance window are not detected here; the caller has to remember the
+// signatures it has seen for at least SignatureTolerance.
+func (a *AdminCredentials) AuthenticateSignature(request *SignedRequest, now time.Time) (*AdminPrincipal, error) {
+	var (
+		secret    string
+		principal *AdminPrincipal
+	)
+
+	if request.KeyID == RootKeyID {
+		secret = a.rootKey
+		principal = &AdminPrincipal{Root: true}
+	} else {
+		secret = a.appKeys[request.KeyID]
+		principal = &AdminPrincipal{AppID: request.KeyID}
+	}
+
+	if secret == "" {
+		return nil, ErrInvalidAdminKey
+	}
+
+	timestamp, err := strconv.ParseInt(request.Timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew < -a.signatureTolerance || skew > a.signatureTolerance {
+		return nil, ErrSignatureOutsideRange
+	}
+
+	expected := SignAdminRequest(secret, request.Method, request.URI, request.Timestamp, request.Body)
+
+	if !secureEqual(strings.ToLower(request.Signature), expected) {
+		return nil, ErrInvalidSignature
+	}
+
+	return principal, nil
+}
+
+// SignAdminRequest returns the hex encoded HMAC-SHA256 of
+//
+//	METHOD \n URI \n TIMESTAMP \n hex(sha256(BODY))
+//
+// which is what clients send in the signature header.
+func SignAdminRequest(secret string, method string, uri string, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.ToUpper(method)))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(uri))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(hex.EncodeToString(bodyHash[:])))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestNewAdminCredentialsFromConfigKeepsAppIDCase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "airstate.yaml")
+	if err := os.WriteFile(path, []byte("admin:\n  appKeys:\n    MyApp: k3y\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.SetConfigFile(path)
+	t.Cleanup(viper.Reset)
+
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := NewAdminCredentialsFromConfig()
+
+	principal, err := credentials.AuthenticateBearer("k3y")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !principal.AllowsApp("MyApp") || principal.AllowsApp("myapp") {
+		t.Fatalf("the key of MyApp authenticated as %q", principal.AppID)
+	}
+}
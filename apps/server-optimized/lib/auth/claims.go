@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims is the payload of a client token. The `data` object mirrors
+// server-rapid's token payload, with an added `serverState` section.
+type Claims struct {
+	AppID string     `json:"appId"`
+	Data  ClaimsData `json:"data"`
+
+	jwt.RegisteredClaims
+}
+
+type ClaimsData struct {
+	ServerState *ServerStateClaims `json:"serverState,omitempty"`
+	Presence    *PresenceClaims    `json:"presence,omitempty"`
+	Yjs         *YjsClaims         `json:"yjs,omitempty"`
+}
+
+type ServerStateClaims struct {
+	// Read holds key patterns, where `*` matches any run of characters and
+	// `?` matches exactly one; a missing list means every key is readable
+	Read []string `json:"read,omitempty"`
+
+	// Write holds the rules for writes from the client; without any, the
+	// client can not write at all
+	Write []ServerStateWriteRule `json:"write,omitempty"`
+}
+
+// ServerStateWriteRule lets the client write the keys matching Keys (the same
+// patterns as Read) with the Ops it lists: set, merge or atomic, all three
+// when missing. MaxValueSize caps the encoded value or operations in bytes;
+// 0 leaves only the server-wide cap.
+type ServerStateWriteRule struct {
+	Keys         []string `json:"keys"`
+	Ops          []string `json:"ops,omitempty"`
+	MaxValueSize int      `json:"maxValueSize,omitempty"`
+}
+
+type PresenceClaims struct {
+	Permissions *PresencePermissions `json:"permissions,omitempty"`
+	PeerID      string               `json:"peerId,omitempty"`
+	Meta        map[string]any       `json:"meta,omitempty"`
+}
+
+type PresencePermissions struct {
+	Join        *bool `json:"join,omitempty"`
+	UpdateState *bool `json:"update_state,omitempty"`
+}
+
+type YjsClaims struct {
+	Permissions *YjsPermissions `json:"permissions,omitempty"`
+}
+
+type YjsPermissions struct {
+	Read  *bool `json:"read,omitempty"`
+	Write *bool `json:"write,omitempty"`
+}
+
+// Identity is what a connection authenticated as. An anonymous identity has
+// no claims and is only produced when tokens are not required.
+type Identity struct {
+	Claims *Claims
+
+	verifier *Verifier
+}
+
+func (i *Identity) IsAnonymous() bool {
+	return i == nil || i.Claims == nil
+}
+
+// Actor names the identity in the change feed: client:<sub> for a token, or
+// client:anonymous.
+func (i *Identity) Actor() string {
+	if i.IsAnonymous() || i.Claims.Subject == "" {
+		return "client:anonymous"
+	}
+
+	return "client:" + i.Claims.Subject
+}
+
+// AppID is the app of the token, empty for an anonymous identity.
+func (i *Identity) AppID() string {
+	if i.IsAnonymous() {
+		return ""
+	}
+
+	return i.Claims.AppID
+}
+
+// AllowsApp reports whether the identity may touch anything under appID.
+func (i *Identity) AllowsApp(appID string) bool {
+	if i.IsAnonymous() {
+		return i == nil || i.verifier == nil || i.verifier.AllowsAnonymous(appID)
+	}
+
+	return i.Claims.AppID == appID
+}
+
+func (i *Identity) CanReadServerStateKey(key string) bool {
+	if i.IsAnonymous() || i.Claims.Data.ServerState == nil || i.Claims.Data.ServerState.Read == nil {
+		return true
+	}
+
+	for _, pattern := range i.Claims.Data.ServerState.Read {
+		if matchKeyPattern(pattern, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServerStateWriteLimit reports whether the identity may write key with op,
+// and the largest value it may write (0 when only the server-wide cap
+// applies). Unlike reads, writes need a token that grants them.
+func (i *Identity) ServerStateWriteLimit(key string, op string) (bool, int) {
+	if i.IsAnonymous() || i.Claims.Data.ServerState == nil {
+		return false, 0
+	}
+
+	allowed, maxValueSize := false, 0
+
+	for _, rule := range i.Claims.Data.ServerState.Write {
+		if !rule.allowsOp(op) || !rule.matches(key) {
+			continue
+		}
+
+		// the most generous of the matching rules wins
+		if !allowed || rule.MaxValueSize == 0 || (maxValueSize != 0 && rule.MaxValueSize > maxValueSize) {
+			maxValueSize = rule.MaxValueSize
+		}
+
+		allowed = true
+	}
+
+	return allowed, maxValueSize
+}
+
+func (r *ServerStateWriteRule) allowsOp(op string) bool {
+	if r.Ops == nil {
+		return true
+	}
+
+	for _, allowed := range r.Ops {
+		if allowed == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *ServerStateWriteRule) matches(key string) bool {
+	for _, pattern := range r.Keys {
+		if matchKeyPattern(pattern, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (i *Identity) CanJoinPresence() bool {
+	if i.IsAnonymous() || i.Claims.Data.Presence == nil || i.Claims.Data.Presence.Permissions == nil {
+		return true
+	}
+
+	return allowedByDefault(i.Claims.Data.Presence.Permissions.Join)
+}
+
+func (i *Identity) CanUpdatePresenceState() bool {
+	if i.IsAnonymous() || i.Claims.Data.Presence == nil || i.Claims.Data.Presence.Permissions == nil {
+		return true
+	}
+
+	return allowedByDefault(i.Claims.Data.Presence.Permissions.UpdateState)
+}
+
+// PresencePeerID is the peer id the token pins the connection to, if any.
+func (i *Identity) PresencePeerID() string {
+	if i.IsAnonymous() || i.Claims.Data.Presence == nil {
+		return ""
+	}
+
+	return i.Claims.Data.Presence.PeerID
+}
+
+// PresenceMeta is the peer meta issued by the token; it takes precedence over
+// whatever the client sends.
+func (i *Identity) PresenceMeta() map[string]any {
+	if i.IsAnonymous() || i.Claims.Data.Presence == nil {
+		return nil
+	}
+
+	return i.Claims.Data.Presence.Meta
+}
+
+func (i *Identity) CanReadYjs() bool {
+	if i.IsAnonymous() || i.Claims.Data.Yjs == nil || i.Claims.Data.Yjs.Permissions == nil {
+		return true
+	}
+
+	return allowedByDefault(i.Claims.Data.Yjs.Permissions.Read)
+}
+
+func (i *Identity) CanWriteYjs() bool {
+	if i.IsAnonymous() || i.Claims.Data.Yjs == nil || i.Claims.Data.Yjs.Permissions == nil {
+		return true
+	}
+
+	return allowedByDefault(i.Claims.Data.Yjs.Permissions.Write)
+}
+
+func allowedByDefault(permission *bool) bool {
+	return permission == nil || *permission
+}
+
+// matchKeyPattern is a glob match without path.Match's special treatment of
+// `/`, since server-state keys are free-form.
+func matchKeyPattern(pattern string, key string) bool {
+	p, k := 0, 0
+	starP, starK := -1, 0
+
+	for k < len(key) {
+		if p < len(pattern) && (pattern[p] == '?' || pattern[p] == key[k]) {
+			p++
+			k++
+		} else if p < len(pattern) && pattern[p] == '*' {
+			starP = p
+			starK = k
+			p++
+		} else if starP != -1 {
+			p = starP + 1
+			starK++
+			k = starK
+		} else {
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
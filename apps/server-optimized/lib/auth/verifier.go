@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"server-optimized/lib/config"
+
+	"github.com/bytedance/sonic"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrTokenRequired = errors.New("a token is required")
+	ErrUnknownApp    = errors.New("no signing secret is configured for the token's app")
+	ErrUnknownKey    = errors.New("no matching key in the jwks file")
+)
+
+type VerifierOptions struct {
+	// Required rejects connections that do not present a token at all
+	Required bool
+
+	// AppSecrets maps an app id to its HS256 signing secret
+	AppSecrets map[string]string
+
+	// JWKSFile is a local JSON Web Key Set holding the RS256 public keys
+	JWKSFile string
+}
+
+type Verifier struct {
+	required   bool
+	appSecrets map[string]string
+	rsaKeys    map[string]*rsa.PublicKey
+
+	// jwks is set when a JWKS file is configured, which holds the keys of
+	// every app
+	jwks bool
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func NewVerifier(options *VerifierOptions) (*Verifier, error) {
+	verifier := &Verifier{
+		required:   options.Required,
+		appSecrets: options.AppSecrets,
+		rsaKeys:    make(map[string]*rsa.PublicKey),
+		jwks:       options.JWKSFile != "",
+	}
+
+	if verifier.appSecrets == nil {
+		verifier.appSecrets = make(map[string]string)
+	}
+
+	if options.JWKSFile != "" {
+		if err := verifier.loadJWKS(options.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return verifier, nil
+}
+
+// NewVerifierFromConfig builds a verifier from the `auth.*` config keys. App
+// IDs are case-sensitive, as everywhere else.
+func NewVerifierFromConfig() (*Verifier, error) {
+	return NewVerifier(&VerifierOptions{
+		Required:   viper.GetBool("auth.required"),
+		AppSecrets: config.StringMapString("auth.appSecrets"),
+		JWKSFile:   viper.GetString("auth.jwksFile"),
+	})
+}
+
+func (v *Verifier) loadJWKS(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read jwks file: %w", err)
+	}
+
+	var keySet jsonWebKeySet
+	if err := sonic.Unmarshal(raw, &keySet); err != nil {
+		return fmt.Errorf("failed to parse jwks file: %w", err)
+	}
+
+	for _, key := range keySet.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") || (key.Alg != "" && key.Alg != "RS256") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return fmt.Errorf("invalid modulus for key %q: %w", key.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return fmt.Errorf("invalid exponent for key %q: %w", key.Kid, err)
+		}
+
+		v.rsaKeys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return nil
+}
+
+// AllowsAnonymous reports whether a connection without a token may use appID.
+// Once tokens can be verified for an app, with its signing secret or the
+// keys of a JWKS file, its data is only reachable with a token.
+func (v *Verifier) AllowsAnonymous(appID string) bool {
+	if v.required || v.jwks {
+		return false
+	}
+
+	_, hasSecret := v.appSecrets[appID]
+	return !hasSecret
+}
+
+// Authenticate verifies the token and returns the identity it carries. An
+// empty token yields an anonymous identity unless tokens are required.
+func (v *Verifier) Authenticate(token string) (*Identity, error) {
+	if token == "" {
+		if v.required {
+			return nil, ErrTokenRequired
+		}
+
+		return &Identity{verifier: v}, nil
+	}
+
+	claims := &Claims{}
+
+	_, err := jwt.ParseWithClaims(token, claims, v.keyFunc, jwt.WithValidMethods([]string{
+		jwt.SigningMethodHS256.Alg(),
+		jwt.SigningMethodRS256.Alg(),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.AppID == "" {
+		return nil, errors.New("token is missing the appId claim")
+	}
+
+	return &Identity{Claims: claims, verifier: v}, nil
+}
+
+func (v *Verifier) keyFunc(token *jwt.Token) (any, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		claims, ok := token.Claims.(*Claims)
+		if !ok {
+			return nil, errors.New("unexpected claims type")
+		}
+
+		secret, ok := v.appSecrets[claims.AppID]
+		if !ok || secret == "" {
+			return nil, ErrUnknownApp
+		}
+
+		return []byte(secret), nil
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := token.Header["kid"].(string)
+
+		if key, ok := v.rsaKeys[kid]; ok {
+			return key, nil
+		}
+
+		// a token without a kid is fine as long as there is only one key
+		if kid == "" && len(v.rsaKeys) == 1 {
+			for _, key := range v.rsaKeys {
+				return key, nil
+			}
+		}
+
+		return nil, ErrUnknownKey
+	}
+
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bytedance/sonic"
+	"github.com/spf13/viper"
+)
+
+// writeJWKS writes a key set with one fresh RS256 key and returns its path.
+func writeJWKS(t *testing.T) string {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := sonic.Marshal(&jsonWebKeySet{Keys: []jsonWebKey{{
+		Kty: "RSA",
+		Kid: "test",
+		Alg: "RS256",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestAllowsAnonymous(t *testing.T) {
+	jwksFile := writeJWKS(t)
+
+	for _, test := range []struct {
+		name     string
+		options  VerifierOptions
+		appID    string
+		expected bool
+	}{
+		{"no verifier", VerifierOptions{}, "app", true},
+		{"tokens required", VerifierOptions{Required: true}, "app", false},
+		{"secret for the app", VerifierOptions{AppSecrets: map[string]string{"app": "s3cret"}}, "app", false},
+		{"secret for another app", VerifierOptions{AppSecrets: map[string]string{"other": "s3cret"}}, "app", true},
+		{"jwks", VerifierOptions{JWKSFile: jwksFile}, "app", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			verifier, err := NewVerifier(&test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if allowed := verifier.AllowsAnonymous(test.appID); allowed != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, allowed)
+			}
+
+			identity, err := verifier.Authenticate("")
+			if test.options.Required {
+				if err != ErrTokenRequired {
+					t.Fatalf("expected ErrTokenRequired, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if identity.AllowsApp(test.appID) != test.expected {
+				t.Fatalf("an anonymous identity disagrees with the verifier for %s", test.appID)
+			}
+		})
+	}
+}
+
+func TestNewVerifierFromConfigKeepsAppIDCase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "airstate.yaml")
+	if err := os.WriteFile(path, []byte("auth:\n  appSecrets:\n    MyApp: s3cret\n    lower: s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.SetConfigFile(path)
+	t.Cleanup(viper.Reset)
+
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewVerifierFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verifier.AllowsAnonymous("MyApp") || verifier.AllowsAnonymous("lower") {
+		t.Fatal("an app with a secret allows anonymous access")
+	}
+
+	if !verifier.AllowsAnonymous("myapp") {
+		t.Fatal("the secret of MyApp applies to myapp")
+	}
+
+	if _, ok := verifier.appSecrets["MyApp"]; !ok {
+		t.Fatalf("unexpected app secrets %v", verifier.appSecrets)
+	}
+}
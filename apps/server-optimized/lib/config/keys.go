@@ -0,0 +1,89 @@
+// Package config reads what viper cannot: it lowercases every key of the
+// config file, while the maps configured per app are keyed by app IDs, which
+// are case-sensitive.
+package config
+
+import (
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
+)
+
+// StringMapString is viper.GetStringMapString keyed by the app IDs as the
+// config file spells them.
+func StringMapString(path string) map[string]string {
+	return RestoreKeyCase(path, viper.GetStringMapString(path))
+}
+
+// RestoreKeyCase gives the keys of values, the map at path as viper read it,
+// back the case they have in the config file. Keys the file does not have,
+// such as those set through viper.Set, are left as they are.
+func RestoreKeyCase[V any](path string, values map[string]V) map[string]V {
+	restored := make(map[string]V, len(values))
+	for key, value := range values {
+		restored[key] = value
+	}
+
+	for _, key := range fileKeys(path) {
+		lower := strings.ToLower(key)
+		if lower == key {
+			continue
+		}
+
+		if value, ok := values[lower]; ok {
+			delete(restored, lower)
+			restored[key] = value
+		}
+	}
+
+	return restored
+}
+
+// fileKeys returns the keys of the map at path in the config file viper read,
+// if any. Like viper, it matches the parts of path regardless of case.
+func fileKeys(path string) []string {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	// JSON is YAML as well
+	var node any
+	if err := yaml.Unmarshal(raw, &node); err != nil {
+		return nil
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		parent, ok := node.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		node = nil
+		for key, value := range parent {
+			if strings.EqualFold(key, part) {
+				node = value
+				break
+			}
+		}
+	}
+
+	children, ok := node.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	keys := make([]string, 0, len(children))
+	for key := range children {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
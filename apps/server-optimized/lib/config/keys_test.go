@@ -0,0 +1,46 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestRestoreKeyCase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "airstate.yaml")
+	contents := "Webhooks:\n  apps:\n    MyApp:\n      - url: http://localhost/a\n    lower:\n      - url: http://localhost/b\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.SetConfigFile(path)
+	t.Cleanup(viper.Reset)
+
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	type endpoint struct {
+		URL string `mapstructure:"url"`
+	}
+
+	var apps map[string][]endpoint
+	if err := viper.UnmarshalKey("webhooks.apps", &apps); err != nil {
+		t.Fatal(err)
+	}
+
+	apps = RestoreKeyCase("webhooks.apps", apps)
+
+	if len(apps) != 2 || len(apps["MyApp"]) != 1 || apps["MyApp"][0].URL != "http://localhost/a" || len(apps["lower"]) != 1 {
+		t.Fatalf("unexpected apps %v", apps)
+	}
+
+	// set outside the file, a key keeps its case anyway
+	viper.Set("auth.appSecrets", map[string]string{"OtherApp": "s3cret"})
+
+	if secrets := StringMapString("auth.appSecrets"); secrets["OtherApp"] != "s3cret" {
+		t.Fatalf("unexpected secrets %v", secrets)
+	}
+}
@@ -0,0 +1,121 @@
+package jsonpatch
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bytedance/sonic"
+)
+
+// Operation is one RFC 6902 operation. Diff only ever produces add, remove
+// and replace.
+type Operation struct {
+	Op    string
+	Path  string
+	Value any
+}
+
+func (o Operation) MarshalJSON() ([]byte, error) {
+	if o.Op == "remove" {
+		return sonic.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{o.Op, o.Path})
+	}
+
+	return sonic.Marshal(struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value any    `json:"value"`
+	}{o.Op, o.Path, o.Value})
+}
+
+// Diff returns a patch that turns from into to. Both are expected to be
+// decoded JSON (maps, slices and scalars, as encoding/json produces them).
+// Objects are compared member by member and arrays index by index, with
+// elements added or removed at the end; anything else that differs is
+// replaced outright.
+func Diff(from any, to any) []Operation {
+	return diff([]Operation{}, "", from, to)
+}
+
+// Replace is the patch for a value that changed as a whole, e.g. a deleted key.
+func Replace(value any) []Operation {
+	return []Operation{{Op: "replace", Path: "", Value: value}}
+}
+
+func diff(patch []Operation, path string, from any, to any) []Operation {
+	switch fromValue := from.(type) {
+	case map[string]any:
+		if toValue, ok := to.(map[string]any); ok {
+			return diffObjects(patch, path, fromValue, toValue)
+		}
+	case []any:
+		if toValue, ok := to.([]any); ok {
+			return diffArrays(patch, path, fromValue, toValue)
+		}
+	}
+
+	if reflect.DeepEqual(from, to) {
+		return patch
+	}
+
+	return append(patch, Operation{Op: "replace", Path: path, Value: to})
+}
+
+func diffObjects(patch []Operation, path string, from map[string]any, to map[string]any) []Operation {
+	keys := make([]string, 0, len(from)+len(to))
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	// sorted for a stable patch, which keeps deltas comparable across runs
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		childPath := path + "/" + escapeToken(key)
+		fromValue, inFrom := from[key]
+		toValue, inTo := to[key]
+
+		switch {
+		case !inTo:
+			patch = append(patch, Operation{Op: "remove", Path: childPath})
+		case !inFrom:
+			patch = append(patch, Operation{Op: "add", Path: childPath, Value: toValue})
+		default:
+			patch = diff(patch, childPath, fromValue, toValue)
+		}
+	}
+
+	return patch
+}
+
+func diffArrays(patch []Operation, path string, from []any, to []any) []Operation {
+	common := min(len(from), len(to))
+
+	for i := 0; i < common; i++ {
+		patch = diff(patch, path+"/"+strconv.Itoa(i), from[i], to[i])
+	}
+
+	// removing from the back keeps the earlier indexes valid
+	for i := len(from) - 1; i >= common; i-- {
+		patch = append(patch, Operation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+	}
+
+	for i := common; i < len(to); i++ {
+		patch = append(patch, Operation{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: to[i]})
+	}
+
+	return patch
+}
+
+func escapeToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
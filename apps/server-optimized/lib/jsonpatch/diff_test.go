@@ -0,0 +1,57 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func decode(t *testing.T, raw string) any {
+	t.Helper()
+
+	var value any
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func assertPatch(t *testing.T, from string, to string, expected string) {
+	t.Helper()
+
+	patch, err := json.Marshal(Diff(decode(t, from), decode(t, to)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(patch) != expected {
+		t.Fatalf("diff of %s and %s:\n got  %s\n want %s", from, to, patch, expected)
+	}
+}
+
+func TestDiffEqual(t *testing.T) {
+	assertPatch(t, `{"a":[1,{"b":null}]}`, `{"a":[1,{"b":null}]}`, `[]`)
+}
+
+func TestDiffObjects(t *testing.T) {
+	assertPatch(t,
+		`{"keep":1,"change":{"deep":1,"gone":true},"drop":"x"}`,
+		`{"keep":1,"change":{"deep":2},"new":null}`,
+		`[{"op":"replace","path":"/change/deep","value":2},{"op":"remove","path":"/change/gone"},{"op":"remove","path":"/drop"},{"op":"add","path":"/new","value":null}]`,
+	)
+}
+
+func TestDiffArrays(t *testing.T) {
+	assertPatch(t, `[1,2,3,4]`, `[1,5]`, `[{"op":"replace","path":"/1","value":5},{"op":"remove","path":"/3"},{"op":"remove","path":"/2"}]`)
+	assertPatch(t, `[1]`, `[1,[2],3]`, `[{"op":"add","path":"/1","value":[2]},{"op":"add","path":"/2","value":3}]`)
+}
+
+func TestDiffTypeChanges(t *testing.T) {
+	assertPatch(t, `{"a":[1]}`, `{"a":{"0":1}}`, `[{"op":"replace","path":"/a","value":{"0":1}}]`)
+	assertPatch(t, `{"a":1}`, `null`, `[{"op":"replace","path":"","value":null}]`)
+	assertPatch(t, `null`, `"x"`, `[{"op":"replace","path":"","value":"x"}]`)
+}
+
+func TestDiffEscapesTokens(t *testing.T) {
+	assertPatch(t, `{}`, `{"a/b~c":1}`, `[{"op":"add","path":"/a~1b~0c","value":1}]`)
+}
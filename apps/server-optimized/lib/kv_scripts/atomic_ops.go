@@ -0,0 +1,44 @@
+package kv_scripts
+
+// AtomicOps maps field paths to operands. Paths use dot notation with
+// array indexes (`items.0.qty`, `items[-1]`, `a\\.b` for a literal dot) or a
+// JSON Pointer (`/items/0/qty`); see parse_path in operations.lua.
+type AtomicOps struct {
+	Set    map[string]interface{} `json:"$set,omitempty"`
+	Unset  []string               `json:"$unset,omitempty"`
+	Rename map[string]string      `json:"$rename,omitempty"`
+	Inc    map[string]float64     `json:"$inc,omitempty"`
+	Mul    map[string]float64     `json:"$mul,omitempty"`
+	Min    map[string]interface{} `json:"$min,omitempty"`
+	Max    map[string]interface{} `json:"$max,omitempty"`
+	Concat map[string]interface{} `json:"$concat,omitempty"`
+
+	// Push takes a single value, or {"$each": [...], "$position": n, "$slice": n}
+	Push map[string]interface{} `json:"$push,omitempty"`
+
+	// AddToSet takes a single value, or {"$each": [...]}
+	AddToSet map[string]interface{} `json:"$addToSet,omitempty"`
+
+	// Pull removes elements equal to the value; an object value removes every
+	// object element that has the same values for the given fields
+	Pull map[string]interface{} `json:"$pull,omitempty"`
+
+	// Pop removes the last (1) or the first (-1) element
+	Pop map[string]int `json:"$pop,omitempty"`
+}
+
+func (r *AtomicOps) IsEmpty() bool {
+	return r.Set == nil && r.Unset == nil && r.Rename == nil && r.Inc == nil && r.Mul == nil &&
+		r.Min == nil && r.Max == nil && r.Concat == nil && r.Push == nil && r.AddToSet == nil &&
+		r.Pull == nil && r.Pop == nil
+}
+
+// AtomicOpsResult is what atomic_ops.lua returns, JSON encoded. Value is
+// the new value, an object or an array.
+type AtomicOpsResult struct {
+	Success     bool        `json:"success"`
+	Value       interface{} `json:"value,omitempty"`
+	Previous    *string     `json:"previous,omitempty"`
+	UpdateCount int64       `json:"update_count,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
@@ -1,41 +1,19 @@
 local key = KEYS[1]
 local counter_key = KEYS[2]
-local new_value_str = ARGV[1]
+local index_key = KEYS[3]
+local new_value_str = ARGV[2]
 
-local current_value = redis.call('GET', key)
-
-if not current_value or current_value == "" then
-    redis.call('SET', key, new_value_str)
-    local update_count = redis.call('INCR', counter_key)
-    return {update_count,new_value_str}
-end
-
-local success, current_obj = pcall(cjson.decode, current_value)
-local new_success, new_obj = pcall(cjson.decode, new_value_str)
-
-if not success or not new_success or type(current_obj) ~= 'table' or type(new_obj) ~= 'table' then
-    redis.call('SET', key, new_value_str)
-    local update_count = redis.call('INCR', counter_key)
-    return {update_count,new_value_str}
+local conflict = check_expected_update_count(key, counter_key, ARGV[1])
+if conflict then
+    return conflict
 end
 
-local function deep_merge(target, source)
-    for k, v in pairs(source) do
-        if type(v) == 'table' and type(target[k]) == 'table' then
-            deep_merge(target[k], v)
-        else
-            target[k] = v
-        end
-    end
-    return target
-end
-
-local merged = deep_merge(current_obj, new_obj)
-
-local merged_str = cjson.encode(merged)
+local previous = redis.call('GET', key)
+local merged_str = merge_values(previous, new_value_str)
 
-redis.call('SET', key, merged_str)
+set_state(key, merged_str, ARGV[3], index_key)
 
-local update_count = redis.call('INCR', counter_key)
+local update_count = bump_update_count(counter_key)
+record_history(key, update_count, merged_str, ARGV[4])
 
-return { update_count, merged_str }
+return { update_count, merged_str, previous }
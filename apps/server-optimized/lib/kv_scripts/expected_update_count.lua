@@ -0,0 +1,17 @@
+-- prepended to every script; the single-key scripts take the expected update
+-- count as ARGV[1], or an empty string to write unconditionally
+
+local function check_expected_update_count(key, counter_key, expected)
+    if not expected or expected == "" then
+        return nil
+    end
+
+    local current_count = tonumber(redis.call('GET', counter_key) or "0")
+
+    if current_count == tonumber(expected) then
+        return nil
+    end
+
+    return { "conflict", current_count, redis.call('GET', key) }
+end
+
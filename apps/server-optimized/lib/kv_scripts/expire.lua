@@ -0,0 +1,32 @@
+-- run by the expiry sweeper for a key whose TTL was due; KEYS[3] is the
+-- expiry index of its app and ARGV[1] the history argument. Returns the TTL of
+-- a key that is still there, as it was written again since (-1 for none),
+-- {"expired", count} for a key whose watchers are yet to hear that it
+-- expired, or nil when they already did, through remove or an earlier sweep,
+-- either of which took it out of the index. The key leaves the index unless
+-- it has a TTL again
+local key = KEYS[1]
+local counter_key = KEYS[2]
+local index_key = KEYS[3]
+
+if redis.call('EXISTS', key) == 1 then
+    local ttl = redis.call('PTTL', key)
+
+    -- a write with a TTL already put the new deadline in the index
+    if ttl < 0 then
+        index_expiry(index_key, key, "0")
+    end
+
+    return ttl
+end
+
+if index_key and not redis.call('ZSCORE', index_key, key) then
+    return nil
+end
+
+index_expiry(index_key, key, "0")
+
+local update_count = bump_update_count(counter_key)
+record_history(key, update_count, nil, ARGV[1])
+
+return { "expired", update_count }
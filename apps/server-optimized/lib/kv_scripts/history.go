@@ -0,0 +1,22 @@
+package kv_scripts
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// HistoryArg is the history argument of the write scripts, from the
+// serverState.history settings: the most versions to keep of a key and for
+// how long, or an empty string when no history is kept.
+func HistoryArg() string {
+	maxVersions := viper.GetInt("serverState.history.maxVersions")
+	maxAge := viper.GetDuration("serverState.history.maxAge")
+
+	if maxVersions <= 0 && maxAge <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d:%d:%d", max(maxVersions, 0), max(maxAge.Milliseconds(), 0), time.Now().UnixMilli())
+}
@@ -0,0 +1,50 @@
+local key = KEYS[1]
+local counter_key = KEYS[2]
+local index_key = KEYS[3]
+local operations_str = ARGV[2]
+
+local conflict = check_expected_update_count(key, counter_key, ARGV[1])
+if conflict then
+    return conflict
+end
+
+local success, operations = pcall(decode_json, operations_str)
+
+if not success or json_type(operations) ~= 'array' then
+    return cjson.encode({
+        success = false,
+        error = "Invalid JSON patch"
+    })
+end
+
+local previous = redis.call('GET', key)
+
+-- the document is patched as a whole before anything is written, so a failing
+-- operation leaves the stored value untouched
+local patched, patch_error, index, test_failed = apply_json_patch(decode_stored_value(previous), operations)
+
+if patch_error then
+    return cjson.encode({
+        success = false,
+        error = patch_error,
+        index = index - 1,
+        test_failed = test_failed
+    })
+end
+
+if patched == nil then
+    patched = cjson.null
+end
+
+local patched_str = encode_json(patched)
+set_state(key, patched_str, ARGV[3], index_key)
+
+local update_count = bump_update_count(counter_key)
+record_history(key, update_count, patched_str, ARGV[4])
+
+return encode_json({
+    success = true,
+    value = patched,
+    previous = previous or cjson.null,
+    update_count = update_count
+})
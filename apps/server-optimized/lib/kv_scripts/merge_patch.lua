@@ -0,0 +1,34 @@
+local key = KEYS[1]
+local counter_key = KEYS[2]
+local index_key = KEYS[3]
+local patch_str = ARGV[2]
+
+local conflict = check_expected_update_count(key, counter_key, ARGV[1])
+if conflict then
+    return conflict
+end
+
+local success, patch = pcall(decode_json, patch_str)
+
+if not success then
+    return cjson.encode({
+        success = false,
+        error = "Invalid merge patch JSON"
+    })
+end
+
+local previous = redis.call('GET', key)
+local patched = merge_patch(decode_stored_value(previous), patch)
+
+local patched_str = encode_json(patched)
+set_state(key, patched_str, ARGV[3], index_key)
+
+local update_count = bump_update_count(counter_key)
+record_history(key, update_count, patched_str, ARGV[4])
+
+return encode_json({
+    success = true,
+    value = patched,
+    previous = previous or cjson.null,
+    update_count = update_count
+})
@@ -0,0 +1,1016 @@
+-- shared by the single-key scripts and transaction.lua; prepended after
+-- expected_update_count.lua
+
+-- cjson decodes `[]` and `{}` to the same empty table and encodes it back as
+-- `{}`, so arrays are tagged with array_mt while decoding (empty ones by way of
+-- a placeholder element) and empty tagged tables are turned back into `[]`
+-- while encoding. A stored `["@@airstate:empty-array@@"]` reads as `[]`.
+local array_mt = {}
+local EMPTY_ARRAY_PLACEHOLDER = "@@airstate:empty-array@@"
+local EMPTY_OBJECT_PLACEHOLDER = "@@airstate:empty-object@@"
+
+local function new_array(t)
+    return setmetatable(t or {}, array_mt)
+end
+
+local function is_array(value)
+    return type(value) == 'table' and (getmetatable(value) == array_mt or value[1] ~= nil)
+end
+
+local function replace_empty_arrays(str)
+    if not string.find(str, "%[%s*%]") then
+        return str
+    end
+
+    local parts = {}
+    local i, start = 1, 1
+    local in_string = false
+
+    while i <= #str do
+        local c = string.byte(str, i)
+
+        if in_string then
+            if c == 92 then -- backslash, skip the escaped character
+                i = i + 1
+            elseif c == 34 then
+                in_string = false
+            end
+        elseif c == 34 then
+            in_string = true
+        elseif c == 91 then
+            local close = string.match(str, "^%s*()%]", i + 1)
+            if close then
+                table.insert(parts, string.sub(str, start, i - 1))
+                table.insert(parts, '["' .. EMPTY_ARRAY_PLACEHOLDER .. '"]')
+                i = close
+                start = close + 1
+            end
+        end
+
+        i = i + 1
+    end
+
+    table.insert(parts, string.sub(str, start))
+    return table.concat(parts)
+end
+
+local function tag_arrays(value)
+    if type(value) ~= 'table' then
+        return
+    end
+
+    if value[1] == EMPTY_ARRAY_PLACEHOLDER and value[2] == nil then
+        value[1] = nil
+        setmetatable(value, array_mt)
+        return
+    end
+
+    if value[1] ~= nil then
+        setmetatable(value, array_mt)
+    end
+
+    for _, child in pairs(value) do
+        tag_arrays(child)
+    end
+end
+
+-- a drop-in for cjson.decode (raises on invalid JSON, so use with pcall)
+local function decode_json(str)
+    local value = cjson.decode(replace_empty_arrays(str))
+    tag_arrays(value)
+    return value
+end
+
+local function encode_json(value)
+    local filled = {}
+
+    local function fill(v)
+        if type(v) ~= 'table' then
+            return
+        end
+
+        if next(v) == nil then
+            -- empty objects get a placeholder too, since not every cjson
+            -- build encodes an empty table as `{}`
+            if getmetatable(v) == array_mt then
+                v[1] = EMPTY_ARRAY_PLACEHOLDER
+                table.insert(filled, { v, 1 })
+            else
+                v[EMPTY_OBJECT_PLACEHOLDER] = true
+                table.insert(filled, { v, EMPTY_OBJECT_PLACEHOLDER })
+            end
+            return
+        end
+
+        for _, child in pairs(v) do
+            fill(child)
+        end
+    end
+
+    fill(value)
+    local encoded = cjson.encode(value)
+
+    for _, entry in ipairs(filled) do
+        entry[1][entry[2]] = nil
+    end
+
+    encoded = string.gsub(encoded, '%["@@airstate:empty%-array@@"%]', '[]')
+    return (string.gsub(encoded, '{"@@airstate:empty%-object@@":true}', '{}'))
+end
+
+local function deep_merge(target, source)
+    for k, v in pairs(source) do
+        if type(v) == 'table' and type(target[k]) == 'table' then
+            deep_merge(target[k], v)
+        else
+            target[k] = v
+        end
+    end
+    return target
+end
+
+-- merges new_value_str into current_value the way deep_merge.lua always has:
+-- anything that is not a pair of JSON objects is simply replaced
+local function merge_values(current_value, new_value_str)
+    if not current_value or current_value == "" then
+        return new_value_str
+    end
+
+    local success, current_obj = pcall(decode_json, current_value)
+    local new_success, new_obj = pcall(decode_json, new_value_str)
+
+    if not success or not new_success or type(current_obj) ~= 'table' or type(new_obj) ~= 'table' then
+        return new_value_str
+    end
+
+    return encode_json(deep_merge(current_obj, new_obj))
+end
+
+-- splits a JSON Pointer (RFC 6901) into its unescaped reference tokens; the
+-- empty pointer refers to the whole document and has none
+local function parse_pointer(pointer)
+    local segments = {}
+
+    if pointer == "" then
+        return segments
+    end
+
+    if string.sub(pointer, 1, 1) ~= '/' then
+        return nil, string.format("JSON Pointer '%s' must start with '/'", pointer)
+    end
+
+    for raw in string.gmatch(string.sub(pointer, 2) .. '/', "([^/]*)/") do
+        local name = string.gsub(string.gsub(raw, "~1", "/"), "~0", "~")
+        table.insert(segments, { name = name })
+    end
+
+    return segments
+end
+
+-- Field paths are either dot notation or a JSON Pointer (RFC 6901) when they
+-- start with `/`:
+--
+--   items.3.qty      `3` is an index if `items` is an array, else a field
+--   items[3].qty     `[3]` always is an array index
+--   items[-1]        negative indexes count from the end
+--   a\.b             `\` escapes `.`, `[` and `\` itself
+--   /items/3/qty     JSON Pointer, with `-` as "past the end" for writes
+--
+-- Indexes are 0-based, like in JSON Pointer and MongoDB.
+local function parse_path(path)
+    if type(path) ~= 'string' or path == "" then
+        return nil, "Field path must be a non-empty string"
+    end
+
+    if string.sub(path, 1, 1) == '/' then
+        return parse_pointer(path)
+    end
+
+    local segments = {}
+    local current = {}
+    local escaped = false
+    local i = 1
+
+    local function flush()
+        if #current > 0 then
+            table.insert(segments, { name = table.concat(current) })
+            current = {}
+        end
+    end
+
+    while i <= #path do
+        local ch = string.sub(path, i, i)
+
+        if escaped then
+            table.insert(current, ch)
+            escaped = false
+        elseif ch == '\\' then
+            escaped = true
+        elseif ch == '.' then
+            flush()
+        elseif ch == '[' then
+            local close = string.find(path, ']', i, true)
+            if not close then
+                return nil, string.format("Unterminated '[' in path '%s'", path)
+            end
+
+            local index = string.sub(path, i + 1, close - 1)
+            if not string.match(index, "^%-?%d+$") then
+                return nil, string.format("Invalid array index '[%s]' in path '%s'", index, path)
+            end
+
+            flush()
+            table.insert(segments, { name = index, index = true })
+            i = close
+        else
+            table.insert(current, ch)
+        end
+
+        i = i + 1
+    end
+
+    if escaped then
+        return nil, string.format("Path '%s' ends with an escape character", path)
+    end
+
+    flush()
+
+    if #segments == 0 then
+        return nil, string.format("Path '%s' does not address any field", path)
+    end
+
+    return segments
+end
+
+-- returns the Lua key of segment within container. When writing, the index
+-- right past the end is allowed (it appends); anything further is an error.
+-- When reading, an unusable segment just yields nil.
+local function child_key(container, segment, path, writing)
+    if is_array(container) then
+        if writing and segment.name == '-' then
+            return #container + 1
+        end
+
+        if not string.match(segment.name, "^%-?%d+$") then
+            if writing then
+                return nil, string.format("Cannot use '%s' as an array index in path '%s'", segment.name, path)
+            end
+            return nil
+        end
+
+        local index = tonumber(segment.name)
+        if index < 0 then
+            index = #container + index
+        end
+
+        local last_index = writing and #container or #container - 1
+        if index < 0 or index > last_index then
+            if writing then
+                return nil, string.format("Index %s is out of range for an array of length %d in path '%s'", segment.name, #container, path)
+            end
+            return nil
+        end
+
+        return index + 1
+    end
+
+    if segment.index then
+        if writing then
+            return nil, string.format("Cannot use [%s] on a non-array in path '%s'", segment.name, path)
+        end
+        return nil
+    end
+
+    return segment.name
+end
+
+-- returns the container holding the addressed field and the field's key in
+-- it, or nothing when the path leads nowhere; the third value is a path syntax
+-- error, if any
+local function get_nested(obj, path)
+    local segments, path_error = parse_path(path)
+    if path_error then
+        return nil, nil, path_error
+    end
+
+    local current = obj
+    for i = 1, #segments do
+        if type(current) ~= 'table' then
+            return nil
+        end
+
+        local key = child_key(current, segments[i], path, false)
+        if key == nil then
+            return nil
+        end
+
+        if i == #segments then
+            return current, key
+        end
+
+        current = current[key]
+    end
+end
+
+-- sets the addressed field, creating missing objects (or arrays, for `[n]`
+-- segments) along the way; returns an error message on failure
+local function set_nested(obj, path, value)
+    local segments, path_error = parse_path(path)
+    if path_error then
+        return path_error
+    end
+
+    local current = obj
+    for i = 1, #segments - 1 do
+        local key, key_error = child_key(current, segments[i], path, true)
+        if key_error then
+            return key_error
+        end
+
+        if type(current[key]) ~= 'table' then
+            current[key] = segments[i + 1].index and new_array() or {}
+        end
+
+        current = current[key]
+    end
+
+    local key, key_error = child_key(current, segments[#segments], path, true)
+    if key_error then
+        return key_error
+    end
+
+    current[key] = value
+    return nil
+end
+
+-- removes the addressed field; array elements are removed rather than nulled,
+-- shifting the ones after them. Returns a path syntax error, if any.
+local function unset_nested(obj, path)
+    local parent, key, path_error = get_nested(obj, path)
+    if path_error then
+        return path_error
+    end
+
+    if parent == nil then
+        return nil
+    end
+
+    if is_array(parent) then
+        table.remove(parent, key)
+    else
+        parent[key] = nil
+    end
+
+    return nil
+end
+
+-- decodes the stored value for atomic operations; a missing value starts out
+-- as an empty object
+local function decode_object(current_value)
+    if not current_value or current_value == "" then
+        return {}
+    end
+
+    local parse_success, parsed = pcall(decode_json, current_value)
+    if not parse_success or type(parsed) ~= 'table' then
+        return nil, "Current value is not a valid JSON object"
+    end
+
+    return parsed
+end
+
+-- describes a decoded JSON value for error messages
+local function json_type(value)
+    if value == nil then
+        return "missing"
+    elseif value == cjson.null then
+        return "null"
+    elseif type(value) == 'table' then
+        if is_array(value) then
+            return "array"
+        end
+        return "object"
+    end
+
+    return type(value)
+end
+
+local function values_equal(a, b)
+    if type(a) ~= type(b) then
+        return false
+    end
+
+    if type(a) ~= 'table' then
+        return a == b
+    end
+
+    for k, v in pairs(a) do
+        if not values_equal(v, b[k]) then
+            return false
+        end
+    end
+
+    for k in pairs(b) do
+        if a[k] == nil then
+            return false
+        end
+    end
+
+    return true
+end
+
+-- an object condition matches any object element holding (at least) the same
+-- fields with equal values; anything else has to be equal
+local function matches_condition(element, condition)
+    if json_type(condition) == 'object' and json_type(element) == 'object' then
+        for k, v in pairs(condition) do
+            if not values_equal(element[k], v) then
+                return false
+            end
+        end
+        return true
+    end
+
+    return values_equal(element, condition)
+end
+
+local function array_contains(array, value)
+    for _, v in ipairs(array) do
+        if values_equal(v, value) then
+            return true
+        end
+    end
+
+    return false
+end
+
+local function is_integer(value)
+    return type(value) == 'number' and value == math.floor(value)
+end
+
+-- reads an array field for the array operators; a missing field is returned
+-- as nil, anything other than an array is an error
+local function get_array(obj, field, operator)
+    local parent, last_key = get_nested(obj, field)
+    local current_value = parent and parent[last_key] or nil
+
+    if current_value == nil then
+        return nil
+    end
+
+    if json_type(current_value) ~= 'array' then
+        return nil, string.format("Cannot %s field '%s': current value is not an array", operator, field)
+    end
+
+    return current_value
+end
+
+-- applies the operators in place; returns an error message on failure, in
+-- which case current_obj may be partially modified and must be discarded
+local function apply_atomic_ops(current_obj, operations)
+    if operations['$set'] and type(operations['$set']) == 'table' then
+        for field, value in pairs(operations['$set']) do
+            local path_error = set_nested(current_obj, field, value)
+            if path_error then
+                return path_error
+            end
+        end
+    end
+
+    if operations['$unset'] and type(operations['$unset']) == 'table' then
+        for i, field in ipairs(operations['$unset']) do
+            if type(field) == 'string' then
+                local path_error = unset_nested(current_obj, field)
+                if path_error then
+                    return path_error
+                end
+            end
+        end
+    end
+
+    if operations['$rename'] and type(operations['$rename']) == 'table' then
+        for field, new_field in pairs(operations['$rename']) do
+            if type(new_field) ~= 'string' or new_field == "" then
+                return string.format("$rename target for field '%s' must be a non-empty string", field)
+            end
+
+            if new_field == field then
+                return string.format("Cannot $rename field '%s' to itself", field)
+            end
+
+            local parent, last_key = get_nested(current_obj, field)
+            local current_value = parent and parent[last_key]
+
+            if current_value ~= nil then
+                local path_error = unset_nested(current_obj, field) or set_nested(current_obj, new_field, current_value)
+                if path_error then
+                    return path_error
+                end
+            end
+        end
+    end
+
+    if operations['$inc'] and type(operations['$inc']) == 'table' then
+        for field, amount in pairs(operations['$inc']) do
+            if type(amount) ~= 'number' then
+                return string.format("$inc amount for field '%s' must be a number", field)
+            end
+
+            local parent, last_key = get_nested(current_obj, field)
+            local current_value = 0
+
+            if parent and parent[last_key] ~= nil then
+                if type(parent[last_key]) ~= 'number' then
+                    return string.format("Cannot $inc field '%s': current value is not a number", field)
+                end
+                current_value = parent[last_key]
+            end
+
+            local path_error = set_nested(current_obj, field, current_value + amount)
+            if path_error then
+                return path_error
+            end
+        end
+    end
+
+    if operations['$mul'] and type(operations['$mul']) == 'table' then
+        for field, factor in pairs(operations['$mul']) do
+            if type(factor) ~= 'number' then
+                return string.format("$mul factor for field '%s' must be a number", field)
+            end
+
+            local parent, last_key = get_nested(current_obj, field)
+            local current_value = 0
+
+            if parent and parent[last_key] ~= nil then
+                if type(parent[last_key]) ~= 'number' then
+                    return string.format("Cannot $mul field '%s': current value is not a number", field)
+                end
+                current_value = parent[last_key]
+            end
+
+            local path_error = set_nested(current_obj, field, current_value * factor)
+            if path_error then
+                return path_error
+            end
+        end
+    end
+
+    for _, operator in ipairs({ '$min', '$max' }) do
+        if operations[operator] and type(operations[operator]) == 'table' then
+            for field, value in pairs(operations[operator]) do
+                if type(value) ~= 'number' and type(value) ~= 'string' then
+                    return string.format("%s value for field '%s' must be a number or a string", operator, field)
+                end
+
+                local parent, last_key = get_nested(current_obj, field)
+                local current_value = parent and parent[last_key]
+
+                if current_value == nil then
+                    local path_error = set_nested(current_obj, field, value)
+                    if path_error then
+                        return path_error
+                    end
+                elseif type(current_value) ~= type(value) then
+                    return string.format("Cannot %s field '%s': type mismatch (existing: %s, new: %s)", operator, field, json_type(current_value), type(value))
+                elseif (operator == '$min' and value < current_value) or (operator == '$max' and value > current_value) then
+                    local path_error = set_nested(current_obj, field, value)
+                    if path_error then
+                        return path_error
+                    end
+                end
+            end
+        end
+    end
+
+    if operations['$concat'] and type(operations['$concat']) == 'table' then
+        for field, value in pairs(operations['$concat']) do
+            local parent, last_key = get_nested(current_obj, field)
+            local current_value = parent and parent[last_key] or nil
+
+            if current_value == nil then
+                local path_error = set_nested(current_obj, field, value)
+                if path_error then
+                    return path_error
+                end
+            elseif type(current_value) == 'string' then
+                if type(value) ~= 'string' then
+                    return string.format("Cannot $concat field '%s': type mismatch (existing: string, new: %s)", field, type(value))
+                end
+                local path_error = set_nested(current_obj, field, current_value .. value)
+                if path_error then
+                    return path_error
+                end
+            elseif type(current_value) == 'table' then
+                if type(value) ~= 'table' then
+                    return string.format("Cannot $concat field '%s': type mismatch (existing: array, new: %s)", field, type(value))
+                end
+                local concatenated = new_array()
+                for i, v in ipairs(current_value) do
+                    table.insert(concatenated, v)
+                end
+                for i, v in ipairs(value) do
+                    table.insert(concatenated, v)
+                end
+                local path_error = set_nested(current_obj, field, concatenated)
+                if path_error then
+                    return path_error
+                end
+            else
+                return string.format("Cannot $concat field '%s': current value is neither string nor array", field)
+            end
+        end
+    end
+
+    if operations['$push'] and type(operations['$push']) == 'table' then
+        for field, value in pairs(operations['$push']) do
+            local current_value, array_error = get_array(current_obj, field, "$push to")
+            if array_error then
+                return array_error
+            end
+
+            local pushed = new_array()
+            for i, v in ipairs(current_value or {}) do
+                table.insert(pushed, v)
+            end
+
+            if json_type(value) == 'object' and value['$each'] ~= nil then
+                local each = value['$each']
+                local position = value['$position']
+                local slice = value['$slice']
+
+                if json_type(each) ~= 'array' then
+                    return string.format("$each for field '%s' must be an array", field)
+                end
+
+                if position ~= nil and not is_integer(position) then
+                    return string.format("$position for field '%s' must be an integer", field)
+                end
+
+                if slice ~= nil and not is_integer(slice) then
+                    return string.format("$slice for field '%s' must be an integer", field)
+                end
+
+                -- a negative position counts from the end, like in MongoDB
+                local insert_at = #pushed + 1
+                if position ~= nil then
+                    if position < 0 then
+                        insert_at = math.max(#pushed + position + 1, 1)
+                    else
+                        insert_at = math.min(position + 1, #pushed + 1)
+                    end
+                end
+
+                for i, v in ipairs(each) do
+                    table.insert(pushed, insert_at + i - 1, v)
+                end
+
+                if slice ~= nil then
+                    local sliced = new_array()
+                    if slice >= 0 then
+                        for i = 1, math.min(slice, #pushed) do
+                            table.insert(sliced, pushed[i])
+                        end
+                    else
+                        for i = math.max(#pushed + slice + 1, 1), #pushed do
+                            table.insert(sliced, pushed[i])
+                        end
+                    end
+                    pushed = sliced
+                end
+            else
+                table.insert(pushed, value)
+            end
+
+            local path_error = set_nested(current_obj, field, pushed)
+            if path_error then
+                return path_error
+            end
+        end
+    end
+
+    if operations['$addToSet'] and type(operations['$addToSet']) == 'table' then
+        for field, value in pairs(operations['$addToSet']) do
+            local current_value, array_error = get_array(current_obj, field, "$addToSet to")
+            if array_error then
+                return array_error
+            end
+
+            local values = { value }
+            if json_type(value) == 'object' and value['$each'] ~= nil then
+                if json_type(value['$each']) ~= 'array' then
+                    return string.format("$each for field '%s' must be an array", field)
+                end
+                values = value['$each']
+            end
+
+            local set = new_array()
+            for i, v in ipairs(current_value or {}) do
+                table.insert(set, v)
+            end
+
+            for _, v in ipairs(values) do
+                if not array_contains(set, v) then
+                    table.insert(set, v)
+                end
+            end
+
+            local path_error = set_nested(current_obj, field, set)
+            if path_error then
+                return path_error
+            end
+        end
+    end
+
+    if operations['$pull'] and type(operations['$pull']) == 'table' then
+        for field, condition in pairs(operations['$pull']) do
+            local current_value, array_error = get_array(current_obj, field, "$pull from")
+            if array_error then
+                return array_error
+            end
+
+            if current_value ~= nil then
+                local kept = new_array()
+                for i, v in ipairs(current_value) do
+                    if not matches_condition(v, condition) then
+                        table.insert(kept, v)
+                    end
+                end
+
+                local path_error = set_nested(current_obj, field, kept)
+                if path_error then
+                    return path_error
+                end
+            end
+        end
+    end
+
+    if operations['$pop'] and type(operations['$pop']) == 'table' then
+        for field, direction in pairs(operations['$pop']) do
+            if direction ~= 1 and direction ~= -1 then
+                return string.format("$pop direction for field '%s' must be 1 (last) or -1 (first)", field)
+            end
+
+            local current_value, array_error = get_array(current_obj, field, "$pop")
+            if array_error then
+                return array_error
+            end
+
+            if current_value ~= nil and #current_value > 0 then
+                if direction == 1 then
+                    table.remove(current_value, #current_value)
+                else
+                    table.remove(current_value, 1)
+                end
+            end
+        end
+    end
+
+    return nil
+end
+
+
+
+-- decodes a stored value of any JSON type for the patch scripts: a missing
+-- value is nil, and one that is not JSON (a plain string stored by replace
+-- before it stored JSON) is that string
+local function decode_stored_value(current_value)
+    if not current_value then
+        return nil
+    end
+
+    local success, value = pcall(decode_json, current_value)
+    if not success then
+        return current_value
+    end
+
+    return value
+end
+
+local function deep_copy(value)
+    if type(value) ~= 'table' then
+        return value
+    end
+
+    local copy = setmetatable({}, getmetatable(value))
+    for k, v in pairs(value) do
+        copy[k] = deep_copy(v)
+    end
+
+    return copy
+end
+
+-- RFC 7386: objects are merged recursively, null removes a member and
+-- anything else (arrays included) replaces the target outright
+local function merge_patch(target, patch)
+    if json_type(patch) ~= 'object' then
+        return patch
+    end
+
+    if json_type(target) ~= 'object' then
+        target = {}
+    end
+
+    for k, v in pairs(patch) do
+        if v == cjson.null then
+            target[k] = nil
+        else
+            target[k] = merge_patch(target[k], v)
+        end
+    end
+
+    return target
+end
+
+-- RFC 6902 array indexes: no sign, no leading zeros, and `-` (past the end)
+-- only where a value is being added
+local function pointer_index(array, token, pointer, adding)
+    if adding and token == '-' then
+        return #array + 1
+    end
+
+    if token ~= "0" and not string.match(token, "^[1-9]%d*$") then
+        return nil, string.format("'%s' is not a valid array index in path '%s'", token, pointer)
+    end
+
+    local index = tonumber(token) + 1
+    local last_index = adding and #array + 1 or #array
+
+    if index > last_index then
+        return nil, string.format("Index %s is out of range for an array of length %d in path '%s'", token, #array, pointer)
+    end
+
+    return index
+end
+
+-- returns the container the last token of a non-empty pointer refers into and
+-- that token's key in it; `adding` allows the key to be missing
+local function resolve_pointer(doc, pointer, adding)
+    local segments, pointer_error = parse_pointer(pointer)
+    if pointer_error then
+        return nil, nil, pointer_error
+    end
+
+    local current = doc
+    for i = 1, #segments do
+        local kind = json_type(current)
+        local key
+
+        if kind == 'array' then
+            local index_error
+            key, index_error = pointer_index(current, segments[i].name, pointer, adding and i == #segments)
+            if index_error then
+                return nil, nil, index_error
+            end
+        elseif kind == 'object' then
+            key = segments[i].name
+        else
+            return nil, nil, string.format("Path '%s' does not exist", pointer)
+        end
+
+        if i == #segments then
+            if not adding and current[key] == nil then
+                return nil, nil, string.format("Path '%s' does not exist", pointer)
+            end
+
+            return current, key
+        end
+
+        if current[key] == nil then
+            return nil, nil, string.format("Path '%s' does not exist", pointer)
+        end
+
+        current = current[key]
+    end
+end
+
+local function pointer_get(doc, pointer)
+    if pointer == "" then
+        if doc == nil then
+            return nil, "The document does not exist"
+        end
+        return doc
+    end
+
+    local parent, key, pointer_error = resolve_pointer(doc, pointer, false)
+    if pointer_error then
+        return nil, pointer_error
+    end
+
+    return parent[key]
+end
+
+-- each pointer_* writer returns the (possibly replaced) document and an error
+local function pointer_add(doc, pointer, value)
+    if pointer == "" then
+        return value
+    end
+
+    local parent, key, pointer_error = resolve_pointer(doc, pointer, true)
+    if pointer_error then
+        return doc, pointer_error
+    end
+
+    if is_array(parent) then
+        table.insert(parent, key, value)
+    else
+        parent[key] = value
+    end
+
+    return doc
+end
+
+local function pointer_remove(doc, pointer)
+    if pointer == "" then
+        return doc, "Cannot remove the whole document; delete the key instead"
+    end
+
+    local parent, key, pointer_error = resolve_pointer(doc, pointer, false)
+    if pointer_error then
+        return doc, pointer_error
+    end
+
+    if is_array(parent) then
+        table.remove(parent, key)
+    else
+        parent[key] = nil
+    end
+
+    return doc
+end
+
+local function pointer_replace(doc, pointer, value)
+    if pointer == "" then
+        if doc == nil then
+            return doc, "The document does not exist"
+        end
+        return value
+    end
+
+    local parent, key, pointer_error = resolve_pointer(doc, pointer, false)
+    if pointer_error then
+        return doc, pointer_error
+    end
+
+    parent[key] = value
+    return doc
+end
+
+-- applies an RFC 6902 patch to doc (nil for a missing key). Returns the new
+-- document, or nil, an error message, the 1-based index of the failing
+-- operation and whether it was a `test` that did not hold.
+local function apply_json_patch(doc, operations)
+    for i, op in ipairs(operations) do
+        local path = op.path
+        local op_error
+
+        if type(path) ~= 'string' then
+            return nil, "Every operation needs a string path", i, false
+        end
+
+        if op.op == 'add' then
+            doc, op_error = pointer_add(doc, path, op.value)
+        elseif op.op == 'remove' then
+            doc, op_error = pointer_remove(doc, path)
+        elseif op.op == 'replace' then
+            doc, op_error = pointer_replace(doc, path, op.value)
+        elseif op.op == 'move' or op.op == 'copy' then
+            local from = op.from
+
+            if type(from) ~= 'string' then
+                return nil, string.format("%s needs a string from", op.op), i, false
+            end
+
+            local value
+            value, op_error = pointer_get(doc, from)
+
+            if not op_error and op.op == 'move' and from ~= path then
+                if string.sub(path, 1, #from + 1) == from .. '/' then
+                    op_error = string.format("Cannot move '%s' into one of its own children", from)
+                else
+                    doc, op_error = pointer_remove(doc, from)
+                    if not op_error then
+                        doc, op_error = pointer_add(doc, path, value)
+                    end
+                end
+            elseif not op_error and op.op == 'copy' then
+                doc, op_error = pointer_add(doc, path, deep_copy(value))
+            end
+        elseif op.op == 'test' then
+            local value
+            value, op_error = pointer_get(doc, path)
+
+            if not op_error and not values_equal(value, op.value) then
+                return nil, string.format("Test failed for path '%s'", path), i, true
+            end
+        else
+            return nil, string.format("Unknown operation '%s'", tostring(op.op)), i, false
+        end
+
+        if op_error then
+            return nil, op_error, i, false
+        end
+    end
+
+    return doc
+end
@@ -1,8 +1,16 @@
 local key = KEYS[1]
 local counter_key = KEYS[2]
+local index_key = KEYS[3]
+
+local conflict = check_expected_update_count(key, counter_key, ARGV[1])
+if conflict then
+    return conflict
+end
 
 redis.call('DEL', key)
+index_expiry(index_key, key, "0")
 
-local update_count = redis.call('INCR', counter_key)
+local update_count = bump_update_count(counter_key)
+record_history(key, update_count, nil, ARGV[2])
 
 return update_count
@@ -1,10 +1,19 @@
 
 local key = KEYS[1]
 local counter_key = KEYS[2]
-local new_value = ARGV[1]
+local index_key = KEYS[3]
+local new_value = ARGV[2]
 
-redis.call('SET', key, new_value)
+local conflict = check_expected_update_count(key, counter_key, ARGV[1])
+if conflict then
+    return conflict
+end
 
-local update_count = redis.call('INCR', counter_key)
+local previous = redis.call('GET', key)
 
-return update_count
+set_state(key, new_value, ARGV[3], index_key)
+
+local update_count = bump_update_count(counter_key)
+record_history(key, update_count, new_value, ARGV[4])
+
+return { update_count, previous }
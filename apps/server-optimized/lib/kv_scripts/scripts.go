@@ -10,24 +10,67 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+//go:embed expected_update_count.lua
+var ExpectedUpdateCountScript string
+
+//go:embed operations.lua
+var OperationsScript string
+
+//go:embed state.lua
+var StateScript string
+
+//go:embed transaction.lua
+var TransactionScript string
+
 //go:embed atomic_ops.lua
 var AtomicOpsScript string
 
 //go:embed deep_merge.lua
 var DeepMergeScript string
 
+//go:embed merge_patch.lua
+var MergePatchScript string
+
+//go:embed json_patch.lua
+var JSONPatchScript string
+
 //go:embed remove.lua
 var RemoveScript string
 
 //go:embed replace.lua
 var ReplaceScript string
 
+//go:embed touch.lua
+var TouchScript string
+
+//go:embed expire.lua
+var ExpireScript string
+
+//go:embed unlock.lua
+var UnlockScript string
+
+// scriptPrelude is prepended to every script so they can share helpers.
+var scriptPrelude = ExpectedUpdateCountScript + StateScript + OperationsScript
+
+// Evaluator is where scripts are loaded and run: KVRocks, or the in-memory
+// store that runs the same Lua.
+type Evaluator interface {
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+}
+
 type ScriptManager struct {
-	kvClient  *redis.Client
-	Replace   Script
-	Remove    Script
-	DeepMerge Script
-	AtomicOps Script
+	kvClient    Evaluator
+	Replace     Script
+	Remove      Script
+	DeepMerge   Script
+	MergePatch  Script
+	JSONPatch   Script
+	AtomicOps   Script
+	Transaction Script
+	Touch       Script
+	Expire      Script
+	Unlock      Script
 }
 
 type Script struct {
@@ -37,41 +80,74 @@ type Script struct {
 }
 
 var (
-	once            sync.Once
-	managerInstance *ScriptManager
+	managersMutex sync.Mutex
+	managers      = make(map[Evaluator]*ScriptManager)
 )
 
-func GetScriptManager(kvClient *redis.Client) *ScriptManager {
-	once.Do(func() {
+// GetScriptManager returns the manager for kvClient, loading the scripts into
+// it the first time.
+func GetScriptManager(kvClient Evaluator) *ScriptManager {
+	managersMutex.Lock()
+	defer managersMutex.Unlock()
+
+	managerInstance, ok := managers[kvClient]
+	if !ok {
 		managerInstance = &ScriptManager{
 			kvClient: kvClient,
 			Replace: Script{
 				Name:    "replace",
-				Content: ReplaceScript,
+				Content: scriptPrelude + ReplaceScript,
 			},
 			Remove: Script{
 				Name:    "remove",
-				Content: RemoveScript,
+				Content: scriptPrelude + RemoveScript,
 			},
 			DeepMerge: Script{
 				Name:    "deep_merge",
-				Content: DeepMergeScript,
+				Content: scriptPrelude + DeepMergeScript,
+			},
+			MergePatch: Script{
+				Name:    "merge_patch",
+				Content: scriptPrelude + MergePatchScript,
+			},
+			JSONPatch: Script{
+				Name:    "json_patch",
+				Content: scriptPrelude + JSONPatchScript,
 			},
 			AtomicOps: Script{
 				Name:    "atomic_ops",
-				Content: AtomicOpsScript,
+				Content: scriptPrelude + AtomicOpsScript,
+			},
+			Transaction: Script{
+				Name:    "transaction",
+				Content: scriptPrelude + TransactionScript,
+			},
+			Touch: Script{
+				Name:    "touch",
+				Content: scriptPrelude + TouchScript,
+			},
+			Expire: Script{
+				Name:    "expire",
+				Content: scriptPrelude + ExpireScript,
+			},
+			Unlock: Script{
+				Name:    "unlock",
+				Content: scriptPrelude + UnlockScript,
 			},
 		}
 
 		if err := managerInstance.LoadAll(context.Background()); err != nil {
 			log.Fatal().Err(err).Msg("Failed to load Lua kv_scripts")
 		}
-	})
+
+		managers[kvClient] = managerInstance
+	}
+
 	return managerInstance
 }
 
 func (sm *ScriptManager) LoadAll(ctx context.Context) error {
-	scripts := []*Script{&sm.Replace, &sm.Remove, &sm.DeepMerge, &sm.AtomicOps}
+	scripts := []*Script{&sm.Replace, &sm.Remove, &sm.DeepMerge, &sm.MergePatch, &sm.JSONPatch, &sm.AtomicOps, &sm.Transaction, &sm.Touch, &sm.Expire, &sm.Unlock}
 
 	for _, script := range scripts {
 		sha, err := sm.kvClient.ScriptLoad(ctx, script.Content).Result()
@@ -84,10 +160,45 @@ func (sm *ScriptManager) LoadAll(ctx context.Context) error {
 	return nil
 }
 
-func (sm *ScriptManager) GetReplace() *Script   { return &sm.Replace }
-func (sm *ScriptManager) GetRemove() *Script    { return &sm.Remove }
-func (sm *ScriptManager) GetDeepMerge() *Script { return &sm.DeepMerge }
-func (sm *ScriptManager) GetAtomicOps() *Script { return &sm.AtomicOps }
+// Conflict is what a write script returns instead of writing when the
+// expected update count does not match the current one.
+type Conflict struct {
+	UpdateCount int64
+	Value       *string
+}
+
+// ParseConflict recognizes the `{"conflict", count, value}` reply of
+// check_expected_update_count.
+func ParseConflict(result interface{}) (*Conflict, bool) {
+	reply, ok := result.([]interface{})
+	if !ok || len(reply) != 3 {
+		return nil, false
+	}
+
+	if marker, ok := reply[0].(string); !ok || marker != "conflict" {
+		return nil, false
+	}
+
+	updateCount, _ := reply[1].(int64)
+	conflict := &Conflict{UpdateCount: updateCount}
+
+	if value, ok := reply[2].(string); ok {
+		conflict.Value = &value
+	}
+
+	return conflict, true
+}
+
+func (sm *ScriptManager) GetReplace() *Script     { return &sm.Replace }
+func (sm *ScriptManager) GetRemove() *Script      { return &sm.Remove }
+func (sm *ScriptManager) GetDeepMerge() *Script   { return &sm.DeepMerge }
+func (sm *ScriptManager) GetMergePatch() *Script  { return &sm.MergePatch }
+func (sm *ScriptManager) GetJSONPatch() *Script   { return &sm.JSONPatch }
+func (sm *ScriptManager) GetAtomicOps() *Script   { return &sm.AtomicOps }
+func (sm *ScriptManager) GetTransaction() *Script { return &sm.Transaction }
+func (sm *ScriptManager) GetTouch() *Script       { return &sm.Touch }
+func (sm *ScriptManager) GetExpire() *Script      { return &sm.Expire }
+func (sm *ScriptManager) GetUnlock() *Script      { return &sm.Unlock }
 
 func (sm *ScriptManager) ReloadScript(ctx context.Context, script *Script) error {
 	sha, err := sm.kvClient.ScriptLoad(ctx, script.Content).Result()
@@ -0,0 +1,92 @@
+-- prepended to every script; how the state, update-count and history keys of
+-- a server-state key are written
+
+-- index_key is the expiry index of the key's app, a sorted set of the state
+-- keys that have a TTL scored by when they are due in unix milliseconds, or
+-- nil when none is kept (see the expiry service). ttl is as for set_state
+local function index_expiry(index_key, key, ttl)
+    if not index_key or not ttl or ttl == "" then
+        return
+    end
+
+    if ttl == "0" then
+        redis.call('ZREM', index_key, key)
+        return
+    end
+
+    local time = redis.call('TIME')
+    local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+    redis.call('ZADD', index_key, now + tonumber(ttl), key)
+end
+
+-- ttl is the write's TTL argument: an empty string keeps the TTL the key has,
+-- "0" removes it, anything else is the new TTL in milliseconds
+local function set_state(key, value, ttl, index_key)
+    if not ttl or ttl == "" then
+        redis.call('SET', key, value, 'KEEPTTL')
+    elseif ttl == "0" then
+        redis.call('SET', key, value)
+    else
+        redis.call('SET', key, value, 'PX', ttl)
+    end
+
+    index_expiry(index_key, key, ttl)
+end
+
+-- bumps the update count of a key that is written, removed or expired. The
+-- counter never expires, not even with its key: a count that started over
+-- would go back below what watchers, resumed sessions and expected update
+-- counts already hold
+local function bump_update_count(counter_key)
+    local update_count = redis.call('INCR', counter_key)
+    redis.call('PERSIST', counter_key)
+
+    return update_count
+end
+
+-- history is the history argument of the scripts, "<max versions>:<max age
+-- in milliseconds>:<now in unix milliseconds>", or an empty string when no
+-- history is kept. value is the key's new stored value, nil when the write
+-- removed it. A 0 bound is no bound
+local function record_history(key, update_count, value, history)
+    if not history or history == "" then
+        return
+    end
+
+    local max_versions, max_age, now = string.match(history, "^(%d+):(%d+):(%d+)$")
+    if not max_versions then
+        return
+    end
+
+    max_versions, max_age, now = tonumber(max_versions), tonumber(max_age), tonumber(now)
+
+    local history_key = key .. ':history'
+    local entry = { update_count = update_count, time = now }
+
+    if value then
+        entry.value = value
+    else
+        entry.deleted = true
+    end
+
+    redis.call('LPUSH', history_key, cjson.encode(entry))
+
+    if max_versions > 0 then
+        redis.call('LTRIM', history_key, 0, max_versions - 1)
+    end
+
+    if max_age > 0 then
+        while true do
+            local oldest = redis.call('LINDEX', history_key, -1)
+            if not oldest or now - cjson.decode(oldest).time <= max_age then
+                break
+            end
+
+            redis.call('RPOP', history_key)
+        end
+
+        -- a key that is no longer written does not keep its history forever
+        redis.call('PEXPIRE', history_key, max_age)
+    end
+end
@@ -0,0 +1,20 @@
+-- sets the TTL of a key to ARGV[1] milliseconds, or removes it with "0",
+-- without writing the value. Returns the update count, or nil when the key
+-- does not exist
+local key = KEYS[1]
+local counter_key = KEYS[2]
+local index_key = KEYS[3]
+
+if redis.call('EXISTS', key) == 0 then
+    return nil
+end
+
+if ARGV[1] == "0" then
+    redis.call('PERSIST', key)
+else
+    redis.call('PEXPIRE', key, ARGV[1])
+end
+
+index_expiry(index_key, key, ARGV[1])
+
+return tonumber(redis.call('GET', counter_key) or "0")
@@ -0,0 +1,134 @@
+-- KEYS holds a (state key, counter key) pair per distinct key; ARGV[1] is a
+-- JSON array of operations, each referring to its pair through `key_index`,
+-- and ARGV[2] the history argument. Written keys keep their TTL. A last, odd
+-- key is the expiry index of the app, when one is kept
+
+local index_key = nil
+if #KEYS % 2 == 1 then
+    index_key = KEYS[#KEYS]
+end
+
+local decode_success, operations = pcall(cjson.decode, ARGV[1])
+
+if not decode_success or type(operations) ~= 'table' then
+    return cjson.encode({
+        success = false,
+        error = "Invalid transaction JSON"
+    })
+end
+
+-- every precondition is checked against the counts from before the
+-- transaction, before anything is written
+for i, op in ipairs(operations) do
+    local conflict = check_expected_update_count(KEYS[op.key_index * 2 - 1], KEYS[op.key_index * 2], op.expected)
+
+    if conflict then
+        return cjson.encode({
+            success = false,
+            index = i - 1,
+            conflict = {
+                update_count = conflict[2],
+                value = conflict[3] or cjson.null
+            }
+        })
+    end
+end
+
+-- new values per key index; false marks a deleted key
+local values = {}
+-- stored values from before the transaction, for the change deltas
+local previous = {}
+local changed = {}
+
+for i, op in ipairs(operations) do
+    local key_index = op.key_index
+    local current_value = values[key_index]
+
+    if current_value == nil then
+        current_value = redis.call('GET', KEYS[key_index * 2 - 1])
+        previous[key_index] = current_value
+    end
+
+    local new_value
+
+    if op.type == 'replace' then
+        new_value = op.payload
+    elseif op.type == 'merge' then
+        new_value = merge_values(current_value, op.payload)
+    elseif op.type == 'atomic' then
+        local ops_success, atomic_operations = pcall(decode_json, op.payload)
+        if not ops_success then
+            return cjson.encode({
+                success = false,
+                index = i - 1,
+                error = "Invalid operations JSON"
+            })
+        end
+
+        local current_obj, decode_error = decode_object(current_value)
+        if decode_error then
+            return cjson.encode({
+                success = false,
+                index = i - 1,
+                error = decode_error
+            })
+        end
+
+        local ops_error = apply_atomic_ops(current_obj, atomic_operations)
+        if ops_error then
+            return cjson.encode({
+                success = false,
+                index = i - 1,
+                error = ops_error
+            })
+        end
+
+        new_value = encode_json(current_obj)
+    elseif op.type == 'delete' then
+        new_value = false
+    else
+        return cjson.encode({
+            success = false,
+            index = i - 1,
+            error = "Unknown operation type"
+        })
+    end
+
+    if values[key_index] == nil then
+        table.insert(changed, key_index)
+    end
+
+    values[key_index] = new_value
+end
+
+local results = {}
+
+for _, key_index in ipairs(changed) do
+    local key = KEYS[key_index * 2 - 1]
+    local counter_key = KEYS[key_index * 2]
+
+    local update_count
+
+    if values[key_index] == false then
+        redis.call('DEL', key)
+        index_expiry(index_key, key, "0")
+        update_count = bump_update_count(counter_key)
+        record_history(key, update_count, nil, ARGV[2])
+    else
+        set_state(key, values[key_index], "")
+        update_count = bump_update_count(counter_key)
+        record_history(key, update_count, values[key_index], ARGV[2])
+    end
+
+    table.insert(results, {
+        key_index = key_index,
+        update_count = update_count,
+        value = values[key_index] or cjson.null,
+        previous = previous[key_index] or cjson.null
+    })
+end
+
+return cjson.encode({
+    success = true,
+    results = results
+})
@@ -0,0 +1,40 @@
+package kv_scripts
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ParseTTL reads a TTL as given to the API: milliseconds, or a duration such
+// as 30s or 1h. 0 removes the TTL of a key.
+func ParseTTL(raw string) (int64, error) {
+	milliseconds, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		duration, durationErr := time.ParseDuration(raw)
+		if durationErr != nil {
+			return 0, errors.New("ttl must be milliseconds or a duration like 30s")
+		}
+
+		milliseconds = duration.Milliseconds()
+		if duration > 0 && milliseconds == 0 {
+			milliseconds = 1
+		}
+	}
+
+	if milliseconds < 0 {
+		return 0, errors.New("ttl must not be negative")
+	}
+
+	return milliseconds, nil
+}
+
+// TTLArg is the ttl argument of the write scripts: nil keeps the TTL the key
+// has, 0 removes it, anything else is the new TTL in milliseconds.
+func TTLArg(ttl *int64) string {
+	if ttl == nil {
+		return ""
+	}
+
+	return strconv.FormatInt(*ttl, 10)
+}
@@ -0,0 +1,8 @@
+-- releases the lock KEYS[1] if it is still held with ARGV[1], the token its
+-- holder took it with; one whose lock ran out must not drop the next
+-- holder's. Returns 1 when it was released
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('DEL', KEYS[1])
+end
+
+return 0
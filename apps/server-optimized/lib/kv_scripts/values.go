@@ -0,0 +1,27 @@
+package kv_scripts
+
+import "encoding/json"
+
+// EncodeReplaceValue produces what gets stored for a replaced value: its JSON,
+// strings included, so that a string such as "42" or "null" reads back as
+// the string it was.
+func EncodeReplaceValue(value interface{}) (string, error) {
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jsonBytes), nil
+}
+
+// DecodeStoredValue turns a stored value back into JSON. Replace used to
+// store plain strings as-is rather than JSON encoded, so anything that does
+// not parse is returned as the string it is.
+func DecodeStoredValue(rawValue string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(rawValue), &value); err != nil {
+		return rawValue
+	}
+
+	return value
+}
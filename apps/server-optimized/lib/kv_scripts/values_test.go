@@ -0,0 +1,36 @@
+package kv_scripts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStoredValueRoundTrip(t *testing.T) {
+	for _, value := range []interface{}{
+		"42",
+		"true",
+		"null",
+		`{"a":1}`,
+		"plain",
+		"",
+		float64(42),
+		true,
+		nil,
+		map[string]interface{}{"a": "1"},
+		[]interface{}{"x", float64(2)},
+	} {
+		stored, err := EncodeReplaceValue(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded := DecodeStoredValue(stored); !reflect.DeepEqual(decoded, value) {
+			t.Fatalf("%#v was stored as %q and read back as %#v", value, stored, decoded)
+		}
+	}
+
+	// a plain string stored by an older version
+	if decoded := DecodeStoredValue("plain"); decoded != "plain" {
+		t.Fatalf("unexpected value %#v", decoded)
+	}
+}
@@ -0,0 +1,228 @@
+package yjs
+
+import (
+	"errors"
+	"unicode/utf16"
+)
+
+var ErrUnexpectedEndOfUpdate = errors.New("unexpected end of update")
+
+// decoder reads the lib0 primitives used by the Yjs v1 update format.
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func newDecoder(buf []byte) *decoder {
+	return &decoder{buf: buf}
+}
+
+func (d *decoder) hasContent() bool {
+	return d.pos < len(d.buf)
+}
+
+func (d *decoder) readUint8() (uint8, error) {
+	if d.pos >= len(d.buf) {
+		return 0, ErrUnexpectedEndOfUpdate
+	}
+
+	b := d.buf[d.pos]
+	d.pos++
+
+	return b, nil
+}
+
+func (d *decoder) readVarUint() (uint64, error) {
+	var num uint64
+	var shift uint
+
+	for {
+		b, err := d.readUint8()
+		if err != nil {
+			return 0, err
+		}
+
+		num |= uint64(b&0x7f) << shift
+		shift += 7
+
+		if b < 0x80 {
+			return num, nil
+		}
+
+		if shift > 63 {
+			return 0, errors.New("varuint overflows 64 bits")
+		}
+	}
+}
+
+func (d *decoder) readBytes(n uint64) ([]byte, error) {
+	if uint64(len(d.buf)-d.pos) < n {
+		return nil, ErrUnexpectedEndOfUpdate
+	}
+
+	b := d.buf[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+
+	return b, nil
+}
+
+func (d *decoder) readVarBytes() ([]byte, error) {
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.readBytes(n)
+}
+
+func (d *decoder) readVarString() (string, error) {
+	b, err := d.readVarBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// skipVarInt skips a lib0 signed varint without decoding it.
+func (d *decoder) skipVarInt() error {
+	for {
+		b, err := d.readUint8()
+		if err != nil {
+			return err
+		}
+
+		if b < 0x80 {
+			return nil
+		}
+	}
+}
+
+// readAnyRaw returns the raw bytes of one lib0 `any` value so it can be
+// written back verbatim.
+func (d *decoder) readAnyRaw() ([]byte, error) {
+	start := d.pos
+
+	if err := d.skipAny(); err != nil {
+		return nil, err
+	}
+
+	return d.buf[start:d.pos], nil
+}
+
+func (d *decoder) skipAny() error {
+	typ, err := d.readUint8()
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case 127, 126, 121, 120: // undefined, null, false, true
+		return nil
+	case 125: // varint
+		return d.skipVarInt()
+	case 124: // float32
+		_, err = d.readBytes(4)
+		return err
+	case 123, 122: // float64, bigint64
+		_, err = d.readBytes(8)
+		return err
+	case 119: // string
+		_, err = d.readVarBytes()
+		return err
+	case 118: // object
+		n, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.readVarBytes(); err != nil {
+				return err
+			}
+
+			if err := d.skipAny(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case 117: // array
+		n, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < n; i++ {
+			if err := d.skipAny(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case 116: // Uint8Array
+		_, err = d.readVarBytes()
+		return err
+	default:
+		return errors.New("unknown lib0 any type")
+	}
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) writeUint8(b uint8) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *encoder) writeVarUint(num uint64) {
+	for num >= 0x80 {
+		e.buf = append(e.buf, byte(num)|0x80)
+		num >>= 7
+	}
+
+	e.buf = append(e.buf, byte(num))
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) writeVarBytes(b []byte) {
+	e.writeVarUint(uint64(len(b)))
+	e.writeBytes(b)
+}
+
+func (e *encoder) writeVarString(s string) {
+	e.writeVarUint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// utf16Length is the length of s as JavaScript sees it, which is what Yjs
+// uses as the clock length of string content.
+func utf16Length(s string) uint64 {
+	var n uint64
+
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+
+	return n
+}
+
+// utf16Slice mirrors String.prototype.slice on UTF-16 offsets; halves of a
+// split surrogate pair become U+FFFD, as they do when JavaScript encodes them.
+func utf16Slice(s string, from uint64) string {
+	units := utf16.Encode([]rune(s))
+
+	if from >= uint64(len(units)) {
+		return ""
+	}
+
+	return string(utf16.Decode(units[from:]))
+}
@@ -0,0 +1,368 @@
+package yjs
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	structGC   = 0
+	structSkip = 10
+
+	contentDeleted = 1
+	contentJSON    = 2
+	contentBinary  = 3
+	contentString  = 4
+	contentEmbed   = 5
+	contentFormat  = 6
+	contentType    = 7
+	contentAny     = 8
+	contentDoc     = 9
+
+	typeRefXMLElement = 3
+	typeRefXMLHook    = 5
+
+	bitOrigin      = 0x80
+	bitRightOrigin = 0x40
+	bitParentSub   = 0x20
+	bits5          = 0x1f
+)
+
+type id struct {
+	client uint64
+	clock  uint64
+}
+
+// structRef is a decoded GC, Skip or Item struct. Only the parts needed to
+// re-encode, slice and merge updates are kept; nothing is integrated.
+type structRef struct {
+	kind   uint8 // structGC, structSkip or the content ref of an Item
+	id     id
+	length uint64
+
+	origin      *id
+	rightOrigin *id
+
+	// parent is either a root type name (parentYKey) or the id of a parent item
+	hasParent  bool
+	parentYKey *string
+	parentID   *id
+	parentSub  *string
+
+	// content, interpreted per kind
+	strContent string   // contentString
+	entries    [][]byte // contentJSON strings or contentAny raw values
+	raw        []byte   // remaining single-length contents, verbatim
+}
+
+func (s *structRef) isSkip() bool {
+	return s.kind == structSkip
+}
+
+func (s *structRef) isGC() bool {
+	return s.kind == structGC
+}
+
+func (s *structRef) end() uint64 {
+	return s.id.clock + s.length
+}
+
+func readID(d *decoder) (*id, error) {
+	client, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+
+	clock, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+
+	return &id{client: client, clock: clock}, nil
+}
+
+func readStruct(d *decoder, client uint64, clock uint64) (*structRef, error) {
+	info, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &structRef{
+		kind: info & bits5,
+		id:   id{client: client, clock: clock},
+	}
+
+	switch s.kind {
+	case structGC, structSkip:
+		s.length, err = d.readVarUint()
+		return s, err
+	}
+
+	if info&bitOrigin != 0 {
+		if s.origin, err = readID(d); err != nil {
+			return nil, err
+		}
+	}
+
+	if info&bitRightOrigin != 0 {
+		if s.rightOrigin, err = readID(d); err != nil {
+			return nil, err
+		}
+	}
+
+	if info&(bitOrigin|bitRightOrigin) == 0 {
+		s.hasParent = true
+
+		isYKey, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		if isYKey == 1 {
+			key, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+
+			s.parentYKey = &key
+		} else if s.parentID, err = readID(d); err != nil {
+			return nil, err
+		}
+
+		if info&bitParentSub != 0 {
+			sub, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+
+			s.parentSub = &sub
+		}
+	}
+
+	if err := readContent(d, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func readContent(d *decoder, s *structRef) error {
+	start := d.pos
+
+	switch s.kind {
+	case contentDeleted:
+		length, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+
+		s.length = length
+		return nil
+	case contentJSON, contentAny:
+		n, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+
+		s.entries = make([][]byte, 0, n)
+
+		for i := uint64(0); i < n; i++ {
+			var entry []byte
+
+			if s.kind == contentJSON {
+				entry, err = d.readVarBytes()
+			} else {
+				entry, err = d.readAnyRaw()
+			}
+
+			if err != nil {
+				return err
+			}
+
+			s.entries = append(s.entries, entry)
+		}
+
+		s.length = n
+		return nil
+	case contentString:
+		str, err := d.readVarString()
+		if err != nil {
+			return err
+		}
+
+		s.strContent = str
+		s.length = utf16Length(str)
+		return nil
+	case contentBinary, contentEmbed:
+		if _, err := d.readVarBytes(); err != nil {
+			return err
+		}
+	case contentFormat:
+		if _, err := d.readVarBytes(); err != nil {
+			return err
+		}
+
+		if _, err := d.readVarBytes(); err != nil {
+			return err
+		}
+	case contentType:
+		typeRef, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+
+		if typeRef == typeRefXMLElement || typeRef == typeRefXMLHook {
+			if _, err := d.readVarBytes(); err != nil {
+				return err
+			}
+		}
+	case contentDoc:
+		if _, err := d.readVarBytes(); err != nil {
+			return err
+		}
+
+		if err := d.skipAny(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown content ref %d", s.kind)
+	}
+
+	s.raw = d.buf[start:d.pos]
+	s.length = 1
+
+	return nil
+}
+
+// write encodes the struct starting at offset, like Yjs' `struct.write(encoder, offset)`.
+func (s *structRef) write(e *encoder, offset uint64) {
+	switch s.kind {
+	case structGC, structSkip:
+		e.writeUint8(s.kind)
+		e.writeVarUint(s.length - offset)
+		return
+	}
+
+	origin := s.origin
+	if offset > 0 {
+		origin = &id{client: s.id.client, clock: s.id.clock + offset - 1}
+	}
+
+	info := s.kind
+	if origin != nil {
+		info |= bitOrigin
+	}
+
+	if s.rightOrigin != nil {
+		info |= bitRightOrigin
+	}
+
+	if origin == nil && s.rightOrigin == nil && s.parentSub != nil {
+		info |= bitParentSub
+	}
+
+	e.writeUint8(info)
+
+	if origin != nil {
+		e.writeVarUint(origin.client)
+		e.writeVarUint(origin.clock)
+	}
+
+	if s.rightOrigin != nil {
+		e.writeVarUint(s.rightOrigin.client)
+		e.writeVarUint(s.rightOrigin.clock)
+	}
+
+	if origin == nil && s.rightOrigin == nil {
+		if s.parentYKey != nil {
+			e.writeVarUint(1)
+			e.writeVarString(*s.parentYKey)
+		} else {
+			e.writeVarUint(0)
+
+			parentID := s.parentID
+			if parentID == nil {
+				parentID = &id{}
+			}
+
+			e.writeVarUint(parentID.client)
+			e.writeVarUint(parentID.clock)
+		}
+
+		if s.parentSub != nil {
+			e.writeVarString(*s.parentSub)
+		}
+	}
+
+	switch s.kind {
+	case contentDeleted:
+		e.writeVarUint(s.length - offset)
+	case contentJSON, contentAny:
+		e.writeVarUint(uint64(len(s.entries)) - offset)
+
+		for _, entry := range s.entries[offset:] {
+			if s.kind == contentJSON {
+				e.writeVarBytes(entry)
+			} else {
+				e.writeBytes(entry)
+			}
+		}
+	case contentString:
+		if offset == 0 {
+			e.writeVarString(s.strContent)
+		} else {
+			e.writeVarString(utf16Slice(s.strContent, offset))
+		}
+	default:
+		e.writeBytes(s.raw)
+	}
+}
+
+// slice returns the part of the struct starting at diff, like Yjs' `sliceStruct`.
+func (s *structRef) slice(diff uint64) (*structRef, error) {
+	if diff == 0 {
+		return s, nil
+	}
+
+	if diff >= s.length {
+		return nil, errors.New("cannot slice struct beyond its length")
+	}
+
+	sliced := *s
+	sliced.id = id{client: s.id.client, clock: s.id.clock + diff}
+	sliced.length = s.length - diff
+
+	switch s.kind {
+	case structGC, structSkip:
+		return &sliced, nil
+	}
+
+	sliced.origin = &id{client: s.id.client, clock: s.id.clock + diff - 1}
+	sliced.hasParent = false
+	sliced.parentYKey = nil
+	sliced.parentID = nil
+	sliced.parentSub = nil
+
+	switch s.kind {
+	case contentDeleted:
+	case contentJSON, contentAny:
+		sliced.entries = s.entries[diff:]
+	case contentString:
+		sliced.strContent = utf16Slice(s.strContent, diff)
+	default:
+		return nil, errors.New("cannot slice struct with single-length content")
+	}
+
+	return &sliced, nil
+}
+
+// mergeWith appends next to s when both are the same kind of filler struct.
+// Items are never merged; the output is still valid, just less compact.
+func (s *structRef) mergeWith(next *structRef) bool {
+	if (s.isGC() || s.isSkip()) && s.kind == next.kind {
+		s.length += next.length
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,549 @@
+// Package yjs implements the parts of the Yjs v1 update format that a server
+// needs to take part in the y-protocols sync handshake without holding a
+// Y.Doc: merging updates, extracting state vectors and computing diffs. It is
+// a port of the struct-level helpers in yjs' `updates.js`.
+package yjs
+
+import (
+	"errors"
+	"sort"
+)
+
+type deleteRange struct {
+	clock  uint64
+	length uint64
+}
+
+type deleteSet map[uint64][]deleteRange
+
+type decodedUpdate struct {
+	structs   []*structRef
+	deleteSet deleteSet
+}
+
+func decodeUpdate(update []byte) (*decodedUpdate, error) {
+	d := newDecoder(update)
+
+	numClients, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := &decodedUpdate{}
+
+	for i := uint64(0); i < numClients; i++ {
+		numStructs, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		for j := uint64(0); j < numStructs; j++ {
+			s, err := readStruct(d, client, clock)
+			if err != nil {
+				return nil, err
+			}
+
+			decoded.structs = append(decoded.structs, s)
+			clock += s.length
+		}
+	}
+
+	if decoded.deleteSet, err = readDeleteSet(d); err != nil {
+		return nil, err
+	}
+
+	return decoded, nil
+}
+
+func readDeleteSet(d *decoder) (deleteSet, error) {
+	ds := deleteSet{}
+
+	numClients, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < numClients; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		numRanges, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		for j := uint64(0); j < numRanges; j++ {
+			clock, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+
+			length, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+
+			ds[client] = append(ds[client], deleteRange{clock: clock, length: length})
+		}
+	}
+
+	return ds, nil
+}
+
+func mergeDeleteSets(sets []deleteSet) deleteSet {
+	merged := deleteSet{}
+
+	for _, ds := range sets {
+		for client, ranges := range ds {
+			merged[client] = append(merged[client], ranges...)
+		}
+	}
+
+	for client, ranges := range merged {
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i].clock < ranges[j].clock
+		})
+
+		compacted := ranges[:1]
+
+		for _, r := range ranges[1:] {
+			last := &compacted[len(compacted)-1]
+
+			if last.clock+last.length >= r.clock {
+				if r.clock+r.length > last.clock+last.length {
+					last.length = r.clock + r.length - last.clock
+				}
+			} else {
+				compacted = append(compacted, r)
+			}
+		}
+
+		merged[client] = compacted
+	}
+
+	return merged
+}
+
+func writeDeleteSet(e *encoder, ds deleteSet) {
+	clients := make([]uint64, 0, len(ds))
+
+	for client, ranges := range ds {
+		if len(ranges) > 0 {
+			clients = append(clients, client)
+		}
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i] > clients[j]
+	})
+
+	e.writeVarUint(uint64(len(clients)))
+
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeVarUint(uint64(len(ds[client])))
+
+		for _, r := range ds[client] {
+			e.writeVarUint(r.clock)
+			e.writeVarUint(r.length)
+		}
+	}
+}
+
+// structWriter groups consecutive structs of the same client, like Yjs' LazyStructWriter.
+type structWriter struct {
+	clientChunks []encoder
+	chunkCounts  []uint64
+
+	current    encoder
+	currClient uint64
+	written    uint64
+}
+
+func (w *structWriter) write(s *structRef, offset uint64) {
+	if w.written > 0 && w.currClient != s.id.client {
+		w.flush()
+	}
+
+	if w.written == 0 {
+		w.currClient = s.id.client
+		w.current.writeVarUint(s.id.client)
+		w.current.writeVarUint(s.id.clock + offset)
+	}
+
+	s.write(&w.current, offset)
+	w.written++
+}
+
+func (w *structWriter) flush() {
+	if w.written == 0 {
+		return
+	}
+
+	w.clientChunks = append(w.clientChunks, w.current)
+	w.chunkCounts = append(w.chunkCounts, w.written)
+	w.current = encoder{}
+	w.written = 0
+}
+
+func (w *structWriter) finish(e *encoder) {
+	w.flush()
+
+	e.writeVarUint(uint64(len(w.clientChunks)))
+
+	for i, chunk := range w.clientChunks {
+		e.writeVarUint(w.chunkCounts[i])
+		e.writeBytes(chunk.buf)
+	}
+}
+
+// structReader walks the structs of one update, optionally skipping Skips.
+type structReader struct {
+	structs     []*structRef
+	pos         int
+	filterSkips bool
+	curr        *structRef
+}
+
+func newStructReader(structs []*structRef, filterSkips bool) *structReader {
+	r := &structReader{structs: structs, pos: -1, filterSkips: filterSkips}
+	r.next()
+
+	return r
+}
+
+func (r *structReader) next() *structRef {
+	for {
+		r.pos++
+
+		if r.pos >= len(r.structs) {
+			r.curr = nil
+			return nil
+		}
+
+		r.curr = r.structs[r.pos]
+
+		if !r.filterSkips || !r.curr.isSkip() {
+			return r.curr
+		}
+	}
+}
+
+// ValidateUpdate reports whether update is a well-formed v1 update.
+func ValidateUpdate(update []byte) error {
+	_, err := decodeUpdate(update)
+	return err
+}
+
+// MergeUpdates merges v1 updates into a single update, like `Y.mergeUpdates`.
+func MergeUpdates(updates [][]byte) ([]byte, error) {
+	if len(updates) == 0 {
+		return EmptyUpdate(), nil
+	}
+
+	if len(updates) == 1 {
+		if err := ValidateUpdate(updates[0]); err != nil {
+			return nil, err
+		}
+
+		return updates[0], nil
+	}
+
+	readers := make([]*structReader, 0, len(updates))
+	deleteSets := make([]deleteSet, 0, len(updates))
+
+	for _, update := range updates {
+		decoded, err := decodeUpdate(update)
+		if err != nil {
+			return nil, err
+		}
+
+		readers = append(readers, newStructReader(decoded.structs, true))
+		deleteSets = append(deleteSets, decoded.deleteSet)
+	}
+
+	type pendingWrite struct {
+		s      *structRef
+		offset uint64
+	}
+
+	var currWrite *pendingWrite
+	writer := &structWriter{}
+
+	for {
+		active := readers[:0]
+		for _, reader := range readers {
+			if reader.curr != nil {
+				active = append(active, reader)
+			}
+		}
+		readers = active
+
+		if len(readers) == 0 {
+			break
+		}
+
+		// higher clients first, then by clock
+		sort.SliceStable(readers, func(i, j int) bool {
+			a, b := readers[i].curr, readers[j].curr
+
+			if a.id.client != b.id.client {
+				return a.id.client > b.id.client
+			}
+
+			if a.id.clock != b.id.clock {
+				return a.id.clock < b.id.clock
+			}
+
+			return !a.isSkip() && b.isSkip()
+		})
+
+		currReader := readers[0]
+		firstClient := currReader.curr.id.client
+
+		if currWrite != nil {
+			curr := currReader.curr
+			iterated := false
+
+			// skip what has already been written
+			for curr != nil && curr.end() <= currWrite.s.end() && curr.id.client >= currWrite.s.id.client {
+				curr = currReader.next()
+				iterated = true
+			}
+
+			if curr == nil || curr.id.client != firstClient || (iterated && curr.id.clock > currWrite.s.end()) {
+				continue
+			}
+
+			if firstClient != currWrite.s.id.client {
+				writer.write(currWrite.s, currWrite.offset)
+				currWrite = &pendingWrite{s: curr}
+				currReader.next()
+			} else if currWrite.s.end() < curr.id.clock {
+				if currWrite.s.isSkip() {
+					currWrite.s.length = curr.end() - currWrite.s.id.clock
+				} else {
+					writer.write(currWrite.s, currWrite.offset)
+
+					skip := &structRef{
+						kind:   structSkip,
+						id:     id{client: firstClient, clock: currWrite.s.end()},
+						length: curr.id.clock - currWrite.s.end(),
+					}
+
+					currWrite = &pendingWrite{s: skip}
+				}
+			} else {
+				diff := currWrite.s.end() - curr.id.clock
+
+				if diff > 0 {
+					if currWrite.s.isSkip() {
+						currWrite.s.length -= diff
+					} else {
+						sliced, err := curr.slice(diff)
+						if err != nil {
+							return nil, err
+						}
+
+						curr = sliced
+					}
+				}
+
+				if !currWrite.s.mergeWith(curr) {
+					writer.write(currWrite.s, currWrite.offset)
+					currWrite = &pendingWrite{s: curr}
+					currReader.next()
+				}
+			}
+		} else {
+			currWrite = &pendingWrite{s: currReader.curr}
+			currReader.next()
+		}
+
+		for next := currReader.curr; next != nil && next.id.client == firstClient && next.id.clock == currWrite.s.end() && !next.isSkip(); next = currReader.next() {
+			writer.write(currWrite.s, currWrite.offset)
+			currWrite = &pendingWrite{s: next}
+		}
+	}
+
+	if currWrite != nil {
+		writer.write(currWrite.s, currWrite.offset)
+	}
+
+	e := &encoder{}
+	writer.finish(e)
+	writeDeleteSet(e, mergeDeleteSets(deleteSets))
+
+	return e.buf, nil
+}
+
+// EncodeStateVectorFromUpdate returns the state vector an update would
+// produce when applied to an empty document.
+func EncodeStateVectorFromUpdate(update []byte) ([]byte, error) {
+	decoded, err := decodeUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		client uint64
+		clock  uint64
+	}
+
+	var entries []entry
+
+	reader := newStructReader(decoded.structs, false)
+
+	if curr := reader.curr; curr != nil {
+		currClient := curr.id.client
+		stopCounting := curr.id.clock != 0
+
+		var currClock uint64
+		if !stopCounting {
+			currClock = curr.end()
+		}
+
+		for ; curr != nil; curr = reader.next() {
+			if currClient != curr.id.client {
+				if currClock != 0 {
+					entries = append(entries, entry{client: currClient, clock: currClock})
+				}
+
+				currClient = curr.id.client
+				currClock = 0
+				stopCounting = curr.id.clock != 0
+			}
+
+			if curr.isSkip() {
+				stopCounting = true
+			}
+
+			if !stopCounting {
+				currClock = curr.end()
+			}
+		}
+
+		if currClock != 0 {
+			entries = append(entries, entry{client: currClient, clock: currClock})
+		}
+	}
+
+	e := &encoder{}
+	e.writeVarUint(uint64(len(entries)))
+
+	for _, en := range entries {
+		e.writeVarUint(en.client)
+		e.writeVarUint(en.clock)
+	}
+
+	return e.buf, nil
+}
+
+func decodeStateVector(stateVector []byte) (map[uint64]uint64, error) {
+	state := make(map[uint64]uint64)
+
+	if len(stateVector) == 0 {
+		return state, nil
+	}
+
+	d := newDecoder(stateVector)
+
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		state[client] = clock
+	}
+
+	if d.hasContent() {
+		return nil, errors.New("trailing bytes after state vector")
+	}
+
+	return state, nil
+}
+
+// ValidateStateVector reports whether stateVector is a well-formed encoded state vector.
+func ValidateStateVector(stateVector []byte) error {
+	_, err := decodeStateVector(stateVector)
+	return err
+}
+
+// DiffUpdate returns the part of update that a peer with stateVector is
+// missing, like `Y.diffUpdate`. This is y-protocols' sync step 2.
+func DiffUpdate(update []byte, stateVector []byte) ([]byte, error) {
+	state, err := decodeStateVector(stateVector)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := decodeUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &structWriter{}
+	reader := newStructReader(decoded.structs, false)
+
+	for reader.curr != nil {
+		curr := reader.curr
+		currClient := curr.id.client
+		svClock := state[currClient]
+
+		if curr.isSkip() {
+			reader.next()
+			continue
+		}
+
+		if curr.end() > svClock {
+			var offset uint64
+			if svClock > curr.id.clock {
+				offset = svClock - curr.id.clock
+			}
+
+			writer.write(curr, offset)
+
+			for reader.next(); reader.curr != nil && reader.curr.id.client == currClient; reader.next() {
+				writer.write(reader.curr, 0)
+			}
+		} else {
+			for reader.curr != nil && reader.curr.id.client == currClient && reader.curr.end() <= svClock {
+				reader.next()
+			}
+		}
+	}
+
+	e := &encoder{}
+	writer.finish(e)
+	writeDeleteSet(e, decoded.deleteSet)
+
+	return e.buf, nil
+}
+
+// EmptyUpdate is the encoding of an update without structs or deletions.
+func EmptyUpdate() []byte {
+	return []byte{0, 0}
+}
@@ -0,0 +1,146 @@
+package yjs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// client 1 inserts "abc" into the root type "text"
+var insertABC = []byte{1, 1, 1, 0, contentString, 1, 4, 't', 'e', 'x', 't', 3, 'a', 'b', 'c', 0}
+
+// client 1 appends "de" after its own clock 2
+var insertDE = []byte{1, 1, 1, 3, contentString | bitOrigin, 1, 2, 2, 'd', 'e', 0}
+
+// client 1 inserts "abcde" in one go
+var insertABCDE = []byte{1, 1, 1, 0, contentString, 1, 4, 't', 'e', 'x', 't', 5, 'a', 'b', 'c', 'd', 'e', 0}
+
+// client 1 deletes its clock 1 ("b")
+var deleteB = []byte{0, 1, 1, 1, 1, 1}
+
+var mergedABCDE = []byte{
+	1, 2, 1, 0,
+	contentString, 1, 4, 't', 'e', 'x', 't', 3, 'a', 'b', 'c',
+	contentString | bitOrigin, 1, 2, 2, 'd', 'e',
+	0,
+}
+
+func TestMergeUpdatesInOrder(t *testing.T) {
+	merged, err := MergeUpdates([][]byte{insertABC, insertDE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(merged, mergedABCDE) {
+		t.Fatalf("unexpected merge result %v", merged)
+	}
+}
+
+func TestMergeUpdatesOutOfOrder(t *testing.T) {
+	merged, err := MergeUpdates([][]byte{insertDE, insertABC})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(merged, mergedABCDE) {
+		t.Fatalf("unexpected merge result %v", merged)
+	}
+}
+
+func TestMergeUpdatesOverlapping(t *testing.T) {
+	merged, err := MergeUpdates([][]byte{insertABC, insertABCDE, insertABC})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(merged, mergedABCDE) {
+		t.Fatalf("unexpected merge result %v", merged)
+	}
+}
+
+func TestMergeUpdatesWithDeleteSet(t *testing.T) {
+	merged, err := MergeUpdates([][]byte{insertABC, deleteB, insertDE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(append([]byte{}, mergedABCDE[:len(mergedABCDE)-1]...), 1, 1, 1, 1, 1)
+
+	if !bytes.Equal(merged, expected) {
+		t.Fatalf("unexpected merge result %v", merged)
+	}
+}
+
+func TestEncodeStateVectorFromUpdate(t *testing.T) {
+	sv, err := EncodeStateVectorFromUpdate(mergedABCDE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sv, []byte{1, 1, 5}) {
+		t.Fatalf("unexpected state vector %v", sv)
+	}
+
+	// an update that does not start at clock 0 cannot advance the state
+	sv, err = EncodeStateVectorFromUpdate(insertDE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sv, []byte{0}) {
+		t.Fatalf("unexpected state vector %v", sv)
+	}
+}
+
+func TestDiffUpdate(t *testing.T) {
+	diff, err := DiffUpdate(mergedABCDE, []byte{1, 1, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{1, 1, 1, 4, contentString | bitOrigin, 1, 3, 1, 'e', 0}
+
+	if !bytes.Equal(diff, expected) {
+		t.Fatalf("unexpected diff %v", diff)
+	}
+
+	diff, err = DiffUpdate(mergedABCDE, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(diff, mergedABCDE) {
+		t.Fatalf("diff against an empty state vector should be the full update, got %v", diff)
+	}
+
+	diff, err = DiffUpdate(mergedABCDE, []byte{1, 1, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(diff, EmptyUpdate()) {
+		t.Fatalf("diff against an up-to-date state vector should be empty, got %v", diff)
+	}
+}
+
+func TestSliceSurrogatePair(t *testing.T) {
+	s := &structRef{kind: contentString, id: id{client: 1}, strContent: "a😀b", length: utf16Length("a😀b")}
+
+	if s.length != 4 {
+		t.Fatalf("expected utf-16 length 4, got %d", s.length)
+	}
+
+	sliced, err := s.slice(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sliced.strContent != "�b" || sliced.length != 2 {
+		t.Fatalf("unexpected slice %q (%d)", sliced.strContent, sliced.length)
+	}
+}
+
+func TestDecodeRejectsTruncatedUpdate(t *testing.T) {
+	if err := ValidateUpdate(insertABC[:len(insertABC)-3]); err == nil {
+		t.Fatal("expected truncated update to be rejected")
+	}
+}
@@ -91,6 +91,28 @@ func main() {
 					return nil
 				},
 			},
+			&cli.BoolFlag{
+				Name:  "standalone",
+				Usage: "run without NATS and KVRocks, keeping pub/sub and storage in this process",
+				Action: func(ctx context.Context, command *cli.Command, b bool) error {
+					if b {
+						viper.Set("standalone.enabled", true)
+					}
+
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:  "standalone-file",
+				Usage: "file to persist the standalone store to, loaded again on start",
+				Action: func(ctx context.Context, command *cli.Command, s string) error {
+					if s != "" {
+						viper.Set("standalone.dataFile", s)
+					}
+
+					return nil
+				},
+			},
 			&cli.Uint8Flag{
 				Name:  "max-transactional-routines",
 				Usage: "maximum number of concurrent transaction routines to use per connection",
@@ -169,6 +191,9 @@ func main() {
 				}
 			}
 
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
 			bootErr := boot.Boot(ctx)
 
 			if bootErr != nil {
@@ -181,6 +206,10 @@ func main() {
 			signal.Notify(osSignalChannel, os.Interrupt, syscall.SIGTERM)
 
 			<-osSignalChannel
+
+			cancel()
+			boot.Wait()
+
 			return nil
 		},
 	}
@@ -0,0 +1,137 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"server-optimized/services/hub"
+	"server-optimized/services/nats"
+	"time"
+
+	natsGo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// StreamName is the JetStream stream that keeps the change feeds when they
+// are durable.
+const StreamName = "AIRSTATE_CHANGES"
+
+var ErrNotDurable = errors.New("the change feed is not durable, it cannot be resumed")
+
+type ServiceOptions struct {
+	// Durable keeps the changes in a JetStream stream, so that a consumer
+	// can resume from the sequence of the last change it saw. It needs a
+	// NATS server with JetStream; in memory, the feed is live only.
+	Durable bool
+
+	// MaxAge and Replicas configure the stream
+	MaxAge   time.Duration
+	Replicas int
+}
+
+type Service interface {
+	GetChangeFeed() *ChangeFeed
+}
+
+// Handler gets every change of a feed, as published by hub.PublishChange,
+// with its stream sequence; the sequence is 0 when the feed is not durable.
+type Handler func(change []byte, sequence uint64)
+
+// ChangeFeed streams every server-state write of an app to backend
+// consumers.
+type ChangeFeed struct {
+	pubSub nats.PubSub
+	stream jetstream.Stream
+}
+
+func CreateChangeFeedService(conn *natsGo.Conn, pubSub nats.PubSub, options *ServiceOptions) (*ChangeFeed, error) {
+	feed := &ChangeFeed{
+		pubSub: pubSub,
+	}
+
+	if !options.Durable || conn == nil {
+		return feed, nil
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := options.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	feed.stream, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     StreamName,
+		Subjects: []string{hub.ChangesSubject(">")},
+		MaxAge:   options.MaxAge,
+		Replicas: replicas,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return feed, nil
+}
+
+func (f *ChangeFeed) GetChangeFeed() *ChangeFeed {
+	return f
+}
+
+// Durable tells whether the feed can be resumed from a sequence.
+func (f *ChangeFeed) Durable() bool {
+	return f.stream != nil
+}
+
+// Subscribe calls handler with every change of appID, until stop is called.
+// With a durable feed, since resumes after that sequence; nil starts with
+// the changes to come.
+func (f *ChangeFeed) Subscribe(ctx context.Context, appID string, since *uint64, handler Handler) (stop func(), err error) {
+	if f.stream == nil {
+		if since != nil {
+			return nil, ErrNotDurable
+		}
+
+		subscription, err := f.pubSub.Subscribe(hub.ChangesSubject(appID), func(msg *natsGo.Msg) {
+			handler(msg.Data, 0)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return func() { subscription.Unsubscribe() }, nil
+	}
+
+	config := jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{hub.ChangesSubject(appID)},
+		DeliverPolicy:  jetstream.DeliverNewPolicy,
+	}
+
+	if since != nil {
+		config.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		config.OptStartSeq = *since + 1
+	}
+
+	consumer, err := f.stream.OrderedConsumer(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	consumeContext, err := consumer.Consume(func(msg jetstream.Msg) {
+		metadata, err := msg.Metadata()
+		if err != nil {
+			return
+		}
+
+		handler(msg.Data(), metadata.Sequence.Stream)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return consumeContext.Stop, nil
+}
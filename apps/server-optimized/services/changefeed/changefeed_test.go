@@ -0,0 +1,63 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"server-optimized/lib/jsonpatch"
+	"server-optimized/services/hub"
+	"server-optimized/services/nats"
+	"testing"
+	"time"
+)
+
+func TestChangeFeedLive(t *testing.T) {
+	pubSub := nats.NewMemoryPubSub()
+	defer pubSub.Close()
+
+	feed, err := CreateChangeFeedService(nil, pubSub, &ServiceOptions{Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feed.Durable() {
+		t.Fatal("a feed without a NATS connection cannot be durable")
+	}
+
+	since := uint64(1)
+	if _, err := feed.Subscribe(context.Background(), "app", &since, func([]byte, uint64) {}); !errors.Is(err, ErrNotDurable) {
+		t.Fatalf("expected ErrNotDurable, got %v", err)
+	}
+
+	received := make(chan hub.Change, 4)
+	stop, err := feed.Subscribe(context.Background(), "app", nil, func(data []byte, sequence uint64) {
+		var change hub.Change
+		if err := json.Unmarshal(data, &change); err != nil {
+			t.Error(err)
+		}
+
+		received <- change
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	hub.Publish(pubSub, "other-app", "doc", nil, 1, 1, hub.Origin{Op: "set", Actor: "admin:root"})
+	hub.Publish(pubSub, "app", "doc", jsonpatch.Replace(nil), nil, 7, hub.Origin{Op: "remove", Actor: "admin:app"})
+
+	select {
+	case change := <-received:
+		if change.Key != "doc" || change.Op != "remove" || change.Value != nil || change.UpdateCount != 7 || change.Actor != "admin:app" || change.Time == 0 {
+			t.Fatalf("unexpected change: %+v", change)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the change")
+	}
+
+	select {
+	case change := <-received:
+		t.Fatalf("got a change of another app: %+v", change)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,265 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"server-optimized/lib/jsonpatch"
+	"server-optimized/lib/kv_scripts"
+	"server-optimized/services/hub"
+	"server-optimized/services/kv"
+	"server-optimized/services/nats"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// appsKey is a hash of the apps whose keys were ever written with an
+	// expiry index, for the sweeper to find the indexes
+	appsKey = "server-state:expiries:apps"
+
+	// lockKey makes one instance sweep at a time
+	lockKey = "server-state:expiries:lock"
+
+	// lockIntervals is how many intervals the lock outlives the sweep that
+	// took it by, in case the instance dies while sweeping
+	lockIntervals = 10
+
+	// sweepBatch is how many due keys of an app a sweep handles; the rest
+	// wait for the next one
+	sweepBatch = 500
+)
+
+// IndexKey is the expiry index of an app: a sorted set of the state keys
+// written with a TTL, scored by when they are due in unix milliseconds. The
+// write scripts keep it, and it shares the app's hash tag so that they can.
+func IndexKey(appID string) string {
+	return appID + ":server-state:expiries"
+}
+
+type ServiceOptions struct {
+	// Native is set when the store tells about expired keys on its own, as
+	// the JetStream one does with its expiry markers; nothing is swept then
+	Native bool
+
+	// Unindexed is set when the write scripts cannot reach the index of an
+	// app, as on a cluster whose keys only share a slot per key; keys still
+	// expire, but their watchers are not told
+	Unindexed bool
+
+	// Interval is how often the indexes are swept, which is also how late
+	// watchers can hear that a key expired
+	Interval time.Duration
+}
+
+type Service interface {
+	GetExpiry() *Expiry
+}
+
+// Expiry tells watchers about server-state keys whose TTL ran out. KVRocks
+// drops such a key without a word, so the write scripts put every key with a
+// TTL in an index that a sweeper walks: for each key that is due and gone, it
+// bumps the update count and publishes null, like a remove.
+type Expiry struct {
+	store     kv.Store
+	pubSub    nats.PubSub
+	native    bool
+	unindexed bool
+	interval  time.Duration
+	instance  string
+
+	// apps registered with the sweeper by this instance
+	registered sync.Map
+
+	stop    context.CancelFunc
+	stopped sync.WaitGroup
+}
+
+func CreateExpiryService(store kv.Store, pubSub nats.PubSub, options *ServiceOptions) *Expiry {
+	interval := options.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	return &Expiry{
+		store:     store,
+		pubSub:    pubSub,
+		native:    options.Native,
+		unindexed: options.Unindexed,
+		interval:  interval,
+		instance:  strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+func (e *Expiry) GetExpiry() *Expiry {
+	return e
+}
+
+// ScriptKeys returns the keys of a write script on keys of appID with the
+// app's expiry index after them, when one is kept, and registers the app with
+// the sweeper.
+func (e *Expiry) ScriptKeys(ctx context.Context, appID string, keys ...string) []string {
+	if e.native || e.unindexed {
+		return keys
+	}
+
+	if _, ok := e.registered.Load(appID); !ok {
+		if err := e.store.HSet(ctx, appsKey, appID, "1").Err(); err != nil {
+			log.Error().Err(err).Str("app", appID).Msg("failed to register the server-state expiry index")
+		} else {
+			e.registered.Store(appID, struct{}{})
+		}
+	}
+
+	return append(keys, IndexKey(appID))
+}
+
+// Start sweeps the indexes every interval until ctx is done or Stop is
+// called.
+func (e *Expiry) Start(ctx context.Context) {
+	if e.native || e.unindexed {
+		return
+	}
+
+	ctx, e.stop = context.WithCancel(ctx)
+	e.stopped.Add(1)
+
+	go func() {
+		defer e.stopped.Done()
+
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			locked, err := e.store.SetNX(ctx, lockKey, e.instance, lockIntervals*e.interval).Result()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to take the server-state expiry lock")
+				continue
+			}
+
+			// another instance is sweeping
+			if !locked {
+				continue
+			}
+
+			if _, err := e.Sweep(ctx); err != nil {
+				log.Error().Err(err).Msg("failed to sweep expired server-state keys")
+			}
+
+			e.unlock()
+		}
+	}()
+}
+
+// unlock releases the lock, unless it ran out and another instance holds it
+// by now.
+func (e *Expiry) unlock() {
+	scriptMgr := kv_scripts.GetScriptManager(e.store)
+
+	if err := scriptMgr.Execute(context.Background(), scriptMgr.GetUnlock(), []string{lockKey}, e.instance).Err(); err != nil {
+		log.Error().Err(err).Msg("failed to release the server-state expiry lock")
+	}
+}
+
+// Stop ends the sweeps and waits for the one running, if any, so that the
+// store can be closed after it.
+func (e *Expiry) Stop() {
+	if e.stop == nil {
+		return
+	}
+
+	e.stop()
+	e.stopped.Wait()
+}
+
+// Sweep handles the keys of the indexes that are due, up to sweepBatch per
+// app, and returns how many had expired.
+func (e *Expiry) Sweep(ctx context.Context) (int, error) {
+	apps, err := e.store.HGetAll(ctx, appsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+
+	for appID := range apps {
+		if ctx.Err() != nil {
+			break
+		}
+
+		swept, err := e.sweepApp(ctx, appID)
+		if err != nil {
+			log.Error().Err(err).Str("app", appID).Msg("failed to sweep the server-state expiry index")
+		}
+
+		expired += swept
+	}
+
+	return expired, nil
+}
+
+func (e *Expiry) sweepApp(ctx context.Context, appID string) (int, error) {
+	indexKey := IndexKey(appID)
+
+	due, err := e.store.ZRangeByScore(ctx, indexKey, &goRedis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: sweepBatch,
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	scriptMgr := kv_scripts.GetScriptManager(e.store)
+	expired := 0
+
+	for _, stateKey := range due {
+		// the script takes the key out of the index, unless it has a TTL again
+		result := scriptMgr.Execute(ctx, scriptMgr.GetExpire(), []string{stateKey, stateKey + ":update-count", indexKey}, kv_scripts.HistoryArg())
+		if errors.Is(result.Err(), goRedis.Nil) {
+			// already removed
+			continue
+		}
+
+		if result.Err() != nil {
+			log.Error().Err(result.Err()).Str("key", stateKey).Msg("failed to execute expire script")
+			continue
+		}
+
+		reply, ok := result.Val().([]interface{})
+		if !ok || len(reply) != 2 {
+			// written again since
+			continue
+		}
+
+		_, key, ok := splitStateKey(stateKey)
+		if !ok {
+			continue
+		}
+
+		updateCount, _ := reply[1].(int64)
+		hub.Publish(e.pubSub, appID, key, jsonpatch.Replace(nil), nil, updateCount, hub.Origin{Op: "expire", Actor: "system:expiry"})
+
+		expired++
+	}
+
+	return expired, nil
+}
+
+// splitStateKey reads the app and key back from <app>:server-state:<key>:state.
+func splitStateKey(stateKey string) (string, string, bool) {
+	appID, rest, found := strings.Cut(stateKey, ":server-state:")
+	key, isState := strings.CutSuffix(rest, ":state")
+
+	return appID, key, found && isState && appID != "" && key != ""
+}
@@ -0,0 +1,162 @@
+package expiry
+
+import (
+	"context"
+	"server-optimized/lib/kv_scripts"
+	"server-optimized/services/hub"
+	"server-optimized/services/kv"
+	"server-optimized/services/nats"
+	"testing"
+	"time"
+
+	natsGo "github.com/nats-io/nats.go"
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+func TestSweepPublishesExpiredKeys(t *testing.T) {
+	pubSub := nats.NewMemoryPubSub()
+	defer pubSub.Close()
+
+	store, err := kv.NewMemoryStore(&kv.MemoryStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	scriptMgr := kv_scripts.GetScriptManager(store)
+	expiry := CreateExpiryService(store, pubSub, &ServiceOptions{})
+	keys := expiry.ScriptKeys(ctx, "app", "app:server-state:poll:state", "app:server-state:poll:state:update-count")
+
+	ttl := int64(20)
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetReplace(), keys, "", `{"votes":1}`, kv_scripts.TTLArg(&ttl)).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// written again without a TTL, then with one: indexed once, by the last
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetTouch(), keys, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if due, _ := store.ZRangeByScore(ctx, IndexKey("app"), &goRedis.ZRangeBy{Min: "-inf", Max: "+inf"}).Result(); len(due) != 0 {
+		t.Fatalf("a key without a TTL stayed in the index: %v", due)
+	}
+
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetTouch(), keys, kv_scripts.TTLArg(&ttl)).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	subject, _ := hub.Subject("app", "poll")
+	messages := make(chan *natsGo.Msg, 4)
+	subscription, err := pubSub.ChanSubscribe(subject, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe()
+
+	// not due yet
+	if expired, err := expiry.Sweep(ctx); err != nil || expired != 0 {
+		t.Fatalf("swept %d keys early: %v", expired, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if expired, err := expiry.Sweep(ctx); err != nil || expired != 1 {
+		t.Fatalf("expected one expired key, got %d: %v", expired, err)
+	}
+
+	select {
+	case msg := <-messages:
+		if string(msg.Data) != "null" || msg.Header.Get("update_count") != "2" {
+			t.Fatalf("unexpected message %q with update count %q", msg.Data, msg.Header.Get("update_count"))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no update for the expired key")
+	}
+
+	if due, _ := store.ZRangeByScore(ctx, IndexKey("app"), &goRedis.ZRangeBy{Min: "-inf", Max: "+inf"}).Result(); len(due) != 0 {
+		t.Fatalf("the index kept %v", due)
+	}
+}
+
+func TestSweepRemovedKeys(t *testing.T) {
+	store, err := kv.NewMemoryStore(&kv.MemoryStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	scriptMgr := kv_scripts.GetScriptManager(store)
+	expiry := CreateExpiryService(store, nats.NewMemoryPubSub(), &ServiceOptions{})
+	keys := expiry.ScriptKeys(ctx, "app", "app:server-state:draft:state", "app:server-state:draft:state:update-count")
+
+	ttl := int64(10)
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetReplace(), keys, "", `"text"`, kv_scripts.TTLArg(&ttl)).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetRemove(), keys, "").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if due, _ := store.ZRangeByScore(ctx, IndexKey("app"), &goRedis.ZRangeBy{Min: "-inf", Max: "+inf"}).Result(); len(due) != 0 {
+		t.Fatalf("a removed key stayed in the index: %v", due)
+	}
+}
+
+func TestExpiryUnlock(t *testing.T) {
+	store, err := kv.NewMemoryStore(&kv.MemoryStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	expiry := CreateExpiryService(store, nats.NewMemoryPubSub(), &ServiceOptions{})
+
+	// the lock ran out and another instance took it
+	store.Set(ctx, lockKey, "other", 0)
+	expiry.unlock()
+
+	if values, _ := store.MGet(ctx, lockKey).Result(); len(values) != 1 || values[0] != "other" {
+		t.Fatalf("released the lock of another instance: %v", values)
+	}
+
+	store.Set(ctx, lockKey, expiry.instance, 0)
+	expiry.unlock()
+
+	if values, _ := store.MGet(ctx, lockKey).Result(); len(values) != 1 || values[0] != nil {
+		t.Fatalf("kept its own lock: %v", values)
+	}
+}
+
+func TestExpiryStop(t *testing.T) {
+	store, err := kv.NewMemoryStore(&kv.MemoryStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	expiry := CreateExpiryService(store, nats.NewMemoryPubSub(), &ServiceOptions{Interval: 5 * time.Millisecond})
+	expiry.Start(ctx)
+
+	time.Sleep(20 * time.Millisecond)
+	expiry.Stop()
+
+	// a sweep would take the key out of the index, so none must run after Stop
+	scriptMgr := kv_scripts.GetScriptManager(store)
+	keys := expiry.ScriptKeys(ctx, "app", "app:server-state:poll:state", "app:server-state:poll:state:update-count")
+
+	ttl := int64(1)
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetReplace(), keys, "", "1", kv_scripts.TTLArg(&ttl)).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if due, _ := store.ZRangeByScore(ctx, IndexKey("app"), &goRedis.ZRangeBy{Min: "-inf", Max: "+inf"}).Result(); len(due) != 1 {
+		t.Fatalf("the sweeper kept running after Stop: %v", due)
+	}
+}
@@ -0,0 +1,246 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"server-optimized/lib/kv_scripts"
+	"server-optimized/services/kv"
+	"server-optimized/services/localstate"
+	natsService "server-optimized/services/nats"
+	"server-optimized/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	natsGo "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+type Service interface {
+	GetHub() *Hub
+}
+
+// resyncReadTimeout bounds the KV read of each key in Resync
+const resyncReadTimeout = 5 * time.Second
+
+// Hub fans server-state updates out to every local watcher of a key through a
+// single NATS subscription per subject, decoding each message once no matter
+// how many sessions and SSE streams are watching.
+type Hub struct {
+	pubSub natsService.PubSub
+
+	mu       sync.Mutex
+	subjects map[string]*subject
+}
+
+type subject struct {
+	appID        string
+	key          string
+	subscription natsService.Subscription
+	watchers     map[*Watch]func(update *localstate.ServerStateUpdate)
+}
+
+// Watch is one watcher's registration on a subject. It satisfies
+// localstate.Subscription.
+type Watch struct {
+	hub     *Hub
+	subject string
+}
+
+func (h *Hub) GetHub() *Hub {
+	return h
+}
+
+func CreateHub(pubSub natsService.PubSub) *Hub {
+	return &Hub{
+		pubSub:   pubSub,
+		subjects: make(map[string]*subject),
+	}
+}
+
+// Subject is where the admin plane publishes the updates of a key.
+func Subject(appID string, key string) (string, error) {
+	hashedKey, err := utils.GenerateHash(key)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("server-state.%s_%s", appID, hashedKey), nil
+}
+
+// Watch calls handler with every update published for key until the returned
+// Watch is unsubscribed. handler runs on the subject's dispatch goroutine and
+// is shared with every other watcher of the key, so it must neither block nor
+// modify the update; a Queue is the usual handler.
+func (h *Hub) Watch(appID string, key string, handler func(update *localstate.ServerStateUpdate)) (*Watch, error) {
+	subjectName, err := Subject(appID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entry, ok := h.subjects[subjectName]
+	if !ok {
+		entry = &subject{
+			appID:    appID,
+			key:      key,
+			watchers: make(map[*Watch]func(update *localstate.ServerStateUpdate)),
+		}
+
+		subscription, err := h.pubSub.Subscribe(subjectName, func(msg *natsGo.Msg) {
+			update, err := UpdateFromMsg(appID, key, msg)
+			if err != nil {
+				log.Error().Err(err).Str("subject", subjectName).Msg("failed to unmarshal nats message for server-state")
+				return
+			}
+
+			h.mu.Lock()
+			handlers := make([]func(update *localstate.ServerStateUpdate), 0, len(entry.watchers))
+			for _, handler := range entry.watchers {
+				handlers = append(handlers, handler)
+			}
+			h.mu.Unlock()
+
+			for _, handler := range handlers {
+				handler(update)
+			}
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		entry.subscription = subscription
+		h.subjects[subjectName] = entry
+	}
+
+	watch := &Watch{
+		hub:     h,
+		subject: subjectName,
+	}
+
+	entry.watchers[watch] = handler
+
+	return watch, nil
+}
+
+// Unsubscribe removes the watcher; the NATS subscription goes with the last
+// one. It is safe to call more than once.
+func (w *Watch) Unsubscribe() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+
+	entry, ok := w.hub.subjects[w.subject]
+	if !ok {
+		return nil
+	}
+
+	delete(entry.watchers, w)
+
+	if len(entry.watchers) > 0 {
+		return nil
+	}
+
+	delete(w.hub.subjects, w.subject)
+
+	return entry.subscription.Unsubscribe()
+}
+
+// Resync reads every watched key from KV and hands it to its watchers, for
+// when updates may have been missed, like while NATS was reconnecting. The
+// values go out as regular updates rather than snapshots, so watchers that
+// are already up to date drop them by their update count.
+func (h *Hub) Resync(ctx context.Context, kvClient kv.Store) {
+	h.mu.Lock()
+	entries := make([]*subject, 0, len(h.subjects))
+	for _, entry := range h.subjects {
+		entries = append(entries, entry)
+	}
+	h.mu.Unlock()
+
+	for _, entry := range entries {
+		readCtx, cancel := context.WithTimeout(ctx, resyncReadTimeout)
+		update, err := ReadSnapshot(readCtx, kvClient, entry.appID, entry.key)
+		cancel()
+
+		if err != nil {
+			log.Error().Err(err).Str("appId", entry.appID).Str("key", entry.key).Msg("failed to resync server-state key")
+			continue
+		}
+
+		update.Snapshot = false
+
+		h.mu.Lock()
+		handlers := make([]func(update *localstate.ServerStateUpdate), 0, len(entry.watchers))
+		for _, handler := range entry.watchers {
+			handlers = append(handlers, handler)
+		}
+		h.mu.Unlock()
+
+		for _, handler := range handlers {
+			handler(update)
+		}
+	}
+
+	log.Info().Int("keys", len(entries)).Msg("resynced watched server-state keys")
+}
+
+// ReadSnapshot reads a key's value together with its update count (0 for a
+// key that was never written) in a single MGET.
+func ReadSnapshot(ctx context.Context, kvClient kv.Store, appID string, key string) (*localstate.ServerStateUpdate, error) {
+	fullKey := fmt.Sprintf("%s:server-state:%s:state", appID, key)
+
+	values, err := kvClient.MGet(ctx, fullKey, fullKey+":update-count").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &localstate.ServerStateUpdate{
+		AppID:    appID,
+		Key:      key,
+		Snapshot: true,
+	}
+
+	if rawValue, ok := values[0].(string); ok && rawValue != "" && rawValue != "null" {
+		snapshot.Value = kv_scripts.DecodeStoredValue(rawValue)
+	}
+
+	if rawCount, ok := values[1].(string); ok {
+		snapshot.UpdateCount, _ = strconv.ParseInt(rawCount, 10, 64)
+	}
+
+	return snapshot, nil
+}
+
+// UpdateFromMsg reads a message published by the admin plane: the full value,
+// its update count and, when the writer could compute one, the delta from the
+// previous count.
+func UpdateFromMsg(appID string, key string, msg *natsGo.Msg) (*localstate.ServerStateUpdate, error) {
+	update := &localstate.ServerStateUpdate{AppID: appID, Key: key}
+
+	if len(msg.Data) != 0 && string(msg.Data) != "null" {
+		if err := json.Unmarshal(msg.Data, &update.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	updateCount, err := strconv.ParseInt(msg.Header.Get("update_count"), 10, 64)
+	if err != nil {
+		updateCount = -1
+	}
+
+	update.UpdateCount = updateCount
+
+	if delta := msg.Header.Get("delta"); delta != "" && update.UpdateCount > 0 {
+		baseUpdateCount, err := strconv.ParseInt(msg.Header.Get("base_update_count"), 10, 64)
+		if err == nil {
+			update.BaseUpdateCount = baseUpdateCount
+			update.Delta = json.RawMessage(delta)
+		}
+	}
+
+	return update, nil
+}
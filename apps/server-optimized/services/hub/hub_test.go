@@ -0,0 +1,48 @@
+package hub
+
+import (
+	"context"
+	"server-optimized/services/kv"
+	"server-optimized/services/localstate"
+	"server-optimized/services/nats"
+	"testing"
+)
+
+func TestHubResync(t *testing.T) {
+	pubSub := nats.NewMemoryPubSub()
+	defer pubSub.Close()
+
+	store, err := kv.NewMemoryStore(&kv.MemoryStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	store.Set(ctx, "app:server-state:doc:state", `{"a":1}`, 0)
+	store.Set(ctx, "app:server-state:doc:state:update-count", "4", 0)
+
+	hub := CreateHub(pubSub)
+
+	var received []*localstate.ServerStateUpdate
+	watch, err := hub.Watch("app", "doc", func(update *localstate.ServerStateUpdate) {
+		received = append(received, update)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Unsubscribe()
+
+	hub.Resync(ctx, store)
+
+	if len(received) != 1 {
+		t.Fatalf("expected one update, got %d", len(received))
+	}
+
+	update := received[0]
+	value, _ := update.Value.(map[string]interface{})
+
+	if update.Key != "doc" || update.UpdateCount != 4 || update.Snapshot || value["a"] != float64(1) {
+		t.Fatalf("unexpected update: %+v", update)
+	}
+}
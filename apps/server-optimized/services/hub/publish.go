@@ -0,0 +1,125 @@
+package hub
+
+import (
+	"encoding/json"
+	"server-optimized/lib/jsonpatch"
+	"server-optimized/lib/kv_scripts"
+	natsService "server-optimized/services/nats"
+	"strconv"
+	"time"
+
+	natsGo "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+// Origin is what made a write, as the change feed tells it: the operation
+// (set, merge, atomic, remove, ...) and who ran it.
+type Origin struct {
+	Op    string
+	Actor string
+}
+
+// Change is a write as the change feed of its app carries it.
+type Change struct {
+	Key         string                `json:"key"`
+	Op          string                `json:"op"`
+	Value       interface{}           `json:"value"`
+	Delta       []jsonpatch.Operation `json:"delta,omitempty"`
+	UpdateCount int64                 `json:"update_count"`
+	Actor       string                `json:"actor,omitempty"`
+
+	// Time is when the change was published, in unix milliseconds
+	Time int64 `json:"time"`
+}
+
+// ChangesSubject is where every write of an app is published for the change
+// feed, whatever the key.
+func ChangesSubject(appID string) string {
+	return "server-state-changes." + appID
+}
+
+// Publish fans a write out to the key's subscribers and to the change feed of
+// the app. The message always carries the full value; when the delta (a JSON
+// Patch from the value at update_count - 1) is smaller than that, it rides
+// along in the `delta` and `base_update_count` headers for subscribers that
+// asked for deltas.
+func Publish(pubSub natsService.PubSub, appID string, key string, delta []jsonpatch.Operation, value interface{}, updateCount int64, origin Origin) {
+
+	subject, err := Subject(appID, key)
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Msg("Failed to generate key hash")
+		return
+	}
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Msg("Failed to marshal event")
+		return
+	}
+
+	msg := natsGo.NewMsg(subject)
+	msg.Data = valueJSON
+	msg.Header.Add("update_count", strconv.FormatInt(updateCount, 10))
+
+	if delta != nil {
+		deltaJSON, err := json.Marshal(delta)
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Msg("Failed to marshal delta")
+		} else if len(deltaJSON) < len(valueJSON) {
+			msg.Header.Add("base_update_count", strconv.FormatInt(updateCount-1, 10))
+			msg.Header.Add("delta", string(deltaJSON))
+		}
+	}
+
+	if err := pubSub.PublishMsg(msg); err != nil {
+		log.Error().Err(err).Msg("Failed to publish to NATS")
+	}
+
+	PublishChange(pubSub, appID, &Change{
+		Key:         key,
+		Op:          origin.Op,
+		Value:       value,
+		Delta:       delta,
+		UpdateCount: updateCount,
+		Actor:       origin.Actor,
+	})
+}
+
+// PublishChange publishes a write to the change feed of appID.
+func PublishChange(pubSub natsService.PubSub, appID string, change *Change) {
+	if change.Time == 0 {
+		change.Time = time.Now().UnixMilli()
+	}
+
+	changeJSON, err := json.Marshal(change)
+	if err != nil {
+		log.Error().Err(err).Str("key", change.Key).Msg("Failed to marshal change")
+		return
+	}
+
+	if err := pubSub.Publish(ChangesSubject(appID), changeJSON); err != nil {
+		log.Error().Err(err).Msg("Failed to publish change to NATS")
+	}
+}
+
+// DiffFromStored computes the delta from the stored value a script returned
+// as "previous" (nil when the key did not exist). Only objects and arrays are
+// diffed; any other change replaces the value as a whole.
+func DiffFromStored(previous interface{}, value interface{}) []jsonpatch.Operation {
+	raw, ok := previous.(string)
+	if !ok {
+		return jsonpatch.Replace(value)
+	}
+
+	previousValue := kv_scripts.DecodeStoredValue(raw)
+
+	switch previousValue.(type) {
+	case map[string]interface{}, []interface{}:
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return jsonpatch.Diff(previousValue, value)
+		}
+	}
+
+	return jsonpatch.Replace(value)
+}
@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"server-optimized/services/localstate"
+	"sync"
+)
+
+// Queue is a session's inbox for server-state updates. Push never blocks, so
+// a slow client can not hold up the hub or the other watchers of a key: the
+// queue keeps at most one pending update per key of an app, and an update
+// for a key that is still pending takes the place of the older one. What the
+// client misses in between is covered by the newer value, and the update
+// counts tell the consumer that a delta no longer applies.
+type Queue struct {
+	mu      sync.Mutex
+	pending map[localstate.ServerStateKey]*localstate.ServerStateUpdate
+	order   []localstate.ServerStateKey
+	ready   chan struct{}
+	closed  bool
+}
+
+func NewQueue() *Queue {
+	return &Queue{
+		pending: make(map[localstate.ServerStateKey]*localstate.ServerStateUpdate),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+func (q *Queue) Push(update *localstate.ServerStateUpdate) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	stateKey := update.StateKey()
+
+	if current, ok := q.pending[stateKey]; ok {
+		if !supersedes(current, update) {
+			q.pending[stateKey] = update
+		}
+
+		return
+	}
+
+	q.pending[stateKey] = update
+	q.order = append(q.order, stateKey)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready receives once there is something to Drain.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Drain takes the pending updates, in the order their keys were first queued.
+func (q *Queue) Drain() []*localstate.ServerStateUpdate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	updates := make([]*localstate.ServerStateUpdate, 0, len(q.order))
+	for _, stateKey := range q.order {
+		updates = append(updates, q.pending[stateKey])
+	}
+
+	q.pending = make(map[localstate.ServerStateKey]*localstate.ServerStateUpdate)
+	q.order = q.order[:0]
+
+	return updates
+}
+
+// Close drops everything pushed from now on.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.pending = nil
+	q.order = nil
+}
+
+// supersedes tells whether the pending update current is to be kept over
+// update, which is the case when update is older or is a published copy of a
+// snapshot that has to be delivered as one.
+func supersedes(current *localstate.ServerStateUpdate, update *localstate.ServerStateUpdate) bool {
+	if current.UpdateCount < 0 || update.UpdateCount < 0 {
+		return false
+	}
+
+	return update.UpdateCount < current.UpdateCount || (update.UpdateCount == current.UpdateCount && current.Snapshot && !update.Snapshot)
+}
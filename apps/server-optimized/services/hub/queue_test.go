@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"server-optimized/services/localstate"
+	"testing"
+)
+
+func update(key string, updateCount int64, snapshot bool) *localstate.ServerStateUpdate {
+	return &localstate.ServerStateUpdate{Key: key, UpdateCount: updateCount, Snapshot: snapshot}
+}
+
+func TestQueueCoalescesPerKey(t *testing.T) {
+	queue := NewQueue()
+
+	queue.Push(update("a", 1, false))
+	queue.Push(update("b", 1, false))
+	queue.Push(update("a", 3, false))
+	queue.Push(update("a", 2, false))
+
+	select {
+	case <-queue.Ready():
+	default:
+		t.Fatal("queue is not ready after a push")
+	}
+
+	updates := queue.Drain()
+	if len(updates) != 2 || updates[0].Key != "a" || updates[0].UpdateCount != 3 || updates[1].Key != "b" {
+		t.Fatalf("unexpected drain: %+v", updates)
+	}
+
+	if len(queue.Drain()) != 0 {
+		t.Fatal("drain did not empty the queue")
+	}
+}
+
+func TestQueueKeepsAppsApart(t *testing.T) {
+	queue := NewQueue()
+
+	first := update("a", 4, false)
+	first.AppID = "first"
+
+	second := update("a", 1, false)
+	second.AppID = "second"
+
+	queue.Push(first)
+	queue.Push(second)
+
+	updates := queue.Drain()
+	if len(updates) != 2 || updates[0].AppID != "first" || updates[1].AppID != "second" || updates[1].UpdateCount != 1 {
+		t.Fatalf("unexpected drain: %+v", updates)
+	}
+}
+
+func TestQueueKeepsSnapshotOverPublishedCopy(t *testing.T) {
+	queue := NewQueue()
+
+	queue.Push(update("a", 5, true))
+	queue.Push(update("a", 5, false))
+
+	if updates := queue.Drain(); len(updates) != 1 || !updates[0].Snapshot {
+		t.Fatalf("the snapshot was replaced: %+v", updates)
+	}
+
+	// without a count, the newest always wins
+	queue.Push(update("a", 5, false))
+	queue.Push(update("a", -1, false))
+
+	if updates := queue.Drain(); len(updates) != 1 || updates[0].UpdateCount != -1 {
+		t.Fatalf("an update without a count was dropped: %+v", updates)
+	}
+}
+
+func TestQueueDropsAfterClose(t *testing.T) {
+	queue := NewQueue()
+	queue.Close()
+
+	queue.Push(update("a", 1, false))
+
+	if updates := queue.Drain(); len(updates) != 0 {
+		t.Fatalf("a closed queue took an update: %+v", updates)
+	}
+}
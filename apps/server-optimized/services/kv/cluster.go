@@ -0,0 +1,287 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+const (
+	clusterHashTagApp = "app"
+	clusterHashTagKey = "key"
+
+	// clusterScanNodeShift puts the node index above the node's own cursor
+	clusterScanNodeShift = 48
+)
+
+// clusterStore is a Store on a Redis Cluster. Every key gets a hash tag in
+// front, {<hash>}, so that the keys a script or transaction touches together
+// are in one slot: the state and update-count keys of a server-state key, the
+// snapshot and updates of a document, the peers and heartbeats of a room. In
+// the app hash tag mode it is all keys of the app. The tag never leaves the
+// store, Scan strips it again.
+type clusterStore struct {
+	client  *goRedis.ClusterClient
+	hashTag string
+}
+
+func newClusterStore(client *goRedis.ClusterClient, hashTag string) (*clusterStore, error) {
+	switch hashTag {
+	case "":
+		hashTag = clusterHashTagApp
+	case clusterHashTagApp, clusterHashTagKey:
+	default:
+		return nil, fmt.Errorf("unknown kv cluster hash tag %q, expected app or key", hashTag)
+	}
+
+	return &clusterStore{client: client, hashTag: hashTag}, nil
+}
+
+// tag prefixes the key with the hash tag of its group: the app (the part
+// before the first ':') or the first three parts, e.g. app:server-state:doc
+// for both app:server-state:doc:state and its update-count key.
+func (c *clusterStore) tag(key string) string {
+	parts := 3
+	if c.hashTag == clusterHashTagApp {
+		parts = 1
+	}
+
+	group := key
+	if fields := strings.SplitN(key, ":", parts+1); len(fields) > parts {
+		group = strings.Join(fields[:parts], ":")
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(group))
+
+	return "{" + strconv.FormatUint(hash.Sum64(), 16) + "}" + key
+}
+
+func (c *clusterStore) tags(keys []string) []string {
+	tagged := make([]string, len(keys))
+	for i, key := range keys {
+		tagged[i] = c.tag(key)
+	}
+
+	return tagged
+}
+
+func untag(key string) string {
+	if !strings.HasPrefix(key, "{") {
+		return key
+	}
+
+	if index := strings.IndexByte(key, '}'); index >= 0 {
+		return key[index+1:]
+	}
+
+	return key
+}
+
+// MGet reads the keys with one GET each, as they may be in different slots.
+func (c *clusterStore) MGet(ctx context.Context, keys ...string) *goRedis.SliceCmd {
+	pipe := c.client.Pipeline()
+
+	gets := make([]*goRedis.StringCmd, len(keys))
+	for i, key := range keys {
+		gets[i] = pipe.Get(ctx, c.tag(key))
+	}
+
+	// a missing key fails its GET with redis: nil, which is a nil value here
+	pipe.Exec(ctx)
+
+	values := make([]interface{}, len(keys))
+	for i, get := range gets {
+		switch err := get.Err(); err {
+		case nil:
+			values[i] = get.Val()
+		case goRedis.Nil:
+		default:
+			return goRedis.NewSliceResult(nil, err)
+		}
+	}
+
+	return goRedis.NewSliceResult(values, nil)
+}
+
+func (c *clusterStore) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.StatusCmd {
+	return c.client.Set(ctx, c.tag(key), value, expiration)
+}
+
+func (c *clusterStore) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.BoolCmd {
+	return c.client.SetNX(ctx, c.tag(key), value, expiration)
+}
+
+func (c *clusterStore) GetDel(ctx context.Context, key string) *goRedis.StringCmd {
+	return c.client.GetDel(ctx, c.tag(key))
+}
+
+// Del deletes the keys with one DEL each, as they may be in different slots.
+func (c *clusterStore) Del(ctx context.Context, keys ...string) *goRedis.IntCmd {
+	pipe := c.client.Pipeline()
+
+	dels := make([]*goRedis.IntCmd, len(keys))
+	for i, key := range keys {
+		dels[i] = pipe.Del(ctx, c.tag(key))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return goRedis.NewIntResult(0, err)
+	}
+
+	var deleted int64
+	for _, del := range dels {
+		deleted += del.Val()
+	}
+
+	return goRedis.NewIntResult(deleted, nil)
+}
+
+// masters lists the master nodes in a stable order, for Scan to walk through.
+func (c *clusterStore) masters(ctx context.Context) ([]*goRedis.Client, error) {
+	var mu sync.Mutex
+	var masters []*goRedis.Client
+
+	err := c.client.ForEachMaster(ctx, func(ctx context.Context, client *goRedis.Client) error {
+		mu.Lock()
+		masters = append(masters, client)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+
+	return masters, nil
+}
+
+// Scan walks the masters one after the other. The cursor holds the index of
+// the master above clusterScanNodeShift and that master's cursor below it.
+// A resharding during a scan can skip or repeat keys, just like SCAN can.
+func (c *clusterStore) Scan(ctx context.Context, cursor uint64, match string, count int64) *goRedis.ScanCmd {
+	masters, err := c.masters(ctx)
+	if err != nil {
+		return goRedis.NewScanCmdResult(nil, 0, err)
+	}
+
+	node := int(cursor >> clusterScanNodeShift)
+	nodeCursor := cursor & (1<<clusterScanNodeShift - 1)
+
+	if node >= len(masters) {
+		return goRedis.NewScanCmdResult(nil, 0, nil)
+	}
+
+	if match == "" {
+		match = "*"
+	}
+
+	keys, next, err := masters[node].Scan(ctx, nodeCursor, "{*}"+match, count).Result()
+	if err != nil {
+		return goRedis.NewScanCmdResult(nil, 0, err)
+	}
+
+	for i, key := range keys {
+		keys[i] = untag(key)
+	}
+
+	if next != 0 {
+		return goRedis.NewScanCmdResult(keys, uint64(node)<<clusterScanNodeShift|next, nil)
+	}
+
+	if node+1 < len(masters) {
+		return goRedis.NewScanCmdResult(keys, uint64(node+1)<<clusterScanNodeShift, nil)
+	}
+
+	return goRedis.NewScanCmdResult(keys, 0, nil)
+}
+
+func (c *clusterStore) HGetAll(ctx context.Context, key string) *goRedis.MapStringStringCmd {
+	return c.client.HGetAll(ctx, c.tag(key))
+}
+
+func (c *clusterStore) HSet(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	return c.client.HSet(ctx, c.tag(key), values...)
+}
+
+func (c *clusterStore) HDel(ctx context.Context, key string, fields ...string) *goRedis.IntCmd {
+	return c.client.HDel(ctx, c.tag(key), fields...)
+}
+
+func (c *clusterStore) RPush(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	return c.client.RPush(ctx, c.tag(key), values...)
+}
+
+// ZRangeByScore returns the members untagged: the sets hold keys, which a
+// script adds through its KEYS, so they come in tagged.
+func (c *clusterStore) ZRangeByScore(ctx context.Context, key string, opt *goRedis.ZRangeBy) *goRedis.StringSliceCmd {
+	return untagMembers(c.client.ZRangeByScore(ctx, c.tag(key), opt))
+}
+
+func untagMembers(cmd *goRedis.StringSliceCmd) *goRedis.StringSliceCmd {
+	members := cmd.Val()
+	for i, member := range members {
+		members[i] = untag(member)
+	}
+
+	cmd.SetVal(members)
+
+	return cmd
+}
+
+func (c *clusterStore) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *goRedis.Cmd {
+	return c.client.EvalSha(ctx, sha1, c.tags(keys), args...)
+}
+
+// ScriptLoad loads the script on every master.
+func (c *clusterStore) ScriptLoad(ctx context.Context, script string) *goRedis.StringCmd {
+	return c.client.ScriptLoad(ctx, script)
+}
+
+func (c *clusterStore) TxPipeline() Tx {
+	return &clusterTx{store: c, pipe: c.client.TxPipeline()}
+}
+
+func (c *clusterStore) Close() error {
+	return c.client.Close()
+}
+
+// clusterTx tags the keys of a transaction; they must be in one slot.
+type clusterTx struct {
+	store *clusterStore
+	pipe  goRedis.Pipeliner
+}
+
+func (t *clusterTx) Get(ctx context.Context, key string) *goRedis.StringCmd {
+	return t.pipe.Get(ctx, t.store.tag(key))
+}
+
+func (t *clusterTx) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.StatusCmd {
+	return t.pipe.Set(ctx, t.store.tag(key), value, expiration)
+}
+
+func (t *clusterTx) LRange(ctx context.Context, key string, start, stop int64) *goRedis.StringSliceCmd {
+	return t.pipe.LRange(ctx, t.store.tag(key), start, stop)
+}
+
+func (t *clusterTx) LTrim(ctx context.Context, key string, start, stop int64) *goRedis.StatusCmd {
+	return t.pipe.LTrim(ctx, t.store.tag(key), start, stop)
+}
+
+func (t *clusterTx) HSet(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	return t.pipe.HSet(ctx, t.store.tag(key), values...)
+}
+
+func (t *clusterTx) Exec(ctx context.Context) ([]goRedis.Cmder, error) {
+	return t.pipe.Exec(ctx)
+}
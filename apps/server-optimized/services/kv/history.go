@@ -0,0 +1,74 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// HistorySuffix marks the list holding the past versions of a server-state
+// key, newest first, next to its state key.
+const HistorySuffix = ":history"
+
+// HistoryEntry is one version of a key: its value after the write that
+// made update count UpdateCount, or Deleted when that write removed it.
+type HistoryEntry struct {
+	UpdateCount int64   `json:"update_count"`
+	Value       *string `json:"value,omitempty"`
+	Deleted     bool    `json:"deleted,omitempty"`
+
+	// Time is when the version was written, in unix milliseconds
+	Time int64 `json:"time"`
+}
+
+// historyStore is a store that keeps the versions of a key on its own.
+type historyStore interface {
+	History(ctx context.Context, key string) ([]HistoryEntry, error)
+}
+
+// ReadHistory returns the versions of the state key, newest first: the list
+// the write scripts keep, or what the store itself remembers.
+func ReadHistory(ctx context.Context, store Store, key string) ([]HistoryEntry, error) {
+	if history, ok := store.(historyStore); ok {
+		return history.History(ctx, key)
+	}
+
+	tx := store.TxPipeline()
+	versions := tx.LRange(ctx, key+HistorySuffix, 0, -1)
+
+	if _, err := tx.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	entries := make([]HistoryEntry, 0, len(versions.Val()))
+	for _, raw := range versions.Val() {
+		var entry HistoryEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// TrimHistory applies the bounds of the history, for stores that do not trim
+// it on write.
+func TrimHistory(entries []HistoryEntry, maxVersions int, maxAge time.Duration) []HistoryEntry {
+	if maxVersions > 0 && len(entries) > maxVersions {
+		entries = entries[:maxVersions]
+	}
+
+	if maxAge > 0 {
+		oldest := time.Now().Add(-maxAge).UnixMilli()
+
+		for i, entry := range entries {
+			if entry.Time < oldest {
+				return entries[:i]
+			}
+		}
+	}
+
+	return entries
+}
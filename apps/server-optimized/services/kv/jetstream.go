@@ -0,0 +1,768 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	natsGo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+const (
+	// updateCountSuffix marks the key holding another key's update count
+	updateCountSuffix = ":update-count"
+
+	// jetStreamWriterHeader marks the writes made through the store, so the
+	// fan-out consumer can tell them from writes made by other NATS clients
+	jetStreamWriterHeader = "Airstate-Writer"
+
+	jetStreamKVOperationHeader = "KV-Operation"
+
+	// jetStreamWriteAttempts bounds the compare-and-set retries of a write
+	jetStreamWriteAttempts = 16
+)
+
+var errJetStreamContention = errors.New("ERR the key kept changing, giving up after retrying")
+
+// JetStreamStore is a Store on JetStream Key-Value buckets, so that NATS is
+// all AirState needs. Every app (the part of a key before its first `:`) has
+// its own bucket, every key is one entry, and every write is a
+// compare-and-set on the revision it was based on. Hashes and lists are
+// stored JSON encoded and rewritten as a whole.
+//
+// Update counts are not stored: the `<key>:update-count` of a key reads as
+// the revision of the key's last write or delete, and a script's INCR of it
+// is the revision its write gets. Revisions grow but skip, since they are
+// shared by the bucket, so subscribers that asked for deltas get full values:
+// a delta is only published on top of the count right before.
+//
+// A script may write one key, which covers every admin operation but
+// multi-key transactions.
+type JetStreamStore struct {
+	js      jetstream.JetStream
+	options JetStreamStoreOptions
+	scripts *scriptCache
+
+	mu      sync.Mutex
+	buckets map[string]*jetStreamBucket
+	closed  bool
+}
+
+type JetStreamStoreOptions struct {
+	// BucketPrefix names the buckets, `<prefix>_<app>`
+	BucketPrefix string
+
+	// Replicas and History configure the buckets the store creates
+	Replicas int
+	History  int
+
+	// OnExternalWrite, when set, is called once per cluster with every write
+	// another NATS client makes to a bucket this node has opened
+	OnExternalWrite func(key string, value []byte, deleted bool, revision uint64)
+}
+
+type jetStreamBucket struct {
+	name   string
+	app    string
+	kv     jetstream.KeyValue
+	stream jetstream.Stream
+
+	fanOut jetstream.ConsumeContext
+}
+
+// jetStreamEntry is what the last message on a key's subject says about it.
+type jetStreamEntry struct {
+	value []byte
+
+	// revision is the stream sequence of the last message, or 0 if there is
+	// none; deletes and expiry markers have revisions too
+	revision uint64
+	exists   bool
+
+	// expiresAt is when a value written with a TTL goes, zero for never
+	expiresAt time.Time
+}
+
+// jetStreamWrite is a new value for a key, or its deletion.
+type jetStreamWrite struct {
+	value   []byte
+	deleted bool
+	ttl     time.Duration
+}
+
+func NewJetStreamStore(conn *natsGo.Conn, options *JetStreamStoreOptions) (*JetStreamStore, error) {
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &JetStreamStore{
+		js:      js,
+		options: *options,
+		scripts: newScriptCache(),
+		buckets: make(map[string]*jetStreamBucket),
+	}
+
+	if s.options.BucketPrefix == "" {
+		s.options.BucketPrefix = "airstate"
+	}
+
+	return s, nil
+}
+
+// splitKey maps a key to its bucket and the entry key within it.
+func (s *JetStreamStore) splitKey(key string) (app string, bucket string, entryKey string) {
+	app, rest, found := strings.Cut(key, ":")
+	if !found {
+		app, rest = "", key
+	}
+
+	return app, s.bucketName(app), encodeJetStreamKey(rest)
+}
+
+func (s *JetStreamStore) bucketName(app string) string {
+	if app == "" {
+		return s.options.BucketPrefix
+	}
+
+	var name strings.Builder
+	name.WriteString(s.options.BucketPrefix)
+	name.WriteByte('_')
+
+	for i := 0; i < len(app); i++ {
+		c := app[i]
+		if c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			name.WriteByte(c)
+		} else {
+			fmt.Fprintf(&name, "_%02X", c)
+		}
+	}
+
+	return name.String()
+}
+
+// encodeJetStreamKey turns the `:` separated segments of a key into `.`
+// separated tokens, so bucket keys stay readable and filterable; bytes a
+// JetStream key cannot hold are written as `=XX` and an empty segment as `=`.
+func encodeJetStreamKey(key string) string {
+	var encoded strings.Builder
+
+	for i, segment := range strings.Split(key, ":") {
+		if i > 0 {
+			encoded.WriteByte('.')
+		}
+
+		if segment == "" {
+			encoded.WriteByte('=')
+			continue
+		}
+
+		for j := 0; j < len(segment); j++ {
+			c := segment[j]
+			if c == '-' || c == '_' || c == '/' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+				encoded.WriteByte(c)
+			} else {
+				fmt.Fprintf(&encoded, "=%02X", c)
+			}
+		}
+	}
+
+	return encoded.String()
+}
+
+func decodeJetStreamKey(encoded string) (string, error) {
+	segments := strings.Split(encoded, ".")
+
+	for i, segment := range segments {
+		if segment == "=" {
+			segments[i] = ""
+			continue
+		}
+
+		var decoded strings.Builder
+
+		for j := 0; j < len(segment); j++ {
+			if segment[j] != '=' {
+				decoded.WriteByte(segment[j])
+				continue
+			}
+
+			if j+3 > len(segment) {
+				return "", fmt.Errorf("invalid escape in key %q", encoded)
+			}
+
+			c, err := strconv.ParseUint(segment[j+1:j+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in key %q", encoded)
+			}
+
+			decoded.WriteByte(byte(c))
+			j += 2
+		}
+
+		segments[i] = decoded.String()
+	}
+
+	return strings.Join(segments, ":"), nil
+}
+
+// bucket opens the bucket for app, creating it on first use.
+func (s *JetStreamStore) bucket(ctx context.Context, app string, name string) (*jetStreamBucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, natsGo.ErrConnectionClosed
+	}
+
+	if bucket, ok := s.buckets[name]; ok {
+		return bucket, nil
+	}
+
+	kv, err := s.js.KeyValue(ctx, name)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		kv, err = s.js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:   name,
+			History:  uint8(min(max(s.options.History, 1), jetstream.KeyValueMaxHistory)),
+			Replicas: s.options.Replicas,
+
+			// lets a write carry its own TTL, and leaves a marker when it
+			// expires so the revision does not go back
+			LimitMarkerTTL: time.Minute,
+		})
+
+		// created by another node meanwhile
+		if errors.Is(err, jetstream.ErrBucketExists) {
+			kv, err = s.js.KeyValue(ctx, name)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := s.js.Stream(ctx, "KV_"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := &jetStreamBucket{
+		name:   name,
+		app:    app,
+		kv:     kv,
+		stream: stream,
+	}
+
+	if s.options.OnExternalWrite != nil {
+		if err := s.startFanOut(ctx, bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	s.buckets[name] = bucket
+
+	return bucket, nil
+}
+
+// read returns the current entry of key.
+func (s *JetStreamStore) read(ctx context.Context, key string) (*jetStreamEntry, error) {
+	app, bucketName, entryKey := s.splitKey(key)
+
+	bucket, err := s.bucket(ctx, app, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := bucket.stream.GetLastMsgForSubject(ctx, "$KV."+bucketName+"."+entryKey)
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return &jetStreamEntry{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &jetStreamEntry{
+		revision: msg.Sequence,
+		exists:   msg.Header.Get(jetStreamKVOperationHeader) == "" && msg.Header.Get(jetstream.MarkerReasonHeader) == "",
+	}
+
+	if entry.exists {
+		entry.value = msg.Data
+
+		if ttl := msg.Header.Get(jetstream.MsgTTLHeader); ttl != "" {
+			if duration, err := parseMsgTTL(ttl); err == nil && duration > 0 {
+				entry.expiresAt = msg.Time.Add(duration)
+			}
+		}
+	}
+
+	return entry, nil
+}
+
+// History returns the revisions the bucket kept of key, newest first, as
+// many as its History setting allows.
+func (s *JetStreamStore) History(ctx context.Context, key string) ([]HistoryEntry, error) {
+	app, bucketName, entryKey := s.splitKey(key)
+
+	bucket, err := s.bucket(ctx, app, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := bucket.kv.History(ctx, entryKey)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return []HistoryEntry{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]HistoryEntry, 0, len(revisions))
+	for i := len(revisions) - 1; i >= 0; i-- {
+		revision := revisions[i]
+
+		entry := HistoryEntry{
+			UpdateCount: int64(revision.Revision()),
+			Time:        revision.Created().UnixMilli(),
+		}
+
+		if revision.Operation() == jetstream.KeyValuePut {
+			value := string(revision.Value())
+			entry.Value = &value
+		} else {
+			entry.Deleted = true
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// parseMsgTTL reads a Nats-TTL header, a duration or a number of seconds.
+func parseMsgTTL(ttl string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(ttl, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return time.ParseDuration(ttl)
+}
+
+// write stores a new value for key, or deletes it, if its revision is still
+// revision, and returns the revision of the write. A revision conflict is
+// reported as errJetStreamConflict.
+func (s *JetStreamStore) write(ctx context.Context, key string, change *jetStreamWrite, revision uint64) (uint64, error) {
+	_, bucketName, entryKey := s.splitKey(key)
+
+	msg := natsGo.NewMsg("$KV." + bucketName + "." + entryKey)
+	msg.Header.Set(jetstream.ExpectedLastSubjSeqHeader, strconv.FormatUint(revision, 10))
+	msg.Header.Set(jetStreamWriterHeader, "1")
+
+	if change.deleted {
+		msg.Header.Set(jetStreamKVOperationHeader, "DEL")
+	} else {
+		msg.Data = change.value
+	}
+
+	// a delete with a TTL is a tombstone that goes away on its own
+	if change.ttl > 0 {
+		// the server counts in whole seconds
+		msg.Header.Set(jetstream.MsgTTLHeader, (change.ttl + time.Second - 1).Truncate(time.Second).String())
+	}
+
+	ack, err := s.js.PublishMsg(ctx, msg)
+	if err != nil {
+		var apiErr *jetstream.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence {
+			return 0, errJetStreamConflict
+		}
+
+		return 0, err
+	}
+
+	return ack.Sequence, nil
+}
+
+var errJetStreamConflict = errors.New("revision conflict")
+
+// update applies change to the current entry of key under compare-and-set,
+// retrying while other writes get in between. A nil write leaves the key as
+// it is.
+func (s *JetStreamStore) update(ctx context.Context, key string, change func(entry *jetStreamEntry) (*jetStreamWrite, error)) error {
+	for attempt := 0; attempt < jetStreamWriteAttempts; attempt++ {
+		entry, err := s.read(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		write, err := change(entry)
+		if err != nil || write == nil {
+			return err
+		}
+
+		_, err = s.write(ctx, key, write, entry.revision)
+		if !errors.Is(err, errJetStreamConflict) {
+			return err
+		}
+	}
+
+	return errJetStreamContention
+}
+
+// keepTTL is the TTL left on entry, for writes that keep it.
+func (e *jetStreamEntry) keepTTL() time.Duration {
+	if e.expiresAt.IsZero() {
+		return 0
+	}
+
+	return max(time.Until(e.expiresAt), time.Second)
+}
+
+func (s *JetStreamStore) MGet(ctx context.Context, keys ...string) *goRedis.SliceCmd {
+	values := make([]interface{}, len(keys))
+
+	for i, key := range keys {
+		if base, ok := strings.CutSuffix(key, updateCountSuffix); ok {
+			entry, err := s.read(ctx, base)
+			if err != nil {
+				return goRedis.NewSliceResult(nil, err)
+			}
+
+			if entry.revision > 0 {
+				values[i] = strconv.FormatUint(entry.revision, 10)
+			}
+
+			continue
+		}
+
+		entry, err := s.read(ctx, key)
+		if err != nil {
+			return goRedis.NewSliceResult(nil, err)
+		}
+
+		if entry.exists {
+			values[i] = string(entry.value)
+		}
+	}
+
+	return goRedis.NewSliceResult(values, nil)
+}
+
+func (s *JetStreamStore) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.StatusCmd {
+	raw, err := argBytes(value)
+	if err != nil {
+		return goRedis.NewStatusResult("", err)
+	}
+
+	err = s.update(ctx, key, func(entry *jetStreamEntry) (*jetStreamWrite, error) {
+		write := &jetStreamWrite{value: raw, ttl: expiration}
+		if expiration == goRedis.KeepTTL {
+			write.ttl = entry.keepTTL()
+		}
+
+		return write, nil
+	})
+	if err != nil {
+		return goRedis.NewStatusResult("", err)
+	}
+
+	return goRedis.NewStatusResult("OK", nil)
+}
+
+func (s *JetStreamStore) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.BoolCmd {
+	raw, err := argBytes(value)
+	if err != nil {
+		return goRedis.NewBoolResult(false, err)
+	}
+
+	set := false
+
+	err = s.update(ctx, key, func(entry *jetStreamEntry) (*jetStreamWrite, error) {
+		if entry.exists {
+			return nil, nil
+		}
+
+		set = true
+		return &jetStreamWrite{value: raw, ttl: max(expiration, 0)}, nil
+	})
+
+	return goRedis.NewBoolResult(set && err == nil, err)
+}
+
+func (s *JetStreamStore) GetDel(ctx context.Context, key string) *goRedis.StringCmd {
+	var value []byte
+
+	err := s.update(ctx, key, func(entry *jetStreamEntry) (*jetStreamWrite, error) {
+		if !entry.exists {
+			return nil, goRedis.Nil
+		}
+
+		value = entry.value
+		return &jetStreamWrite{deleted: true}, nil
+	})
+	if err != nil {
+		return goRedis.NewStringResult("", err)
+	}
+
+	return goRedis.NewStringResult(string(value), nil)
+}
+
+func (s *JetStreamStore) Del(ctx context.Context, keys ...string) *goRedis.IntCmd {
+	var removed int64
+
+	for _, key := range keys {
+		err := s.update(ctx, key, func(entry *jetStreamEntry) (*jetStreamWrite, error) {
+			if !entry.exists {
+				return nil, nil
+			}
+
+			removed++
+			return &jetStreamWrite{deleted: true}, nil
+		})
+		if err != nil {
+			return goRedis.NewIntResult(removed, err)
+		}
+	}
+
+	return goRedis.NewIntResult(removed, nil)
+}
+
+// Scan lists the keys of the one app match names, sorted, cursor being an
+// offset into them.
+func (s *JetStreamStore) Scan(ctx context.Context, cursor uint64, match string, count int64) *goRedis.ScanCmd {
+	app, _, found := strings.Cut(match, ":")
+	if !found || strings.ContainsAny(app, `*?[\`) {
+		return goRedis.NewScanCmdResult(nil, 0, errors.New("ERR the JetStream store only scans within one app"))
+	}
+
+	bucket, err := s.bucket(ctx, app, s.bucketName(app))
+	if err != nil {
+		return goRedis.NewScanCmdResult(nil, 0, err)
+	}
+
+	lister, err := bucket.kv.ListKeys(ctx)
+	if err != nil {
+		return goRedis.NewScanCmdResult(nil, 0, err)
+	}
+
+	var keys []string
+	for entryKey := range lister.Keys() {
+		decoded, err := decodeJetStreamKey(entryKey)
+		if err != nil {
+			// written by something else than the store
+			continue
+		}
+
+		if key := app + ":" + decoded; matchGlob(match, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	if count <= 0 {
+		count = 10
+	}
+
+	if cursor >= uint64(len(keys)) {
+		return goRedis.NewScanCmdResult([]string{}, 0, nil)
+	}
+
+	end := min(cursor+uint64(count), uint64(len(keys)))
+
+	next := end
+	if end == uint64(len(keys)) {
+		next = 0
+	}
+
+	return goRedis.NewScanCmdResult(keys[cursor:end], next, nil)
+}
+
+func decodeJetStreamHash(entry *jetStreamEntry) (map[string][]byte, error) {
+	hash := make(map[string][]byte)
+	if !entry.exists {
+		return hash, nil
+	}
+
+	if err := json.Unmarshal(entry.value, &hash); err != nil {
+		return nil, errWrongType
+	}
+
+	return hash, nil
+}
+
+func decodeJetStreamList(entry *jetStreamEntry) ([][]byte, error) {
+	var list [][]byte
+	if !entry.exists {
+		return list, nil
+	}
+
+	if err := json.Unmarshal(entry.value, &list); err != nil {
+		return nil, errWrongType
+	}
+
+	return list, nil
+}
+
+func (s *JetStreamStore) HGetAll(ctx context.Context, key string) *goRedis.MapStringStringCmd {
+	entry, err := s.read(ctx, key)
+	if err != nil {
+		return goRedis.NewMapStringStringResult(nil, err)
+	}
+
+	hash, err := decodeJetStreamHash(entry)
+	if err != nil {
+		return goRedis.NewMapStringStringResult(nil, err)
+	}
+
+	values := make(map[string]string, len(hash))
+	for field, value := range hash {
+		values[field] = string(value)
+	}
+
+	return goRedis.NewMapStringStringResult(values, nil)
+}
+
+func (s *JetStreamStore) hset(ctx context.Context, key string, values []interface{}) (int64, error) {
+	pairs, err := fieldValuePairs(values)
+	if err != nil {
+		return 0, err
+	}
+
+	var added int64
+
+	err = s.update(ctx, key, func(entry *jetStreamEntry) (*jetStreamWrite, error) {
+		hash, err := decodeJetStreamHash(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		added = 0
+		for i := 0; i < len(pairs); i += 2 {
+			if _, exists := hash[string(pairs[i])]; !exists {
+				added++
+			}
+
+			hash[string(pairs[i])] = pairs[i+1]
+		}
+
+		raw, err := json.Marshal(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		return &jetStreamWrite{value: raw, ttl: entry.keepTTL()}, nil
+	})
+
+	return added, err
+}
+
+func (s *JetStreamStore) HSet(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	return goRedis.NewIntResult(s.hset(ctx, key, values))
+}
+
+func (s *JetStreamStore) HDel(ctx context.Context, key string, fields ...string) *goRedis.IntCmd {
+	var removed int64
+
+	err := s.update(ctx, key, func(entry *jetStreamEntry) (*jetStreamWrite, error) {
+		hash, err := decodeJetStreamHash(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		removed = 0
+		for _, field := range fields {
+			if _, exists := hash[field]; exists {
+				delete(hash, field)
+				removed++
+			}
+		}
+
+		if removed == 0 {
+			return nil, nil
+		}
+
+		if len(hash) == 0 {
+			return &jetStreamWrite{deleted: true}, nil
+		}
+
+		raw, err := json.Marshal(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		return &jetStreamWrite{value: raw, ttl: entry.keepTTL()}, nil
+	})
+
+	return goRedis.NewIntResult(removed, err)
+}
+
+func (s *JetStreamStore) RPush(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	pushed := make([][]byte, len(values))
+	for i, value := range values {
+		raw, err := argBytes(value)
+		if err != nil {
+			return goRedis.NewIntResult(0, err)
+		}
+
+		pushed[i] = raw
+	}
+
+	var length int64
+
+	err := s.update(ctx, key, func(entry *jetStreamEntry) (*jetStreamWrite, error) {
+		list, err := decodeJetStreamList(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, pushed...)
+		length = int64(len(list))
+
+		raw, err := json.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+
+		return &jetStreamWrite{value: raw, ttl: entry.keepTTL()}, nil
+	})
+
+	return goRedis.NewIntResult(length, err)
+}
+
+// ZRangeByScore is not supported: nothing keeps a sorted set in JetStream,
+// server-state keys expire natively there.
+func (s *JetStreamStore) ZRangeByScore(ctx context.Context, key string, opt *goRedis.ZRangeBy) *goRedis.StringSliceCmd {
+	return goRedis.NewStringSliceResult(nil, errors.New("ERR sorted sets are not supported by the JetStream store"))
+}
+
+func (s *JetStreamStore) ScriptLoad(ctx context.Context, script string) *goRedis.StringCmd {
+	return goRedis.NewStringResult(s.scripts.load(script))
+}
+
+// Close stops the fan-out consumers; the connection belongs to the NATS
+// service.
+func (s *JetStreamStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	for _, bucket := range s.buckets {
+		if bucket.fanOut != nil {
+			bucket.fanOut.Stop()
+		}
+	}
+
+	return nil
+}
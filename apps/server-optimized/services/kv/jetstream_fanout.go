@@ -0,0 +1,64 @@
+package kv
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// jetStreamFanOutConsumer is shared by every node, so each write made around
+// the store is handled by one of them.
+const jetStreamFanOutConsumer = "airstate-fan-out"
+
+// startFanOut consumes the bucket's new writes and hands those not made
+// through the store to OnExternalWrite.
+func (s *JetStreamStore) startFanOut(ctx context.Context, bucket *jetStreamBucket) error {
+	consumer, err := bucket.stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       jetStreamFanOutConsumer,
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		return err
+	}
+
+	prefix := "$KV." + bucket.name + "."
+
+	bucket.fanOut, err = consumer.Consume(func(msg jetstream.Msg) {
+		defer msg.Ack()
+
+		headers := msg.Headers()
+		if headers.Get(jetStreamWriterHeader) != "" {
+			return
+		}
+
+		metadata, err := msg.Metadata()
+		if err != nil {
+			log.Error().Err(err).Str("bucket", bucket.name).Msg("failed to read the metadata of a bucket write")
+			return
+		}
+
+		entryKey, ok := strings.CutPrefix(msg.Subject(), prefix)
+		if !ok {
+			return
+		}
+
+		key, err := decodeJetStreamKey(entryKey)
+		if err != nil {
+			log.Warn().Err(err).Str("bucket", bucket.name).Msg("ignoring a bucket write to a key the store cannot read")
+			return
+		}
+
+		if bucket.app != "" {
+			key = bucket.app + ":" + key
+		}
+
+		deleted := headers.Get(jetStreamKVOperationHeader) != "" || headers.Get(jetstream.MarkerReasonHeader) != ""
+
+		s.options.OnExternalWrite(key, msg.Data(), deleted, metadata.Sequence.Stream)
+	})
+
+	return err
+}
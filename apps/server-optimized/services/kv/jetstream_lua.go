@@ -0,0 +1,647 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+var errJetStreamMultiKeyScript = errors.New("ERR the JetStream store cannot write more than one key in a script")
+
+// jetStreamScript is one optimistic run of a script: reads are taken from
+// JetStream once and remembered, writes are collected and only made when the
+// script is done, as one compare-and-set on the revision that was read.
+type jetStreamScript struct {
+	ctx   context.Context
+	store *JetStreamStore
+
+	entries map[string]*jetStreamEntry
+	writes  map[string]*jetStreamWrite
+
+	// incremented holds the keys whose update count the script bumped
+	incremented map[string]bool
+
+	// revision is what INCR of an update count returns; a guess on the first
+	// run, the actual revision of the write on the second
+	revision uint64
+}
+
+func (s *JetStreamStore) newScript(ctx context.Context, entries map[string]*jetStreamEntry) *jetStreamScript {
+	if entries == nil {
+		entries = make(map[string]*jetStreamEntry)
+	}
+
+	return &jetStreamScript{
+		ctx:         ctx,
+		store:       s,
+		entries:     entries,
+		writes:      make(map[string]*jetStreamWrite),
+		incremented: make(map[string]bool),
+	}
+}
+
+func (r *jetStreamScript) entry(key string) (*jetStreamEntry, error) {
+	if entry, ok := r.entries[key]; ok {
+		return entry, nil
+	}
+
+	entry, err := r.store.read(r.ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	r.entries[key] = entry
+
+	return entry, nil
+}
+
+// current is the value of key as the script sees it, its own writes
+// included.
+func (r *jetStreamScript) current(key string) ([]byte, bool, error) {
+	if write, ok := r.writes[key]; ok {
+		return write.value, !write.deleted, nil
+	}
+
+	entry, err := r.entry(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return entry.value, entry.exists, nil
+}
+
+// EvalSha runs a loaded script against the keys' current entries and then
+// commits what it wrote, running it again if a key changed in the meantime.
+// A script that bumps an update count is run a second time on the same
+// entries once its write has a revision, so that it returns the actual one.
+func (s *JetStreamStore) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *goRedis.Cmd {
+	proto, err := s.scripts.get(sha1)
+	if err != nil {
+		return goRedis.NewCmdResult(nil, err)
+	}
+
+	for attempt := 0; attempt < jetStreamWriteAttempts; attempt++ {
+		run := s.newScript(ctx, nil)
+
+		result, err := runScript(proto, keys, args, run.command)
+		if err != nil {
+			return goRedis.NewCmdResult(nil, err)
+		}
+
+		key, write, revision, err := run.pendingWrite()
+		if err != nil || write == nil {
+			return goRedis.NewCmdResult(result, err)
+		}
+
+		committed, err := s.write(ctx, key, write, revision)
+		if errors.Is(err, errJetStreamConflict) {
+			continue
+		}
+
+		if err != nil || len(run.incremented) == 0 {
+			return goRedis.NewCmdResult(result, err)
+		}
+
+		replay := s.newScript(ctx, run.entries)
+		replay.revision = committed
+
+		result, err = runScript(proto, keys, args, replay.command)
+		if err == nil {
+			if _, replayed, _, _ := replay.pendingWrite(); replayed == nil || !bytes.Equal(replayed.value, write.value) || replayed.deleted != write.deleted {
+				err = errors.New("ERR script wrote differently once its update count was known")
+			}
+		}
+
+		return goRedis.NewCmdResult(result, err)
+	}
+
+	return goRedis.NewCmdResult(nil, errJetStreamContention)
+}
+
+// pendingWrite is the one write the script made, with the revision it is
+// based on. Bumping an update count without writing the key rewrites it as
+// it is, so the count moves on anyway.
+// ttl is what is left of the TTL of key, or -1 when it has none and -2 when
+// it does not exist (in nanoseconds, so as not to be mistaken for a TTL).
+func (r *jetStreamScript) ttl(key string) (time.Duration, error) {
+	if write, ok := r.writes[key]; ok {
+		switch {
+		case write.deleted:
+			return -2, nil
+		case write.ttl > 0:
+			return write.ttl, nil
+		default:
+			return -1, nil
+		}
+	}
+
+	entry, err := r.entry(key)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case !entry.exists:
+		return -2, nil
+	case entry.expiresAt.IsZero():
+		return -1, nil
+	default:
+		return max(time.Until(entry.expiresAt), time.Millisecond), nil
+	}
+}
+
+func (r *jetStreamScript) pendingWrite() (string, *jetStreamWrite, uint64, error) {
+	for key := range r.incremented {
+		if _, ok := r.writes[key]; ok {
+			continue
+		}
+
+		entry, err := r.entry(key)
+		if err != nil {
+			return "", nil, 0, err
+		}
+
+		r.writes[key] = &jetStreamWrite{value: entry.value, deleted: !entry.exists, ttl: entry.keepTTL()}
+	}
+
+	if len(r.writes) > 1 {
+		return "", nil, 0, errJetStreamMultiKeyScript
+	}
+
+	for key, write := range r.writes {
+		entry, err := r.entry(key)
+		if err != nil {
+			return "", nil, 0, err
+		}
+
+		return key, write, entry.revision, nil
+	}
+
+	return "", nil, 0, nil
+}
+
+// command runs the subset of Redis commands scripts may call.
+func (r *jetStreamScript) command(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("ERR wrong number of arguments")
+	}
+
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	arity := func(n int) error {
+		return commandArity(name, args, n)
+	}
+
+	// the history of a key is the revisions the bucket keeps, see History
+	if len(args) > 0 && strings.HasSuffix(args[0], HistorySuffix) {
+		switch name {
+		case "LPUSH", "PEXPIRE":
+			return int64(0), nil
+		case "LTRIM":
+			return luaStatus("OK"), nil
+		case "LRANGE":
+			return []interface{}{}, nil
+		case "LINDEX", "RPOP":
+			return nil, nil
+		}
+	}
+
+	switch name {
+	case "GET":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		if base, ok := strings.CutSuffix(args[0], updateCountSuffix); ok {
+			entry, err := r.entry(base)
+			if err != nil || entry.revision == 0 {
+				return nil, err
+			}
+
+			return strconv.FormatUint(entry.revision, 10), nil
+		}
+
+		value, ok, err := r.current(args[0])
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		return string(value), nil
+	case "SET":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		options, err := parseSetOptions(args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasSuffix(args[0], updateCountSuffix) {
+			return nil, errors.New("ERR update counts are revisions in the JetStream store and cannot be set")
+		}
+
+		_, exists, err := r.current(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if (options.onlyMissing && exists) || (options.onlyPresent && !exists) {
+			return nil, nil
+		}
+
+		write := &jetStreamWrite{value: []byte(args[1]), ttl: options.expiration}
+		if options.expiration == goRedis.KeepTTL {
+			entry, err := r.entry(args[0])
+			if err != nil {
+				return nil, err
+			}
+
+			write.ttl = entry.keepTTL()
+		}
+
+		r.writes[args[0]] = write
+
+		return luaStatus("OK"), nil
+	case "INCR", "INCRBY":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		base, ok := strings.CutSuffix(args[0], updateCountSuffix)
+		if !ok {
+			return nil, fmt.Errorf("ERR the JetStream store only increments update counts")
+		}
+
+		if name == "INCRBY" {
+			if err := arity(2); err != nil {
+				return nil, err
+			}
+
+			if args[1] != "1" {
+				return nil, errors.New("ERR update counts are revisions in the JetStream store and only move on by one write")
+			}
+		}
+
+		r.incremented[base] = true
+
+		if r.revision != 0 {
+			return int64(r.revision), nil
+		}
+
+		entry, err := r.entry(base)
+		if err != nil {
+			return nil, err
+		}
+
+		return int64(entry.revision + 1), nil
+	case "DEL":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		var removed int64
+		for _, key := range args {
+			// the count of a deleted key lives on as the revision of its
+			// delete
+			if strings.HasSuffix(key, updateCountSuffix) {
+				continue
+			}
+
+			_, exists, err := r.current(key)
+			if err != nil {
+				return nil, err
+			}
+
+			if exists {
+				r.writes[key] = &jetStreamWrite{deleted: true}
+				removed++
+			}
+		}
+
+		return removed, nil
+	case "EXISTS":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		var count int64
+		for _, key := range args {
+			_, exists, err := r.current(key)
+			if err != nil {
+				return nil, err
+			}
+
+			if exists {
+				count++
+			}
+		}
+
+		return count, nil
+	case "PEXPIRE":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		milliseconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+
+		ttl := time.Duration(milliseconds) * time.Millisecond
+
+		// an update count goes with its key; the one of a key the script
+		// deletes lives on in the delete, which expires like it
+		if base, ok := strings.CutSuffix(args[0], updateCountSuffix); ok {
+			if write, ok := r.writes[base]; ok && write.deleted {
+				write.ttl = max(ttl, 0)
+				return int64(1), nil
+			}
+
+			return int64(0), nil
+		}
+
+		value, exists, err := r.current(args[0])
+		if err != nil || !exists {
+			return int64(0), err
+		}
+
+		if ttl <= 0 {
+			r.writes[args[0]] = &jetStreamWrite{deleted: true}
+		} else {
+			r.writes[args[0]] = &jetStreamWrite{value: value, ttl: ttl}
+		}
+
+		return int64(1), nil
+	case "PERSIST":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		if strings.HasSuffix(args[0], updateCountSuffix) {
+			return int64(0), nil
+		}
+
+		ttl, err := r.ttl(args[0])
+		if err != nil || ttl <= 0 {
+			return int64(0), err
+		}
+
+		value, _, err := r.current(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		r.writes[args[0]] = &jetStreamWrite{value: value}
+
+		return int64(1), nil
+	case "PTTL":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		if base, ok := strings.CutSuffix(args[0], updateCountSuffix); ok {
+			entry, err := r.entry(base)
+			if err != nil {
+				return nil, err
+			}
+
+			if entry.revision == 0 {
+				return int64(-2), nil
+			}
+
+			return int64(-1), nil
+		}
+
+		ttl, err := r.ttl(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if ttl > 0 {
+			return ttl.Milliseconds(), nil
+		}
+
+		return ttl.Nanoseconds(), nil
+	default:
+		return nil, fmt.Errorf("ERR unknown command '%s' in the JetStream store", strings.ToLower(name))
+	}
+}
+
+// jetStreamTx queues commands until Exec. Reads are made first, together,
+// and repeated until no key changed in between, which gives them one point
+// in time; writes follow in order, each on its own. The server's
+// transactions either only read or only write.
+type jetStreamTx struct {
+	store    *JetStreamStore
+	commands []jetStreamTxCommand
+}
+
+type jetStreamTxCommand struct {
+	cmd goRedis.Cmder
+
+	// key is read at one point in time with the others for a read; write
+	// is set for commands that change key
+	key   string
+	read  func(entry *jetStreamEntry) error
+	write func(ctx context.Context) error
+}
+
+func (s *JetStreamStore) TxPipeline() Tx {
+	return &jetStreamTx{store: s}
+}
+
+func (t *jetStreamTx) Get(ctx context.Context, key string) *goRedis.StringCmd {
+	cmd := goRedis.NewStringCmd(ctx, "get", key)
+
+	t.commands = append(t.commands, jetStreamTxCommand{cmd: cmd, key: key, read: func(entry *jetStreamEntry) error {
+		if !entry.exists {
+			cmd.SetErr(goRedis.Nil)
+			return goRedis.Nil
+		}
+
+		cmd.SetVal(string(entry.value))
+		return nil
+	}})
+
+	return cmd
+}
+
+func (t *jetStreamTx) LRange(ctx context.Context, key string, start, stop int64) *goRedis.StringSliceCmd {
+	cmd := goRedis.NewStringSliceCmd(ctx, "lrange", key, start, stop)
+
+	t.commands = append(t.commands, jetStreamTxCommand{cmd: cmd, key: key, read: func(entry *jetStreamEntry) error {
+		list, err := decodeJetStreamList(entry)
+		if err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+
+		values := []string{}
+		if from, to, ok := listRange(int64(len(list)), start, stop); ok {
+			for _, value := range list[from : to+1] {
+				values = append(values, string(value))
+			}
+		}
+
+		cmd.SetVal(values)
+		return nil
+	}})
+
+	return cmd
+}
+
+func (t *jetStreamTx) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.StatusCmd {
+	cmd := goRedis.NewStatusCmd(ctx, "set", key, value)
+
+	t.commands = append(t.commands, jetStreamTxCommand{cmd: cmd, write: func(ctx context.Context) error {
+		err := t.store.Set(ctx, key, value, expiration).Err()
+		if err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+
+		cmd.SetVal("OK")
+		return nil
+	}})
+
+	return cmd
+}
+
+func (t *jetStreamTx) LTrim(ctx context.Context, key string, start, stop int64) *goRedis.StatusCmd {
+	cmd := goRedis.NewStatusCmd(ctx, "ltrim", key, start, stop)
+
+	t.commands = append(t.commands, jetStreamTxCommand{cmd: cmd, write: func(ctx context.Context) error {
+		err := t.store.update(ctx, key, func(entry *jetStreamEntry) (*jetStreamWrite, error) {
+			list, err := decodeJetStreamList(entry)
+			if err != nil || !entry.exists {
+				return nil, err
+			}
+
+			from, to, ok := listRange(int64(len(list)), start, stop)
+			if !ok {
+				return &jetStreamWrite{deleted: true}, nil
+			}
+
+			raw, err := json.Marshal(list[from : to+1])
+			if err != nil {
+				return nil, err
+			}
+
+			return &jetStreamWrite{value: raw, ttl: entry.keepTTL()}, nil
+		})
+		if err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+
+		cmd.SetVal("OK")
+		return nil
+	}})
+
+	return cmd
+}
+
+func (t *jetStreamTx) HSet(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	cmd := goRedis.NewIntCmd(ctx, "hset", key)
+
+	t.commands = append(t.commands, jetStreamTxCommand{cmd: cmd, write: func(ctx context.Context) error {
+		added, err := t.store.hset(ctx, key, values)
+		if err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+
+		cmd.SetVal(added)
+		return nil
+	}})
+
+	return cmd
+}
+
+func (t *jetStreamTx) Exec(ctx context.Context) ([]goRedis.Cmder, error) {
+	commands := t.commands
+	t.commands = nil
+
+	cmds := make([]goRedis.Cmder, len(commands))
+	for i, command := range commands {
+		cmds[i] = command.cmd
+	}
+
+	entries, err := t.readConsistently(ctx, commands)
+	if err != nil {
+		return cmds, err
+	}
+
+	var firstErr error
+
+	for _, command := range commands {
+		if command.read != nil {
+			err = command.read(entries[command.key])
+		} else {
+			err = command.write(ctx)
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return cmds, firstErr
+}
+
+// readConsistently reads the keys of the transaction's reads until a second
+// look finds all of them at the same revision, which means there was a
+// moment all of them were as read.
+func (t *jetStreamTx) readConsistently(ctx context.Context, commands []jetStreamTxCommand) (map[string]*jetStreamEntry, error) {
+	keys := make(map[string]struct{})
+	for _, command := range commands {
+		if command.read != nil {
+			keys[command.key] = struct{}{}
+		}
+	}
+
+	entries := make(map[string]*jetStreamEntry, len(keys))
+
+	for attempt := 0; attempt < jetStreamWriteAttempts; attempt++ {
+		for key := range keys {
+			entry, err := t.store.read(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+
+			entries[key] = entry
+		}
+
+		if len(keys) < 2 {
+			return entries, nil
+		}
+
+		stable := true
+		for key := range keys {
+			entry, err := t.store.read(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+
+			if entry.revision != entries[key].revision {
+				stable = false
+				break
+			}
+		}
+
+		if stable {
+			return entries, nil
+		}
+	}
+
+	return nil, errJetStreamContention
+}
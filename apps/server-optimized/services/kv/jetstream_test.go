@@ -0,0 +1,54 @@
+package kv
+
+import "testing"
+
+func TestJetStreamKeyEncoding(t *testing.T) {
+	for _, key := range []string{
+		"server-state:doc:state",
+		"server-state:a.b c/d:state",
+		"server-state::state",
+		"yjs:=x:updates",
+		"",
+		"ünïcode",
+	} {
+		encoded := encodeJetStreamKey(key)
+
+		for i := 0; i < len(encoded); i++ {
+			c := encoded[i]
+			if !(c == '-' || c == '_' || c == '/' || c == '=' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+				t.Fatalf("%q encodes to %q, which JetStream does not allow", key, encoded)
+			}
+		}
+
+		if encoded[0] == '.' || encoded[len(encoded)-1] == '.' {
+			t.Fatalf("%q encodes to %q, with an empty token", key, encoded)
+		}
+
+		decoded, err := decodeJetStreamKey(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded != key {
+			t.Fatalf("%q round-trips to %q", key, decoded)
+		}
+	}
+
+	if encoded := encodeJetStreamKey("server-state:doc:state"); encoded != "server-state.doc.state" {
+		t.Fatalf("plain keys should stay readable, got %q", encoded)
+	}
+}
+
+func TestJetStreamSplitKey(t *testing.T) {
+	store := &JetStreamStore{options: JetStreamStoreOptions{BucketPrefix: "airstate"}}
+
+	app, bucket, entryKey := store.splitKey("my_app:server-state:doc:state")
+	if app != "my_app" || bucket != "airstate_my_5Fapp" || entryKey != "server-state.doc.state" {
+		t.Fatalf("unexpected split: %q %q %q", app, bucket, entryKey)
+	}
+
+	app, bucket, entryKey = store.splitKey("standalone")
+	if app != "" || bucket != "airstate" || entryKey != "standalone" {
+		t.Fatalf("unexpected split: %q %q %q", app, bucket, entryKey)
+	}
+}
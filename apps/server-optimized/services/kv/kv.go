@@ -1,55 +1,89 @@
 package kv
 
 import (
-	"context"
+	"errors"
 	"os"
+	"time"
 
-	goRedis "github.com/redis/go-redis/v9"
-	"github.com/redis/go-redis/v9/maintnotifications"
-	"github.com/rs/zerolog/log"
+	natsGo "github.com/nats-io/nats.go"
 )
 
 type ServiceOptions struct {
-	url string
+	// Redis is the KVRocks connection, used unless one of the other stores is
+	Redis RedisOptions
+
+	// InMemory keeps the data inside the process instead of dialing KVRocks
+	InMemory bool
+
+	// DataFile and PersistInterval persist the in-memory store, see
+	// MemoryStoreOptions
+	DataFile        string
+	PersistInterval time.Duration
+
+	// JetStream keeps the data in JetStream Key-Value buckets on this
+	// connection instead of KVRocks
+	JetStream        bool
+	NATSConnection   *natsGo.Conn
+	JetStreamOptions JetStreamStoreOptions
 }
 
 type Service interface {
-	GetKVClient() *goRedis.Client
+	GetKVClient() Store
 }
 
 type KV struct {
-	kvClient *goRedis.Client
+	kvClient Store
 }
 
-func (r *KV) GetKVClient() *goRedis.Client {
+func (r *KV) GetKVClient() Store {
 	return r.kvClient
 }
 
+func (r *KV) Close() error {
+	return r.kvClient.Close()
+}
+
 func CreateKVService(options *ServiceOptions) (*KV, error) {
-	kvURL := options.url
+	if options.InMemory {
+		store, err := NewMemoryStore(&MemoryStoreOptions{
+			DataFile:        options.DataFile,
+			PersistInterval: options.PersistInterval,
+		})
+		if err != nil {
+			return nil, err
+		}
 
-	if kvURL == "" {
-		// read from os env
-		kvURL = os.Getenv("KVROCKS_URL")
+		return &KV{
+			kvClient: store,
+		}, nil
 	}
 
-	if kvURL == "" {
-		// default NATS URL
-		kvURL = "kv://localhost:6379"
+	if options.JetStream {
+		if options.NATSConnection == nil {
+			return nil, errors.New("the JetStream store needs a NATS connection")
+		}
+
+		store, err := NewJetStreamStore(options.NATSConnection, &options.JetStreamOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		return &KV{
+			kvClient: store,
+		}, nil
+	}
+
+	if options.Redis.URL == "" {
+		// read from os env
+		options.Redis.URL = os.Getenv("KVROCKS_URL")
 	}
 
-	client := goRedis.NewClient(&goRedis.Options{
-		Addr: kvURL,
-		MaintNotificationsConfig: &maintnotifications.Config{
-			Mode: maintnotifications.ModeDisabled,
-		},
-		OnConnect: func(ctx context.Context, cn *goRedis.Conn) error {
-			log.Info().Msg("connected to redis")
-			return nil
-		},
-	})
+	store, err := newRedisStore(&options.Redis)
+	if err != nil {
+		return nil, err
+	}
 
 	return &KV{
-		kvClient: client,
+		kvClient: store,
 	}, nil
 }
@@ -0,0 +1,492 @@
+package kv
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// The stores that do not live in Redis run the server's Lua scripts
+// themselves, with gopher-lua, a cjson work-alike and a redis.call that the
+// store provides.
+
+var errNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+
+// luaStatus is a status reply (like SET's OK), which scripts see as {ok=...}.
+type luaStatus string
+
+// luaCommand runs one redis.call for a script.
+type luaCommand func(args []string) (interface{}, error)
+
+// scriptCache holds the compiled scripts by their SHA1, as SCRIPT LOAD does.
+type scriptCache struct {
+	mu     sync.RWMutex
+	protos map[string]*lua.FunctionProto
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{
+		protos: make(map[string]*lua.FunctionProto),
+	}
+}
+
+func (c *scriptCache) load(script string) (string, error) {
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+
+	chunk, err := parse.Parse(strings.NewReader(script), "user_script")
+	if err != nil {
+		return "", fmt.Errorf("ERR Error compiling script: %w", err)
+	}
+
+	proto, err := lua.Compile(chunk, "user_script")
+	if err != nil {
+		return "", fmt.Errorf("ERR Error compiling script: %w", err)
+	}
+
+	c.mu.Lock()
+	c.protos[sha] = proto
+	c.mu.Unlock()
+
+	return sha, nil
+}
+
+func (c *scriptCache) get(sha string) (*lua.FunctionProto, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	proto, ok := c.protos[strings.ToLower(sha)]
+	if !ok {
+		return nil, errNoScript
+	}
+
+	return proto, nil
+}
+
+// runScript runs a compiled script the way Redis does, with KEYS and ARGV
+// set, redis.call going to command and cjson for JSON, converting the result
+// with Redis' rules. Atomicity is up to the caller.
+func runScript(proto *lua.FunctionProto, keys []string, args []interface{}, command luaCommand) (interface{}, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	null := L.NewUserData()
+
+	cjson := L.NewTable()
+	cjson.RawSetString("null", null)
+	cjson.RawSetString("encode", L.NewFunction(func(L *lua.LState) int {
+		var buffer bytes.Buffer
+		if err := encodeLuaJSON(&buffer, L.CheckAny(1), null, 0); err != nil {
+			L.RaiseError("Cannot serialise %s", err)
+		}
+
+		L.Push(lua.LString(buffer.String()))
+		return 1
+	}))
+	cjson.RawSetString("decode", L.NewFunction(func(L *lua.LState) int {
+		var value interface{}
+		if err := json.Unmarshal([]byte(L.CheckString(1)), &value); err != nil {
+			L.RaiseError("Expected value but found invalid token: %s", err)
+		}
+
+		L.Push(goToLua(L, value, null))
+		return 1
+	}))
+	L.SetGlobal("cjson", cjson)
+
+	call := func(protected bool) lua.LGFunction {
+		return func(L *lua.LState) int {
+			commandArgs := make([]string, L.GetTop())
+			for i := range commandArgs {
+				switch arg := L.Get(i + 1).(type) {
+				case lua.LString:
+					commandArgs[i] = string(arg)
+				case lua.LNumber:
+					commandArgs[i] = strconv.FormatFloat(float64(arg), 'f', -1, 64)
+				default:
+					L.RaiseError("Lua redis lib command arguments must be strings or integers")
+				}
+			}
+
+			reply, err := command(commandArgs)
+			if err != nil {
+				if !protected {
+					L.RaiseError("%s", err.Error())
+				}
+
+				errTable := L.NewTable()
+				errTable.RawSetString("err", lua.LString(err.Error()))
+				L.Push(errTable)
+				return 1
+			}
+
+			L.Push(replyToLua(L, reply))
+			return 1
+		}
+	}
+
+	redis := L.NewTable()
+	redis.RawSetString("call", L.NewFunction(call(false)))
+	redis.RawSetString("pcall", L.NewFunction(call(true)))
+	L.SetGlobal("redis", redis)
+
+	keysTable := L.NewTable()
+	for _, key := range keys {
+		keysTable.Append(lua.LString(key))
+	}
+	L.SetGlobal("KEYS", keysTable)
+
+	argvTable := L.NewTable()
+	for _, arg := range args {
+		raw, err := argBytes(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		argvTable.Append(lua.LString(raw))
+	}
+	L.SetGlobal("ARGV", argvTable)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, fmt.Errorf("ERR user_script: %w", err)
+	}
+
+	reply, err := luaToReply(L.Get(-1))
+	if err == nil && reply == nil {
+		// go-redis gives a nil reply as redis: nil, which callers check for
+		return nil, goRedis.Nil
+	}
+
+	return reply, err
+}
+
+// setOptions are the flags of a SET after its key and value.
+type setOptions struct {
+	expiration  time.Duration
+	onlyMissing bool
+	onlyPresent bool
+}
+
+func parseSetOptions(args []string) (*setOptions, error) {
+	options := &setOptions{}
+
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			options.onlyMissing = true
+		case "XX":
+			options.onlyPresent = true
+		case "KEEPTTL":
+			options.expiration = goRedis.KeepTTL
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+
+			amount, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || amount <= 0 {
+				return nil, errors.New("ERR invalid expire time in 'set' command")
+			}
+
+			unit := time.Second
+			if strings.ToUpper(args[i]) == "PX" {
+				unit = time.Millisecond
+			}
+
+			options.expiration = time.Duration(amount) * unit
+			i++
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+
+	return options, nil
+}
+
+// commandArity checks a command has at least n arguments after its name.
+func commandArity(name string, args []string, n int) error {
+	if len(args) < n {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+	}
+
+	return nil
+}
+
+// replyToLua converts a command reply for a script: nil becomes false, a
+// status {ok=...}.
+func replyToLua(L *lua.LState, reply interface{}) lua.LValue {
+	switch v := reply.(type) {
+	case nil:
+		return lua.LFalse
+	case int64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case luaStatus:
+		status := L.NewTable()
+		status.RawSetString("ok", lua.LString(v))
+		return status
+	case []interface{}:
+		array := L.NewTable()
+		for _, element := range v {
+			array.Append(replyToLua(L, element))
+		}
+		return array
+	default:
+		return lua.LFalse
+	}
+}
+
+// luaToReply converts what a script returns into what go-redis would read
+// off the wire: numbers are truncated to integers, true is 1, false and nil
+// are nil, and a table is an array up to its first nil unless it carries
+// `err` or `ok`.
+func luaToReply(value lua.LValue) (interface{}, error) {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return int64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LBool:
+		if v {
+			return int64(1), nil
+		}
+
+		return nil, nil
+	case *lua.LTable:
+		if errValue, ok := v.RawGetString("err").(lua.LString); ok {
+			return nil, errors.New(string(errValue))
+		}
+
+		if okValue, ok := v.RawGetString("ok").(lua.LString); ok {
+			return string(okValue), nil
+		}
+
+		values := make([]interface{}, 0, v.Len())
+		for i := 1; ; i++ {
+			element := v.RawGetInt(i)
+			if element == lua.LNil {
+				break
+			}
+
+			// errors nested in arrays are returned as values
+			converted, err := luaToReply(element)
+			if err != nil {
+				converted = err
+			}
+
+			values = append(values, converted)
+		}
+
+		return values, nil
+	default:
+		return nil, nil
+	}
+}
+
+func goToLua(L *lua.LState, value interface{}, null lua.LValue) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return null
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		array := L.CreateTable(len(v), 0)
+		for i, element := range v {
+			array.RawSetInt(i+1, goToLua(L, element, null))
+		}
+		return array
+	case map[string]interface{}:
+		object := L.CreateTable(0, len(v))
+		for key, element := range v {
+			object.RawSetString(key, goToLua(L, element, null))
+		}
+		return object
+	default:
+		return null
+	}
+}
+
+// encodeLuaJSON follows lua-cjson's defaults: tables whose keys are all
+// positive integers are arrays (unless excessively sparse), empty tables are
+// objects, numbers use %.14g and `/` is escaped.
+func encodeLuaJSON(buffer *bytes.Buffer, value lua.LValue, null lua.LValue, depth int) error {
+	if depth > 1000 {
+		return errors.New("table: nested too deep")
+	}
+
+	switch v := value.(type) {
+	case *lua.LNilType:
+		buffer.WriteString("null")
+	case lua.LBool:
+		buffer.WriteString(strconv.FormatBool(bool(v)))
+	case lua.LNumber:
+		number := float64(v)
+		if math.IsNaN(number) || math.IsInf(number, 0) {
+			return errors.New("number: must not be NaN or Inf")
+		}
+
+		buffer.WriteString(fmt.Sprintf("%.14g", number))
+	case lua.LString:
+		encodeLuaJSONString(buffer, string(v))
+	case *lua.LUserData:
+		if value != null {
+			return errors.New("userdata")
+		}
+
+		buffer.WriteString("null")
+	case *lua.LTable:
+		return encodeLuaJSONTable(buffer, v, null, depth)
+	default:
+		return errors.New(value.Type().String())
+	}
+
+	return nil
+}
+
+func encodeLuaJSONTable(buffer *bytes.Buffer, table *lua.LTable, null lua.LValue, depth int) error {
+	maxIndex, count, isArray := 0, 0, true
+
+	table.ForEach(func(key lua.LValue, _ lua.LValue) {
+		count++
+
+		number, ok := key.(lua.LNumber)
+		if !ok || float64(number) < 1 || float64(number) != math.Floor(float64(number)) {
+			isArray = false
+			return
+		}
+
+		maxIndex = max(maxIndex, int(number))
+	})
+
+	if isArray && count > 0 {
+		if maxIndex > count*2 && maxIndex > 10 {
+			return errors.New("table: excessively sparse array")
+		}
+
+		buffer.WriteByte('[')
+		for i := 1; i <= maxIndex; i++ {
+			if i > 1 {
+				buffer.WriteByte(',')
+			}
+
+			if err := encodeLuaJSON(buffer, table.RawGetInt(i), null, depth+1); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+
+		return nil
+	}
+
+	type member struct {
+		key   string
+		value lua.LValue
+	}
+
+	members := make([]member, 0, count)
+	var keyErr error
+
+	table.ForEach(func(key lua.LValue, value lua.LValue) {
+		switch k := key.(type) {
+		case lua.LString:
+			members = append(members, member{string(k), value})
+		case lua.LNumber:
+			members = append(members, member{fmt.Sprintf("%.14g", float64(k)), value})
+		default:
+			keyErr = errors.New("table key must be a number or string")
+		}
+	})
+
+	if keyErr != nil {
+		return keyErr
+	}
+
+	// lua-cjson writes members in table order, which is arbitrary; sorting
+	// keeps the output stable
+	sort.Slice(members, func(i, j int) bool { return members[i].key < members[j].key })
+
+	buffer.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+
+		encodeLuaJSONString(buffer, m.key)
+		buffer.WriteByte(':')
+
+		if err := encodeLuaJSON(buffer, m.value, null, depth+1); err != nil {
+			return err
+		}
+	}
+	buffer.WriteByte('}')
+
+	return nil
+}
+
+func encodeLuaJSONString(buffer *bytes.Buffer, s string) {
+	buffer.WriteByte('"')
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch c {
+		case '"':
+			buffer.WriteString(`\"`)
+		case '\\':
+			buffer.WriteString(`\\`)
+		case '/':
+			buffer.WriteString(`\/`)
+		case '\b':
+			buffer.WriteString(`\b`)
+		case '\f':
+			buffer.WriteString(`\f`)
+		case '\n':
+			buffer.WriteString(`\n`)
+		case '\r':
+			buffer.WriteString(`\r`)
+		case '\t':
+			buffer.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(buffer, `\u%04x`, c)
+			} else {
+				buffer.WriteByte(c)
+			}
+		}
+	}
+
+	buffer.WriteByte('"')
+}
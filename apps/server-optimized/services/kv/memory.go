@@ -0,0 +1,955 @@
+package kv
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+const (
+	memoryString = "string"
+	memoryList   = "list"
+	memoryHash   = "hash"
+	memoryZSet   = "zset"
+)
+
+// memoryEntry is one key of the in-memory store. Only the field matching Kind
+// is set.
+type memoryEntry struct {
+	Kind      string
+	String    []byte
+	List      [][]byte
+	Hash      map[string][]byte
+	ZSet      map[string]float64
+	ExpiresAt int64 // unix milliseconds, 0 for none
+}
+
+// MemoryStore is an in-process Store for --standalone. Every command, and
+// every script as a whole, runs under one lock, which gives the atomicity the
+// server gets from Redis. Scripts are the same Lua the server loads into
+// KVRocks, run by gopher-lua.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	scripts *scriptCache
+
+	// persistence, when a data file is set
+	dataFile string
+	dirty    bool
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+type MemoryStoreOptions struct {
+	// DataFile, when set, is loaded on start and rewritten every
+	// PersistInterval while there are changes, and on Close
+	DataFile        string
+	PersistInterval time.Duration
+}
+
+func NewMemoryStore(options *MemoryStoreOptions) (*MemoryStore, error) {
+	m := &MemoryStore{
+		entries:  make(map[string]*memoryEntry),
+		scripts:  newScriptCache(),
+		dataFile: options.DataFile,
+	}
+
+	if m.dataFile == "" {
+		return m, nil
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	interval := options.PersistInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	m.stop = make(chan struct{})
+	m.stopped = make(chan struct{})
+
+	go m.persistLoop(interval)
+
+	return m, nil
+}
+
+// lookup returns the live entry for key, dropping it if it has expired.
+// The caller holds the lock.
+func (m *MemoryStore) lookup(key string) *memoryEntry {
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if entry.ExpiresAt != 0 && entry.ExpiresAt <= time.Now().UnixMilli() {
+		delete(m.entries, key)
+		return nil
+	}
+
+	return entry
+}
+
+func (m *MemoryStore) lookupKind(key string, kind string) (*memoryEntry, error) {
+	entry := m.lookup(key)
+	if entry != nil && entry.Kind != kind {
+		return nil, errWrongType
+	}
+
+	return entry, nil
+}
+
+func (m *MemoryStore) getString(key string) ([]byte, bool, error) {
+	entry, err := m.lookupKind(key, memoryString)
+	if err != nil || entry == nil {
+		return nil, false, err
+	}
+
+	return entry.String, true, nil
+}
+
+func (m *MemoryStore) setString(key string, value []byte, expiration time.Duration) {
+	entry := &memoryEntry{Kind: memoryString, String: value}
+
+	if expiration == goRedis.KeepTTL {
+		if current := m.lookup(key); current != nil {
+			entry.ExpiresAt = current.ExpiresAt
+		}
+	} else if expiration > 0 {
+		entry.ExpiresAt = time.Now().Add(expiration).UnixMilli()
+	}
+
+	m.entries[key] = entry
+	m.dirty = true
+}
+
+func (m *MemoryStore) del(keys ...string) int64 {
+	var removed int64
+
+	for _, key := range keys {
+		if m.lookup(key) != nil {
+			delete(m.entries, key)
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		m.dirty = true
+	}
+
+	return removed
+}
+
+func (m *MemoryStore) incrBy(key string, increment int64) (int64, error) {
+	raw, ok, err := m.getString(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var value int64
+	if ok {
+		if value, err = strconv.ParseInt(string(raw), 10, 64); err != nil {
+			return 0, errors.New("ERR value is not an integer or out of range")
+		}
+	}
+
+	value += increment
+	m.setString(key, []byte(strconv.FormatInt(value, 10)), goRedis.KeepTTL)
+
+	return value, nil
+}
+
+func (m *MemoryStore) hset(key string, values []interface{}) (int64, error) {
+	entry, err := m.lookupKind(key, memoryHash)
+	if err != nil {
+		return 0, err
+	}
+
+	pairs, err := fieldValuePairs(values)
+	if err != nil {
+		return 0, err
+	}
+
+	if entry == nil {
+		entry = &memoryEntry{Kind: memoryHash, Hash: make(map[string][]byte)}
+		m.entries[key] = entry
+	}
+
+	var added int64
+	for i := 0; i < len(pairs); i += 2 {
+		field := string(pairs[i])
+		if _, exists := entry.Hash[field]; !exists {
+			added++
+		}
+
+		entry.Hash[field] = pairs[i+1]
+	}
+
+	m.dirty = true
+
+	return added, nil
+}
+
+func (m *MemoryStore) lrange(key string, start, stop int64) ([]string, error) {
+	entry, err := m.lookupKind(key, memoryList)
+	if err != nil || entry == nil {
+		return []string{}, err
+	}
+
+	from, to, ok := listRange(int64(len(entry.List)), start, stop)
+	if !ok {
+		return []string{}, nil
+	}
+
+	values := make([]string, 0, to-from+1)
+	for _, value := range entry.List[from : to+1] {
+		values = append(values, string(value))
+	}
+
+	return values, nil
+}
+
+func (m *MemoryStore) ltrim(key string, start, stop int64) error {
+	entry, err := m.lookupKind(key, memoryList)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	from, to, ok := listRange(int64(len(entry.List)), start, stop)
+	if !ok {
+		delete(m.entries, key)
+	} else {
+		entry.List = append([][]byte(nil), entry.List[from:to+1]...)
+	}
+
+	m.dirty = true
+
+	return nil
+}
+
+func (m *MemoryStore) lpush(key string, values []string) (int64, error) {
+	entry, err := m.lookupKind(key, memoryList)
+	if err != nil {
+		return 0, err
+	}
+
+	if entry == nil {
+		entry = &memoryEntry{Kind: memoryList}
+		m.entries[key] = entry
+	}
+
+	for _, value := range values {
+		entry.List = append([][]byte{[]byte(value)}, entry.List...)
+	}
+
+	m.dirty = true
+
+	return int64(len(entry.List)), nil
+}
+
+func (m *MemoryStore) lindex(key string, index int64) ([]byte, bool, error) {
+	entry, err := m.lookupKind(key, memoryList)
+	if err != nil || entry == nil {
+		return nil, false, err
+	}
+
+	if index < 0 {
+		index += int64(len(entry.List))
+	}
+
+	if index < 0 || index >= int64(len(entry.List)) {
+		return nil, false, nil
+	}
+
+	return entry.List[index], true, nil
+}
+
+func (m *MemoryStore) rpop(key string) ([]byte, bool, error) {
+	entry, err := m.lookupKind(key, memoryList)
+	if err != nil || entry == nil || len(entry.List) == 0 {
+		return nil, false, err
+	}
+
+	last := entry.List[len(entry.List)-1]
+	entry.List = entry.List[:len(entry.List)-1]
+
+	if len(entry.List) == 0 {
+		delete(m.entries, key)
+	}
+
+	m.dirty = true
+
+	return last, true, nil
+}
+
+func (m *MemoryStore) zadd(key string, score float64, member string) (int64, error) {
+	entry, err := m.lookupKind(key, memoryZSet)
+	if err != nil {
+		return 0, err
+	}
+
+	if entry == nil {
+		entry = &memoryEntry{Kind: memoryZSet, ZSet: make(map[string]float64)}
+		m.entries[key] = entry
+	}
+
+	_, exists := entry.ZSet[member]
+	entry.ZSet[member] = score
+	m.dirty = true
+
+	if exists {
+		return 0, nil
+	}
+
+	return 1, nil
+}
+
+func (m *MemoryStore) zrem(key string, members []string) (int64, error) {
+	entry, err := m.lookupKind(key, memoryZSet)
+	if err != nil || entry == nil {
+		return 0, err
+	}
+
+	var removed int64
+	for _, member := range members {
+		if _, ok := entry.ZSet[member]; ok {
+			delete(entry.ZSet, member)
+			removed++
+		}
+	}
+
+	if len(entry.ZSet) == 0 {
+		delete(m.entries, key)
+	}
+
+	if removed > 0 {
+		m.dirty = true
+	}
+
+	return removed, nil
+}
+
+func (m *MemoryStore) zscore(key string, member string) (float64, bool, error) {
+	entry, err := m.lookupKind(key, memoryZSet)
+	if err != nil || entry == nil {
+		return 0, false, err
+	}
+
+	score, ok := entry.ZSet[member]
+
+	return score, ok, nil
+}
+
+// zrangeByScore returns the members scored between min and max, lowest
+// first and, like Redis, by member between equal scores. A negative count is
+// no limit.
+func (m *MemoryStore) zrangeByScore(key string, min, max string, offset, count int64) ([]string, error) {
+	low, lowExclusive, lowErr := parseScoreBound(min)
+	high, highExclusive, highErr := parseScoreBound(max)
+	if lowErr != nil || highErr != nil {
+		return nil, errors.New("ERR min or max is not a float")
+	}
+
+	entry, err := m.lookupKind(key, memoryZSet)
+	if err != nil || entry == nil {
+		return []string{}, err
+	}
+
+	members := make([]string, 0, len(entry.ZSet))
+	for member, score := range entry.ZSet {
+		if score < low || (lowExclusive && score == low) || score > high || (highExclusive && score == high) {
+			continue
+		}
+
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if entry.ZSet[members[i]] != entry.ZSet[members[j]] {
+			return entry.ZSet[members[i]] < entry.ZSet[members[j]]
+		}
+
+		return members[i] < members[j]
+	})
+
+	if offset < 0 || offset >= int64(len(members)) {
+		return []string{}, nil
+	}
+
+	members = members[offset:]
+	if count >= 0 && count < int64(len(members)) {
+		members = members[:count]
+	}
+
+	return members, nil
+}
+
+func (m *MemoryStore) MGet(ctx context.Context, keys ...string) *goRedis.SliceCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := make([]interface{}, len(keys))
+
+	for i, key := range keys {
+		// like Redis, keys of another kind read as missing
+		if entry := m.lookup(key); entry != nil && entry.Kind == memoryString {
+			values[i] = string(entry.String)
+		}
+	}
+
+	return goRedis.NewSliceResult(values, nil)
+}
+
+func (m *MemoryStore) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.StatusCmd {
+	raw, err := argBytes(value)
+	if err != nil {
+		return goRedis.NewStatusResult("", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setString(key, raw, expiration)
+
+	return goRedis.NewStatusResult("OK", nil)
+}
+
+func (m *MemoryStore) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.BoolCmd {
+	raw, err := argBytes(value)
+	if err != nil {
+		return goRedis.NewBoolResult(false, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lookup(key) != nil {
+		return goRedis.NewBoolResult(false, nil)
+	}
+
+	m.setString(key, raw, expiration)
+
+	return goRedis.NewBoolResult(true, nil)
+}
+
+func (m *MemoryStore) GetDel(ctx context.Context, key string) *goRedis.StringCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok, err := m.getString(key)
+	if err != nil {
+		return goRedis.NewStringResult("", err)
+	}
+
+	if !ok {
+		return goRedis.NewStringResult("", goRedis.Nil)
+	}
+
+	m.del(key)
+
+	return goRedis.NewStringResult(string(value), nil)
+}
+
+func (m *MemoryStore) Del(ctx context.Context, keys ...string) *goRedis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return goRedis.NewIntResult(m.del(keys...), nil)
+}
+
+// Scan walks the keys in sorted order; the cursor is the number of keys
+// already walked.
+func (m *MemoryStore) Scan(ctx context.Context, cursor uint64, match string, count int64) *goRedis.ScanCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if count <= 0 {
+		count = 10
+	}
+
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		if m.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	matched := make([]string, 0, count)
+	next := cursor
+
+	for next < uint64(len(keys)) && next < cursor+uint64(count) {
+		if match == "" || matchGlob(match, keys[next]) {
+			matched = append(matched, keys[next])
+		}
+
+		next++
+	}
+
+	if next >= uint64(len(keys)) {
+		next = 0
+	}
+
+	return goRedis.NewScanCmdResult(matched, next, nil)
+}
+
+func (m *MemoryStore) HGetAll(ctx context.Context, key string) *goRedis.MapStringStringCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookupKind(key, memoryHash)
+	if err != nil {
+		return goRedis.NewMapStringStringResult(nil, err)
+	}
+
+	values := make(map[string]string)
+	if entry != nil {
+		for field, value := range entry.Hash {
+			values[field] = string(value)
+		}
+	}
+
+	return goRedis.NewMapStringStringResult(values, nil)
+}
+
+func (m *MemoryStore) HSet(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return goRedis.NewIntResult(m.hset(key, values))
+}
+
+func (m *MemoryStore) HDel(ctx context.Context, key string, fields ...string) *goRedis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookupKind(key, memoryHash)
+	if err != nil || entry == nil {
+		return goRedis.NewIntResult(0, err)
+	}
+
+	var removed int64
+	for _, field := range fields {
+		if _, ok := entry.Hash[field]; ok {
+			delete(entry.Hash, field)
+			removed++
+		}
+	}
+
+	if len(entry.Hash) == 0 {
+		delete(m.entries, key)
+	}
+
+	if removed > 0 {
+		m.dirty = true
+	}
+
+	return goRedis.NewIntResult(removed, nil)
+}
+
+func (m *MemoryStore) ZRangeByScore(ctx context.Context, key string, opt *goRedis.ZRangeBy) *goRedis.StringSliceCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := opt.Count
+	if opt.Offset == 0 && count == 0 {
+		count = -1
+	}
+
+	return goRedis.NewStringSliceResult(m.zrangeByScore(key, opt.Min, opt.Max, opt.Offset, count))
+}
+
+func (m *MemoryStore) RPush(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookupKind(key, memoryList)
+	if err != nil {
+		return goRedis.NewIntResult(0, err)
+	}
+
+	if entry == nil {
+		entry = &memoryEntry{Kind: memoryList}
+		m.entries[key] = entry
+	}
+
+	for _, value := range values {
+		raw, err := argBytes(value)
+		if err != nil {
+			return goRedis.NewIntResult(0, err)
+		}
+
+		entry.List = append(entry.List, raw)
+	}
+
+	m.dirty = true
+
+	return goRedis.NewIntResult(int64(len(entry.List)), nil)
+}
+
+func (m *MemoryStore) TxPipeline() Tx {
+	return &memoryTx{store: m}
+}
+
+func (m *MemoryStore) Close() error {
+	if m.stop == nil {
+		return nil
+	}
+
+	close(m.stop)
+	<-m.stopped
+
+	return m.save()
+}
+
+// memoryTx queues commands and runs them under one hold of the store's lock.
+type memoryTx struct {
+	store *MemoryStore
+	queue []func() error
+	cmds  []goRedis.Cmder
+}
+
+func (t *memoryTx) add(cmd goRedis.Cmder, run func() error) {
+	t.cmds = append(t.cmds, cmd)
+	t.queue = append(t.queue, run)
+}
+
+func (t *memoryTx) Get(ctx context.Context, key string) *goRedis.StringCmd {
+	cmd := goRedis.NewStringCmd(ctx, "get", key)
+
+	t.add(cmd, func() error {
+		value, ok, err := t.store.getString(key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return goRedis.Nil
+		}
+
+		cmd.SetVal(string(value))
+		return nil
+	})
+
+	return cmd
+}
+
+func (t *memoryTx) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.StatusCmd {
+	cmd := goRedis.NewStatusCmd(ctx, "set", key, value)
+
+	t.add(cmd, func() error {
+		raw, err := argBytes(value)
+		if err != nil {
+			return err
+		}
+
+		t.store.setString(key, raw, expiration)
+		cmd.SetVal("OK")
+		return nil
+	})
+
+	return cmd
+}
+
+func (t *memoryTx) LRange(ctx context.Context, key string, start, stop int64) *goRedis.StringSliceCmd {
+	cmd := goRedis.NewStringSliceCmd(ctx, "lrange", key, start, stop)
+
+	t.add(cmd, func() error {
+		values, err := t.store.lrange(key, start, stop)
+		cmd.SetVal(values)
+		return err
+	})
+
+	return cmd
+}
+
+func (t *memoryTx) LTrim(ctx context.Context, key string, start, stop int64) *goRedis.StatusCmd {
+	cmd := goRedis.NewStatusCmd(ctx, "ltrim", key, start, stop)
+
+	t.add(cmd, func() error {
+		if err := t.store.ltrim(key, start, stop); err != nil {
+			return err
+		}
+
+		cmd.SetVal("OK")
+		return nil
+	})
+
+	return cmd
+}
+
+func (t *memoryTx) HSet(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd {
+	cmd := goRedis.NewIntCmd(ctx, append([]interface{}{"hset", key}, values...)...)
+
+	t.add(cmd, func() error {
+		added, err := t.store.hset(key, values)
+		cmd.SetVal(added)
+		return err
+	})
+
+	return cmd
+}
+
+// Exec runs the queued commands and, like go-redis, reports the first error
+// of any of them (goRedis.Nil included).
+func (t *memoryTx) Exec(ctx context.Context) ([]goRedis.Cmder, error) {
+	t.store.mu.Lock()
+	defer t.store.mu.Unlock()
+
+	var firstErr error
+
+	for i, run := range t.queue {
+		if err := run(); err != nil {
+			t.cmds[i].SetErr(err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	cmds := t.cmds
+	t.queue, t.cmds = nil, nil
+
+	return cmds, firstErr
+}
+
+// argBytes turns a command argument into bytes the way go-redis writes it.
+func argBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return []byte{}, nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return append([]byte(nil), v...), nil
+	case int:
+		return []byte(strconv.FormatInt(int64(v), 10)), nil
+	case int8:
+		return []byte(strconv.FormatInt(int64(v), 10)), nil
+	case int16:
+		return []byte(strconv.FormatInt(int64(v), 10)), nil
+	case int32:
+		return []byte(strconv.FormatInt(int64(v), 10)), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case uint:
+		return []byte(strconv.FormatUint(uint64(v), 10)), nil
+	case uint8:
+		return []byte(strconv.FormatUint(uint64(v), 10)), nil
+	case uint16:
+		return []byte(strconv.FormatUint(uint64(v), 10)), nil
+	case uint32:
+		return []byte(strconv.FormatUint(uint64(v), 10)), nil
+	case uint64:
+		return []byte(strconv.FormatUint(v, 10)), nil
+	case float32:
+		return []byte(strconv.FormatFloat(float64(v), 'f', -1, 32)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case bool:
+		if v {
+			return []byte("1"), nil
+		}
+
+		return []byte("0"), nil
+	case time.Time:
+		return []byte(v.Format(time.RFC3339Nano)), nil
+	case time.Duration:
+		return []byte(strconv.FormatInt(v.Nanoseconds(), 10)), nil
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	default:
+		return nil, fmt.Errorf("redis: can't marshal %T (implement encoding.BinaryMarshaler)", value)
+	}
+}
+
+// fieldValuePairs flattens HSet's arguments: field-value pairs, a slice of
+// them or a map.
+func fieldValuePairs(values []interface{}) ([][]byte, error) {
+	if len(values) == 1 {
+		switch v := values[0].(type) {
+		case map[string]interface{}:
+			values = make([]interface{}, 0, len(v)*2)
+			for field, value := range v {
+				values = append(values, field, value)
+			}
+		case map[string]string:
+			values = make([]interface{}, 0, len(v)*2)
+			for field, value := range v {
+				values = append(values, field, value)
+			}
+		case []string:
+			values = make([]interface{}, len(v))
+			for i, value := range v {
+				values[i] = value
+			}
+		case []interface{}:
+			values = v
+		}
+	}
+
+	if len(values) == 0 || len(values)%2 != 0 {
+		return nil, errors.New("ERR wrong number of arguments for 'hset' command")
+	}
+
+	pairs := make([][]byte, len(values))
+	for i, value := range values {
+		raw, err := argBytes(value)
+		if err != nil {
+			return nil, err
+		}
+
+		pairs[i] = raw
+	}
+
+	return pairs, nil
+}
+
+// parseScoreBound reads a ZRANGEBYSCORE bound: a number, -inf or +inf, or
+// one of them after a ( for an exclusive bound.
+func parseScoreBound(bound string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(bound, "(")
+	bound = strings.TrimPrefix(bound, "(")
+
+	switch bound {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	}
+
+	score, err := strconv.ParseFloat(bound, 64)
+
+	return score, exclusive, err
+}
+
+// listRange resolves Redis' inclusive, possibly negative, list indexes.
+func listRange(length, start, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start += length
+	}
+
+	if stop < 0 {
+		stop += length
+	}
+
+	start = max(start, 0)
+	stop = min(stop, length-1)
+
+	return start, stop, start <= stop && start < length
+}
+
+// matchGlob matches Redis' glob-style patterns: `*`, `?`, `[...]` classes
+// (with `^` and ranges) and `\` escapes.
+func matchGlob(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 0 {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+
+			end := 1
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' {
+					end++
+				}
+
+				end++
+			}
+
+			if end >= len(pattern) {
+				// an unterminated class is a literal `[`
+				if s[0] != '[' {
+					return false
+				}
+
+				break
+			}
+
+			if !matchClass(pattern[1:end], s[0]) {
+				return false
+			}
+
+			pattern = pattern[end:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+
+	return len(s) == 0
+}
+
+func matchClass(class string, c byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+
+	matched := false
+
+	for i := 0; i < len(class); i++ {
+		switch {
+		case class[i] == '\\' && i+1 < len(class):
+			i++
+			matched = matched || class[i] == c
+		case i+2 < len(class) && class[i+1] == '-':
+			low, high := class[i], class[i+2]
+			if low > high {
+				low, high = high, low
+			}
+
+			matched = matched || (c >= low && c <= high)
+			i += 2
+		default:
+			matched = matched || class[i] == c
+		}
+	}
+
+	return matched != negate
+}
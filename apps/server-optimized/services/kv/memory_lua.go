@@ -0,0 +1,299 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+func (m *MemoryStore) ScriptLoad(ctx context.Context, script string) *goRedis.StringCmd {
+	return goRedis.NewStringResult(m.scripts.load(script))
+}
+
+// EvalSha runs a loaded script under the store's lock, which makes it atomic
+// the way it is in Redis.
+func (m *MemoryStore) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *goRedis.Cmd {
+	proto, err := m.scripts.get(sha1)
+	if err != nil {
+		return goRedis.NewCmdResult(nil, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return goRedis.NewCmdResult(runScript(proto, keys, args, m.command))
+}
+
+// command runs the subset of Redis commands scripts may call. The caller
+// holds the lock.
+func (m *MemoryStore) command(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("ERR wrong number of arguments")
+	}
+
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	arity := func(n int) error {
+		return commandArity(name, args, n)
+	}
+
+	switch name {
+	case "GET":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		value, ok, err := m.getString(args[0])
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		return string(value), nil
+	case "SET":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		options, err := parseSetOptions(args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		exists := m.lookup(args[0]) != nil
+		if (options.onlyMissing && exists) || (options.onlyPresent && !exists) {
+			return nil, nil
+		}
+
+		m.setString(args[0], []byte(args[1]), options.expiration)
+
+		return luaStatus("OK"), nil
+	case "INCR", "INCRBY":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		increment := int64(1)
+		if name == "INCRBY" {
+			if err := arity(2); err != nil {
+				return nil, err
+			}
+
+			parsed, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+
+			increment = parsed
+		}
+
+		return m.incrBy(args[0], increment)
+	case "DEL":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		return m.del(args...), nil
+	case "EXISTS":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		var count int64
+		for _, key := range args {
+			if m.lookup(key) != nil {
+				count++
+			}
+		}
+
+		return count, nil
+	case "LPUSH":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		return m.lpush(args[0], args[1:])
+	case "LRANGE", "LTRIM":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+
+		start, startErr := strconv.ParseInt(args[1], 10, 64)
+		stop, stopErr := strconv.ParseInt(args[2], 10, 64)
+		if startErr != nil || stopErr != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+
+		if name == "LTRIM" {
+			if err := m.ltrim(args[0], start, stop); err != nil {
+				return nil, err
+			}
+
+			return luaStatus("OK"), nil
+		}
+
+		values, err := m.lrange(args[0], start, stop)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := make([]interface{}, len(values))
+		for i, value := range values {
+			reply[i] = value
+		}
+
+		return reply, nil
+	case "LINDEX":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		index, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+
+		value, ok, err := m.lindex(args[0], index)
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		return string(value), nil
+	case "RPOP":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		value, ok, err := m.rpop(args[0])
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		return string(value), nil
+	case "PEXPIRE":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		milliseconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+
+		entry := m.lookup(args[0])
+		if entry == nil {
+			return int64(0), nil
+		}
+
+		if milliseconds <= 0 {
+			m.del(args[0])
+			return int64(1), nil
+		}
+
+		entry.ExpiresAt = time.Now().UnixMilli() + milliseconds
+		m.dirty = true
+
+		return int64(1), nil
+	case "PERSIST":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		entry := m.lookup(args[0])
+		if entry == nil || entry.ExpiresAt == 0 {
+			return int64(0), nil
+		}
+
+		entry.ExpiresAt = 0
+		m.dirty = true
+
+		return int64(1), nil
+	case "PTTL":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		entry := m.lookup(args[0])
+		if entry == nil {
+			return int64(-2), nil
+		}
+
+		if entry.ExpiresAt == 0 {
+			return int64(-1), nil
+		}
+
+		return entry.ExpiresAt - time.Now().UnixMilli(), nil
+	case "ZADD":
+		// no flags, one score and member at a time is all the scripts need
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+
+		score, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return nil, errors.New("ERR value is not a valid float")
+		}
+
+		return m.zadd(args[0], score, args[2])
+	case "ZREM":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		return m.zrem(args[0], args[1:])
+	case "ZSCORE":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		score, ok, err := m.zscore(args[0], args[1])
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		return strconv.FormatFloat(score, 'f', -1, 64), nil
+	case "ZRANGEBYSCORE":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+
+		offset, count := int64(0), int64(-1)
+
+		if len(args) > 3 {
+			if len(args) != 6 || strings.ToUpper(args[3]) != "LIMIT" {
+				return nil, errors.New("ERR syntax error")
+			}
+
+			parsedOffset, offsetErr := strconv.ParseInt(args[4], 10, 64)
+			parsedCount, countErr := strconv.ParseInt(args[5], 10, 64)
+			if offsetErr != nil || countErr != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+
+			offset, count = parsedOffset, parsedCount
+		}
+
+		members, err := m.zrangeByScore(args[0], args[1], args[2], offset, count)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := make([]interface{}, len(members))
+		for i, member := range members {
+			reply[i] = member
+		}
+
+		return reply, nil
+	case "TIME":
+		now := time.Now()
+
+		return []interface{}{strconv.FormatInt(now.Unix(), 10), strconv.FormatInt(int64(now.Nanosecond()/1000), 10)}, nil
+	default:
+		return nil, fmt.Errorf("ERR unknown command '%s' in the in-memory store", strings.ToLower(name))
+	}
+}
@@ -0,0 +1,97 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// load reads the data file, if there is one yet.
+func (m *MemoryStore) load() error {
+	raw, err := os.ReadFile(m.dataFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]*memoryEntry)
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&entries); err != nil {
+		return err
+	}
+
+	m.entries = entries
+
+	log.Info().Str("file", m.dataFile).Int("keys", len(entries)).Msg("loaded in-memory store")
+
+	return nil
+}
+
+// save writes the store to the data file if it changed since the last save.
+// The file is replaced in one rename, so a crash never leaves half of it.
+func (m *MemoryStore) save() error {
+	m.mu.Lock()
+
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(m.entries)
+	m.dirty = false
+
+	m.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(m.dataFile), filepath.Base(m.dataFile)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(buffer.Bytes()); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), m.dataFile)
+}
+
+func (m *MemoryStore) persistLoop(interval time.Duration) {
+	defer close(m.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if err := m.save(); err != nil {
+				log.Error().Err(err).Str("file", m.dataFile).Msg("failed to persist in-memory store")
+
+				// try again on the next tick
+				m.mu.Lock()
+				m.dirty = true
+				m.mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"server-optimized/lib/kv_scripts"
+	"testing"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+const (
+	testKey        = "app:server-state:doc:state"
+	testCounterKey = testKey + ":update-count"
+)
+
+func newTestStore(t *testing.T, options *MemoryStoreOptions) *MemoryStore {
+	t.Helper()
+
+	if options == nil {
+		options = &MemoryStoreOptions{}
+	}
+
+	store, err := NewMemoryStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	return store
+}
+
+func execute(t *testing.T, store *MemoryStore, script func(*kv_scripts.ScriptManager) *kv_scripts.Script, args ...interface{}) interface{} {
+	t.Helper()
+
+	scriptMgr := kv_scripts.GetScriptManager(store)
+
+	result := scriptMgr.Execute(context.Background(), script(scriptMgr), []string{testKey, testCounterKey}, args...)
+	if result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+
+	return result.Val()
+}
+
+func stored(t *testing.T, store *MemoryStore, key string) string {
+	t.Helper()
+
+	values, err := store.MGet(context.Background(), key).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, _ := values[0].(string)
+	return value
+}
+
+func assertJSON(t *testing.T, actual string, expected string) {
+	t.Helper()
+
+	var a, e interface{}
+	if err := json.Unmarshal([]byte(actual), &a); err != nil {
+		t.Fatalf("invalid JSON %q: %v", actual, err)
+	}
+
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	aRaw, _ := json.Marshal(a)
+	eRaw, _ := json.Marshal(e)
+
+	if string(aRaw) != string(eRaw) {
+		t.Fatalf("expected %s, got %s", eRaw, aRaw)
+	}
+}
+
+func TestMemoryStoreReplaceScript(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	reply := execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":1}`)
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 || values[0] != int64(1) || values[1] != nil {
+		// GET gives false for a missing key, which replies as a nil element
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	reply = execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":2}`)
+	values, ok = reply.([]interface{})
+	if !ok || len(values) != 2 || values[0] != int64(2) || values[1] != `{"a":1}` {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	if value := stored(t, store, testKey); value != `{"a":2}` {
+		t.Fatalf("unexpected value %q", value)
+	}
+}
+
+func TestMemoryStoreExpectedUpdateCountConflict(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":1}`)
+
+	reply := execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "5", `{"a":2}`)
+	conflict, ok := kv_scripts.ParseConflict(reply)
+	if !ok {
+		t.Fatalf("expected a conflict, got %#v", reply)
+	}
+
+	if conflict.UpdateCount != 1 || conflict.Value == nil || *conflict.Value != `{"a":1}` {
+		t.Fatalf("unexpected conflict: %+v", conflict)
+	}
+
+	reply = execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "1", `{"a":2}`)
+	if _, ok := kv_scripts.ParseConflict(reply); ok {
+		t.Fatal("matching update count conflicted")
+	}
+}
+
+func TestMemoryStoreDeepMergeScript(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":{"b":1,"c":2},"list":[],"gone":true}`)
+
+	reply := execute(t, store, (*kv_scripts.ScriptManager).GetDeepMerge, "", `{"a":{"c":3,"d":[]},"gone":null}`)
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 3 || values[0] != int64(2) {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	// deep_merge keeps nulls, unlike a merge patch
+	assertJSON(t, values[1].(string), `{"a":{"b":1,"c":3,"d":[]},"list":[],"gone":null}`)
+	assertJSON(t, stored(t, store, testKey), `{"a":{"b":1,"c":3,"d":[]},"list":[],"gone":null}`)
+}
+
+func TestMemoryStoreAtomicOpsScript(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"count":1,"items":[{"qty":1}],"tags":["a"]}`)
+
+	reply := execute(t, store, (*kv_scripts.ScriptManager).GetAtomicOps, "",
+		`{"$inc":{"count":2,"items.0.qty":0.5},"$push":{"tags":"b"},"$set":{"name":"doc"}}`)
+
+	var result struct {
+		Success     bool            `json:"success"`
+		Value       json.RawMessage `json:"value"`
+		UpdateCount int64           `json:"update_count"`
+		Error       string          `json:"error"`
+	}
+
+	raw, ok := reply.(string)
+	if !ok {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	if err := json.Unmarshal([]byte(raw), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Success || result.UpdateCount != 2 {
+		t.Fatalf("unexpected result: %s", raw)
+	}
+
+	assertJSON(t, string(result.Value), `{"count":3,"items":[{"qty":1.5}],"tags":["a","b"],"name":"doc"}`)
+
+	reply = execute(t, store, (*kv_scripts.ScriptManager).GetAtomicOps, "", `{"$inc":{"name":1}}`)
+	if err := json.Unmarshal([]byte(reply.(string)), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Success || result.Error == "" {
+		t.Fatalf("expected an error for $inc on a string, got %s", reply)
+	}
+}
+
+func TestMemoryStoreAtomicOpsScriptArrayRoot(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `[{"qty":1},{"qty":2}]`)
+
+	reply := execute(t, store, (*kv_scripts.ScriptManager).GetAtomicOps, "", `{"$inc":{"1.qty":3}}`)
+
+	var result kv_scripts.AtomicOpsResult
+	if err := json.Unmarshal([]byte(reply.(string)), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Success || result.UpdateCount != 2 {
+		t.Fatalf("unexpected result: %s", reply)
+	}
+
+	value, err := json.Marshal(result.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertJSON(t, string(value), `[{"qty":1},{"qty":5}]`)
+}
+
+func TestMemoryStoreRemoveScript(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":1}`)
+
+	reply := execute(t, store, (*kv_scripts.ScriptManager).GetRemove, "1")
+	if reply != int64(2) {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	if value := stored(t, store, testKey); value != "" {
+		t.Fatalf("key survived remove: %q", value)
+	}
+}
+
+func TestMemoryStoreWriteTTL(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":1}`, "60000")
+	if store.entries[testKey].ExpiresAt == 0 {
+		t.Fatal("replace with a ttl left the key without one")
+	}
+
+	// no ttl argument keeps the one the key has
+	execute(t, store, (*kv_scripts.ScriptManager).GetDeepMerge, "", `{"b":2}`)
+	if store.entries[testKey].ExpiresAt == 0 {
+		t.Fatal("merge without a ttl dropped the key's ttl")
+	}
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetAtomicOps, "", `{"$inc":{"a":1}}`, "0")
+	if store.entries[testKey].ExpiresAt != 0 {
+		t.Fatal("ttl 0 left the key with a ttl")
+	}
+}
+
+func TestMemoryStoreRemoveScriptTombstone(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":1}`)
+
+	if reply := execute(t, store, (*kv_scripts.ScriptManager).GetRemove, ""); reply != int64(2) {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+
+	// a count that started over would fall behind what watchers hold
+	if store.entries[testCounterKey].ExpiresAt != 0 {
+		t.Fatal("the update count of a removed key expires")
+	}
+
+	// written again, the key keeps counting
+	reply := execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":2}`)
+	if values, ok := reply.([]interface{}); !ok || values[0] != int64(3) {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+}
+
+func TestMemoryStoreExpireScript(t *testing.T) {
+	store := newTestStore(t, nil)
+	scriptMgr := kv_scripts.GetScriptManager(store)
+	ctx := context.Background()
+
+	const indexKey = "app:server-state:expiries"
+
+	expire := func() *goRedis.Cmd {
+		return scriptMgr.Execute(ctx, scriptMgr.GetExpire(), []string{testKey, testCounterKey, indexKey}, "")
+	}
+
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetReplace(), []string{testKey, testCounterKey, indexKey}, "", `{"a":1}`, "60000").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// not expired yet: the TTL that is left
+	if ttl, err := expire().Int64(); err != nil || ttl <= 0 || ttl > 60000 {
+		t.Fatalf("unexpected ttl %d: %v", ttl, err)
+	}
+
+	store.entries[testKey].ExpiresAt = 1
+
+	reply, err := expire().Slice()
+	if err != nil || len(reply) != 2 || reply[0] != "expired" || reply[1] != int64(2) {
+		t.Fatalf("unexpected reply: %#v, %v", reply, err)
+	}
+
+	// the watchers already know
+	if err := expire().Err(); err != goRedis.Nil {
+		t.Fatalf("expected nil for an expired key swept before, got %v", err)
+	}
+
+	if store.entries[testCounterKey].ExpiresAt != 0 {
+		t.Fatal("the update count of an expired key expires")
+	}
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":2}`)
+
+	if ttl, err := expire().Int64(); err != nil || ttl != -1 {
+		t.Fatalf("expected -1 for a key written again without a ttl, got %d: %v", ttl, err)
+	}
+}
+
+func TestMemoryStoreTouchScript(t *testing.T) {
+	store := newTestStore(t, nil)
+	scriptMgr := kv_scripts.GetScriptManager(store)
+	ctx := context.Background()
+
+	touch := func(ttl string) *goRedis.Cmd {
+		return scriptMgr.Execute(ctx, scriptMgr.GetTouch(), []string{testKey, testCounterKey}, ttl)
+	}
+
+	if err := touch("1000").Err(); err != goRedis.Nil {
+		t.Fatalf("expected nil for a missing key, got %v", err)
+	}
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":1}`)
+
+	if count, err := touch("1000").Int64(); err != nil || count != 1 {
+		t.Fatalf("unexpected reply %d: %v", count, err)
+	}
+
+	if store.entries[testKey].ExpiresAt == 0 {
+		t.Fatal("touch did not set a ttl")
+	}
+
+	touch("0")
+
+	if store.entries[testKey].ExpiresAt != 0 {
+		t.Fatal("touch with 0 left the ttl")
+	}
+}
+
+func TestMemoryStoreExpiryIndex(t *testing.T) {
+	store := newTestStore(t, nil)
+	scriptMgr := kv_scripts.GetScriptManager(store)
+	ctx := context.Background()
+
+	const indexKey = "app:server-state:expiries"
+	keys := []string{testKey, testCounterKey, indexKey}
+
+	indexed := func(max string) []string {
+		t.Helper()
+
+		members, err := store.ZRangeByScore(ctx, indexKey, &goRedis.ZRangeBy{Min: "-inf", Max: max}).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return members
+	}
+
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetReplace(), keys, "", `{"a":1}`, "60000").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// due in a minute, not now
+	now := time.Now().UnixMilli()
+	if len(indexed(fmt.Sprint(now))) != 0 || len(indexed(fmt.Sprint(now+61000))) != 1 {
+		t.Fatalf("unexpected index %v", indexed("+inf"))
+	}
+
+	// writes that keep the TTL keep the entry
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetDeepMerge(), keys, "", `{"b":2}`, "").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(indexed("+inf")) != 1 {
+		t.Fatal("a write keeping the TTL dropped the index entry")
+	}
+
+	if err := scriptMgr.Execute(ctx, scriptMgr.GetRemove(), keys, "").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if members := indexed("+inf"); len(members) != 0 {
+		t.Fatalf("a removed key stayed in the index: %v", members)
+	}
+}
+
+func TestMemoryStoreHistory(t *testing.T) {
+	store := newTestStore(t, nil)
+	ctx := context.Background()
+
+	history := func(maxVersions int, maxAge int64, now int64) string {
+		return fmt.Sprintf("%d:%d:%d", maxVersions, maxAge, now)
+	}
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":1}`, "", history(3, 0, 1000))
+	execute(t, store, (*kv_scripts.ScriptManager).GetAtomicOps, "", `{"$inc":{"a":1}}`, "", history(3, 0, 2000))
+	execute(t, store, (*kv_scripts.ScriptManager).GetDeepMerge, "", `{"b":true}`, "", history(3, 0, 3000))
+	execute(t, store, (*kv_scripts.ScriptManager).GetRemove, "", history(3, 0, 4000))
+
+	entries, err := ReadHistory(ctx, store, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first version fell out, newest first
+	if len(entries) != 3 || entries[0].UpdateCount != 4 || !entries[0].Deleted || entries[2].UpdateCount != 2 {
+		t.Fatalf("unexpected history: %+v", entries)
+	}
+
+	assertJSON(t, *entries[1].Value, `{"a":2,"b":true}`)
+
+	if entries[1].Time != 3000 {
+		t.Fatalf("unexpected time %d", entries[1].Time)
+	}
+
+	// versions older than the max age go on the next write
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":3}`, "", history(0, 1500, 5000))
+
+	entries, err = ReadHistory(ctx, store, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].UpdateCount != 5 || entries[1].UpdateCount != 4 {
+		t.Fatalf("unexpected history: %+v", entries)
+	}
+
+	if store.entries[testKey+HistorySuffix].ExpiresAt == 0 {
+		t.Fatal("a history with a max age does not expire")
+	}
+
+	// without the argument, no history is kept
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":4}`)
+
+	if entries, _ = ReadHistory(ctx, store, testKey); len(entries) != 2 {
+		t.Fatalf("a write without history was recorded: %+v", entries)
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	now := time.Now().UnixMilli()
+	entries := []HistoryEntry{
+		{UpdateCount: 3, Time: now},
+		{UpdateCount: 2, Time: now - 30_000},
+		{UpdateCount: 1, Time: now - 90_000},
+	}
+
+	if trimmed := TrimHistory(entries, 2, 0); len(trimmed) != 2 || trimmed[1].UpdateCount != 2 {
+		t.Fatalf("unexpected trim by count: %+v", trimmed)
+	}
+
+	if trimmed := TrimHistory(entries, 0, time.Minute); len(trimmed) != 2 {
+		t.Fatalf("unexpected trim by age: %+v", trimmed)
+	}
+
+	if trimmed := TrimHistory(entries, 0, 0); len(trimmed) != 3 {
+		t.Fatalf("unbounded history was trimmed: %+v", trimmed)
+	}
+}
+
+func TestMemoryStoreTxPipeline(t *testing.T) {
+	store := newTestStore(t, nil)
+	ctx := context.Background()
+
+	store.RPush(ctx, "list", "a", "b", "c")
+
+	tx := store.TxPipeline()
+	lrange := tx.LRange(ctx, "list", 0, -1)
+	tx.LTrim(ctx, "list", 3, -1)
+	tx.Set(ctx, "snapshot", "abc", 0)
+
+	if _, err := tx.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if values := lrange.Val(); len(values) != 3 || values[2] != "c" {
+		t.Fatalf("unexpected range: %v", values)
+	}
+
+	if values, err := store.MGet(ctx, "list", "snapshot").Result(); err != nil || values[0] != nil || values[1] != "abc" {
+		t.Fatalf("unexpected values: %v, %v", values, err)
+	}
+
+	tx = store.TxPipeline()
+	tx.Get(ctx, "missing")
+
+	if _, err := tx.Exec(ctx); err != goRedis.Nil {
+		t.Fatalf("expected redis: nil, got %v", err)
+	}
+}
+
+func TestMemoryStorePersistence(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "airstate.db")
+
+	store, err := NewMemoryStore(&MemoryStoreOptions{DataFile: dataFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execute(t, store, (*kv_scripts.ScriptManager).GetReplace, "", `{"a":1}`)
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = newTestStore(t, &MemoryStoreOptions{DataFile: dataFile})
+
+	if value := stored(t, store, testKey); value != `{"a":1}` {
+		t.Fatalf("unexpected value after reload %q", value)
+	}
+
+	if value := stored(t, store, testCounterKey); value != "1" {
+		t.Fatalf("unexpected update count after reload %q", value)
+	}
+}
@@ -0,0 +1,367 @@
+package kv
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+	"github.com/redis/go-redis/v9/maintnotifications"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RedisModeSingle   = "single"
+	RedisModeSentinel = "sentinel"
+	RedisModeCluster  = "cluster"
+)
+
+const defaultRedisURL = "redis://localhost:6379"
+
+// RedisOptions is how to reach KVRocks (or any Redis). URL carries the
+// address and, like go-redis' ParseURL, credentials, database and query
+// options such as ?dial_timeout=3s; the other fields override it when set.
+type RedisOptions struct {
+	// URL is redis:// or rediss:// (TLS). A bare host:port, and the old
+	// kv:// scheme, are read as redis://
+	URL string
+
+	// Mode is single (the default), sentinel or cluster
+	Mode string
+
+	// Username and Password are the ACL credentials, DB the database of a
+	// single or sentinel connection when it is not 0
+	Username string
+	Password string
+	DB       int
+
+	TLS      RedisTLSOptions
+	Sentinel RedisSentinelOptions
+	Cluster  RedisClusterOptions
+
+	// PoolSize and MinIdleConns are per node, PoolTimeout is how long to wait
+	// for a connection when the pool is exhausted
+	PoolSize     int
+	MinIdleConns int
+	PoolTimeout  time.Duration
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	MaxRetries   int
+}
+
+type RedisTLSOptions struct {
+	// Enabled turns TLS on for a redis:// URL; rediss:// always has it
+	Enabled bool
+
+	// CAFile verifies the server instead of the system roots, CertFile and
+	// KeyFile are the client certificate for mutual TLS
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+type RedisSentinelOptions struct {
+	// MasterName is the monitored master, it can also be ?master_name= in
+	// the URL
+	MasterName string
+
+	// Addresses are more sentinels besides the one in the URL
+	Addresses []string
+
+	// Username and Password authenticate against the sentinels. The ones in
+	// the URL do both, the sentinels and the master
+	Username string
+	Password string
+}
+
+type RedisClusterOptions struct {
+	// Addresses are more seed nodes besides the one in the URL
+	Addresses []string
+
+	// HashTag picks the keys that share a slot: "app" (the default) puts all
+	// keys of an app together, so transactions across its keys work; "key"
+	// only keeps the keys of one state, document or room together, which
+	// spreads an app over the cluster but leaves the watchers of expired keys
+	// untold, as the expiry index of an app is in a slot of its own
+	HashTag string
+}
+
+// normalizeRedisURL makes the URL parseable by go-redis.
+func normalizeRedisURL(raw string) string {
+	if raw == "" {
+		return defaultRedisURL
+	}
+
+	scheme, rest, found := strings.Cut(raw, "://")
+	if !found {
+		return "redis://" + raw
+	}
+
+	if scheme == "kv" {
+		return "redis://" + rest
+	}
+
+	return raw
+}
+
+// addressList splits comma separated entries, as an environment variable gives
+// the whole list in one.
+func addressList(entries []string) []string {
+	var addresses []string
+
+	for _, entry := range entries {
+		for _, address := range strings.Split(entry, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses
+}
+
+// tlsConfig builds the TLS configuration, starting from the one a rediss://
+// URL gave, or nil when TLS is off.
+func (o *RedisOptions) tlsConfig(fromURL *tls.Config) (*tls.Config, error) {
+	config := fromURL
+
+	if config == nil {
+		if !o.TLS.Enabled {
+			return nil, nil
+		}
+
+		config = &tls.Config{}
+	}
+
+	config.MinVersion = tls.VersionTLS12
+
+	if o.TLS.ServerName != "" {
+		config.ServerName = o.TLS.ServerName
+	}
+
+	config.InsecureSkipVerify = config.InsecureSkipVerify || o.TLS.InsecureSkipVerify
+
+	if o.TLS.CAFile != "" {
+		raw, err := os.ReadFile(o.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the KV CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificates in the KV CA file %s", o.TLS.CAFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if o.TLS.CertFile != "" || o.TLS.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(o.TLS.CertFile, o.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the KV client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+func logRedisConnect(ctx context.Context, cn *goRedis.Conn) error {
+	log.Info().Msg("connected to redis")
+	return nil
+}
+
+// newRedisStore connects to KVRocks in the configured mode.
+func newRedisStore(o *RedisOptions) (Store, error) {
+	switch o.Mode {
+	case "", RedisModeSingle:
+		options, err := o.singleOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		return &redisStore{Client: goRedis.NewClient(options)}, nil
+	case RedisModeSentinel:
+		options, err := o.failoverOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		return &redisStore{Client: goRedis.NewFailoverClient(options)}, nil
+	case RedisModeCluster:
+		options, err := o.clusterOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		return newClusterStore(goRedis.NewClusterClient(options), o.Cluster.HashTag)
+	default:
+		return nil, fmt.Errorf("unknown kv mode %q, expected single, sentinel or cluster", o.Mode)
+	}
+}
+
+func (o *RedisOptions) singleOptions() (*goRedis.Options, error) {
+	options, err := goRedis.ParseURL(normalizeRedisURL(o.URL))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Username != "" {
+		options.Username = o.Username
+	}
+
+	if o.Password != "" {
+		options.Password = o.Password
+	}
+
+	if o.DB != 0 {
+		options.DB = o.DB
+	}
+
+	if options.TLSConfig, err = o.tlsConfig(options.TLSConfig); err != nil {
+		return nil, err
+	}
+
+	o.pool(&options.PoolSize, &options.MinIdleConns, &options.PoolTimeout)
+	o.timeouts(&options.DialTimeout, &options.ReadTimeout, &options.WriteTimeout, &options.MaxRetries)
+
+	options.MaintNotificationsConfig = &maintnotifications.Config{
+		Mode: maintnotifications.ModeDisabled,
+	}
+	options.OnConnect = logRedisConnect
+
+	return options, nil
+}
+
+func (o *RedisOptions) failoverOptions() (*goRedis.FailoverOptions, error) {
+	options, err := goRedis.ParseFailoverURL(normalizeRedisURL(o.URL))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Sentinel.MasterName != "" {
+		options.MasterName = o.Sentinel.MasterName
+	}
+
+	if options.MasterName == "" {
+		return nil, errors.New("the sentinel kv mode needs a master name")
+	}
+
+	options.SentinelAddrs = append(options.SentinelAddrs, addressList(o.Sentinel.Addresses)...)
+
+	// go-redis only gives the URL credentials to the sentinels
+	if options.Username == "" && options.Password == "" {
+		options.Username, options.Password = options.SentinelUsername, options.SentinelPassword
+	}
+
+	if o.Sentinel.Username != "" {
+		options.SentinelUsername = o.Sentinel.Username
+	}
+
+	if o.Sentinel.Password != "" {
+		options.SentinelPassword = o.Sentinel.Password
+	}
+
+	if o.Username != "" {
+		options.Username = o.Username
+	}
+
+	if o.Password != "" {
+		options.Password = o.Password
+	}
+
+	if o.DB != 0 {
+		options.DB = o.DB
+	}
+
+	if options.TLSConfig, err = o.tlsConfig(options.TLSConfig); err != nil {
+		return nil, err
+	}
+
+	o.pool(&options.PoolSize, &options.MinIdleConns, &options.PoolTimeout)
+	o.timeouts(&options.DialTimeout, &options.ReadTimeout, &options.WriteTimeout, &options.MaxRetries)
+
+	options.OnConnect = logRedisConnect
+
+	return options, nil
+}
+
+func (o *RedisOptions) clusterOptions() (*goRedis.ClusterOptions, error) {
+	options, err := goRedis.ParseClusterURL(normalizeRedisURL(o.URL))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.DB != 0 {
+		return nil, errors.New("the cluster kv mode only has database 0")
+	}
+
+	options.Addrs = append(options.Addrs, addressList(o.Cluster.Addresses)...)
+
+	if o.Username != "" {
+		options.Username = o.Username
+	}
+
+	if o.Password != "" {
+		options.Password = o.Password
+	}
+
+	if options.TLSConfig, err = o.tlsConfig(options.TLSConfig); err != nil {
+		return nil, err
+	}
+
+	o.pool(&options.PoolSize, &options.MinIdleConns, &options.PoolTimeout)
+	o.timeouts(&options.DialTimeout, &options.ReadTimeout, &options.WriteTimeout, &options.MaxRetries)
+
+	options.MaintNotificationsConfig = &maintnotifications.Config{
+		Mode: maintnotifications.ModeDisabled,
+	}
+	options.OnConnect = logRedisConnect
+
+	return options, nil
+}
+
+// pool and timeouts override what the URL set, zero keeps it (or the go-redis
+// default).
+func (o *RedisOptions) pool(size, minIdle *int, timeout *time.Duration) {
+	if o.PoolSize != 0 {
+		*size = o.PoolSize
+	}
+
+	if o.MinIdleConns != 0 {
+		*minIdle = o.MinIdleConns
+	}
+
+	if o.PoolTimeout != 0 {
+		*timeout = o.PoolTimeout
+	}
+}
+
+func (o *RedisOptions) timeouts(dial, read, write *time.Duration, maxRetries *int) {
+	if o.DialTimeout != 0 {
+		*dial = o.DialTimeout
+	}
+
+	if o.ReadTimeout != 0 {
+		*read = o.ReadTimeout
+	}
+
+	if o.WriteTimeout != 0 {
+		*write = o.WriteTimeout
+	}
+
+	if o.MaxRetries != 0 {
+		*maxRetries = o.MaxRetries
+	}
+}
@@ -0,0 +1,162 @@
+package kv
+
+import (
+	"testing"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+func TestNormalizeRedisURL(t *testing.T) {
+	cases := map[string]string{
+		"":                         "redis://localhost:6379",
+		"kv:6379":                  "redis://kv:6379",
+		"kv://localhost:6379":      "redis://localhost:6379",
+		"rediss://user:pw@kv:6380": "rediss://user:pw@kv:6380",
+	}
+
+	for raw, expected := range cases {
+		if actual := normalizeRedisURL(raw); actual != expected {
+			t.Errorf("normalizeRedisURL(%q) = %q, expected %q", raw, actual, expected)
+		}
+	}
+}
+
+func TestRedisSingleOptions(t *testing.T) {
+	options, err := (&RedisOptions{URL: "rediss://app:secret@kv:6380/2?dial_timeout=3s"}).singleOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.Addr != "kv:6380" || options.Username != "app" || options.Password != "secret" || options.DB != 2 {
+		t.Fatalf("unexpected options: %+v", options)
+	}
+
+	if options.TLSConfig == nil || options.DialTimeout != 3*time.Second {
+		t.Fatalf("expected TLS and the URL's dial timeout, got %+v", options)
+	}
+
+	options, err = (&RedisOptions{
+		URL:         "kv:6379",
+		Password:    "override",
+		DB:          5,
+		PoolSize:    20,
+		ReadTimeout: time.Second,
+		TLS:         RedisTLSOptions{Enabled: true, ServerName: "kv.internal"},
+	}).singleOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.Addr != "kv:6379" || options.Password != "override" || options.DB != 5 || options.PoolSize != 20 || options.ReadTimeout != time.Second {
+		t.Fatalf("unexpected options: %+v", options)
+	}
+
+	if options.TLSConfig == nil || options.TLSConfig.ServerName != "kv.internal" {
+		t.Fatalf("unexpected TLS config: %+v", options.TLSConfig)
+	}
+
+	if _, err := (&RedisOptions{URL: "redis://kv", TLS: RedisTLSOptions{CAFile: "/does/not/exist", Enabled: true}}).singleOptions(); err == nil {
+		t.Fatal("expected an error for a missing CA file")
+	}
+}
+
+func TestRedisFailoverOptions(t *testing.T) {
+	if _, err := (&RedisOptions{URL: "redis://sentinel:26379"}).failoverOptions(); err == nil {
+		t.Fatal("expected an error without a master name")
+	}
+
+	options, err := (&RedisOptions{
+		URL:      "redis://user:pw@sentinel-1:26379?master_name=primary",
+		Sentinel: RedisSentinelOptions{Addresses: []string{"sentinel-2:26379, sentinel-3:26379"}},
+	}).failoverOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.MasterName != "primary" || len(options.SentinelAddrs) != 3 || options.SentinelAddrs[2] != "sentinel-3:26379" {
+		t.Fatalf("unexpected options: %+v", options)
+	}
+
+	if options.Username != "user" || options.Password != "pw" || options.SentinelPassword != "pw" {
+		t.Fatalf("expected the URL credentials for the master and sentinels, got %+v", options)
+	}
+}
+
+func TestRedisClusterOptions(t *testing.T) {
+	options, err := (&RedisOptions{
+		URL:     "redis://node-1:7000",
+		Cluster: RedisClusterOptions{Addresses: []string{"node-2:7000", "node-3:7000"}},
+	}).clusterOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(options.Addrs) != 3 {
+		t.Fatalf("unexpected seed nodes: %v", options.Addrs)
+	}
+
+	if _, err := (&RedisOptions{URL: "redis://node-1:7000", DB: 1}).clusterOptions(); err == nil {
+		t.Fatal("expected an error for a database in cluster mode")
+	}
+
+	if _, err := newRedisStore(&RedisOptions{Mode: "replicated"}); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestClusterStoreTag(t *testing.T) {
+	byKey := &clusterStore{hashTag: clusterHashTagKey}
+	byApp := &clusterStore{hashTag: clusterHashTagApp}
+
+	slot := func(tagged string) string {
+		return tagged[:len(tagged)-len(untag(tagged))]
+	}
+
+	state := byKey.tag("app:server-state:doc:1:state")
+	counter := byKey.tag("app:server-state:doc:1:state:update-count")
+	other := byKey.tag("app:server-state:other:state")
+
+	if slot(state) != slot(counter) || slot(state) == slot(other) {
+		t.Fatalf("unexpected tags %q, %q, %q", state, counter, other)
+	}
+
+	if untag(state) != "app:server-state:doc:1:state" {
+		t.Fatalf("untag gave %q", untag(state))
+	}
+
+	if slot(byKey.tag("app:yjs:h:snapshot")) != slot(byKey.tag("app:yjs:h:updates")) {
+		t.Fatal("document keys are in different slots")
+	}
+
+	if slot(byApp.tag("app:server-state:a:state")) != slot(byApp.tag("app:presence:h:peers")) {
+		t.Fatal("app keys are in different slots")
+	}
+
+	if slot(byApp.tag("app:server-state:a:state")) == slot(byApp.tag("other:server-state:a:state")) {
+		t.Fatal("two apps share a tag")
+	}
+
+	if untag("plain") != "plain" {
+		t.Fatal("untag changed a key without a tag")
+	}
+}
+
+func TestClusterStoreZRangeByScoreMembers(t *testing.T) {
+	byKey := &clusterStore{hashTag: clusterHashTagKey}
+
+	// the expiry scripts index KEYS[1], which the store has already tagged
+	cmd := untagMembers(goRedis.NewStringSliceResult([]string{
+		byKey.tag("app:server-state:doc:state"),
+		"app:server-state:plain:state",
+	}, nil))
+
+	members := cmd.Val()
+	if len(members) != 2 || members[0] != "app:server-state:doc:state" || members[1] != "app:server-state:plain:state" {
+		t.Fatalf("unexpected members %q", members)
+	}
+
+	if _, err := untagMembers(goRedis.NewStringSliceResult(nil, goRedis.Nil)).Result(); err != goRedis.Nil {
+		t.Fatalf("expected the error to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package kv
+
+import (
+	"context"
+	"time"
+
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+// Store is what the server needs from its key-value storage: the Redis
+// commands it issues, with go-redis' result types. KVRocks (or any Redis)
+// is the default; the in-memory store stands in for it when a single process
+// is all there is, and runs the same Lua scripts.
+type Store interface {
+	MGet(ctx context.Context, keys ...string) *goRedis.SliceCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.StatusCmd
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.BoolCmd
+	GetDel(ctx context.Context, key string) *goRedis.StringCmd
+	Del(ctx context.Context, keys ...string) *goRedis.IntCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *goRedis.ScanCmd
+
+	HGetAll(ctx context.Context, key string) *goRedis.MapStringStringCmd
+	HSet(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd
+	HDel(ctx context.Context, key string, fields ...string) *goRedis.IntCmd
+
+	RPush(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd
+
+	ZRangeByScore(ctx context.Context, key string, opt *goRedis.ZRangeBy) *goRedis.StringSliceCmd
+
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *goRedis.Cmd
+	ScriptLoad(ctx context.Context, script string) *goRedis.StringCmd
+
+	// TxPipeline queues commands to run atomically on Exec
+	TxPipeline() Tx
+
+	Close() error
+}
+
+// Tx is the part of a go-redis transaction pipeline the server uses.
+type Tx interface {
+	Get(ctx context.Context, key string) *goRedis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goRedis.StatusCmd
+	LRange(ctx context.Context, key string, start, stop int64) *goRedis.StringSliceCmd
+	LTrim(ctx context.Context, key string, start, stop int64) *goRedis.StatusCmd
+	HSet(ctx context.Context, key string, values ...interface{}) *goRedis.IntCmd
+	Exec(ctx context.Context) ([]goRedis.Cmder, error)
+}
+
+// redisStore is a Store on a go-redis client.
+type redisStore struct {
+	*goRedis.Client
+}
+
+func (r *redisStore) TxPipeline() Tx {
+	return r.Client.TxPipeline()
+}
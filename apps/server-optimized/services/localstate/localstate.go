@@ -1,9 +1,8 @@
 package localstate
 
 import (
+	"encoding/json"
 	"sync"
-
-	"github.com/nats-io/nats.go"
 )
 
 type Service interface {
@@ -11,20 +10,57 @@ type Service interface {
 }
 
 type LocalState struct {
-	mu          sync.RWMutex
-	sessionMeta map[string]*ServerStateSession
+	mu               sync.RWMutex
+	sessionMeta      map[string]*ServerStateSession
+	presenceSessions map[string]*PresenceSession
+	yjsSessions      map[string]*YjsSession
 }
 
 type ServerStateSession struct {
-	Keys          map[string]struct{}
-	Handler       func(stateKey string, data any)
+	sync.Mutex
+
+	Keys          map[ServerStateKey]struct{}
+	Handler       func(update *ServerStateUpdate)
 	Meta          map[string]any
-	Subscriptions map[string]*nats.Subscription
+	Subscriptions map[ServerStateKey]Subscription
+}
+
+// Subscription is a session's registration for the updates of one subject.
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// ServerStateKey is a key of an app; a session can watch the same key in
+// two apps, which are two states.
+type ServerStateKey struct {
+	AppID string
+	Key   string
+}
+
+// ServerStateUpdate is a value pushed to a server-state session. UpdateCount
+// is -1 when the publisher did not send one; Delta, when set, is a JSON Patch
+// that turns the value at BaseUpdateCount into this one. A Snapshot was read
+// from KV rather than published, and is delivered even if its count was
+// already sent.
+type ServerStateUpdate struct {
+	AppID           string
+	Key             string
+	Value           any
+	UpdateCount     int64
+	BaseUpdateCount int64
+	Delta           json.RawMessage
+	Snapshot        bool
+}
+
+func (u *ServerStateUpdate) StateKey() ServerStateKey {
+	return ServerStateKey{AppID: u.AppID, Key: u.Key}
 }
 
 func CreateLocalStateService() *LocalState {
 	return &LocalState{
-		sessionMeta: make(map[string]*ServerStateSession),
+		sessionMeta:      make(map[string]*ServerStateSession),
+		presenceSessions: make(map[string]*PresenceSession),
+		yjsSessions:      make(map[string]*YjsSession),
 	}
 }
 
@@ -47,9 +83,9 @@ func (l *LocalState) UpsertServerStateSession(sessionID string) *ServerStateSess
 	session, ok := l.sessionMeta[sessionID]
 	if !ok {
 		session = &ServerStateSession{
-			Keys:          make(map[string]struct{}),
+			Keys:          make(map[ServerStateKey]struct{}),
 			Meta:          make(map[string]any),
-			Subscriptions: make(map[string]*nats.Subscription),
+			Subscriptions: make(map[ServerStateKey]Subscription),
 		}
 
 		l.sessionMeta[sessionID] = session
@@ -72,3 +108,68 @@ func (l *LocalState) DeleteSession(sessionID string) {
 	delete(l.sessionMeta, sessionID)
 }
 
+type PresenceSession struct {
+	sync.Mutex
+
+	AppID      string
+	Room       string
+	HashedRoom string
+	PeerID     string
+	PeerMeta   any
+	PeerState  any
+	JoinedAt   int64
+}
+
+func (l *LocalState) GetPresenceSession(sessionID string) (*PresenceSession, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	session, ok := l.presenceSessions[sessionID]
+	return session, ok
+}
+
+func (l *LocalState) SetPresenceSession(sessionID string, session *PresenceSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.presenceSessions[sessionID] = session
+}
+
+func (l *LocalState) DeletePresenceSession(sessionID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.presenceSessions, sessionID)
+}
+
+type YjsSession struct {
+	sync.Mutex
+
+	AppID            string
+	DocumentID       string
+	HashedDocumentID string
+	StateVector      []byte
+	Initialized      chan struct{}
+}
+
+func (l *LocalState) GetYjsSession(sessionID string) (*YjsSession, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	session, ok := l.yjsSessions[sessionID]
+	return session, ok
+}
+
+func (l *LocalState) SetYjsSession(sessionID string, session *YjsSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.yjsSessions[sessionID] = session
+}
+
+func (l *LocalState) DeleteYjsSession(sessionID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.yjsSessions, sessionID)
+}
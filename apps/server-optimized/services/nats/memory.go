@@ -0,0 +1,266 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	natsGo "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+// memoryPendingLimit is how many messages a subscriber may fall behind by
+// before further ones are dropped, like a NATS slow consumer.
+const memoryPendingLimit = 8192
+
+// MemoryPubSub is an in-process PubSub for --standalone. It follows the NATS
+// semantics the server relies on: `*` and `>` wildcards, per-subscription
+// ordered asynchronous delivery, queue groups that get each message once,
+// and no-responders for requests nobody listens to.
+type MemoryPubSub struct {
+	mu            sync.RWMutex
+	subscriptions map[*memorySubscription]struct{}
+	closed        bool
+}
+
+type memorySubscription struct {
+	bus     *MemoryPubSub
+	subject []string
+	queue   string
+	pending chan *natsGo.Msg
+	once    sync.Once
+}
+
+func NewMemoryPubSub() *MemoryPubSub {
+	return &MemoryPubSub{
+		subscriptions: make(map[*memorySubscription]struct{}),
+	}
+}
+
+func (m *MemoryPubSub) Publish(subject string, data []byte) error {
+	return m.PublishMsg(&natsGo.Msg{Subject: subject, Data: data})
+}
+
+func (m *MemoryPubSub) PublishMsg(msg *natsGo.Msg) error {
+	_, err := m.deliver(msg)
+	return err
+}
+
+func (m *MemoryPubSub) deliver(msg *natsGo.Msg) (int, error) {
+	if msg.Subject == "" {
+		return 0, natsGo.ErrBadSubject
+	}
+
+	tokens := strings.Split(msg.Subject, ".")
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return 0, natsGo.ErrConnectionClosed
+	}
+
+	delivered := 0
+
+	// one member of every queue group gets the message; map order makes
+	// the pick random enough
+	queues := make(map[string]struct{})
+
+	for subscription := range m.subscriptions {
+		if !matchSubject(subscription.subject, tokens) {
+			continue
+		}
+
+		if subscription.queue != "" {
+			if _, picked := queues[subscription.queue]; picked {
+				continue
+			}
+
+			queues[subscription.queue] = struct{}{}
+		}
+
+		// every subscriber gets its own copy, as it would off the wire
+		copied := &natsGo.Msg{
+			Subject: msg.Subject,
+			Reply:   msg.Reply,
+			Data:    append([]byte(nil), msg.Data...),
+			Header:  natsGo.Header{},
+		}
+
+		for name, values := range msg.Header {
+			copied.Header[name] = append([]string(nil), values...)
+		}
+
+		select {
+		case subscription.pending <- copied:
+			delivered++
+		default:
+			log.Warn().Str("subject", msg.Subject).Msg("in-memory subscriber is too slow, dropping message")
+		}
+	}
+
+	return delivered, nil
+}
+
+func (m *MemoryPubSub) Subscribe(subject string, handler natsGo.MsgHandler) (Subscription, error) {
+	return m.QueueSubscribe(subject, "", handler)
+}
+
+func (m *MemoryPubSub) QueueSubscribe(subject string, queue string, handler natsGo.MsgHandler) (Subscription, error) {
+	subscription, err := m.subscribe(subject, queue, make(chan *natsGo.Msg, memoryPendingLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for msg := range subscription.pending {
+			handler(msg)
+		}
+	}()
+
+	return subscription, nil
+}
+
+func (m *MemoryPubSub) ChanSubscribe(subject string, ch chan *natsGo.Msg) (Subscription, error) {
+	subscription, err := m.subscribe(subject, "", make(chan *natsGo.Msg, memoryPendingLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for msg := range subscription.pending {
+			select {
+			case ch <- msg:
+			default:
+				log.Warn().Str("subject", msg.Subject).Msg("in-memory subscriber channel is full, dropping message")
+			}
+		}
+	}()
+
+	return subscription, nil
+}
+
+func (m *MemoryPubSub) subscribe(subject string, queue string, pending chan *natsGo.Msg) (*memorySubscription, error) {
+	if !validSubject(subject) {
+		return nil, natsGo.ErrBadSubject
+	}
+
+	subscription := &memorySubscription{
+		bus:     m,
+		subject: strings.Split(subject, "."),
+		queue:   queue,
+		pending: pending,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, natsGo.ErrConnectionClosed
+	}
+
+	m.subscriptions[subscription] = struct{}{}
+
+	return subscription, nil
+}
+
+func (m *MemoryPubSub) RequestWithContext(ctx context.Context, subject string, data []byte) (*natsGo.Msg, error) {
+	inboxID, err := gonanoid.New()
+	if err != nil {
+		return nil, err
+	}
+
+	inbox := "_INBOX." + inboxID
+	replies := make(chan *natsGo.Msg, 1)
+
+	subscription, err := m.ChanSubscribe(inbox, replies)
+	if err != nil {
+		return nil, err
+	}
+
+	defer subscription.Unsubscribe()
+
+	delivered, err := m.deliver(&natsGo.Msg{Subject: subject, Reply: inbox, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	if delivered == 0 {
+		return nil, natsGo.ErrNoResponders
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, natsGo.ErrTimeout
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+func (m *MemoryPubSub) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	m.closed = true
+
+	for subscription := range m.subscriptions {
+		subscription.once.Do(func() {
+			close(subscription.pending)
+		})
+	}
+
+	m.subscriptions = nil
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	s.once.Do(func() {
+		delete(s.bus.subscriptions, s)
+		close(s.pending)
+	})
+
+	return nil
+}
+
+func validSubject(subject string) bool {
+	if subject == "" {
+		return false
+	}
+
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if token == "" || (token == ">" && i != len(tokens)-1) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchSubject matches a published subject against a subscription's, which
+// may use `*` for one token and a trailing `>` for one or more.
+func matchSubject(pattern []string, subject []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return len(subject) > i
+		}
+
+		if i >= len(subject) || (token != "*" && token != subject[i]) {
+			return false
+		}
+	}
+
+	return len(pattern) == len(subject)
+}
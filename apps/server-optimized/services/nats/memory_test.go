@@ -0,0 +1,156 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	natsGo "github.com/nats-io/nats.go"
+)
+
+func receive(t *testing.T, ch chan *natsGo.Msg) *natsGo.Msg {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestMemoryPubSubWildcards(t *testing.T) {
+	bus := NewMemoryPubSub()
+	defer bus.Close()
+
+	exact := make(chan *natsGo.Msg, 8)
+	single := make(chan *natsGo.Msg, 8)
+	rest := make(chan *natsGo.Msg, 8)
+
+	for subject, ch := range map[string]chan *natsGo.Msg{"a.b.c": exact, "a.*.c": single, "a.>": rest} {
+		if _, err := bus.ChanSubscribe(subject, ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bus.Publish("a.b.c", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bus.Publish("a.b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := receive(t, exact); string(msg.Data) != "1" {
+		t.Fatalf("unexpected message %q", msg.Data)
+	}
+
+	if msg := receive(t, single); string(msg.Data) != "1" {
+		t.Fatalf("unexpected message %q", msg.Data)
+	}
+
+	if msg := receive(t, rest); string(msg.Data) != "1" {
+		t.Fatalf("unexpected message %q", msg.Data)
+	}
+
+	if msg := receive(t, rest); string(msg.Data) != "2" {
+		t.Fatalf("unexpected message %q", msg.Data)
+	}
+
+	select {
+	case msg := <-exact:
+		t.Fatalf("a.b.c received %q", msg.Subject)
+	case msg := <-single:
+		t.Fatalf("a.*.c received %q", msg.Subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryPubSubQueueGroups(t *testing.T) {
+	bus := NewMemoryPubSub()
+	defer bus.Close()
+
+	grouped := make(chan *natsGo.Msg, 16)
+	plain := make(chan *natsGo.Msg, 16)
+
+	for i := 0; i < 3; i++ {
+		if _, err := bus.QueueSubscribe("a.*", "workers", func(msg *natsGo.Msg) { grouped <- msg }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := bus.ChanSubscribe("a.*", plain); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := bus.Publish("a.b", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		receive(t, grouped)
+		receive(t, plain)
+	}
+
+	select {
+	case <-grouped:
+		t.Fatal("the queue group got a message more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryPubSubUnsubscribe(t *testing.T) {
+	bus := NewMemoryPubSub()
+	defer bus.Close()
+
+	ch := make(chan *natsGo.Msg, 8)
+
+	subscription, err := bus.ChanSubscribe("a", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := subscription.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	bus.Publish("a", []byte("1"))
+
+	select {
+	case <-ch:
+		t.Fatal("received after unsubscribe")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryPubSubRequest(t *testing.T) {
+	bus := NewMemoryPubSub()
+	defer bus.Close()
+
+	if _, err := bus.RequestWithContext(context.Background(), "service", nil); !errors.Is(err, natsGo.ErrNoResponders) {
+		t.Fatalf("expected no responders, got %v", err)
+	}
+
+	_, err := bus.Subscribe("service", func(msg *natsGo.Msg) {
+		bus.Publish(msg.Reply, append([]byte("re: "), msg.Data...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := bus.RequestWithContext(ctx, "service", []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(reply.Data) != "re: ping" {
+		t.Fatalf("unexpected reply %q", reply.Data)
+	}
+}
@@ -1,29 +1,105 @@
 package nats
 
 import (
+	"crypto/tls"
+	"errors"
 	"os"
+	"strings"
+	"time"
 
 	natsGo "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
 )
 
 type ServiceOptions struct {
-	url string
+	// URL is one server, or a comma separated list of them; NATS_URL when
+	// empty
+	URL string
+
+	// Servers are more seed servers of the cluster
+	Servers []string
+
+	// Name is the connection name the NATS server shows in its monitoring
+	Name string
+
+	// User and Password, Token, CredentialsFile (a .creds file with the
+	// user JWT and its nkey seed) and NKeyFile (an nkey seed) are the ways to
+	// authenticate; at most one of them is used
+	User            string
+	Password        string
+	Token           string
+	CredentialsFile string
+	NKeyFile        string
+
+	TLS TLSOptions
+
+	// MaxReconnects is how often to try to reconnect before giving up, -1
+	// never gives up; ReconnectBufferSize is how many bytes of publishes are
+	// held back while reconnecting
+	MaxReconnects       int
+	ReconnectWait       time.Duration
+	ReconnectBufferSize int
+	ConnectTimeout      time.Duration
+
+	// InMemory keeps messages inside the process instead of dialing NATS
+	InMemory bool
+}
+
+type TLSOptions struct {
+	// Enabled requires TLS on a nats:// URL; tls:// always has it
+	Enabled bool
+
+	// CAFile verifies the server instead of the system roots, CertFile and
+	// KeyFile are the client certificate for mutual TLS
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
 }
 
 type Service interface {
-	GetNATSConnection() *natsGo.Conn
+	GetPubSub() PubSub
 }
 
 type NATS struct {
-	natsConnection *natsGo.Conn
+	pubSub PubSub
 }
 
-func (n *NATS) GetNATSConnection() *natsGo.Conn {
-	return n.natsConnection
+func (n *NATS) GetPubSub() PubSub {
+	return n.pubSub
+}
+
+// GetConnection is the NATS connection under the pub/sub, for JetStream; nil
+// when the pub/sub is in memory.
+func (n *NATS) GetConnection() *natsGo.Conn {
+	if pubSub, ok := n.pubSub.(*natsPubSub); ok {
+		return pubSub.Conn
+	}
+
+	return nil
+}
+
+// OnReconnect calls handler after every reconnect to NATS, on a goroutine of
+// its own. Messages published in the meantime were not delivered to this
+// node's subscriptions. The in-memory pub/sub never disconnects.
+func (n *NATS) OnReconnect(handler func()) {
+	if pubSub, ok := n.pubSub.(*natsPubSub); ok {
+		pubSub.onReconnect(handler)
+	}
+}
+
+func (n *NATS) Close() {
+	n.pubSub.Close()
 }
 
 func CreateNATSService(options *ServiceOptions) (*NATS, error) {
-	natsURL := options.url
+	if options.InMemory {
+		return &NATS{
+			pubSub: NewMemoryPubSub(),
+		}, nil
+	}
+
+	natsURL := options.URL
 
 	if natsURL == "" {
 		// read from os env
@@ -35,13 +111,122 @@ func CreateNATSService(options *ServiceOptions) (*NATS, error) {
 		natsURL = "nats://localhost:4222"
 	}
 
-	nc, err := natsGo.Connect(natsURL)
+	pubSub := &natsPubSub{}
+
+	connectOptions, err := options.connectOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	connectOptions = append(connectOptions,
+		natsGo.DisconnectErrHandler(func(nc *natsGo.Conn, err error) {
+			log.Warn().Err(err).Msg("disconnected from nats")
+		}),
+		natsGo.ReconnectHandler(func(nc *natsGo.Conn) {
+			log.Info().Str("url", nc.ConnectedUrlRedacted()).Msg("reconnected to nats")
+			pubSub.reconnected()
+		}),
+		natsGo.ClosedHandler(func(nc *natsGo.Conn) {
+			if err := nc.LastError(); err != nil {
+				log.Error().Err(err).Msg("nats connection closed")
+				return
+			}
+
+			log.Info().Msg("nats connection closed")
+		}),
+		natsGo.ErrorHandler(func(nc *natsGo.Conn, subscription *natsGo.Subscription, err error) {
+			event := log.Error().Err(err)
+			if subscription != nil {
+				event = event.Str("subject", subscription.Subject)
+			}
+
+			event.Msg("nats error")
+		}),
+	)
+
+	servers := append(strings.Split(natsURL, ","), options.Servers...)
+
+	nc, err := natsGo.Connect(strings.Join(servers, ","), connectOptions...)
 
 	if err != nil {
 		return nil, err
 	}
 
+	log.Info().Str("url", nc.ConnectedUrlRedacted()).Msg("connected to nats")
+
+	pubSub.Conn = nc
+
 	return &NATS{
-		natsConnection: nc,
+		pubSub: pubSub,
 	}, nil
 }
+
+// connectOptions turns the auth, TLS and reconnect settings into NATS
+// options; what is not set keeps the nats.go default.
+func (o *ServiceOptions) connectOptions() ([]natsGo.Option, error) {
+	var connectOptions []natsGo.Option
+
+	if o.Name != "" {
+		connectOptions = append(connectOptions, natsGo.Name(o.Name))
+	}
+
+	methods := 0
+	for _, set := range []bool{o.User != "" || o.Password != "", o.Token != "", o.CredentialsFile != "", o.NKeyFile != ""} {
+		if set {
+			methods++
+		}
+	}
+
+	if methods > 1 {
+		return nil, errors.New("only one of nats user and password, token, credentials file and nkey file can be set")
+	}
+
+	switch {
+	case o.User != "" || o.Password != "":
+		connectOptions = append(connectOptions, natsGo.UserInfo(o.User, o.Password))
+	case o.Token != "":
+		connectOptions = append(connectOptions, natsGo.Token(o.Token))
+	case o.CredentialsFile != "":
+		connectOptions = append(connectOptions, natsGo.UserCredentials(o.CredentialsFile))
+	case o.NKeyFile != "":
+		nkey, err := natsGo.NkeyOptionFromSeed(o.NKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		connectOptions = append(connectOptions, nkey)
+	}
+
+	if o.TLS.Enabled || o.TLS.InsecureSkipVerify {
+		connectOptions = append(connectOptions, natsGo.Secure(&tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: o.TLS.InsecureSkipVerify,
+		}))
+	}
+
+	if o.TLS.CAFile != "" {
+		connectOptions = append(connectOptions, natsGo.RootCAs(o.TLS.CAFile))
+	}
+
+	if o.TLS.CertFile != "" || o.TLS.KeyFile != "" {
+		connectOptions = append(connectOptions, natsGo.ClientCert(o.TLS.CertFile, o.TLS.KeyFile))
+	}
+
+	if o.MaxReconnects != 0 {
+		connectOptions = append(connectOptions, natsGo.MaxReconnects(o.MaxReconnects))
+	}
+
+	if o.ReconnectWait > 0 {
+		connectOptions = append(connectOptions, natsGo.ReconnectWait(o.ReconnectWait))
+	}
+
+	if o.ReconnectBufferSize != 0 {
+		connectOptions = append(connectOptions, natsGo.ReconnectBufSize(o.ReconnectBufferSize))
+	}
+
+	if o.ConnectTimeout > 0 {
+		connectOptions = append(connectOptions, natsGo.Timeout(o.ConnectTimeout))
+	}
+
+	return connectOptions, nil
+}
@@ -0,0 +1,70 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	natsGo "github.com/nats-io/nats.go"
+)
+
+func applied(t *testing.T, options *ServiceOptions) natsGo.Options {
+	t.Helper()
+
+	connectOptions, err := options.connectOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	natsOptions := natsGo.GetDefaultOptions()
+	for _, option := range connectOptions {
+		if err := option(&natsOptions); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return natsOptions
+}
+
+func TestConnectOptions(t *testing.T) {
+	natsOptions := applied(t, &ServiceOptions{
+		Name:                "airstate",
+		User:                "server",
+		Password:            "secret",
+		TLS:                 TLSOptions{Enabled: true},
+		MaxReconnects:       -1,
+		ReconnectWait:       time.Second,
+		ReconnectBufferSize: 1024,
+	})
+
+	if natsOptions.Name != "airstate" || natsOptions.User != "server" || natsOptions.Password != "secret" {
+		t.Fatalf("unexpected options: %+v", natsOptions)
+	}
+
+	if !natsOptions.Secure || natsOptions.TLSConfig == nil {
+		t.Fatal("TLS is not enabled")
+	}
+
+	if natsOptions.MaxReconnect != -1 || natsOptions.ReconnectWait != time.Second || natsOptions.ReconnectBufSize != 1024 {
+		t.Fatalf("unexpected reconnect options: %+v", natsOptions)
+	}
+
+	natsOptions = applied(t, &ServiceOptions{Token: "token"})
+	if natsOptions.Token != "token" || natsOptions.Secure {
+		t.Fatalf("unexpected options: %+v", natsOptions)
+	}
+
+	defaults := natsGo.GetDefaultOptions()
+	if natsOptions.MaxReconnect != defaults.MaxReconnect {
+		t.Fatal("an unset option changed the default")
+	}
+}
+
+func TestConnectOptionsOneAuthMethod(t *testing.T) {
+	if _, err := (&ServiceOptions{User: "server", Token: "token"}).connectOptions(); err == nil {
+		t.Fatal("expected an error for two auth methods")
+	}
+
+	if _, err := (&ServiceOptions{NKeyFile: "/does/not/exist"}).connectOptions(); err == nil {
+		t.Fatal("expected an error for a missing nkey file")
+	}
+}
@@ -0,0 +1,78 @@
+package nats
+
+import (
+	"context"
+	"sync"
+
+	natsGo "github.com/nats-io/nats.go"
+)
+
+// PubSub is what the server needs from its message bus. NATS is the default;
+// the in-memory bus stands in for it when a single process is all there is.
+// Messages are NATS messages either way, so headers and reply subjects work
+// the same on both.
+type PubSub interface {
+	Publish(subject string, data []byte) error
+	PublishMsg(msg *natsGo.Msg) error
+	Subscribe(subject string, handler natsGo.MsgHandler) (Subscription, error)
+	QueueSubscribe(subject string, queue string, handler natsGo.MsgHandler) (Subscription, error)
+	ChanSubscribe(subject string, ch chan *natsGo.Msg) (Subscription, error)
+	RequestWithContext(ctx context.Context, subject string, data []byte) (*natsGo.Msg, error)
+	Close()
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// natsPubSub is a PubSub on a NATS connection.
+type natsPubSub struct {
+	*natsGo.Conn
+
+	mu                sync.Mutex
+	reconnectHandlers []func()
+}
+
+func (n *natsPubSub) onReconnect(handler func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.reconnectHandlers = append(n.reconnectHandlers, handler)
+}
+
+func (n *natsPubSub) reconnected() {
+	n.mu.Lock()
+	handlers := append([]func(){}, n.reconnectHandlers...)
+	n.mu.Unlock()
+
+	for _, handler := range handlers {
+		go handler()
+	}
+}
+
+func (n *natsPubSub) Subscribe(subject string, handler natsGo.MsgHandler) (Subscription, error) {
+	subscription, err := n.Conn.Subscribe(subject, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+func (n *natsPubSub) QueueSubscribe(subject string, queue string, handler natsGo.MsgHandler) (Subscription, error) {
+	subscription, err := n.Conn.QueueSubscribe(subject, queue, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+func (n *natsPubSub) ChanSubscribe(subject string, ch chan *natsGo.Msg) (Subscription, error) {
+	subscription, err := n.Conn.ChanSubscribe(subject, ch)
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
@@ -1,33 +1,131 @@
 package services
 
 import (
+	"context"
+	"fmt"
+	"server-optimized/lib/config"
+	"server-optimized/lib/kv_scripts"
+	"server-optimized/services/changefeed"
+	"server-optimized/services/expiry"
+	"server-optimized/services/hub"
 	"server-optimized/services/kv"
 	"server-optimized/services/localstate"
 	"server-optimized/services/nats"
+	"server-optimized/services/webhooks"
+	"strconv"
+	"strings"
+
+	natsGo "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 )
 
 type Services interface {
 	nats.Service
 	kv.Service
 	localstate.Service
+	hub.Service
+	expiry.Service
+	changefeed.Service
+	webhooks.Service
 }
 
 type ServiceValues struct {
 	nats.NATS
 	kv.KV
 	*localstate.LocalState
+	*hub.Hub
+	*expiry.Expiry
+	*changefeed.ChangeFeed
+	*webhooks.Webhooks
 }
 
 func CreateServices() (*ServiceValues, error) {
+	// with --standalone, both live in this process
+	standalone := viper.GetBool("standalone.enabled")
+
 	// NATS
-	natsService, natsServiceErr := nats.CreateNATSService(&nats.ServiceOptions{})
+	natsService, natsServiceErr := nats.CreateNATSService(&nats.ServiceOptions{
+		URL:             viper.GetString("nats.url"),
+		Servers:         viper.GetStringSlice("nats.servers"),
+		Name:            viper.GetString("nats.name"),
+		User:            viper.GetString("nats.user"),
+		Password:        viper.GetString("nats.password"),
+		Token:           viper.GetString("nats.token"),
+		CredentialsFile: viper.GetString("nats.credentialsFile"),
+		NKeyFile:        viper.GetString("nats.nkeyFile"),
+		TLS: nats.TLSOptions{
+			Enabled:            viper.GetBool("nats.tls.enabled"),
+			CAFile:             viper.GetString("nats.tls.caFile"),
+			CertFile:           viper.GetString("nats.tls.certFile"),
+			KeyFile:            viper.GetString("nats.tls.keyFile"),
+			InsecureSkipVerify: viper.GetBool("nats.tls.insecureSkipVerify"),
+		},
+		MaxReconnects:       viper.GetInt("nats.maxReconnects"),
+		ReconnectWait:       viper.GetDuration("nats.reconnectWait"),
+		ReconnectBufferSize: viper.GetInt("nats.reconnectBufferSize"),
+		ConnectTimeout:      viper.GetDuration("nats.connectTimeout"),
+
+		InMemory: standalone,
+	})
 
 	if natsServiceErr != nil {
 		return nil, natsServiceErr
 	}
 
-	// KV (KVRocks / KV)
-	kvService, kvServiceErr := kv.CreateKVService(&kv.ServiceOptions{})
+	// KV (KVRocks / KV, or JetStream Key-Value buckets)
+	kvBackend := viper.GetString("kv.backend")
+	if kvBackend != "" && kvBackend != "kvrocks" && kvBackend != "jetstream" {
+		return nil, fmt.Errorf("unknown kv backend %q, expected kvrocks or jetstream", kvBackend)
+	}
+
+	kvService, kvServiceErr := kv.CreateKVService(&kv.ServiceOptions{
+		Redis: kv.RedisOptions{
+			URL:      viper.GetString("kv.url"),
+			Mode:     viper.GetString("kv.mode"),
+			Username: viper.GetString("kv.username"),
+			Password: viper.GetString("kv.password"),
+			DB:       viper.GetInt("kv.db"),
+			TLS: kv.RedisTLSOptions{
+				Enabled:            viper.GetBool("kv.tls.enabled"),
+				CAFile:             viper.GetString("kv.tls.caFile"),
+				CertFile:           viper.GetString("kv.tls.certFile"),
+				KeyFile:            viper.GetString("kv.tls.keyFile"),
+				ServerName:         viper.GetString("kv.tls.serverName"),
+				InsecureSkipVerify: viper.GetBool("kv.tls.insecureSkipVerify"),
+			},
+			Sentinel: kv.RedisSentinelOptions{
+				MasterName: viper.GetString("kv.sentinel.masterName"),
+				Addresses:  viper.GetStringSlice("kv.sentinel.addresses"),
+				Username:   viper.GetString("kv.sentinel.username"),
+				Password:   viper.GetString("kv.sentinel.password"),
+			},
+			Cluster: kv.RedisClusterOptions{
+				Addresses: viper.GetStringSlice("kv.cluster.addresses"),
+				HashTag:   viper.GetString("kv.cluster.hashTag"),
+			},
+			PoolSize:     viper.GetInt("kv.pool.size"),
+			MinIdleConns: viper.GetInt("kv.pool.minIdle"),
+			PoolTimeout:  viper.GetDuration("kv.pool.timeout"),
+			DialTimeout:  viper.GetDuration("kv.timeouts.dial"),
+			ReadTimeout:  viper.GetDuration("kv.timeouts.read"),
+			WriteTimeout: viper.GetDuration("kv.timeouts.write"),
+			MaxRetries:   viper.GetInt("kv.maxRetries"),
+		},
+
+		InMemory:        standalone,
+		DataFile:        viper.GetString("standalone.dataFile"),
+		PersistInterval: viper.GetDuration("standalone.persistInterval"),
+
+		JetStream:      !standalone && kvBackend == "jetstream",
+		NATSConnection: natsService.GetConnection(),
+		JetStreamOptions: kv.JetStreamStoreOptions{
+			BucketPrefix:    viper.GetString("kv.jetstream.bucketPrefix"),
+			Replicas:        viper.GetInt("kv.jetstream.replicas"),
+			History:         viper.GetInt("kv.jetstream.history"),
+			OnExternalWrite: fanOutExternalWrite(natsService.GetPubSub()),
+		},
+	})
 
 	if kvServiceErr != nil {
 		return nil, kvServiceErr
@@ -35,9 +133,187 @@ func CreateServices() (*ServiceValues, error) {
 
 	localStateService := localstate.CreateLocalStateService()
 
+	// one NATS subscription per server-state subject, shared by all sessions
+	hubService := hub.CreateHub(natsService.GetPubSub())
+
+	// whatever was published while the connection was down never reached
+	// the hub, so every watched key is read again
+	natsService.OnReconnect(func() {
+		hubService.Resync(context.Background(), kvService.GetKVClient())
+	})
+
+	// KVRocks and the in-memory store drop expired keys silently, JetStream
+	// leaves a marker that the fan-out publishes. A cluster that only keeps
+	// the keys of one state together has no slot for an app's index
+	expiryService := expiry.CreateExpiryService(kvService.GetKVClient(), natsService.GetPubSub(), &expiry.ServiceOptions{
+		Native:    !standalone && kvBackend == "jetstream",
+		Unindexed: !standalone && kvBackend != "jetstream" && viper.GetString("kv.mode") == "cluster" && viper.GetString("kv.cluster.hashTag") == "key",
+		Interval:  viper.GetDuration("serverState.expirySweepInterval"),
+	})
+	expiryService.Start(context.Background())
+
+	// every write of an app, for backend consumers of the admin plane
+	changeFeedService, changeFeedServiceErr := changefeed.CreateChangeFeedService(natsService.GetConnection(), natsService.GetPubSub(), &changefeed.ServiceOptions{
+		Durable:  viper.GetBool("changeFeed.durable"),
+		MaxAge:   viper.GetDuration("changeFeed.maxAge"),
+		Replicas: viper.GetInt("changeFeed.replicas"),
+	})
+
+	if changeFeedServiceErr != nil {
+		expiryService.Stop()
+		return nil, changeFeedServiceErr
+	}
+
+	webhooksService, webhooksServiceErr := createWebhooksService(kvService.GetKVClient(), natsService.GetPubSub())
+	if webhooksServiceErr != nil {
+		expiryService.Stop()
+		return nil, webhooksServiceErr
+	}
+
+	// stopped by Close
+	if err := webhooksService.Start(context.Background()); err != nil {
+		expiryService.Stop()
+		return nil, err
+	}
+
 	return &ServiceValues{
 		NATS:       *natsService,
 		KV:         *kvService,
 		LocalState: localStateService,
+		Hub:        hubService,
+		Expiry:     expiryService,
+		ChangeFeed: changeFeedService,
+		Webhooks:   webhooksService,
 	}, nil
 }
+
+// createWebhooksService reads the endpoints from webhooks.url (for a single
+// one from the environment), webhooks.endpoints and webhooks.apps.
+func createWebhooksService(store kv.Store, pubSub nats.PubSub) (*webhooks.Webhooks, error) {
+	var endpoints []webhooks.Endpoint
+	if err := viper.UnmarshalKey("webhooks.endpoints", &endpoints); err != nil {
+		return nil, fmt.Errorf("invalid webhooks.endpoints: %w", err)
+	}
+
+	var apps map[string][]webhooks.Endpoint
+	if err := viper.UnmarshalKey("webhooks.apps", &apps); err != nil {
+		return nil, fmt.Errorf("invalid webhooks.apps: %w", err)
+	}
+
+	apps = config.RestoreKeyCase("webhooks.apps", apps)
+
+	if err := checkWebhookApps(apps); err != nil {
+		return nil, err
+	}
+
+	if url := viper.GetString("webhooks.url"); url != "" {
+		endpoints = append(endpoints, webhooks.Endpoint{
+			URL:    url,
+			Secret: viper.GetString("webhooks.secret"),
+		})
+	}
+
+	return webhooks.CreateWebhooksService(store, pubSub, &webhooks.ServiceOptions{
+		Endpoints:        endpoints,
+		Apps:             apps,
+		Timeout:          viper.GetDuration("webhooks.timeout"),
+		AuthorizeTimeout: viper.GetDuration("webhooks.authorizeTimeout"),
+		MaxAttempts:      viper.GetInt("webhooks.maxAttempts"),
+		InitialBackoff:   viper.GetDuration("webhooks.initialBackoff"),
+		MaxBackoff:       viper.GetDuration("webhooks.maxBackoff"),
+		Workers:          viper.GetInt("webhooks.workers"),
+		QueueSize:        viper.GetInt("webhooks.queueSize"),
+		MaxDeadLetters:   viper.GetInt("webhooks.maxDeadLetters"),
+	}), nil
+}
+
+// checkWebhookApps matches the apps of webhooks.apps against those with a
+// secret or an admin key. App IDs are case-sensitive, so endpoints for an app
+// spelled differently would never hear of it, and its authorize hooks would
+// never be asked; that is refused. An app that is not configured anywhere
+// else may well be in use, so it is only logged.
+func checkWebhookApps(apps map[string][]webhooks.Endpoint) error {
+	known := make(map[string]struct{})
+	for appID := range config.StringMapString("auth.appSecrets") {
+		known[appID] = struct{}{}
+	}
+
+	for appID := range config.StringMapString("admin.appKeys") {
+		known[appID] = struct{}{}
+	}
+
+	if len(known) == 0 {
+		return nil
+	}
+
+	for appID := range apps {
+		if _, ok := known[appID]; ok {
+			continue
+		}
+
+		for knownAppID := range known {
+			if strings.EqualFold(appID, knownAppID) {
+				return fmt.Errorf("webhooks.apps has %q, which is configured elsewhere as %q; app IDs are case-sensitive", appID, knownAppID)
+			}
+		}
+
+		log.Warn().Str("appId", appID).Msg("webhooks.apps has an app that has no secret or admin key")
+	}
+
+	return nil
+}
+
+// fanOutExternalWrite publishes the server-state writes other NATS clients
+// make to the JetStream buckets, so that subscribers see those too.
+func fanOutExternalWrite(pubSub nats.PubSub) func(key string, value []byte, deleted bool, revision uint64) {
+	return func(key string, value []byte, deleted bool, revision uint64) {
+		appID, rest, found := strings.Cut(key, ":server-state:")
+		stateKey, isState := strings.CutSuffix(rest, ":state")
+
+		if !found || !isState {
+			return
+		}
+
+		subject, err := hub.Subject(appID, stateKey)
+		if err != nil {
+			log.Error().Err(err).Str("key", stateKey).Msg("failed to fan out an external write")
+			return
+		}
+
+		msg := natsGo.NewMsg(subject)
+		msg.Data = value
+		msg.Header.Add("update_count", strconv.FormatUint(revision, 10))
+
+		if deleted {
+			msg.Data = []byte("null")
+		}
+
+		if err := pubSub.PublishMsg(msg); err != nil {
+			log.Error().Err(err).Str("key", stateKey).Msg("failed to fan out an external write")
+		}
+
+		var changeValue interface{}
+		if !deleted {
+			changeValue = kv_scripts.DecodeStoredValue(string(value))
+		}
+
+		hub.PublishChange(pubSub, appID, &hub.Change{
+			Key:         stateKey,
+			Op:          "external",
+			Value:       changeValue,
+			UpdateCount: int64(revision),
+			Actor:       "external",
+		})
+	}
+}
+
+// Close stops the background work, releases the connections, and persists
+// the in-memory store when it has a data file.
+func (s *ServiceValues) Close() error {
+	s.Webhooks.Stop()
+	s.Expiry.Stop()
+
+	s.NATS.Close()
+
+	return s.KV.Close()
+}
@@ -0,0 +1,91 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// VetoError is an authorize endpoint dropping a connection or a watch.
+type VetoError struct {
+	Reason string
+}
+
+func (e *VetoError) Error() string {
+	if e.Reason == "" {
+		return "dropped by an authorization hook"
+	}
+
+	return "dropped by an authorization hook: " + e.Reason
+}
+
+type authorizeResponse struct {
+	Drop   bool   `json:"drop"`
+	Reason string `json:"reason"`
+}
+
+// Authorize asks the authorize endpoints of appID that want event whether it
+// may happen, one after the other, and returns a *VetoError as soon as one
+// drops it. An endpoint that fails to answer with a 2xx drops it too, unless
+// it fails open; either way it is not retried.
+func (w *Webhooks) Authorize(ctx context.Context, appID string, event string, data interface{}) error {
+	var endpoints []*Endpoint
+	for _, endpoint := range w.endpoints(appID) {
+		if endpoint.Authorize && endpoint.wants(event) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	envelope, body, err := newEnvelope(appID, event, data)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		if err := w.authorize(ctx, endpoint, envelope, body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Webhooks) authorize(ctx context.Context, endpoint *Endpoint, envelope *Envelope, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, w.options.AuthorizeTimeout)
+	defer cancel()
+
+	status, responseBody, err := w.post(ctx, endpoint, envelope.ID, envelope.Type, body)
+	if err == nil && (status < 200 || status >= 300) {
+		err = fmt.Errorf("the endpoint answered %d", status)
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Str("url", endpoint.URL).Str("event", envelope.Type).Bool("failOpen", endpoint.FailOpen).Msg("authorization hook failed")
+
+		if endpoint.FailOpen {
+			return nil
+		}
+
+		return &VetoError{Reason: "the authorization hook failed"}
+	}
+
+	// an empty answer lets it through, like server-rapid's
+	var response authorizeResponse
+	if len(responseBody) > 0 {
+		if err := json.Unmarshal(responseBody, &response); err != nil && !endpoint.FailOpen {
+			return &VetoError{Reason: "the authorization hook gave an invalid answer"}
+		}
+	}
+
+	if response.Drop {
+		return &VetoError{Reason: response.Reason}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrEndpointGone       = errors.New("the endpoint of the dead letter is not configured anymore")
+)
+
+// deadLettersKey is a hash of an app's dead letters, from the delivery id to
+// the JSON encoded Delivery. Deliveries of events without an app, like
+// anonymous connections, are kept under "_global".
+func deadLettersKey(appID string) string {
+	if appID == "" {
+		appID = "_global"
+	}
+
+	return appID + ":webhooks:dead-letters"
+}
+
+func (w *Webhooks) deadLetter(delivery *Delivery) {
+	log.Warn().Str("url", delivery.URL).Str("event", delivery.Event).Int("attempts", delivery.Attempts).Str("error", delivery.LastError).Msg("webhook delivery failed for good, dead-lettering it")
+
+	delivery.Time = time.Now().UnixMilli()
+
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode a webhook dead letter")
+		return
+	}
+
+	ctx := context.Background()
+	key := deadLettersKey(delivery.AppID)
+
+	if err := w.store.HSet(ctx, key, delivery.ID, string(encoded)).Err(); err != nil {
+		log.Error().Err(err).Str("url", delivery.URL).Msg("failed to record a webhook dead letter")
+		return
+	}
+
+	if w.options.MaxDeadLetters <= 0 {
+		return
+	}
+
+	deadLetters, err := w.DeadLetters(ctx, delivery.AppID)
+	if err != nil || len(deadLetters) <= w.options.MaxDeadLetters {
+		return
+	}
+
+	for _, old := range deadLetters[w.options.MaxDeadLetters:] {
+		w.store.HDel(ctx, key, old.ID)
+	}
+}
+
+// DeadLetters lists the dead letters of appID, newest first.
+func (w *Webhooks) DeadLetters(ctx context.Context, appID string) ([]Delivery, error) {
+	entries, err := w.store.HGetAll(ctx, deadLettersKey(appID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := make([]Delivery, 0, len(entries))
+
+	for id, encoded := range entries {
+		var delivery Delivery
+		if err := json.Unmarshal([]byte(encoded), &delivery); err != nil {
+			log.Warn().Err(err).Str("id", id).Msg("ignoring a webhook dead letter that does not decode")
+			continue
+		}
+
+		deadLetters = append(deadLetters, delivery)
+	}
+
+	sort.Slice(deadLetters, func(i, j int) bool {
+		return deadLetters[i].Time > deadLetters[j].Time
+	})
+
+	return deadLetters, nil
+}
+
+// Redeliver takes a dead letter of appID out and queues it again, with a
+// fresh set of attempts, for the endpoint with its URL.
+func (w *Webhooks) Redeliver(ctx context.Context, appID string, id string) error {
+	delivery, err := w.takeDeadLetter(ctx, appID, id)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range w.endpoints(appID) {
+		if !endpoint.Authorize && endpoint.URL == delivery.URL {
+			delivery.endpoint = endpoint
+			break
+		}
+	}
+
+	if delivery.endpoint == nil {
+		return ErrEndpointGone
+	}
+
+	if err := w.store.HDel(ctx, deadLettersKey(appID), id).Err(); err != nil {
+		return err
+	}
+
+	delivery.Attempts = 0
+	delivery.LastError = ""
+	delivery.Status = 0
+	delivery.Time = 0
+
+	w.enqueue(delivery)
+
+	return nil
+}
+
+// Discard drops a dead letter of appID.
+func (w *Webhooks) Discard(ctx context.Context, appID string, id string) error {
+	if _, err := w.takeDeadLetter(ctx, appID, id); err != nil {
+		return err
+	}
+
+	return w.store.HDel(ctx, deadLettersKey(appID), id).Err()
+}
+
+func (w *Webhooks) takeDeadLetter(ctx context.Context, appID string, id string) (*Delivery, error) {
+	entries, err := w.store.HGetAll(ctx, deadLettersKey(appID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, ok := entries[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	var delivery Delivery
+	if err := json.Unmarshal([]byte(encoded), &delivery); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
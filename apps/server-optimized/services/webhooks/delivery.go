@@ -0,0 +1,173 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	IDHeader        = "X-AirState-Webhook-Id"
+	EventHeader     = "X-AirState-Webhook-Event"
+	TimestampHeader = "X-AirState-Webhook-Timestamp"
+	SignatureHeader = "X-AirState-Webhook-Signature"
+)
+
+// Delivery is one event on its way to one endpoint.
+type Delivery struct {
+	ID      string          `json:"id"`
+	EventID string          `json:"event_id"`
+	AppID   string          `json:"app_id"`
+	Event   string          `json:"event"`
+	URL     string          `json:"url"`
+	Body    json.RawMessage `json:"body"`
+
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+
+	// Status is the HTTP status of the last attempt, 0 when there was none
+	Status int `json:"status,omitempty"`
+
+	// Time is when the delivery was dead-lettered, in unix milliseconds
+	Time int64 `json:"time,omitempty"`
+
+	endpoint *Endpoint
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of
+//
+//	TIMESTAMP \n BODY
+//
+// which is what deliveries carry in the signature header. Receivers should
+// recompute it and check that the timestamp (unix seconds) is recent.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends body to endpoint, signed, and returns the response status and
+// body. An error means there was no response.
+func (w *Webhooks) post(ctx context.Context, endpoint *Endpoint, id string, event string, body []byte) (int, []byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(IDHeader, id)
+	request.Header.Set(EventHeader, event)
+	request.Header.Set(TimestampHeader, timestamp)
+
+	if endpoint.Secret != "" {
+		request.Header.Set(SignatureHeader, Sign(endpoint.Secret, timestamp, body))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+
+	// answers past this are not read, nothing needs that much
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return response.StatusCode, nil, err
+	}
+
+	return response.StatusCode, responseBody, nil
+}
+
+func (w *Webhooks) enqueue(delivery *Delivery) {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+
+	select {
+	case w.queue <- delivery:
+	default:
+		delivery.LastError = "the delivery queue is full"
+		w.deadLetter(delivery)
+	}
+}
+
+func (w *Webhooks) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case delivery := <-w.queue:
+			w.attempt(ctx, delivery)
+		}
+	}
+}
+
+// attempt tries a delivery once, then schedules the next try or
+// dead-letters it. 2xx answers are delivered; 408, 429 and 5xx ones, like
+// errors, are retried; any other answer will not change and is dead-lettered
+// at once.
+func (w *Webhooks) attempt(ctx context.Context, delivery *Delivery) {
+	attemptCtx, cancel := context.WithTimeout(ctx, w.options.Timeout)
+	defer cancel()
+
+	delivery.Attempts++
+
+	status, _, err := w.post(attemptCtx, delivery.endpoint, delivery.EventID, delivery.Event, delivery.Body)
+	delivery.Status = status
+
+	// stopped while in flight; not the endpoint's fault
+	if ctx.Err() != nil {
+		return
+	}
+
+	switch {
+	case err != nil:
+		delivery.LastError = err.Error()
+	case status >= 200 && status < 300:
+		return
+	default:
+		delivery.LastError = fmt.Sprintf("the endpoint answered %d", status)
+	}
+
+	retryable := err != nil || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+	if !retryable || delivery.Attempts >= w.options.MaxAttempts {
+		w.deadLetter(delivery)
+		return
+	}
+
+	log.Debug().Str("url", delivery.URL).Str("event", delivery.Event).Int("attempts", delivery.Attempts).Str("error", delivery.LastError).Msg("webhook delivery failed, retrying")
+
+	time.AfterFunc(w.backoff(delivery.Attempts), func() {
+		if ctx.Err() == nil {
+			w.enqueue(delivery)
+		}
+	})
+}
+
+// backoff is how long to wait after the attempts-th failure.
+func (w *Webhooks) backoff(attempts int) time.Duration {
+	backoff := w.options.InitialBackoff
+
+	for i := 1; i < attempts && backoff < w.options.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, w.options.MaxBackoff)
+}
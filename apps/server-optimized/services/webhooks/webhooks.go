@@ -0,0 +1,324 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"server-optimized/services/hub"
+	"server-optimized/services/kv"
+	"server-optimized/services/nats"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	natsGo "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+// The events, named as server-rapid's hooks are.
+const (
+	EventClientConnected    = "clientConnected"
+	EventClientDisconnected = "clientDisconnected"
+	EventClientSubscribed   = "clientSubscribed"
+	EventClientUnsubscribed = "clientUnsubscribed"
+	EventServerStateChanged = "serverStateChanged"
+)
+
+// changesQueue makes one node of the cluster deliver each server-state change.
+const changesQueue = "airstate-webhooks"
+
+// Endpoint is a URL that gets the events of an app POSTed to it.
+type Endpoint struct {
+	URL string `mapstructure:"url"`
+
+	// Secret signs the deliveries, see Sign
+	Secret string `mapstructure:"secret"`
+
+	// Events the endpoint gets; all of them when empty
+	Events []string `mapstructure:"events"`
+
+	// Authorize makes the endpoint a synchronous hook that decides on
+	// clientConnected and clientSubscribed before they happen, by answering
+	// {"drop": true, "reason": "..."}. It gets no other event.
+	Authorize bool `mapstructure:"authorize"`
+
+	// FailOpen lets the connection or watch through when an authorize
+	// endpoint fails to answer; by default it is dropped
+	FailOpen bool `mapstructure:"failOpen"`
+}
+
+type ServiceOptions struct {
+	// Endpoints get the events of every app, Apps those of one app only
+	Endpoints []Endpoint
+	Apps      map[string][]Endpoint
+
+	// Timeout bounds a delivery attempt, AuthorizeTimeout a call to an
+	// authorize endpoint
+	Timeout          time.Duration
+	AuthorizeTimeout time.Duration
+
+	// MaxAttempts is how many times a delivery is tried before it is
+	// dead-lettered, waiting InitialBackoff after the first failure and
+	// twice as long after each next one, up to MaxBackoff
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Workers deliver from a queue of QueueSize; a delivery that does not
+	// fit is dead-lettered right away
+	Workers   int
+	QueueSize int
+
+	// MaxDeadLetters is how many dead letters an app keeps, the oldest go
+	MaxDeadLetters int
+}
+
+type Service interface {
+	GetWebhooks() *Webhooks
+}
+
+// Webhooks POSTs connection lifecycle, watch and server-state events to the
+// endpoints configured for their app. Deliveries are signed, retried with
+// exponential backoff, and recorded as dead letters in KV once they run out
+// of attempts, from where they can be redelivered.
+type Webhooks struct {
+	store   kv.Store
+	pubSub  nats.PubSub
+	options ServiceOptions
+	client  *http.Client
+	queue   chan *Delivery
+
+	// done is closed by Stop, after which nothing is queued anymore
+	done         <-chan struct{}
+	stop         context.CancelFunc
+	workers      sync.WaitGroup
+	subscription nats.Subscription
+}
+
+// Envelope is the body of every delivery.
+type Envelope struct {
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	AppID string      `json:"appId"`
+	Time  int64       `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// ClientEvent is the data of clientConnected and clientDisconnected; ClientID
+// is the id of the connection.
+type ClientEvent struct {
+	ClientID string `json:"clientId"`
+	AppID    string `json:"appId,omitempty"`
+	Actor    string `json:"actor"`
+}
+
+// SubscriptionEvent is the data of clientSubscribed and clientUnsubscribed.
+// The client and actor are only known on the node the client is connected
+// to, so clientUnsubscribed, which happens where the session lives, carries
+// the session only.
+type SubscriptionEvent struct {
+	Service   string   `json:"service"`
+	ClientID  string   `json:"clientId,omitempty"`
+	Actor     string   `json:"actor,omitempty"`
+	SessionID string   `json:"sessionId"`
+	AppID     string   `json:"appId"`
+	Keys      []string `json:"keys"`
+}
+
+func CreateWebhooksService(store kv.Store, pubSub nats.PubSub, options *ServiceOptions) *Webhooks {
+	w := &Webhooks{
+		store:   store,
+		pubSub:  pubSub,
+		options: *options,
+	}
+
+	if w.options.Timeout <= 0 {
+		w.options.Timeout = 5 * time.Second
+	}
+
+	if w.options.AuthorizeTimeout <= 0 {
+		w.options.AuthorizeTimeout = 2 * time.Second
+	}
+
+	if w.options.MaxAttempts < 1 {
+		w.options.MaxAttempts = 1
+	}
+
+	if w.options.InitialBackoff <= 0 {
+		w.options.InitialBackoff = time.Second
+	}
+
+	if w.options.MaxBackoff < w.options.InitialBackoff {
+		w.options.MaxBackoff = w.options.InitialBackoff
+	}
+
+	if w.options.Workers < 1 {
+		w.options.Workers = 1
+	}
+
+	if w.options.QueueSize < 1 {
+		w.options.QueueSize = 1024
+	}
+
+	w.client = &http.Client{}
+	w.queue = make(chan *Delivery, w.options.QueueSize)
+
+	return w
+}
+
+func (w *Webhooks) GetWebhooks() *Webhooks {
+	return w
+}
+
+// Start runs the delivery workers until ctx is done or Stop is called, and
+// delivers the server-state changes when an endpoint asked for them.
+func (w *Webhooks) Start(ctx context.Context) error {
+	ctx, w.stop = context.WithCancel(ctx)
+	w.done = ctx.Done()
+
+	for i := 0; i < w.options.Workers; i++ {
+		w.workers.Add(1)
+
+		go func() {
+			defer w.workers.Done()
+			w.work(ctx)
+		}()
+	}
+
+	if !w.wantsChanges() {
+		return nil
+	}
+
+	prefix := hub.ChangesSubject("")
+
+	subscription, err := w.pubSub.QueueSubscribe(hub.ChangesSubject("*"), changesQueue, func(msg *natsGo.Msg) {
+		appID := strings.TrimPrefix(msg.Subject, prefix)
+		w.Dispatch(appID, EventServerStateChanged, json.RawMessage(msg.Data))
+	})
+	if err != nil {
+		w.Stop()
+		return err
+	}
+
+	w.subscription = subscription
+
+	return nil
+}
+
+// Stop unsubscribes from the changes, cancels the deliveries in flight and
+// waits for the workers. Deliveries still queued or waiting for a retry are
+// dropped.
+func (w *Webhooks) Stop() {
+	if w.stop == nil {
+		return
+	}
+
+	if w.subscription != nil {
+		w.subscription.Unsubscribe()
+	}
+
+	w.stop()
+	w.workers.Wait()
+}
+
+func (w *Webhooks) wantsChanges() bool {
+	for _, endpoints := range w.options.Apps {
+		for i := range endpoints {
+			if endpoints[i].wants(EventServerStateChanged) {
+				return true
+			}
+		}
+	}
+
+	for i := range w.options.Endpoints {
+		if w.options.Endpoints[i].wants(EventServerStateChanged) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *Endpoint) wants(event string) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, event)
+}
+
+// endpoints are those configured for appID, then those for every app.
+func (w *Webhooks) endpoints(appID string) []*Endpoint {
+	var endpoints []*Endpoint
+
+	if appID != "" {
+		for i := range w.options.Apps[appID] {
+			endpoints = append(endpoints, &w.options.Apps[appID][i])
+		}
+	}
+
+	for i := range w.options.Endpoints {
+		endpoints = append(endpoints, &w.options.Endpoints[i])
+	}
+
+	return endpoints
+}
+
+func newEnvelope(appID string, event string, data interface{}) (*Envelope, []byte, error) {
+	id, err := gonanoid.New()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	envelope := &Envelope{
+		ID:    id,
+		Type:  event,
+		AppID: appID,
+		Time:  time.Now().UnixMilli(),
+		Data:  data,
+	}
+
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return envelope, body, nil
+}
+
+// Dispatch queues event for every endpoint of appID that wants it. It does
+// not wait for the deliveries.
+func (w *Webhooks) Dispatch(appID string, event string, data interface{}) {
+	var targets []*Endpoint
+	for _, endpoint := range w.endpoints(appID) {
+		if !endpoint.Authorize && endpoint.wants(event) {
+			targets = append(targets, endpoint)
+		}
+	}
+
+	if len(targets) == 0 {
+		return
+	}
+
+	envelope, body, err := newEnvelope(appID, event, data)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("failed to prepare a webhook")
+		return
+	}
+
+	for _, endpoint := range targets {
+		deliveryID, err := gonanoid.New()
+		if err != nil {
+			log.Error().Err(err).Str("event", event).Msg("failed to prepare a webhook")
+			continue
+		}
+
+		w.enqueue(&Delivery{
+			ID:       deliveryID,
+			EventID:  envelope.ID,
+			AppID:    appID,
+			Event:    event,
+			URL:      endpoint.URL,
+			Body:     body,
+			endpoint: endpoint,
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"server-optimized/services/hub"
+	"server-optimized/services/kv"
+	"server-optimized/services/nats"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// newEndpoint serves the deliveries it gets on a channel, answering with
+// whatever status returns.
+func newEndpoint(t *testing.T, status func() int, answer string) (*httptest.Server, chan received) {
+	deliveries := make(chan received, 16)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- received{header: r.Header, body: body}
+
+		w.WriteHeader(status())
+		io.WriteString(w, answer)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, deliveries
+}
+
+func newWebhooks(t *testing.T, options *ServiceOptions) (*Webhooks, kv.Store, *nats.MemoryPubSub) {
+	store, err := kv.NewMemoryStore(&kv.MemoryStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	pubSub := nats.NewMemoryPubSub()
+	t.Cleanup(pubSub.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	w := CreateWebhooksService(store, pubSub, options)
+	if err := w.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return w, store, pubSub
+}
+
+func next(t *testing.T, deliveries chan received) received {
+	t.Helper()
+
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery")
+		return received{}
+	}
+}
+
+func ok() int { return http.StatusOK }
+
+func TestWebhooksDelivery(t *testing.T) {
+	server, deliveries := newEndpoint(t, ok, "")
+
+	w, _, _ := newWebhooks(t, &ServiceOptions{
+		Apps: map[string][]Endpoint{
+			"app": {{URL: server.URL, Secret: "s3cret", Events: []string{EventClientConnected}}},
+		},
+	})
+
+	w.Dispatch("app", EventClientDisconnected, &ClientEvent{ClientID: "c1"})
+	w.Dispatch("other-app", EventClientConnected, &ClientEvent{ClientID: "c1"})
+	w.Dispatch("app", EventClientConnected, &ClientEvent{ClientID: "c1", AppID: "app", Actor: "client:u1"})
+
+	delivery := next(t, deliveries)
+
+	timestamp := delivery.header.Get(TimestampHeader)
+	if delivery.header.Get(SignatureHeader) != Sign("s3cret", timestamp, delivery.body) {
+		t.Fatalf("bad signature %q", delivery.header.Get(SignatureHeader))
+	}
+
+	var envelope struct {
+		Envelope
+		Data ClientEvent `json:"data"`
+	}
+	if err := json.Unmarshal(delivery.body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	if envelope.Type != EventClientConnected || envelope.AppID != "app" || envelope.Data.ClientID != "c1" || envelope.Data.Actor != "client:u1" {
+		t.Fatalf("unexpected delivery: %s", delivery.body)
+	}
+
+	if delivery.header.Get(IDHeader) != envelope.ID || delivery.header.Get(EventHeader) != EventClientConnected {
+		t.Fatalf("unexpected headers: %v", delivery.header)
+	}
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("got an event the endpoint did not ask for: %s", delivery.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhooksRetriesAndDeadLetters(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+
+	server, deliveries := newEndpoint(t, func() int {
+		if failing.Load() {
+			return http.StatusServiceUnavailable
+		}
+
+		return http.StatusOK
+	}, "")
+
+	w, _, _ := newWebhooks(t, &ServiceOptions{
+		Endpoints:      []Endpoint{{URL: server.URL}},
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+	})
+
+	w.Dispatch("app", EventClientConnected, &ClientEvent{ClientID: "c1"})
+
+	for i := 0; i < 3; i++ {
+		next(t, deliveries)
+	}
+
+	ctx := context.Background()
+
+	var deadLetters []Delivery
+	for deadline := time.Now().Add(2 * time.Second); len(deadLetters) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+
+		var err error
+		if deadLetters, err = w.DeadLetters(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != 3 || deadLetters[0].Status != http.StatusServiceUnavailable || deadLetters[0].URL != server.URL {
+		t.Fatalf("unexpected dead letters: %+v", deadLetters)
+	}
+
+	failing.Store(false)
+
+	if err := w.Redeliver(ctx, "app", deadLetters[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	next(t, deliveries)
+
+	if err := w.Redeliver(ctx, "app", deadLetters[0].ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf("expected ErrDeadLetterNotFound, got %v", err)
+	}
+}
+
+func TestWebhooksBackoff(t *testing.T) {
+	w := CreateWebhooksService(nil, nil, &ServiceOptions{
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	})
+
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if backoff := w.backoff(attempts); backoff != expected {
+			t.Fatalf("backoff after %d attempts: expected %v, got %v", attempts, expected, backoff)
+		}
+	}
+}
+
+func TestWebhooksAuthorize(t *testing.T) {
+	dropping, _ := newEndpoint(t, ok, `{"drop":true,"reason":"banned"}`)
+	allowing, _ := newEndpoint(t, ok, `{}`)
+	broken, _ := newEndpoint(t, func() int { return http.StatusInternalServerError }, "")
+
+	w, _, _ := newWebhooks(t, &ServiceOptions{
+		Apps: map[string][]Endpoint{
+			"dropping": {{URL: allowing.URL, Authorize: true}, {URL: dropping.URL, Authorize: true}},
+			"allowing": {{URL: allowing.URL, Authorize: true}, {URL: broken.URL, Authorize: true, FailOpen: true}},
+			"broken":   {{URL: broken.URL, Authorize: true}},
+			"watches":  {{URL: dropping.URL, Authorize: true, Events: []string{EventClientSubscribed}}},
+		},
+	})
+
+	ctx := context.Background()
+	event := &ClientEvent{ClientID: "c1"}
+
+	var veto *VetoError
+	if err := w.Authorize(ctx, "dropping", EventClientConnected, event); !errors.As(err, &veto) || veto.Reason != "banned" {
+		t.Fatalf("expected a veto for banned, got %v", err)
+	}
+
+	if err := w.Authorize(ctx, "allowing", EventClientConnected, event); err != nil {
+		t.Fatalf("expected no veto, got %v", err)
+	}
+
+	if err := w.Authorize(ctx, "broken", EventClientConnected, event); !errors.As(err, &veto) {
+		t.Fatalf("expected a failing hook to drop the connection, got %v", err)
+	}
+
+	if err := w.Authorize(ctx, "watches", EventClientConnected, event); err != nil {
+		t.Fatalf("expected a hook for watches only to let connections through, got %v", err)
+	}
+
+	if err := w.Authorize(ctx, "watches", EventClientSubscribed, &SubscriptionEvent{AppID: "watches"}); !errors.As(err, &veto) {
+		t.Fatalf("expected a veto for the watch, got %v", err)
+	}
+}
+
+func TestWebhooksServerStateChanges(t *testing.T) {
+	server, deliveries := newEndpoint(t, ok, "")
+
+	_, _, pubSub := newWebhooks(t, &ServiceOptions{
+		Apps: map[string][]Endpoint{
+			"app": {{URL: server.URL, Events: []string{EventServerStateChanged}}},
+		},
+	})
+
+	hub.Publish(pubSub, "app", "doc", nil, map[string]interface{}{"a": 1}, 3, hub.Origin{Op: "set", Actor: "admin:root"})
+
+	delivery := next(t, deliveries)
+
+	var envelope struct {
+		Envelope
+		Data hub.Change `json:"data"`
+	}
+	if err := json.Unmarshal(delivery.body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	if envelope.Type != EventServerStateChanged || envelope.AppID != "app" || envelope.Data.Key != "doc" || envelope.Data.UpdateCount != 3 || envelope.Data.Op != "set" {
+		t.Fatalf("unexpected delivery: %s", delivery.body)
+	}
+}
+
+func TestWebhooksStop(t *testing.T) {
+	server, deliveries := newEndpoint(t, ok, "")
+
+	w, _, pubSub := newWebhooks(t, &ServiceOptions{
+		Endpoints: []Endpoint{{URL: server.URL}},
+		Workers:   2,
+	})
+
+	w.Stop()
+
+	hub.Publish(pubSub, "app", "doc", nil, 1, 1, hub.Origin{Op: "set"})
+	w.Dispatch("app", EventClientConnected, &ClientEvent{ClientID: "c1"})
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("delivered after Stop: %s", delivery.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if len(w.queue) != 0 {
+		t.Fatalf("queued %d deliveries after Stop", len(w.queue))
+	}
+}